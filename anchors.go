@@ -0,0 +1,714 @@
+package resolv
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The timers of RFC 5011.
+const (
+	// RFC 5011, Section 2.4.1: a new key becomes a trust anchor once it has
+	// been present for this long.
+	RFC5011AddHoldDown = 30 * 24 * time.Hour
+
+	// RFC 5011, Section 2.4.2: the store forgets a revoked key after this
+	// long.
+	RFC5011RemoveHoldDown = 30 * 24 * time.Hour
+)
+
+// A KeyState is the state of a key-signing key that a [TrustAnchorStore]
+// tracks as per RFC 5011, Section 4.
+type KeyState int
+
+const (
+	// The key is new, and waits out the add hold-down before the store
+	// trusts it.
+	KeyAddPend KeyState = iota + 1
+
+	// The key is a trust anchor.
+	KeyValid
+
+	// The key is a trust anchor, but is missing from the zone's DNSKEY
+	// RRset.
+	KeyMissing
+
+	// The zone revoked the key; the store no longer trusts it.
+	KeyRevoked
+)
+
+var keyStateNames = map[KeyState]string{
+	KeyAddPend: "AddPend",
+	KeyValid:   "Valid",
+	KeyMissing: "Missing",
+	KeyRevoked: "Revoked",
+}
+
+func (s KeyState) String() string {
+	if name, ok := keyStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("KeyState(%d)", int(s))
+}
+
+// A TrackedKey is a key-signing key that a [TrustAnchorStore] tracks as per
+// RFC 5011.
+type TrackedKey struct {
+	Key   *dns.DNSKEY
+	State KeyState
+
+	// For KeyAddPend, when the add hold-down ends; for KeyRevoked, when the
+	// remove hold-down ends.
+	HoldDown time.Time
+}
+
+// trusted returns true if the key is a trust anchor.
+func (k *TrackedKey) trusted() bool {
+	return k.State == KeyValid || k.State == KeyMissing
+}
+
+// sameKey returns true if a and b are the same key, regardless of the
+// REVOKE flag.
+func sameKey(a, b *dns.DNSKEY) bool {
+	return a.Algorithm == b.Algorithm && a.Protocol == b.Protocol && a.PublicKey == b.PublicKey
+}
+
+type anchorZone struct {
+	ds   []*dns.DS
+	keys []*dns.DNSKEY
+
+	// for RFC 5011
+	tracked     []*TrackedKey
+	nextRefresh time.Time
+}
+
+// A TrustAnchorStore holds the trust anchors for DNSSEC validation: DS or
+// DNSKEY records for the zones at which chains of trust start, and negative
+// trust anchors (RFC 7646) for the zones that a validator should treat as
+// unsigned.  A [Client] with Validate set uses the trust anchor that is
+// closest to the name that it validates.
+//
+// The store can also keep its trust anchors current as per RFC 5011 (see
+// [TrustAnchorStore.TrackRFC5011]).
+//
+// A TrustAnchorStore is safe for concurrent use.
+type TrustAnchorStore struct {
+	mu        sync.Mutex
+	zones     map[string]*anchorZone // keyed by canonical name
+	negative  map[string]time.Time   // expiry, or zero for none
+	stateFile string
+	gen       uint64 // incremented on each change, to invalidate caches
+
+	refreshMu sync.Mutex
+
+	// the clock for the validity of root-anchors.xml keys, the expiry of
+	// negative trust anchors, and RFC 5011's timers; nil for time.Now
+	now func() time.Time
+}
+
+// NewTrustAnchorStore returns an empty store.
+func NewTrustAnchorStore() *TrustAnchorStore {
+	return &TrustAnchorStore{
+		zones:    make(map[string]*anchorZone),
+		negative: make(map[string]time.Time),
+	}
+}
+
+func (s *TrustAnchorStore) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+var (
+	defaultAnchorsOnce sync.Once
+	defaultAnchors     *TrustAnchorStore
+)
+
+// defaultTrustAnchors returns the store for the clients without
+// TrustAnchors: one with [RootTrustAnchors].
+func defaultTrustAnchors() *TrustAnchorStore {
+	defaultAnchorsOnce.Do(func() {
+		defaultAnchors = NewTrustAnchorStore()
+		if err := defaultAnchors.Add(RootTrustAnchors()...); err != nil {
+			panic(err)
+		}
+	})
+	return defaultAnchors
+}
+
+// Add adds DS or DNSKEY records as trust anchors.
+func (s *TrustAnchorStore) Add(rrs ...dns.RR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rr := range rrs {
+		zone := dns.CanonicalName(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.DS:
+		case *dns.DNSKEY:
+			if rr.Flags&dns.ZONE == 0 {
+				return fmt.Errorf("DNSKEY trust anchor for %s is not a zone key", zone)
+			}
+		default:
+			return fmt.Errorf("trust anchor for %s is a %s record, not DS or DNSKEY", zone, dns.Type(rr.Header().Rrtype))
+		}
+	}
+
+	for _, rr := range rrs {
+		zone := dns.CanonicalName(rr.Header().Name)
+		z, ok := s.zones[zone]
+		if !ok {
+			z = new(anchorZone)
+			s.zones[zone] = z
+		}
+		switch rr := rr.(type) {
+		case *dns.DS:
+			z.ds = append(z.ds, rr)
+		case *dns.DNSKEY:
+			z.keys = append(z.keys, rr)
+		}
+	}
+	s.gen++
+	return nil
+}
+
+// ReadZoneFile adds the DS and DNSKEY records in r, which is in master file
+// format, as trust anchors.  The function ignores records of other types.
+func (s *TrustAnchorStore) ReadZoneFile(r io.Reader) error {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(r, ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			rrs = append(rrs, rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	return s.Add(rrs...)
+}
+
+// The root-anchors.xml format (RFC 9718).
+type xmlTrustAnchor struct {
+	Zone       string `xml:"Zone"`
+	KeyDigests []struct {
+		ValidFrom  string `xml:"validFrom,attr"`
+		ValidUntil string `xml:"validUntil,attr"`
+		KeyTag     uint16 `xml:"KeyTag"`
+		Algorithm  uint8  `xml:"Algorithm"`
+		DigestType uint8  `xml:"DigestType"`
+		Digest     string `xml:"Digest"`
+	} `xml:"KeyDigest"`
+}
+
+// ReadRootAnchorsXML adds the trust anchors in r, which is in the format of
+// IANA's root-anchors.xml (RFC 9718).  The function skips the anchors that
+// are not valid at the current time, as per their validFrom and validUntil
+// attributes.
+func (s *TrustAnchorStore) ReadRootAnchorsXML(r io.Reader) error {
+	var ta xmlTrustAnchor
+	if err := xml.NewDecoder(r).Decode(&ta); err != nil {
+		return fmt.Errorf("failed to parse trust anchor XML: %w", err)
+	}
+
+	now := s.clock()
+	var rrs []dns.RR
+	for _, kd := range ta.KeyDigests {
+		from, err := time.Parse(time.RFC3339, kd.ValidFrom)
+		if err != nil {
+			return fmt.Errorf("invalid validFrom for key %d: %w", kd.KeyTag, err)
+		}
+		if now.Before(from) {
+			continue
+		}
+		if kd.ValidUntil != "" {
+			until, err := time.Parse(time.RFC3339, kd.ValidUntil)
+			if err != nil {
+				return fmt.Errorf("invalid validUntil for key %d: %w", kd.KeyTag, err)
+			}
+			if !now.Before(until) {
+				continue
+			}
+		}
+		rrs = append(rrs, &dns.DS{
+			Hdr:        dns.RR_Header{Name: dns.Fqdn(ta.Zone), Rrtype: dns.TypeDS, Class: dns.ClassINET},
+			KeyTag:     kd.KeyTag,
+			Algorithm:  kd.Algorithm,
+			DigestType: kd.DigestType,
+			Digest:     strings.ToUpper(kd.Digest),
+		})
+	}
+	if len(rrs) == 0 {
+		return fmt.Errorf("trust anchor XML for %q has no currently valid keys", ta.Zone)
+	}
+	return s.Add(rrs...)
+}
+
+// LoadFile adds the trust anchors in a file: root-anchors.xml (if the file
+// name ends in .xml), or DS and DNSKEY records in master file format.
+func (s *TrustAnchorStore) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".xml") {
+		err = s.ReadRootAnchorsXML(f)
+	} else {
+		err = s.ReadZoneFile(f)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadDir adds the trust anchors in each file of a directory (e.g., one file
+// per zone), as with [TrustAnchorStore.LoadFile].  The function skips
+// subdirectories and hidden files.
+func (s *TrustAnchorStore) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err := s.LoadFile(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddNegative adds a negative trust anchor (RFC 7646) for zone: a validator
+// treats the zone and its descendants as unsigned, unless a (positive) trust
+// anchor is closer to the name.  The negative trust anchor expires after
+// lifetime; if lifetime is zero, it lasts until [TrustAnchorStore.RemoveNegative].
+func (s *TrustAnchorStore) AddNegative(zone string, lifetime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expires time.Time
+	if lifetime > 0 {
+		expires = s.clock().Add(lifetime)
+	}
+	s.negative[dns.CanonicalName(zone)] = expires
+	s.gen++
+}
+
+// RemoveNegative removes the negative trust anchor for zone, if any.
+func (s *TrustAnchorStore) RemoveNegative(zone string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.negative, dns.CanonicalName(zone))
+	s.gen++
+}
+
+// Zones returns the zones that have (positive) trust anchors.
+func (s *TrustAnchorStore) Zones() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var zones []string
+	for zone := range s.zones {
+		zones = append(zones, zone)
+	}
+	slices.SortFunc(zones, canonicalCompare)
+	return zones
+}
+
+// Anchors returns the current trust anchors for zone: the configured DS and
+// DNSKEY records, or, if the store tracks the zone's keys as per RFC 5011,
+// the DNSKEYs of its trusted keys.
+func (s *TrustAnchorStore) Anchors(zone string) []dns.RR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok := s.zones[dns.CanonicalName(zone)]
+	if !ok {
+		return nil
+	}
+	ds, keys := z.anchors()
+	var rrs []dns.RR
+	for _, rr := range ds {
+		rrs = append(rrs, rr)
+	}
+	for _, rr := range keys {
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// anchors returns the zone's trusted DS and DNSKEY records.
+func (z *anchorZone) anchors() ([]*dns.DS, []*dns.DNSKEY) {
+	var keys []*dns.DNSKEY
+	for _, k := range z.tracked {
+		if k.trusted() {
+			keys = append(keys, k.Key)
+		}
+	}
+	if len(keys) > 0 {
+		// RFC 5011 supersedes the configured anchors
+		return nil, keys
+	}
+	return z.ds, z.keys
+}
+
+// lookup returns the trust anchor that is closest to name: its zone, and its
+// DS and DNSKEY records.  If a negative trust anchor is at least as close,
+// lookup instead returns the zone of the negative trust anchor, and true.
+func (s *TrustAnchorStore) lookup(name string) (string, []*dns.DS, []*dns.DNSKEY, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zone := ""
+	for z := range s.zones {
+		if dns.IsSubDomain(z, name) && (zone == "" || dns.CountLabel(z) > dns.CountLabel(zone)) {
+			zone = z
+		}
+	}
+
+	now := s.clock()
+	for nta, expires := range s.negative {
+		if !expires.IsZero() && !now.Before(expires) {
+			delete(s.negative, nta)
+			s.gen++
+			continue
+		}
+		if dns.IsSubDomain(nta, name) && (zone == "" || dns.CountLabel(nta) >= dns.CountLabel(zone)) {
+			return nta, nil, nil, true
+		}
+	}
+
+	if zone == "" {
+		return "", nil, nil, false
+	}
+	ds, keys := s.zones[zone].anchors()
+	return zone, ds, keys, false
+}
+
+// generation returns a number that changes whenever the store's anchors
+// change.
+func (s *TrustAnchorStore) generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen
+}
+
+// The RFC 5011 state file.
+type anchorStateFile struct {
+	Zones map[string]*anchorZoneState `json:"zones"`
+}
+
+type anchorZoneState struct {
+	NextRefresh time.Time          `json:"next_refresh"`
+	Keys        []*trackedKeyState `json:"keys"`
+}
+
+type trackedKeyState struct {
+	DNSKEY   string    `json:"dnskey"`
+	State    string    `json:"state"`
+	HoldDown time.Time `json:"hold_down,omitempty"`
+}
+
+// TrackRFC5011 makes the store keep the key-signing keys of its zones
+// current as per RFC 5011 ("Automated Updates of DNS Security (DNSSEC)
+// Trust Anchors"), and keep the keys' states in the file at path.  If the
+// file exists, TrackRFC5011 loads the states from it; once the store trusts
+// a key of a zone as per RFC 5011, it no longer uses the zone's configured
+// anchors.
+//
+// A validating [Client] that uses the store refreshes a zone's keys when
+// they are due (see [TrustAnchorStore.Refresh]).
+func (s *TrustAnchorStore) TrackRFC5011(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stateFile = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var state anchorStateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for zone, zs := range state.Zones {
+		zone = dns.CanonicalName(zone)
+		z, ok := s.zones[zone]
+		if !ok {
+			z = new(anchorZone)
+			s.zones[zone] = z
+		}
+		z.nextRefresh = zs.NextRefresh
+		z.tracked = nil
+		for _, ks := range zs.Keys {
+			rr, err := dns.NewRR(ks.DNSKEY)
+			key, ok := rr.(*dns.DNSKEY)
+			if err != nil || !ok {
+				return fmt.Errorf("%s: invalid DNSKEY for %s: %q", path, zone, ks.DNSKEY)
+			}
+			state := KeyState(0)
+			for st, name := range keyStateNames {
+				if name == ks.State {
+					state = st
+				}
+			}
+			if state == 0 {
+				return fmt.Errorf("%s: invalid key state for %s: %q", path, zone, ks.State)
+			}
+			z.tracked = append(z.tracked, &TrackedKey{Key: key, State: state, HoldDown: ks.HoldDown})
+		}
+	}
+	s.gen++
+	return nil
+}
+
+// TrackedKeys returns the keys of zone that the store tracks as per RFC 5011.
+func (s *TrustAnchorStore) TrackedKeys(zone string) []TrackedKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok := s.zones[dns.CanonicalName(zone)]
+	if !ok {
+		return nil
+	}
+	var keys []TrackedKey
+	for _, k := range z.tracked {
+		keys = append(keys, *k)
+	}
+	return keys
+}
+
+// save writes the RFC 5011 state file.  The caller must hold s.mu.
+func (s *TrustAnchorStore) save() error {
+	state := anchorStateFile{Zones: make(map[string]*anchorZoneState)}
+	for zone, z := range s.zones {
+		zs := &anchorZoneState{NextRefresh: z.nextRefresh}
+		for _, k := range z.tracked {
+			zs.Keys = append(zs.Keys, &trackedKeyState{
+				DNSKEY:   k.Key.String(),
+				State:    k.State.String(),
+				HoldDown: k.HoldDown,
+			})
+		}
+		state.Zones[zone] = zs
+	}
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write the state atomically
+	tmp := s.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, s.stateFile); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", tmp, err)
+	}
+	return nil
+}
+
+// refreshInterval returns how long to wait before the next refresh of a
+// zone's DNSKEY RRset (RFC 5011, Section 2.3): the active refresh interval
+// after a successful refresh, or the retry interval after a failure.
+func refreshInterval(set *signedRRset, failed bool) time.Duration {
+	if set == nil {
+		return time.Hour
+	}
+
+	ttl := time.Duration(set.minTTL()) * time.Second
+	expiry := time.Duration(0)
+	for _, sig := range set.sigs {
+		ttl = max(ttl, time.Duration(sig.OrigTtl)*time.Second)
+		if d := time.Until(time.Unix(int64(sig.Expiration), 0)); expiry == 0 || d < expiry {
+			expiry = d
+		}
+	}
+	if failed {
+		return max(time.Hour, min(24*time.Hour, ttl/10, expiry/10))
+	}
+	return max(time.Hour, min(15*24*time.Hour, ttl/2, expiry/2))
+}
+
+// selfSigned returns true if one of the RRSIGs of set is a valid signature
+// by key.
+func selfSigned(key *dns.DNSKEY, set *signedRRset) bool {
+	for _, sig := range set.sigs {
+		if sig.KeyTag == key.KeyTag() && sig.Algorithm == key.Algorithm && verifySig(sig, key, set.rrs) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh looks up the DNSKEY RRset of each zone that the store tracks as per
+// RFC 5011, with t, and updates the states of the zone's key-signing keys: a
+// new key (whose DNSKEY RRset a trusted key signs) becomes trusted after the
+// add hold-down, a revoked key (that signs the RRset with its REVOKE bit
+// set) loses trust immediately, and a trusted key that disappears stays
+// trusted.  Refresh saves the states to the state file.
+//
+// A validating [Client] calls Refresh for a zone whenever its refresh is
+// due, so a program need not call Refresh itself.
+func (s *TrustAnchorStore) Refresh(ctx context.Context, t Transport) error {
+	return s.refresh(ctx, t, true)
+}
+
+// refreshDue refreshes the zones whose refresh is due, if the store tracks
+// keys as per RFC 5011.  If another goroutine is refreshing, refreshDue
+// returns at once.
+func (s *TrustAnchorStore) refreshDue(ctx context.Context, t Transport) {
+	s.mu.Lock()
+	tracking := s.stateFile != ""
+	s.mu.Unlock()
+	if !tracking || !s.refreshMu.TryLock() {
+		return
+	}
+	defer s.refreshMu.Unlock()
+	s.refresh(ctx, t, false)
+}
+
+func (s *TrustAnchorStore) refresh(ctx context.Context, t Transport, all bool) error {
+	s.mu.Lock()
+	if s.stateFile == "" {
+		s.mu.Unlock()
+		return errors.New("resolv: the trust anchor store does not track keys as per RFC 5011")
+	}
+	now := s.clock()
+	var due []string
+	for zone, z := range s.zones {
+		if all || !now.Before(z.nextRefresh) {
+			due = append(due, zone)
+		}
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, zone := range due {
+		m := new(dns.Msg)
+		m.SetQuestion(zone, dns.TypeDNSKEY)
+		m.RecursionDesired = true
+		m.CheckingDisabled = true
+		m.SetEdns0(DefaultUDPBufSize, true)
+		resp, err := t.ExchangeContext(WithExchangeInfo(ctx, new(ExchangeInfo)), m)
+		var set *signedRRset
+		if err == nil {
+			set = findRRset(resp.Answer, zone, dns.TypeDNSKEY)
+		}
+
+		s.mu.Lock()
+		z := s.zones[zone]
+		if err == nil {
+			err = s.updateKeys(zone, z, set)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to refresh the trust anchors of %s: %w", zone, err))
+		}
+		z.nextRefresh = s.clock().Add(refreshInterval(set, err != nil))
+		if saveErr := s.save(); saveErr != nil {
+			errs = append(errs, saveErr)
+		}
+		s.gen++
+		s.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// updateKeys applies the RFC 5011 state machine to the tracked keys of a
+// zone, given the zone's DNSKEY RRset.  The caller must hold s.mu.
+func (s *TrustAnchorStore) updateKeys(zone string, z *anchorZone, set *signedRRset) error {
+	ds, keys := z.anchors()
+	st := verifyDNSKEYs(zone, set, ds, keys)
+	if st.status != Secure {
+		return errors.New(st.reason)
+	}
+
+	now := s.clock()
+	bootstrap := !slices.ContainsFunc(z.tracked, (*TrackedKey).trusted)
+	var present []*TrackedKey
+	for _, rr := range set.rrs {
+		key := rr.(*dns.DNSKEY)
+		if key.Flags&dns.SEP == 0 || key.Flags&dns.ZONE == 0 {
+			continue
+		}
+		i := slices.IndexFunc(z.tracked, func(k *TrackedKey) bool { return sameKey(k.Key, key) })
+
+		if key.Flags&dns.REVOKE != 0 {
+			// RFC 5011, Section 2.1: a revoked key must sign the DNSKEY
+			// RRset itself
+			if i >= 0 && z.tracked[i].State != KeyRevoked && selfSigned(key, set) {
+				z.tracked[i].Key = key
+				z.tracked[i].State = KeyRevoked
+				z.tracked[i].HoldDown = now.Add(RFC5011RemoveHoldDown)
+			}
+			if i >= 0 {
+				present = append(present, z.tracked[i])
+			}
+			continue
+		}
+
+		if i < 0 {
+			k := &TrackedKey{Key: key, State: KeyAddPend, HoldDown: now.Add(RFC5011AddHoldDown)}
+			if bootstrap && vouchedFor(key, ds, keys) {
+				// the configured anchors vouch for the key
+				k.State, k.HoldDown = KeyValid, time.Time{}
+			}
+			z.tracked = append(z.tracked, k)
+			present = append(present, k)
+			continue
+		}
+
+		k := z.tracked[i]
+		present = append(present, k)
+		switch k.State {
+		case KeyAddPend:
+			if !now.Before(k.HoldDown) {
+				k.State, k.HoldDown = KeyValid, time.Time{}
+			}
+		case KeyMissing:
+			k.State = KeyValid
+		}
+	}
+
+	z.tracked = slices.DeleteFunc(z.tracked, func(k *TrackedKey) bool {
+		if k.State == KeyRevoked {
+			return !now.Before(k.HoldDown)
+		}
+		if slices.Contains(present, k) {
+			return false
+		}
+		switch k.State {
+		case KeyAddPend:
+			// RFC 5011, Section 4: AddPend -> Start
+			return true
+		case KeyValid:
+			k.State = KeyMissing
+		}
+		return false
+	})
+	return nil
+}
@@ -0,0 +1,404 @@
+package resolv
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootAnchorsXML is in the format of IANA's root-anchors.xml, with a key
+// that has expired, a current key, and a future key.
+const rootAnchorsXML = `<?xml version="1.0" encoding="UTF-8"?>
+<TrustAnchor id="E9724F53-1851-4F86-85E5-F1392102940B" source="http://data.iana.org/root-anchors/root-anchors.xml">
+<Zone>.</Zone>
+<KeyDigest id="Kjqmt7v" validFrom="2010-07-15T00:00:00+00:00" validUntil="2019-01-11T00:00:00+00:00">
+<KeyTag>19036</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>49AAC11D7B6F6446702E54A1607371607A1A41855200FD2CE1CDDE32F24E8FB5</Digest>
+</KeyDigest>
+<KeyDigest id="Klajeyz" validFrom="2017-02-02T00:00:00+00:00">
+<KeyTag>20326</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>e06d44b80b8f1d39a95c0b0d7c65d08458e880409bbc683457104237c7f8ec8d</Digest>
+</KeyDigest>
+<KeyDigest id="Kmyv6jo" validFrom="2024-07-18T00:00:00+00:00">
+<KeyTag>38696</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16</Digest>
+</KeyDigest>
+</TrustAnchor>`
+
+func TestReadRootAnchorsXML(t *testing.T) {
+	tests := []struct {
+		name    string
+		xml     string
+		now     string
+		want    []uint16 // the key tags
+		wantErr bool
+	}{
+		{name: "before the first key", xml: rootAnchorsXML, now: "2010-01-01T00:00:00Z", wantErr: true},
+		{name: "first key", xml: rootAnchorsXML, now: "2015-01-01T00:00:00Z", want: []uint16{19036}},
+		{name: "rollover", xml: rootAnchorsXML, now: "2018-01-01T00:00:00Z", want: []uint16{19036, 20326}},
+		{name: "at validUntil", xml: rootAnchorsXML, now: "2019-01-11T00:00:00Z", want: []uint16{20326}},
+		{name: "at validFrom", xml: rootAnchorsXML, now: "2024-07-18T00:00:00Z", want: []uint16{20326, 38696}},
+		{
+			name:    "invalid validFrom",
+			xml:     strings.Replace(rootAnchorsXML, "2017-02-02T00:00:00+00:00", "2017-02-02", 1),
+			now:     "2020-01-01T00:00:00Z",
+			wantErr: true,
+		},
+		{
+			name:    "invalid validUntil",
+			xml:     strings.Replace(rootAnchorsXML, "2019-01-11T00:00:00+00:00", "tomorrow", 1),
+			now:     "2020-01-01T00:00:00Z",
+			wantErr: true,
+		},
+		{name: "invalid XML", xml: rootAnchorsXML[:200], now: "2020-01-01T00:00:00Z", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := NewTrustAnchorStore()
+			s.now = func() time.Time { return now }
+
+			err = s.ReadRootAnchorsXML(strings.NewReader(tt.xml))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			var got []uint16
+			for _, rr := range s.Anchors(".") {
+				ds := rr.(*dns.DS)
+				if ds.Hdr.Name != "." || ds.Algorithm != dns.RSASHA256 || ds.DigestType != dns.SHA256 || ds.Digest != strings.ToUpper(ds.Digest) {
+					t.Errorf("got anchor %v", ds)
+				}
+				got = append(got, ds.KeyTag)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got key tags %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// revokedTestKey returns k with its REVOKE bit set, which changes its key
+// tag.
+func revokedTestKey(k *testKey) *testKey {
+	key := *k.key
+	key.Flags |= dns.REVOKE
+	return &testKey{key: &key, signer: k.signer, ed448: k.ed448}
+}
+
+// dnskeySet returns a DNSKEY RRset of the root with the keys, signed by the
+// signers.
+func dnskeySet(t *testing.T, keys, signers []*testKey) *signedRRset {
+	t.Helper()
+	set := new(signedRRset)
+	for _, k := range keys {
+		set.rrs = append(set.rrs, k.key)
+	}
+	for _, k := range signers {
+		set.sigs = append(set.sigs, k.sign(t, set.rrs))
+	}
+	return set
+}
+
+func TestRFC5011(t *testing.T) {
+	k1 := newTestKey(t, ".", 257, dns.ECDSAP256SHA256)
+	k2 := newTestKey(t, ".", 257, dns.ECDSAP256SHA256)
+	k3 := newTestKey(t, ".", 257, dns.ECDSAP256SHA256)
+	zsk := newTestKey(t, ".", 256, dns.ECDSAP256SHA256)
+	rogue := newTestKey(t, ".", 257, dns.ECDSAP256SHA256)
+	k1r := revokedTestKey(k1)
+
+	s := NewTrustAnchorStore()
+	if err := s.Add(k1.key.ToDS(dns.SHA256)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	const day = 24 * time.Hour
+	steps := []struct {
+		name    string
+		advance time.Duration
+		keys    []*testKey // the DNSKEY RRset
+		signers []*testKey
+		wantErr bool
+		want    map[*testKey]KeyState
+	}{
+		{
+			name: "bootstrap from the DS", keys: []*testKey{k1, zsk}, signers: []*testKey{k1},
+			want: map[*testKey]KeyState{k1: KeyValid},
+		},
+		{
+			name: "new key", keys: []*testKey{k1, k2, zsk}, signers: []*testKey{k1},
+			want: map[*testKey]KeyState{k1: KeyValid, k2: KeyAddPend},
+		},
+		{
+			name: "unsigned by a trusted key", keys: []*testKey{k1, k2, rogue}, signers: []*testKey{rogue}, wantErr: true,
+			want: map[*testKey]KeyState{k1: KeyValid, k2: KeyAddPend},
+		},
+		{
+			name: "before the add hold-down", advance: 30*day - time.Second, keys: []*testKey{k1, k2, zsk}, signers: []*testKey{k1},
+			want: map[*testKey]KeyState{k1: KeyValid, k2: KeyAddPend},
+		},
+		{
+			name: "after the add hold-down", advance: time.Second, keys: []*testKey{k1, k2, zsk}, signers: []*testKey{k1},
+			want: map[*testKey]KeyState{k1: KeyValid, k2: KeyValid},
+		},
+		{
+			name: "missing key", keys: []*testKey{k1, zsk}, signers: []*testKey{k1},
+			want: map[*testKey]KeyState{k1: KeyValid, k2: KeyMissing},
+		},
+		{
+			name: "missing key returns", keys: []*testKey{k1, k2, zsk}, signers: []*testKey{k2},
+			want: map[*testKey]KeyState{k1: KeyValid, k2: KeyValid},
+		},
+		{
+			name: "pending key", keys: []*testKey{k1, k2, k3}, signers: []*testKey{k1},
+			want: map[*testKey]KeyState{k1: KeyValid, k2: KeyValid, k3: KeyAddPend},
+		},
+		{
+			name: "pending key disappears", keys: []*testKey{k1, k2}, signers: []*testKey{k1},
+			want: map[*testKey]KeyState{k1: KeyValid, k2: KeyValid},
+		},
+		{
+			name: "revoked without a self-signature", keys: []*testKey{k1r, k2}, signers: []*testKey{k2},
+			want: map[*testKey]KeyState{k1: KeyValid, k2: KeyValid},
+		},
+		{
+			name: "revoked", keys: []*testKey{k1r, k2}, signers: []*testKey{k1r, k2},
+			want: map[*testKey]KeyState{k1: KeyRevoked, k2: KeyValid},
+		},
+		{
+			name: "signed by the revoked key only", keys: []*testKey{k1r, k2}, signers: []*testKey{k1r}, wantErr: true,
+			want: map[*testKey]KeyState{k1: KeyRevoked, k2: KeyValid},
+		},
+		{
+			name: "before the remove hold-down", advance: 30*day - time.Second, keys: []*testKey{k2}, signers: []*testKey{k2},
+			want: map[*testKey]KeyState{k1: KeyRevoked, k2: KeyValid},
+		},
+		{
+			name: "after the remove hold-down", advance: time.Second, keys: []*testKey{k2}, signers: []*testKey{k2},
+			want: map[*testKey]KeyState{k2: KeyValid},
+		},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		s.mu.Lock()
+		err := s.updateKeys(".", s.zones["."], dnskeySet(t, step.keys, step.signers))
+		s.mu.Unlock()
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: got error %v, want error %v", step.name, err, step.wantErr)
+		}
+
+		tracked := s.TrackedKeys(".")
+		if len(tracked) != len(step.want) {
+			t.Errorf("%s: got %d tracked keys, want %d", step.name, len(tracked), len(step.want))
+		}
+		for k, want := range step.want {
+			var got KeyState
+			for _, tk := range tracked {
+				if sameKey(tk.Key, k.key) {
+					got = tk.State
+				}
+			}
+			if got != want {
+				t.Errorf("%s: key %d is %v, want %v", step.name, k.key.KeyTag(), got, want)
+			}
+		}
+
+		// the trust anchors are the trusted keys
+		for _, rr := range s.Anchors(".") {
+			key, ok := rr.(*dns.DNSKEY)
+			if !ok {
+				t.Errorf("%s: got anchor %v, want the tracked keys", step.name, rr)
+				continue
+			}
+			for k, state := range step.want {
+				if sameKey(key, k.key) && state != KeyValid && state != KeyMissing {
+					t.Errorf("%s: %v key %d is a trust anchor", step.name, state, k.key.KeyTag())
+				}
+			}
+		}
+	}
+}
+
+func TestRFC5011HoldDown(t *testing.T) {
+	k1 := newTestKey(t, ".", 257, dns.ECDSAP256SHA256)
+	k2 := newTestKey(t, ".", 257, dns.ECDSAP256SHA256)
+
+	s := NewTrustAnchorStore()
+	if err := s.Add(k1.key); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	update := func(set *signedRRset) {
+		t.Helper()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.updateKeys(".", s.zones["."], set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	holdDown := func(k *testKey) time.Time {
+		for _, tk := range s.TrackedKeys(".") {
+			if sameKey(tk.Key, k.key) {
+				return tk.HoldDown
+			}
+		}
+		t.Fatalf("key %d is not tracked", k.key.KeyTag())
+		return time.Time{}
+	}
+
+	update(dnskeySet(t, []*testKey{k1, k2}, []*testKey{k1}))
+	if got, want := holdDown(k2), now.Add(RFC5011AddHoldDown); !got.Equal(want) {
+		t.Errorf("got add hold-down %v, want %v", got, want)
+	}
+	// the hold-down starts when the key first appears
+	now = now.Add(time.Hour)
+	update(dnskeySet(t, []*testKey{k1, k2}, []*testKey{k1}))
+	if got, want := holdDown(k2), now.Add(RFC5011AddHoldDown-time.Hour); !got.Equal(want) {
+		t.Errorf("got add hold-down %v, want %v", got, want)
+	}
+	if !holdDown(k1).IsZero() {
+		t.Errorf("valid key has a hold-down")
+	}
+
+	now = now.Add(RFC5011AddHoldDown)
+	update(dnskeySet(t, []*testKey{k1, k2}, []*testKey{k1}))
+	k1r := revokedTestKey(k1)
+	update(dnskeySet(t, []*testKey{k1r, k2}, []*testKey{k1r, k2}))
+	if got, want := holdDown(k1), now.Add(RFC5011RemoveHoldDown); !got.Equal(want) {
+		t.Errorf("got remove hold-down %v, want %v", got, want)
+	}
+}
+
+func TestTrackRFC5011(t *testing.T) {
+	root := newTestZone(t, ".", dns.ECDSAP256SHA256)
+	k2 := newTestKey(t, ".", 257, dns.ECDSAP256SHA256)
+	root.addRRs(k2.key)
+	root.sign(t)
+	tr := funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		return root.answer(req), nil
+	})
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newStore := func() *TrustAnchorStore {
+		t.Helper()
+		s := NewTrustAnchorStore()
+		s.now = func() time.Time { return now }
+		if err := s.Add(root.key.key.ToDS(dns.SHA256)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.TrackRFC5011(path); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := newStore()
+	if err := s.Refresh(context.Background(), tr); err != nil {
+		t.Fatal(err)
+	}
+	want := s.TrackedKeys(".")
+	if len(want) != 2 {
+		t.Fatalf("got %d tracked keys, want 2", len(want))
+	}
+
+	// a new store restores the states from the file
+	s = newStore()
+	got := s.TrackedKeys(".")
+	if len(got) != len(want) {
+		t.Fatalf("got %d tracked keys from the state file, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !sameKey(got[i].Key, want[i].Key) || got[i].State != want[i].State || !got[i].HoldDown.Equal(want[i].HoldDown) {
+			t.Errorf("got %v %v %v, want %v %v %v", got[i].Key.KeyTag(), got[i].State, got[i].HoldDown,
+				want[i].Key.KeyTag(), want[i].State, want[i].HoldDown)
+		}
+	}
+
+	// the zone's refresh is not due until the refresh interval has passed
+	s.refreshDue(context.Background(), funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		t.Errorf("refreshed before the refresh was due")
+		return root.answer(req), nil
+	}))
+	now = now.Add(RFC5011AddHoldDown)
+	queried := false
+	s.refreshDue(context.Background(), funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		queried = true
+		return root.answer(req), nil
+	}))
+	if !queried {
+		t.Errorf("did not refresh when the refresh was due")
+	}
+	for _, k := range s.TrackedKeys(".") {
+		if k.State != KeyValid {
+			t.Errorf("key %d is %v after the add hold-down, want %v", k.Key.KeyTag(), k.State, KeyValid)
+		}
+	}
+
+	data, err := json.Marshal(&anchorStateFile{Zones: map[string]*anchorZoneState{
+		".": {Keys: []*trackedKeyState{{DNSKEY: root.key.key.String(), State: "Trusted"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewTrustAnchorStore().TrackRFC5011(path); err == nil {
+		t.Errorf("loaded a state file with an invalid state")
+	}
+}
+
+func TestNegativeTrustAnchors(t *testing.T) {
+	k := newTestKey(t, "example.", 257, dns.ECDSAP256SHA256)
+	s := NewTrustAnchorStore()
+	if err := s.Add(k.key.ToDS(dns.SHA256)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	check := func(name, wantZone string, wantNegative bool) {
+		t.Helper()
+		zone, _, _, negative := s.lookup(name)
+		if zone != wantZone || negative != wantNegative {
+			t.Errorf("lookup(%q) = %q, %v; want %q, %v", name, zone, negative, wantZone, wantNegative)
+		}
+	}
+
+	s.AddNegative("Sub.Example", time.Hour)
+	check("www.sub.example.", "sub.example.", true)
+	check("www.example.", "example.", false)
+	now = now.Add(time.Hour - time.Second)
+	check("www.sub.example.", "sub.example.", true)
+	now = now.Add(time.Second)
+	check("www.sub.example.", "example.", false)
+
+	// a negative trust anchor at the zone of a trust anchor overrides it
+	s.AddNegative("example.", 0)
+	check("www.example.", "example.", true)
+	now = now.Add(365 * 24 * time.Hour)
+	check("www.example.", "example.", true)
+	s.RemoveNegative("example.")
+	check("www.example.", "example.", false)
+}
@@ -0,0 +1,422 @@
+package resolv
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The defaults for a [Cache].
+const (
+	DefaultCacheMaxEntries = 4096
+
+	// RFC 2308, Section 5 suggests caching negative answers for at most one
+	// to three hours.
+	DefaultCacheMaxNegativeTTL = 3 * time.Hour
+)
+
+// CacheStats describes the activity of a [Cache].
+type CacheStats struct {
+	Hits      uint64 // the number of queries that the cache answered
+	Misses    uint64 // the number of queries that went to the upstream
+	Evictions uint64 // the number of entries evicted to make room for others
+	Entries   int    // the number of entries in the cache
+}
+
+// A CacheEntry describes one response in a [Cache].
+type CacheEntry struct {
+	// The query that the response answers.
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	DO     bool
+	CD     bool
+
+	// The source prefix of the query's EDNS0 Client Subnet option (RFC
+	// 7871); not valid if the query had none.
+	ClientSubnet netip.Prefix
+
+	// True if the response is NXDOMAIN or NODATA.
+	Negative bool
+
+	// When the entry expires.
+	Expires time.Time
+
+	// A copy of the response, with its TTLs decremented by the time that it
+	// has spent in the cache.
+	Response *dns.Msg
+}
+
+type cacheKey struct {
+	name   string // in canonical (lowercase) form
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+	ecs    netip.Prefix // the query's Client Subnet source prefix, if any
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	resp     *dns.Msg
+	negative bool
+	stored   time.Time
+	expires  time.Time
+}
+
+// A cacheCall is an upstream exchange for a cache miss, which the concurrent
+// misses for the same key share.
+type cacheCall struct {
+	done chan struct{} // closed when resp and err are set
+	resp *dns.Msg
+	err  error
+}
+
+// A Cache is a Transport that answers queries from a cache of the responses
+// of its Upstream transport.  The cache keys each response on the query's
+// name, type, and class, its DO and CD bits, and its EDNS0 Client Subnet
+// option (RFC 7871), if any, so that a response tailored to one client
+// subnet does not answer queries for another.  The cache keeps a response for
+// the smallest TTL of the response's answer records, and decrements the TTLs
+// of the responses that it returns by the time that they have spent in the
+// cache.  If several queries for the same key miss the cache at once, only
+// the first goes to the upstream, and the others share its response.
+//
+// As per RFC 2308, the cache also keeps negative responses (NXDOMAIN and
+// NODATA) whose authority section has an SOA record, for the smaller of the
+// SOA record's TTL and MINIMUM field.  The cache does not keep other error
+// responses, or truncated responses.  When the cache is full, it evicts the
+// least recently used response.
+//
+// The Cache records whether the response came from the cache in the context's
+// [ExchangeInfo].  A Cache is safe for concurrent use if its upstream is.  A
+// program must not modify a Cache's settings after its first exchange.
+type Cache struct {
+	// The transport that answers the queries that the cache can't.
+	Upstream Transport
+
+	// The maximum number of responses in the cache.  If zero, the cache
+	// keeps at most [DefaultCacheMaxEntries] responses.
+	MaxEntries int
+
+	// If non-zero, the longest that the cache keeps a positive response,
+	// regardless of its TTLs.
+	MaxTTL time.Duration
+
+	// The longest that the cache keeps a negative response.  If zero, the
+	// cache uses [DefaultCacheMaxNegativeTTL].
+	MaxNegativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+	calls   map[cacheKey]*cacheCall
+	stats   CacheStats
+}
+
+func (c *Cache) maxEntries() int {
+	if c.MaxEntries > 0 {
+		return c.MaxEntries
+	}
+	return DefaultCacheMaxEntries
+}
+
+func (c *Cache) maxNegativeTTL() time.Duration {
+	if c.MaxNegativeTTL > 0 {
+		return c.MaxNegativeTTL
+	}
+	return DefaultCacheMaxNegativeTTL
+}
+
+// init allocates the cache.  The caller must hold c.mu.
+func (c *Cache) init() {
+	if c.entries != nil {
+		return
+	}
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru = list.New()
+	c.calls = make(map[cacheKey]*cacheCall)
+}
+
+func newCacheKey(req *dns.Msg) cacheKey {
+	q := req.Question[0]
+	key := cacheKey{
+		name:   dns.CanonicalName(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		cd:     req.CheckingDisabled,
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	key.ecs, _ = edns0Subnet(req)
+	return key
+}
+
+// cacheTTL returns how long the cache may keep resp, and whether resp is a
+// negative response.  A TTL of zero means that the cache must not keep resp.
+func (c *Cache) cacheTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated || len(resp.Question) != 1 {
+		return 0, false
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	qtype := resp.Question[0].Qtype
+	negative := resp.Rcode == dns.RcodeNameError
+	if !negative {
+		negative = true
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+				negative = false
+				break
+			}
+		}
+	}
+
+	// The answer section may hold a CNAME chain, even for a negative
+	// response.
+	var ttl uint32
+	haveTTL := false
+	for _, rr := range resp.Answer {
+		if !haveTTL || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			haveTTL = true
+		}
+	}
+
+	if negative {
+		soas := CollectRRs[*dns.SOA](resp.Ns)
+		if len(soas) == 0 {
+			return 0, true
+		}
+		negTTL := min(soas[0].Hdr.Ttl, soas[0].Minttl)
+		if !haveTTL || negTTL < ttl {
+			ttl = negTTL
+		}
+		return min(time.Duration(ttl)*time.Second, c.maxNegativeTTL()), true
+	}
+
+	d := time.Duration(ttl) * time.Second
+	if c.MaxTTL > 0 {
+		d = min(d, c.MaxTTL)
+	}
+	return d, false
+}
+
+// get returns a copy of the cached response to req, if any.  Otherwise, it
+// returns the upstream exchange for the miss, and whether the caller must
+// perform that exchange (or else wait for another caller's).
+func (c *Cache) get(req *dns.Msg, key cacheKey) (*dns.Msg, *cacheCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	now := time.Now()
+	elem, ok := c.entries[key]
+	if ok && !now.Before(elem.Value.(*cacheEntry).expires) {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		if call, ok := c.calls[key]; ok {
+			return nil, call, false
+		}
+		c.stats.Misses++
+		call := &cacheCall{done: make(chan struct{})}
+		c.calls[key] = call
+		return nil, call, true
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	resp := replyFor(req, entry.resp)
+	decrementTTLs(resp, now.Sub(entry.stored))
+	return resp, nil, false
+}
+
+// replyFor returns a copy of resp, a response to a query with the same key as
+// req, as a response to req.
+func replyFor(req, resp *dns.Msg) *dns.Msg {
+	resp = resp.Copy()
+	resp.Id = req.Id
+	// keep the case of the query's name
+	resp.Question = append([]dns.Question(nil), req.Question...)
+	return resp
+}
+
+// finish records the result of the upstream exchange for a miss, and wakes
+// the callers that wait for it.  The callers get copies of their own from a
+// copy of resp, since the leader may modify resp once finish returns.
+func (c *Cache) finish(key cacheKey, call *cacheCall, resp *dns.Msg, err error) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+
+	if resp != nil {
+		call.resp = resp.Copy()
+	}
+	call.err = err
+	close(call.done)
+}
+
+// put adds resp to the cache, if the cache may keep it.
+func (c *Cache) put(key cacheKey, resp *dns.Msg) {
+	ttl, negative := c.cacheTTL(resp)
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:      key,
+		resp:     resp.Copy(),
+		negative: negative,
+		stored:   now,
+		expires:  now.Add(ttl),
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries() {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove removes an entry from the cache.  The caller must hold c.mu.
+func (c *Cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+func (c *Cache) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return c.ExchangeContext(context.Background(), req)
+}
+
+func (c *Cache) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	info := exchangeInfoFrom(ctx)
+	info.CacheHit = false
+
+	if len(req.Question) != 1 {
+		return c.Upstream.ExchangeContext(ctx, req)
+	}
+
+	key := newCacheKey(req)
+	for {
+		resp, call, leader := c.get(req, key)
+		if resp != nil {
+			info.CacheHit = true
+			return resp, nil
+		}
+
+		if leader {
+			resp, err := c.Upstream.ExchangeContext(ctx, req)
+			if err == nil {
+				c.put(key, resp)
+			}
+			c.finish(key, call, resp, err)
+			return resp, err
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.err == nil {
+			return replyFor(req, call.resp), nil
+		}
+		if errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded) {
+			// The other caller gave up, but this one hasn't; try again.
+			continue
+		}
+		return nil, call.err
+	}
+}
+
+// Stats returns the statistics of the cache.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// Entries returns the unexpired entries of the cache, most recently used
+// first.
+func (c *Cache) Entries() []CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	var entries []CacheEntry
+	now := time.Now()
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*cacheEntry)
+		if !now.Before(entry.expires) {
+			continue
+		}
+		resp := entry.resp.Copy()
+		decrementTTLs(resp, now.Sub(entry.stored))
+		entries = append(entries, CacheEntry{
+			Name:         entry.key.name,
+			Qtype:        entry.key.qtype,
+			Qclass:       entry.key.qclass,
+			DO:           entry.key.do,
+			CD:           entry.key.cd,
+			ClientSubnet: entry.key.ecs,
+			Negative:     entry.negative,
+			Expires:      entry.expires,
+			Response:     resp,
+		})
+	}
+	return entries
+}
+
+// Flush removes all of the entries from the cache.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	clear(c.entries)
+	c.lru.Init()
+}
+
+// FlushName removes the entries for name (of any type) from the cache.
+func (c *Cache) FlushName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	name = dns.CanonicalName(name)
+	for key, elem := range c.entries {
+		if key.name == name {
+			c.remove(elem)
+		}
+	}
+}
+
+// Close closes the upstream transport.  The cache keeps its entries.
+func (c *Cache) Close() error {
+	return c.Upstream.Close()
+}
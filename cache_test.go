@@ -0,0 +1,389 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A cacheUpstream is the upstream of a Cache in a test.  It answers each
+// query with the response that answer builds, and counts the queries.
+type cacheUpstream struct {
+	queries atomic.Int32
+	answer  func(req *dns.Msg) *dns.Msg
+}
+
+func (u *cacheUpstream) transport() funcTransport {
+	return func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		u.queries.Add(1)
+		return u.answer(req), nil
+	}
+}
+
+// answerA returns a function that answers each query with an A record with
+// the TTL.
+func answerA(ttl uint32) func(req *dns.Msg) *dns.Msg {
+	return func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   []byte{192, 0, 2, 1},
+		})
+		return resp
+	}
+}
+
+// ageCache makes the entries of c look as if they had been in the cache for d
+// longer than they have.
+func ageCache(c *Cache, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*cacheEntry)
+		entry.stored = entry.stored.Add(-d)
+		entry.expires = entry.expires.Add(-d)
+	}
+}
+
+func cacheQuery(t *testing.T, c *Cache, req *dns.Msg) (*dns.Msg, bool) {
+	t.Helper()
+	info := new(ExchangeInfo)
+	resp, err := c.ExchangeContext(WithExchangeInfo(context.Background(), info), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, info.CacheHit
+}
+
+func TestCacheTTLDecrement(t *testing.T) {
+	u := &cacheUpstream{answer: answerA(300)}
+	c := &Cache{Upstream: u.transport()}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, hit := cacheQuery(t, c, req); hit {
+		t.Fatal("first query hit the cache")
+	}
+
+	ageCache(c, 100*time.Second)
+	req2 := new(dns.Msg)
+	req2.SetQuestion("EXAMPLE.com.", dns.TypeA)
+	resp, hit := cacheQuery(t, c, req2)
+	if !hit {
+		t.Fatal("second query missed the cache")
+	}
+	if resp.Id != req2.Id || resp.Question[0].Name != "EXAMPLE.com." {
+		t.Errorf("cached response doesn't match the query: %v", resp)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 200 {
+		t.Errorf("got TTL %d, want 200", ttl)
+	}
+
+	ageCache(c, 200*time.Second)
+	if _, hit := cacheQuery(t, c, req); hit {
+		t.Error("expired response hit the cache")
+	}
+	if n := u.queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, want 2", n)
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	negative := func(rcode int, soaTTL, minttl uint32) func(req *dns.Msg) *dns.Msg {
+		return func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetRcode(req, rcode)
+			if soaTTL > 0 {
+				resp.Ns = append(resp.Ns, &dns.SOA{
+					Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+					Ns:     "ns.com.",
+					Mbox:   "hostmaster.com.",
+					Minttl: minttl,
+				})
+			}
+			return resp
+		}
+	}
+
+	tests := []struct {
+		name    string
+		answer  func(req *dns.Msg) *dns.Msg
+		maxNeg  time.Duration
+		wantTTL time.Duration // zero if the cache must not keep the response
+	}{
+		{"NXDOMAIN bounded by MINIMUM", negative(dns.RcodeNameError, 3600, 60), 0, 60 * time.Second},
+		{"NODATA bounded by SOA TTL", negative(dns.RcodeSuccess, 30, 900), 0, 30 * time.Second},
+		{"bounded by MaxNegativeTTL", negative(dns.RcodeNameError, 3600, 3600), 10 * time.Second, 10 * time.Second},
+		{"no SOA", negative(dns.RcodeNameError, 0, 0), 0, 0},
+		{"SERVFAIL", negative(dns.RcodeServerFailure, 3600, 60), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cache{Upstream: (&cacheUpstream{answer: tt.answer}).transport(), MaxNegativeTTL: tt.maxNeg}
+			req := new(dns.Msg)
+			req.SetQuestion("nx.example.com.", dns.TypeA)
+			start := time.Now()
+			cacheQuery(t, c, req)
+
+			entries := c.Entries()
+			if tt.wantTTL == 0 {
+				if len(entries) != 0 {
+					t.Fatalf("cache kept the response: %+v", entries)
+				}
+				return
+			}
+			if len(entries) != 1 {
+				t.Fatalf("got %d entries, want 1", len(entries))
+			}
+			e := entries[0]
+			if !e.Negative {
+				t.Errorf("entry isn't negative")
+			}
+			if ttl := e.Expires.Sub(start); ttl < tt.wantTTL || ttl > tt.wantTTL+time.Second {
+				t.Errorf("entry expires after %v, want %v", ttl, tt.wantTTL)
+			}
+
+			ageCache(c, tt.wantTTL-time.Second)
+			if _, hit := cacheQuery(t, c, req); !hit {
+				t.Errorf("missed the cache before the negative TTL")
+			}
+			ageCache(c, time.Second)
+			if _, hit := cacheQuery(t, c, req); hit {
+				t.Errorf("hit the cache after the negative TTL")
+			}
+		})
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	u := &cacheUpstream{answer: answerA(300)}
+	c := &Cache{Upstream: u.transport(), MaxEntries: 2}
+
+	query := func(name string) bool {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		_, hit := cacheQuery(t, c, req)
+		return hit
+	}
+	query("a.example.")
+	query("b.example.")
+	query("a.example.") // a is now the most recently used
+	query("c.example.") // evicts b
+
+	if !query("a.example.") {
+		t.Errorf("evicted the most recently used entry")
+	}
+	if !query("c.example.") {
+		t.Errorf("evicted the newest entry")
+	}
+	if query("b.example.") {
+		t.Errorf("kept the least recently used entry")
+	}
+	if stats := c.Stats(); stats.Evictions != 2 || stats.Entries != 2 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	withDO := func(m *dns.Msg) { m.SetEdns0(DefaultUDPBufSize, true) }
+	withCD := func(m *dns.Msg) { m.CheckingDisabled = true }
+	withECS := func(prefix string) func(m *dns.Msg) {
+		return func(m *dns.Msg) { AddEDNS0Subnet(m, netip.MustParsePrefix(prefix)) }
+	}
+
+	tests := []struct {
+		name      string
+		first     []func(m *dns.Msg)
+		second    []func(m *dns.Msg)
+		wantShare bool
+	}{
+		{"same query", nil, nil, true},
+		{"DO", nil, []func(m *dns.Msg){withDO}, false},
+		{"CD", nil, []func(m *dns.Msg){withCD}, false},
+		{"DO and CD", []func(m *dns.Msg){withDO}, []func(m *dns.Msg){withDO, withCD}, false},
+		{"ECS", nil, []func(m *dns.Msg){withECS("192.0.2.0/24")}, false},
+		{"different ECS", []func(m *dns.Msg){withECS("192.0.2.0/24")}, []func(m *dns.Msg){withECS("198.51.100.0/24")}, false},
+		{"ECS prefix length", []func(m *dns.Msg){withECS("192.0.2.0/24")}, []func(m *dns.Msg){withECS("192.0.2.0/25")}, false},
+		{"same ECS", []func(m *dns.Msg){withECS("2001:db8::/56")}, []func(m *dns.Msg){withECS("2001:db8::/56")}, true},
+		{"ECS opt-out", nil, []func(m *dns.Msg){withECS("0.0.0.0/0")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &cacheUpstream{answer: answerA(300)}
+			c := &Cache{Upstream: u.transport()}
+			for _, opts := range [][]func(m *dns.Msg){tt.first, tt.second} {
+				req := new(dns.Msg)
+				req.SetQuestion("example.com.", dns.TypeA)
+				for _, opt := range opts {
+					opt(req)
+				}
+				cacheQuery(t, c, req)
+			}
+			want := int32(2)
+			if tt.wantShare {
+				want = 1
+			}
+			if n := u.queries.Load(); n != want {
+				t.Errorf("upstream got %d queries, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestCacheEntryClientSubnet(t *testing.T) {
+	c := &Cache{Upstream: (&cacheUpstream{answer: answerA(300)}).transport()}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	AddEDNS0Subnet(req, netip.MustParsePrefix("192.0.2.0/24"))
+	cacheQuery(t, c, req)
+
+	entries := c.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if want := netip.MustParsePrefix("192.0.2.0/24"); entries[0].ClientSubnet != want {
+		t.Errorf("got client subnet %v, want %v", entries[0].ClientSubnet, want)
+	}
+}
+
+func TestCacheSingleFlight(t *testing.T) {
+	release := make(chan struct{})
+	var queries atomic.Int32
+	c := &Cache{Upstream: funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		queries.Add(1)
+		<-release
+		return answerA(300)(req), nil
+	})}
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			resp, err := c.Exchange(req)
+			if err == nil && (resp.Id != req.Id || len(resp.Answer) != 1) {
+				err = errors.New("response doesn't match the query")
+			}
+			errs <- err
+		}()
+	}
+	// Let the queries pile up behind the first.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("upstream got %d queries, want 1", n)
+	}
+	if stats := c.Stats(); stats.Misses != 1 {
+		t.Errorf("got %d misses, want 1", stats.Misses)
+	}
+}
+
+// TestCacheConcurrentClients has several clients share a Cache, and modify
+// the responses that it returns to them: each client synthesizes the CNAME
+// of a DNAME.  Run with -race.
+func TestCacheConcurrentClients(t *testing.T) {
+	release := make(chan struct{})
+	c := &Cache{Upstream: funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		<-release
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = mustRRs(t,
+			"example.com. 300 IN DNAME example.net.",
+			"www.example.net. 300 IN A 192.0.2.1",
+		)
+		return resp, nil
+	})}
+
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &Client{Transport: c, RD: true, MaxCNAMEs: 2}
+			resp, err := client.Lookup("www.example.com.", dns.TypeA)
+			if err == nil && len(CollectRRs[*dns.CNAME](resp.Answer)) != 1 {
+				err = fmt.Errorf("got answer %v, want one synthesized CNAME", resp.Answer)
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCacheSingleFlightLeaderCanceled(t *testing.T) {
+	started := make(chan struct{}, 2)
+	var queries atomic.Int32
+	c := &Cache{Upstream: funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		if queries.Add(1) == 1 {
+			started <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return answerA(300)(req), nil
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		_, err := c.ExchangeContext(ctx, req)
+		leaderErr <- err
+	}()
+	<-started
+
+	waiterErr := make(chan error, 1)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		_, err := c.Exchange(req)
+		waiterErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader got %v, want %v", err, context.Canceled)
+	}
+	// The waiter's context is fine, so it queries the upstream itself.
+	if err := <-waiterErr; err != nil {
+		t.Errorf("waiter got %v", err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, want 2", n)
+	}
+}
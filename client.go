@@ -1,10 +1,14 @@
 package resolv
 
 import (
+	"context"
+	"errors"
 	"net/netip"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/miekg/dns"
-	"github.com/syslab-wm/mu"
 )
 
 // A Client defines the settings for a DNS client: the tranport, and the
@@ -14,6 +18,10 @@ import (
 // wants to modify the Tranport, it should first call the Client's Close
 // method, modify (or assign a new Transport), and then resume using the
 // Client.
+//
+// Multiple goroutines may use a Client concurrently if its Transport is safe
+// for concurrent use (e.g., a [Pool], or a [Do53TCP] or [DoT] in Pipeline
+// mode).
 type Client struct {
 	// Set the AD ("authentic data") bit in queries. Note that DNS only uses
 	// this bit in responses; setting the bit in a query is undefined, though
@@ -55,20 +63,82 @@ type Client struct {
 	// query identify itself."
 	NSID bool
 
+	// Send DNS Cookies (RFC 7873, RFC 9018) in queries, on any transport.
+	// The client keeps a separate random client cookie for each server,
+	// stores the server cookie from each server's responses and echoes it
+	// in later queries to that server, and retries a query once if the
+	// server responds with BADCOOKIE.  The client rejects a response whose
+	// cookie does not echo the client cookie (with [ErrBadCookie]), which
+	// helps defend against off-path spoofing of UDP responses.
+	Cookies bool
+
 	// The maximum number of times the client may issue a new query when
 	// resolving a chain of CNAMEs.  The client always inspects the CNAMES in a
 	// given response to determine if these CNAMEs resolve to the requested record
 	// type.  If the chain of CNAMEs in a response terminates in a CNAME
 	// record, only then does the client re-issue the query, replacing the
-	// original QNAME with the last CNAME target in the chain.
+	// original QNAME with the last CNAME target in the chain.  The client
+	// treats a DNAME record (RFC 6672) in the answer as the CNAME that it
+	// implies for each name of the chain below the DNAME's owner: it adds
+	// the synthesized CNAME to the answer if the answer lacks it (as from a
+	// server that predates DNAME), and replaces a CNAME that conflicts with
+	// it.  Like the CNAMEs in a response, the CNAMEs that the client
+	// synthesizes do not count toward MaxCNAMEs; a chain of DNAMEs that
+	// loops, or implies more than [MaxSynthesizedCNAMEs] CNAMEs, fails with
+	// [ErrMaxCNAMEs].
 	MaxCNAMEs int
 
-	// The underlying tranport (e.g., [Do53UDP], [Do53TCP], [DoT], [DoH])
+	// The maximum number of SVCB or HTTPS AliasMode records (RFC 9460) that
+	// [Client.GetSVCBRecords] and [Client.GetHTTPSRecords] follow when
+	// looking up a service.  If zero, the client follows at most
+	// [DefaultMaxSVCBAliases] AliasMode records.
+	MaxSVCBAliases int
+
+	// The search list: the domains that [Client.Lookup] appends to a name
+	// that is not fully-qualified (has no trailing dot), as with the search
+	// directive of resolv.conf.  If the name has at least NDots dots, Lookup
+	// tries the name as is first, and then with each domain of the search
+	// list; otherwise, it tries the name as is last.  Lookup tries the next
+	// name if the response is NXDOMAIN, NODATA, or SERVFAIL.  If Search is
+	// empty, Lookup treats every name as fully-qualified.
+	Search []string
+	NDots  int
+
+	// Validate the responses with DNSSEC (RFC 4035, Section 5), rather than
+	// trust the AD bit of the upstream.  The client sets the DO and CD bits
+	// in its queries, looks up the DS and DNSKEY records of the zones from
+	// a trust anchor down to the signer of each RRset in a response, and
+	// checks the RRSIGs; it supports algorithms 8, 13, 14, 15, and 16.  The
+	// client records the result in the context's [ExchangeInfo], sets the
+	// response's AD bit only if the response is Secure, and returns a
+	// [ValidationError] if the response is Bogus.  Validate doesn't work
+	// over an [Iterative] transport, which drops RRSIGs; the client returns
+	// [ErrValidateIterative] instead.
+	Validate bool
+
+	// The trust anchors for validation.  If nil, the client uses the root
+	// zone's trust anchors ([RootTrustAnchors]).
+	TrustAnchors *TrustAnchorStore
+
+	// The underlying tranport (e.g., [Do53UDP], [Do53TCP], [DoT], [DoH], [DoQ])
 	Transport Transport
+
+	cookiesOnce sync.Once
+	cookies     *cookieJar
+
+	validatorOnce sync.Once
+	validator     *validator
+}
+
+func (c *Client) cookieJar() *cookieJar {
+	c.cookiesOnce.Do(func() {
+		c.cookies = newCookieJar()
+	})
+	return c.cookies
 }
 
 func (c *Client) usesEDNS0() bool {
-	if c.DO || c.NSID || c.ClientSubnet.IsValid() {
+	if c.DO || c.Validate || c.NSID || c.ClientSubnet.IsValid() {
 		return true
 	}
 	return false
@@ -84,10 +154,10 @@ func (c *Client) NewMsg(name string, qtype uint16) *dns.Msg {
 
 	m.RecursionDesired = c.RD
 	m.AuthenticatedData = c.AD
-	m.CheckingDisabled = c.CD
+	m.CheckingDisabled = c.CD || c.Validate
 
 	if c.usesEDNS0() {
-		m.SetEdns0(DefaultUDPBufSize, c.DO)
+		m.SetEdns0(DefaultUDPBufSize, c.DO || c.Validate)
 		if c.NSID {
 			AddEDNS0NSID(m)
 		}
@@ -106,24 +176,82 @@ func (c *Client) NewMsg(name string, qtype uint16) *dns.Msg {
 //
 // If there is a va
 func (c *Client) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return c.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext is like [Client.Exchange], but the caller may use ctx to
+// cancel the query (including any follow-up queries for CNAME targets), or to
+// give it a deadline.
+func (c *Client) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return c.exchange(ctx, req, nil)
+}
+
+// exchange implements ExchangeContext.  If res is not nil, exchange records
+// each hop, and the CNAME chain, in res.
+func (c *Client) exchange(ctx context.Context, req *dns.Msg, res *Result) (*dns.Msg, error) {
 	var err error
 	var cnames []*dns.CNAME
 	var resp *dns.Msg
 	qtype := req.Question[0].Qtype
 
+	if _, ok := c.Transport.(*Iterative); ok && c.Validate {
+		return nil, ErrValidateIterative
+	}
+
+	if c.Cookies {
+		ctx = withCookieJar(ctx, c.cookieJar())
+	}
+
 	// if following CNAMES, req will change; thus, make a copy so it
 	// doesn't affect the caller
-	if c.MaxCNAMEs > 0 {
+	if c.Validate {
+		req = withDNSSECOK(req)
+	} else if c.MaxCNAMEs > 0 {
 		req = req.Copy()
 	}
 
-	for i := 0; i <= c.MaxCNAMEs; i++ {
-		resp, err = c.Transport.Exchange(req)
+	info := exchangeInfoFrom(ctx)
+	info.Validation, info.ValidationReason = Indeterminate, ""
+	if c.Validate {
+		info.Validation = Secure
+	}
+
+	requeries := 0
+	for {
+		// Each hop gets its own ExchangeInfo, so that details from one hop
+		// (e.g., a TCP fallback) don't carry over to the next.
+		hop := new(Hop)
+		if res != nil {
+			hop.Query = req.Copy()
+			res.Hops = append(res.Hops, hop)
+		}
+		resp, err = c.Transport.ExchangeContext(WithExchangeInfo(ctx, &hop.ExchangeInfo), req)
+		info.setTransportInfo(&hop.ExchangeInfo)
+		hop.QName = req.Question[0].Name
+		hop.Response = resp
 		if err != nil {
 			return nil, err // TODO: when would this ever have a resp to return?
 		}
+		var status ValidationStatus
+		var reason string
+		if c.Validate {
+			status, reason = c.validate(ctx, resp)
+			hop.Validation, hop.ValidationReason = status, reason
+			if status.rank() < info.Validation.rank() {
+				info.Validation, info.ValidationReason = status, reason
+			}
+			resp.AuthenticatedData = status == Secure
+			if status == Bogus && !isNegative(resp) {
+				q := req.Question[0]
+				return resp, &ValidationError{Name: q.Name, Qtype: q.Qtype, Reason: reason}
+			}
+		}
 		if resp.Rcode != dns.RcodeSuccess {
-			return resp, ErrRcode
+			return resp, c.negativeError(resp, status, reason, newRcodeError(req.Question[0], resp, info.Server))
+		}
+
+		if !synthesizeDNAMEs(resp, req.Question[0].Name) {
+			return resp, ErrMaxCNAMEs
 		}
 
 		// gather all RRs that are of the qtype
@@ -133,7 +261,7 @@ func (c *Client) Exchange(req *dns.Msg) (*dns.Msg, error) {
 				ans = append(ans, rr)
 				// if such an RR matches the name we're searching for, it's a
 				// direct hit
-				if rr.Header().Name == req.Question[0].Name {
+				if strings.EqualFold(rr.Header().Name, req.Question[0].Name) {
 					return resp, nil
 				}
 			}
@@ -142,7 +270,7 @@ func (c *Client) Exchange(req *dns.Msg) (*dns.Msg, error) {
 		// get all of the CNAMES from the answer
 		cnames = CollectRRs[*dns.CNAME](resp.Answer)
 		if len(cnames) == 0 {
-			return resp, ErrNoData
+			return resp, c.negativeError(resp, status, reason, ErrNoData)
 		}
 
 		// validate that the CNAMEs form a chain
@@ -152,15 +280,18 @@ func (c *Client) Exchange(req *dns.Msg) (*dns.Msg, error) {
 
 		}
 		// the head of the chain must match the name we're searching for
-		if cnames[0].Hdr.Name != req.Question[0].Name {
+		if !strings.EqualFold(cnames[0].Hdr.Name, req.Question[0].Name) {
 			return resp, ErrInvalidCNAMEs
 		}
+		if res != nil {
+			res.CNAMEs = append(res.CNAMEs, cnames...)
+		}
 
 		// Is the last CNAME in the chain an alias for an RR of the
 		// type we're searching for?  If so, success.
 		lastCNAME := cnames[len(cnames)-1]
 		for _, rr := range ans {
-			if lastCNAME.Target == rr.Header().Name {
+			if strings.EqualFold(lastCNAME.Target, rr.Header().Name) {
 				return resp, nil
 			}
 		}
@@ -173,23 +304,182 @@ func (c *Client) Exchange(req *dns.Msg) (*dns.Msg, error) {
 		}
 
 		// setup to repeat query on the last CNAME in the chain
+		if requeries >= c.MaxCNAMEs {
+			return resp, ErrMaxCNAMEs
+		}
+		requeries++
 		req.SetQuestion(dns.Fqdn(cnames[len(cnames)-1].Target), qtype)
 	}
+}
 
-	if len(cnames) > 0 {
-		return resp, ErrMaxCNAMEs
+// synthesizeDNAMEs completes the chain of aliases in resp's answer, starting
+// at name, with the CNAMEs that the answer's DNAME records imply (RFC 6672,
+// Section 3.4).  For each name of the chain that is below the owner of a
+// DNAME, synthesizeDNAMEs adds the synthesized CNAME if the answer lacks a
+// CNAME for the name, and replaces the CNAME if its target differs.
+//
+// synthesizeDNAMEs returns false if the chain loops, or needs more than
+// [MaxSynthesizedCNAMEs] synthesized CNAMEs.
+func synthesizeDNAMEs(resp *dns.Msg, name string) bool {
+	dnames := CollectRRs[*dns.DNAME](resp.Answer)
+	if len(dnames) == 0 {
+		return true
 	}
 
-	// UNREACHABLE
-	mu.BUG("reached what should be unreachable code: req: %v, resp: %v", req, resp)
-	return resp, ErrNoData
+	n := 0
+	seen := make(map[string]bool)
+	for {
+		if seen[dns.CanonicalName(name)] {
+			return false
+		}
+		seen[dns.CanonicalName(name)] = true
+
+		i := slices.IndexFunc(resp.Answer, func(rr dns.RR) bool {
+			hdr := rr.Header()
+			return hdr.Rrtype == dns.TypeCNAME && strings.EqualFold(hdr.Name, name)
+		})
+		j := slices.IndexFunc(dnames, func(dname *dns.DNAME) bool {
+			return dns.IsSubDomain(dname.Hdr.Name, name) && !strings.EqualFold(dname.Hdr.Name, name)
+		})
+
+		if j < 0 {
+			if i < 0 {
+				return true
+			}
+			name = dns.Fqdn(resp.Answer[i].(*dns.CNAME).Target)
+			continue
+		}
+
+		synth := synthesizeCNAME(dnames[j], name)
+		if _, ok := dns.IsDomainName(synth.Target); !ok {
+			// the target is too long (RFC 6672, Section 2.2)
+			return true
+		}
+		if i < 0 || !strings.EqualFold(resp.Answer[i].(*dns.CNAME).Target, synth.Target) {
+			if n >= MaxSynthesizedCNAMEs {
+				return false
+			}
+			n++
+			if i < 0 {
+				resp.Answer = append(resp.Answer, synth)
+			} else {
+				resp.Answer[i] = synth
+			}
+		}
+		name = synth.Target
+	}
+}
+
+// isNegative returns true if resp is an NXDOMAIN or NODATA response (at the
+// end of any CNAME chain in the answer section).  A response without its
+// question is not.
+func isNegative(resp *dns.Msg) bool {
+	if len(resp.Question) != 1 {
+		return false
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return true
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	qtype := resp.Question[0].Qtype
+	for _, rr := range resp.Answer {
+		if t := rr.Header().Rrtype; t == qtype || t == dns.TypeCNAME {
+			return false
+		}
+	}
+	return true
+}
+
+// negativeError returns the error for a response for which the client would
+// otherwise return err (an RcodeError or ErrNoData).  If the client validates and
+// resp is a negative response, the error is a [DenialError] with the
+// response's validation status.
+func (c *Client) negativeError(resp *dns.Msg, status ValidationStatus, reason string, err error) error {
+	if !c.Validate || !isNegative(resp) {
+		return err
+	}
+	return &DenialError{
+		Name:     deniedName(resp),
+		Qtype:    resp.Question[0].Qtype,
+		NXDomain: resp.Rcode == dns.RcodeNameError,
+		Status:   status,
+		Reason:   reason,
+		Err:      err,
+	}
+}
+
+// searchNames returns the fully-qualified names that Lookup tries for name,
+// in order, as per the client's Search list and NDots.
+func (c *Client) searchNames(name string) []string {
+	if dns.IsFqdn(name) || len(c.Search) == 0 {
+		return []string{dns.Fqdn(name)}
+	}
+
+	var names []string
+	asIs := strings.Count(name, ".") >= c.NDots
+	if asIs {
+		names = append(names, dns.Fqdn(name))
+	}
+	for _, domain := range c.Search {
+		names = append(names, dns.Fqdn(name)+strings.TrimPrefix(dns.Fqdn(domain), "."))
+	}
+	if !asIs {
+		names = append(names, dns.Fqdn(name))
+	}
+	return names
+}
+
+// searchNext returns true if Lookup should try the next name of the search
+// list after a query returned resp and err.
+func searchNext(resp *dns.Msg, err error) bool {
+	if errors.Is(err, ErrNoData) {
+		return true
+	}
+	if errors.Is(err, ErrRcode) {
+		return resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeServerFailure
+	}
+	return false
 }
 
 // Lookup is convenience method that creates a new message and
-// then issues a synchronous query with that message.
+// then issues a synchronous query with that message.  If name is not
+// fully-qualified, Lookup may try several names, as per the client's Search
+// list.  To learn which name produced the response, use [Client.Query] (see
+// [Result].QName), or [Client.LookupContext] with a context that carries an
+// [ExchangeInfo].
 func (c *Client) Lookup(name string, qtype uint16) (*dns.Msg, error) {
-	req := c.NewMsg(name, qtype)
-	return c.Exchange(req)
+	return c.LookupContext(context.Background(), name, qtype)
+}
+
+// LookupContext is like [Client.Lookup], but takes a context that may
+// cancel the query.  It records the name that produced the response in the
+// QName of the context's [ExchangeInfo].
+func (c *Client) LookupContext(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return c.lookup(ctx, name, qtype, nil)
+}
+
+// lookup implements LookupContext.  If res is not nil, lookup records the
+// hops for each name it tries in res.
+func (c *Client) lookup(ctx context.Context, name string, qtype uint16, res *Result) (*dns.Msg, error) {
+	var resp *dns.Msg
+	var err error
+
+	info := exchangeInfoFrom(ctx)
+	names := c.searchNames(name)
+	for i, qname := range names {
+		req := c.NewMsg(qname, qtype)
+		if res != nil {
+			res.CNAMEs = nil
+		}
+		resp, err = c.exchange(ctx, req, res)
+		info.QName = qname
+		if i == len(names)-1 || !searchNext(resp, err) {
+			break
+		}
+	}
+	return resp, err
 }
 
 func (c *Client) Close() error {
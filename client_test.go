@@ -0,0 +1,242 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSearchNames(t *testing.T) {
+	search := []string{"example.com", "example.net."}
+
+	tests := []struct {
+		name   string
+		search []string
+		ndots  int
+		want   []string
+	}{
+		{"www", nil, 1, []string{"www."}},
+		{"www.", search, 1, []string{"www."}},
+		{"www", search, 1, []string{"www.example.com.", "www.example.net.", "www."}},
+		{"www.a", search, 1, []string{"www.a.", "www.a.example.com.", "www.a.example.net."}},
+		{"www.a", search, 2, []string{"www.a.example.com.", "www.a.example.net.", "www.a."}},
+		{"www.a.b", search, 2, []string{"www.a.b.", "www.a.b.example.com.", "www.a.b.example.net."}},
+		{"www", search, 0, []string{"www.", "www.example.com.", "www.example.net."}},
+	}
+	for _, tt := range tests {
+		c := &Client{Search: tt.search, NDots: tt.ndots}
+		if got := c.searchNames(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q (ndots %d): got %q, want %q", tt.name, tt.ndots, got, tt.want)
+		}
+	}
+}
+
+func TestLookupSearch(t *testing.T) {
+	// The server has records for www.example.net. only; it returns NXDOMAIN
+	// for the other names.
+	var mu sync.Mutex
+	var queried []string
+	addr := startDNSServer(t, "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		name := req.Question[0].Name
+		mu.Lock()
+		queried = append(queried, name)
+		mu.Unlock()
+		if strings.EqualFold(name, "www.example.net.") {
+			w.WriteMsg(testAnswer(req))
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeNameError)
+		w.WriteMsg(resp)
+	})
+
+	c := &Client{
+		Transport: &Do53UDP{Server: addr, Timeout: time.Second},
+		RD:        true,
+		Search:    []string{"example.com", "example.net"},
+		NDots:     1,
+	}
+	info := new(ExchangeInfo)
+	resp, err := c.LookupContext(WithExchangeInfo(context.Background(), info), "www", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || info.QName != "www.example.net." {
+		t.Errorf("got answer %v, QName %q", resp.Answer, info.QName)
+	}
+	want := []string{"www.example.com.", "www.example.net."}
+	mu.Lock()
+	if !reflect.DeepEqual(queried, want) {
+		t.Errorf("queried %q, want %q", queried, want)
+	}
+	mu.Unlock()
+
+	res, err := c.Query(context.Background(), "www", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.QName != "www.example.net." {
+		t.Errorf("Query: got QName %q", res.QName)
+	}
+}
+
+func TestDNAME(t *testing.T) {
+	// the answers of the server, by query name
+	answers := map[string][]string{
+		// a server that synthesizes the CNAME
+		"1.2.0.192.in-addr.arpa.": {
+			"2.0.192.in-addr.arpa. 300 IN DNAME new.example.",
+			"1.2.0.192.in-addr.arpa. 300 IN CNAME 1.new.example.",
+			"1.new.example. 300 IN PTR h1.example.",
+		},
+		// a server that predates DNAME
+		"2.2.0.192.in-addr.arpa.": {
+			"2.0.192.in-addr.arpa. 300 IN DNAME new.example.",
+			"2.new.example. 300 IN PTR h2.example.",
+		},
+		// a CNAME that conflicts with the DNAME
+		"3.2.0.192.in-addr.arpa.": {
+			"2.0.192.in-addr.arpa. 300 IN DNAME new.example.",
+			"3.2.0.192.in-addr.arpa. 300 IN CNAME evil.example.",
+			"3.new.example. 300 IN PTR h3.example.",
+			"evil.example. 300 IN PTR evil.example.",
+		},
+		// the DNAME without the target's records
+		"4.2.0.192.in-addr.arpa.": {"2.0.192.in-addr.arpa. 300 IN DNAME new.example."},
+		"4.new.example.":          {"4.new.example. 300 IN PTR h4.example."},
+		// a loop
+		"a.x.example.": {
+			"x.example. 300 IN DNAME y.example.",
+			"y.example. 300 IN DNAME x.example.",
+		},
+		// a DNAME whose target is below its owner
+		"a.self.example.": {"self.example. 300 IN DNAME b.self.example."},
+		// a chain whose names differ in case
+		"mixed.example.": {
+			"Mixed.Example. 300 IN CNAME dname.OLD.example.",
+			"old.example. 300 IN DNAME new.example.",
+			"DNAME.new.example. 300 IN CNAME ptr.example.",
+			"PTR.example. 300 IN PTR h5.example.",
+		},
+	}
+	tr := funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = mustRRs(t, answers[dns.CanonicalName(req.Question[0].Name)]...)
+		return resp, nil
+	})
+
+	tests := []struct {
+		name      string
+		qname     string
+		maxCNAMEs int
+		wantErr   error
+		wantHops  int
+		wantPTR   string // the target of the PTR record
+	}{
+		{name: "DNAME and CNAME", qname: "1.2.0.192.in-addr.arpa.", wantHops: 1, wantPTR: "h1.example."},
+		{name: "DNAME without CNAME", qname: "2.2.0.192.in-addr.arpa.", wantHops: 1, wantPTR: "h2.example."},
+		{name: "mismatched CNAME", qname: "3.2.0.192.in-addr.arpa.", wantHops: 1, wantPTR: "h3.example."},
+		{name: "DNAME to another query", qname: "4.2.0.192.in-addr.arpa.", maxCNAMEs: 1, wantHops: 2, wantPTR: "h4.example."},
+		{name: "DNAME to another query, no requery", qname: "4.2.0.192.in-addr.arpa.", wantErr: ErrMaxCNAMEs, wantHops: 1},
+		{name: "DNAME loop", qname: "a.x.example.", maxCNAMEs: MaxMaxCNAMEs, wantErr: ErrMaxCNAMEs, wantHops: 1},
+		{name: "self-referential DNAME", qname: "a.self.example.", maxCNAMEs: MaxMaxCNAMEs, wantErr: ErrMaxCNAMEs, wantHops: 1},
+		{name: "mixed case", qname: "mixed.example.", wantHops: 1, wantPTR: "h5.example."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{Transport: tr, RD: true, MaxCNAMEs: tt.maxCNAMEs}
+			res, err := c.Query(context.Background(), tt.qname, dns.TypePTR)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(res.Hops) != tt.wantHops {
+				t.Errorf("got %d hops, want %d", len(res.Hops), tt.wantHops)
+			}
+			served := len(CollectRRs[*dns.CNAME](mustRRs(t, answers[tt.qname]...)))
+			if n := len(CollectRRs[*dns.CNAME](res.Msg.Answer)); n > served+MaxSynthesizedCNAMEs {
+				t.Errorf("got %d CNAMEs in the answer, %d of them synthesized", n, n-served)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			// the chain leads from the query's name to the PTR record
+			name := tt.qname
+			for _, cname := range res.CNAMEs {
+				if !strings.EqualFold(cname.Hdr.Name, name) {
+					t.Fatalf("got CNAME chain %v from %s", res.CNAMEs, tt.qname)
+				}
+				name = cname.Target
+			}
+			ptrs := CollectRRs[*dns.PTR](res.Msg.Answer)
+			i := slices.IndexFunc(ptrs, func(ptr *dns.PTR) bool { return strings.EqualFold(ptr.Hdr.Name, name) })
+			if i < 0 || ptrs[i].Ptr != tt.wantPTR {
+				t.Errorf("got answer %v for %s, want PTR %s", res.Msg.Answer, name, tt.wantPTR)
+			}
+		})
+	}
+}
+
+// TestDNAMEDefaultClient checks that a Client with the default settings
+// synthesizes the CNAME of a DNAME, for a server that predates DNAME.
+func TestDNAMEDefaultClient(t *testing.T) {
+	addr := startDNSServer(t, "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = mustRRs(t,
+			"example.com. 300 IN DNAME example.net.",
+			"www.example.net. 300 IN A 192.0.2.1",
+		)
+		w.WriteMsg(resp)
+	})
+
+	c := &Client{Transport: &Do53UDP{Server: addr, Timeout: time.Second}, RD: true}
+	resp, err := c.Lookup("www.example.com.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnames := CollectRRs[*dns.CNAME](resp.Answer)
+	if len(cnames) != 1 || cnames[0].Hdr.Name != "www.example.com." || cnames[0].Target != "www.example.net." {
+		t.Errorf("got answer %v, want the synthesized CNAME", resp.Answer)
+	}
+}
+
+func TestErrorResponseWithoutQuestion(t *testing.T) {
+	// The server answers with an empty question section, as some broken or
+	// strict servers do for the queries that they reject.
+	var serverRcode atomic.Int32
+	addr := startDNSServer(t, "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, int(serverRcode.Load()))
+		resp.Question = nil
+		w.WriteMsg(resp)
+	})
+
+	for _, validate := range []bool{false, true} {
+		for _, rcode := range []int{dns.RcodeFormatError, dns.RcodeRefused, dns.RcodeNotImplemented, dns.RcodeSuccess} {
+			serverRcode.Store(int32(rcode))
+			c := &Client{Transport: &Do53UDP{Server: addr, Timeout: time.Second}, RD: true, Validate: validate}
+			_, err := c.Lookup("www.example.", dns.TypeA)
+
+			if rcode == dns.RcodeSuccess {
+				if !errors.Is(err, ErrNoData) {
+					t.Errorf("validate %v, %s: got error %v, want %v", validate, dns.RcodeToString[rcode], err, ErrNoData)
+				}
+				continue
+			}
+			var rerr *RcodeError
+			if !errors.As(err, &rerr) || rerr.Rcode != rcode || rerr.Name != "www.example." || rerr.Qtype != dns.TypeA {
+				t.Errorf("validate %v, %s: got error %v", validate, dns.RcodeToString[rcode], err)
+			}
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/netip"
 	"strings"
 
+	"github.com/miekg/dns"
 	"github.com/syslab-wm/adt/set"
 	"github.com/syslab-wm/functools"
 	"github.com/syslab-wm/mu"
@@ -14,6 +17,19 @@ import (
 
 /* meta queries */
 
+func getHTTPS(c *resolv.Client, qname string) error {
+	recs, err := c.GetHTTPSRecords(qname)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range recs {
+		fmt.Printf("%s: %v\n", rec.Name, rec)
+	}
+
+	return nil
+}
+
 func getIPs(c *resolv.Client, qname string) error {
 	addrs, err := c.GetIPs(qname)
 	if err != nil {
@@ -88,19 +104,159 @@ func getServices(c *resolv.Client, qname string) error {
 	return nil
 }
 
+// describeTransport returns the protocol and server of a transport.
+func describeTransport(t resolv.Transport) string {
+	switch t := t.(type) {
+	case *resolv.Do53UDP:
+		return fmt.Sprintf("Do53 (UDP) server %s", t.Server)
+	case *resolv.Do53TCP:
+		return fmt.Sprintf("Do53 (TCP) server %s", t.Server)
+	case *resolv.DoT:
+		return fmt.Sprintf("DoT server %s", t.Server)
+	case *resolv.DoQ:
+		return fmt.Sprintf("DoQ server %s", t.Server)
+	case *resolv.DoH:
+		return fmt.Sprintf("DoH server %s", t.ServerURL)
+	default:
+		return fmt.Sprintf("%T", t)
+	}
+}
+
 /* normal query */
 
 func doLookup(c *resolv.Client, qname string, qtype uint16) error {
-	resp, err := c.Lookup(qname, qtype)
+	info := new(resolv.ExchangeInfo)
+	ctx := resolv.WithExchangeInfo(context.Background(), info)
+	res, err := c.Query(ctx, qname, qtype)
 	if err != nil {
+		var rcodeErr *resolv.RcodeError
+		if errors.As(err, &rcodeErr) {
+			for _, ede := range rcodeErr.ExtendedErrors {
+				fmt.Printf(";; extended DNS error: %v\n", ede)
+			}
+		}
 		return err
 	}
 
-	fmt.Printf("%v\n", resp)
+	fmt.Printf("%v\n", res.Msg)
+	if info.QName != dns.Fqdn(qname) {
+		fmt.Printf(";; search list expanded the name to %s\n", info.QName)
+	}
+	for _, hop := range res.Hops {
+		switch {
+		case hop.CacheHit:
+			fmt.Printf(";; %s: answered from cache\n", hop.QName)
+		case hop.Attempts > 1:
+			fmt.Printf(";; %s: %d bytes from %s (%s) in %v, after %d attempts\n",
+				hop.QName, hop.Size, hop.Server, hop.Protocol, hop.RTT, hop.Attempts)
+		default:
+			fmt.Printf(";; %s: %d bytes from %s (%s) in %v\n",
+				hop.QName, hop.Size, hop.Server, hop.Protocol, hop.RTT)
+		}
+	}
+	fmt.Printf(";; query time %v\n", res.Elapsed)
+	if info.TCPFallback {
+		fmt.Printf(";; UDP response truncated, received over TCP\n")
+	} else if info.UDPBufSize != 0 {
+		fmt.Printf(";; received over UDP, advertised bufsize %d\n", info.UDPBufSize)
+	}
+	switch t := c.Transport.(type) {
+	case *resolv.Failover:
+		fmt.Printf(";; answered by %s\n", describeTransport(t.Upstreams[info.Upstream]))
+	case *resolv.Race:
+		fmt.Printf(";; answered by %s\n", describeTransport(t.Upstreams[info.Upstream]))
+	}
+	if c.Validate {
+		if info.ValidationReason != "" {
+			fmt.Printf(";; DNSSEC %v: %s\n", info.Validation, info.ValidationReason)
+		} else {
+			fmt.Printf(";; DNSSEC %v\n", info.Validation)
+		}
+	}
+	if info.ResponsePadded {
+		fmt.Printf(";; response padded\n")
+	}
+	if info.HTTPAge != 0 || info.HTTPFreshness != 0 {
+		fmt.Printf(";; HTTP age %v, fresh for %v\n", info.HTTPAge, info.HTTPFreshness)
+	}
 
 	return nil
 }
 
+// newTransport returns a transport for the server, as per the options.
+func newTransport(opts *Options, server string) resolv.Transport {
+	var t resolv.Transport
+
+	padBlockSize := 0
+	if opts.padding {
+		padBlockSize = resolv.DefaultPadBlockSize
+	}
+
+	if opts.tcp {
+		t = &resolv.Do53TCP{
+			Server:    netx.TryJoinHostPort(server, "53"),
+			IPv4Only:  opts.four,
+			IPv6Only:  opts.six,
+			Timeout:   opts.timeout,
+			KeepOpen:  false,
+			Keepalive: opts.keepalive,
+		}
+	} else if opts.tls {
+		t = &resolv.DoT{
+			Server:       netx.TryJoinHostPort(server, resolv.DefaultDoTPort),
+			IPv4Only:     opts.four,
+			IPv6Only:     opts.six,
+			Timeout:      opts.timeout,
+			KeepOpen:     false,
+			Keepalive:    opts.keepalive,
+			TLSConfig:    opts.tlsConfig,
+			SPKIPins:     opts.spkiPins,
+			PadBlockSize: padBlockSize,
+		}
+	} else if opts.quic {
+		t = &resolv.DoQ{
+			Server:       netx.TryJoinHostPort(server, resolv.DefaultDoQPort),
+			IPv4Only:     opts.four,
+			IPv6Only:     opts.six,
+			Timeout:      opts.timeout,
+			KeepOpen:     false,
+			TLSConfig:    opts.tlsConfig,
+			SPKIPins:     opts.spkiPins,
+			PadBlockSize: padBlockSize,
+		}
+	} else if opts.httpsPath != "" {
+		t = &resolv.DoH{
+			ServerURL:    fmt.Sprintf("https://%s%s", server, opts.httpsPath),
+			Timeout:      opts.timeout,
+			UseGET:       opts.httpsUseGET,
+			UseJSON:      opts.httpsUseJSON,
+			KeepOpen:     false,
+			TLSConfig:    opts.tlsConfig,
+			SPKIPins:     opts.spkiPins,
+			PadBlockSize: padBlockSize,
+		}
+	} else {
+		t = &resolv.Do53UDP{
+			Server:           netx.TryJoinHostPort(server, "53"),
+			IPv4Only:         opts.four,
+			IPv6Only:         opts.six,
+			Timeout:          opts.timeout,
+			UDPBufSize:       opts.bufsize,
+			RetryUDPBufSize:  opts.retryBufsize,
+			IgnoreTruncation: opts.ignore,
+			TCP: &resolv.Do53TCP{
+				Server:    netx.TryJoinHostPort(server, "53"),
+				IPv4Only:  opts.four,
+				IPv6Only:  opts.six,
+				Timeout:   opts.timeout,
+				Keepalive: opts.keepalive,
+			},
+		}
+	}
+
+	return t
+}
+
 func main() {
 	var err error
 
@@ -110,47 +266,54 @@ func main() {
 		AD:           opts.adflag,
 		CD:           opts.cdflag,
 		ClientSubnet: opts.subnetPrefix,
+		Cookies:      opts.cookie,
 		DO:           opts.dnssec,
 		MaxCNAMEs:    opts.maxCNAMEs,
 		NSID:         opts.nsid,
 		RD:           opts.rdflag,
+		Search:       opts.searchList,
+		NDots:        opts.ndots,
+		Validate:     opts.validate,
+		TrustAnchors: opts.anchorStore,
 	}
 
-	if opts.tcp {
-		c.Transport = &resolv.Do53TCP{
-			Server:   netx.TryJoinHostPort(opts.server, "53"),
-			IPv4Only: opts.four,
-			IPv6Only: opts.six,
-			Timeout:  opts.timeout,
-			KeepOpen: false,
-		}
-	} else if opts.tls {
-		c.Transport = &resolv.DoT{
-			Server:   netx.TryJoinHostPort(opts.server, resolv.DefaultDoTPort),
+	var upstreams []resolv.Transport
+	for _, server := range opts.servers {
+		upstreams = append(upstreams, newTransport(opts, server))
+	}
+	if opts.iterative {
+		c.Transport = &resolv.Iterative{
 			IPv4Only: opts.four,
 			IPv6Only: opts.six,
 			Timeout:  opts.timeout,
-			KeepOpen: false,
 		}
-	} else if opts.httpsURL != "" {
-		c.Transport = &resolv.DoH{
-			ServerURL: opts.httpsURL,
-			Timeout:   opts.timeout,
-			UseGET:    opts.httpsUseGET,
-			KeepOpen:  false,
+	} else if len(upstreams) == 1 {
+		c.Transport = upstreams[0]
+	} else if opts.race || opts.hedge {
+		c.Transport = &resolv.Race{
+			Upstreams: upstreams,
+			Hedge:     opts.hedge,
 		}
 	} else {
-		c.Transport = &resolv.Do53UDP{
-			Server:           netx.TryJoinHostPort(opts.server, "53"),
-			IPv4Only:         opts.four,
-			IPv6Only:         opts.six,
-			Timeout:          opts.timeout,
-			UDPBufSize:       opts.bufsize,
-			IgnoreTruncation: opts.ignore,
+		c.Transport = &resolv.Failover{
+			Upstreams: upstreams,
+			Policy:    opts.selectPolicy,
+		}
+	}
+
+	if opts.upgrade {
+		t, err := c.Upgrade(opts.upgradeIP, opts.timeout)
+		c.Close()
+		if err != nil {
+			mu.Fatalf("upgrade failed: %v", err)
 		}
+		c.Transport = t
+		fmt.Printf(";; upgraded to %s\n", describeTransport(t))
 	}
 
 	switch opts.qtypeStr {
+	case "@HTTPS":
+		err = getHTTPS(c, opts.qname)
 	case "@IPS":
 		err = getIPs(c, opts.qname)
 	case "@NAMESERVERS":
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
 	"net/netip"
 	"os"
 	"strconv"
@@ -11,7 +13,6 @@ import (
 
 	"github.com/miekg/dns"
 	"github.com/syslab-wm/mu"
-	"github.com/syslab-wm/netx"
 	"github.com/syslab-wm/resolv"
 )
 
@@ -46,10 +47,17 @@ query options:
 
     Default: 1
 
+  -anchors PATH
+    With -validate, use the trust anchors in PATH rather than the built-in
+    root trust anchors.  PATH is IANA's root-anchors.xml (if the name ends in
+    .xml), a file of DS or DNSKEY records in master file format, or a
+    directory of such files (e.g., one per zone).
+
   -bufsize B
     Set the UDP message buffer size advertised using EDNS0 t B bytes.  The maximum
     and minimum sizes of this buffer are 65535 and 0, respectively.  Values other
-    than 0 will cause an EDNS query to be sent.
+    than 0 will cause an EDNS query to be sent.  EDNS queries otherwise advertise
+    1232 bytes, per the DNS Flag Day 2020 recommendation.
 
   -cdflag[=0|1]
     Sets (unsets) the CD (checking disabled) bit in the query.  The CD bit
@@ -61,12 +69,24 @@ query options:
 
     Default: 0
 
+  -cookie[=0|1]
+    Send a DNS Cookie (RFC 7873) with the query, and check that the response
+    echoes it.
+
+    Default: 0
+
   -dnssec[=0|1]
     Request DNSSEC records be sent by setting the DNSSEC OK bit (DO) in the OPT
     record in the additional section of the query.
 
     Default: 0
 
+  -hedge
+    Like -race, but send the query to the servers one at a time, in order:
+    send it to the next server only if there is no answer yet after the 95th
+    percentile of recent response times (100ms to start with), or if the
+    previous server failed.
+
   -https ENDPOINT
     Use DNS over HTTPS (DoH).  Th port number defaults to 443.  The HTTP POST
     request mode is used when sending the query.
@@ -83,8 +103,15 @@ query options:
     Same as -https, except that the HTTP GET request mode is used when sending
     the query.
 
+  -https-json ENDPOINT
+    Same as -https-get, except that the query is sent to the resolver's JSON
+    API (application/dns-json), as offered by, e.g., Google Public DNS
+    (/resolve) and Cloudflare (/dns-query).
+
   -keepalive[=0|1]
-    Send an EDNS Keepalive option.
+    Send an EDNS Keepalive option (RFC 7828).  Only applies to -tcp and -tls.
+    With -keepopen, the server's idle timeout determines when to close the
+    connection and reconnect.
 
     Default: 0
 
@@ -98,6 +125,12 @@ query options:
     Ignore truncation in UDP responses instead of retrying with TCP.  By
     default, TCP retries are performed.
 
+  -iterative
+    Resolve the query iteratively, starting from the root servers and
+    following referrals, rather than send it to a recursive resolver.  Can't
+    be combined with -server, -upgrade, -tcp, -tls, -quic, -validate, or the
+    -https options.
+
   -max-cnames N
     The maximum of number of CNAMEs to follow.
 
@@ -108,18 +141,57 @@ query options:
 
     Default: 0
 
+  -nta ZONE[,ZONE...]
+    With -validate, add a negative trust anchor for each ZONE: treat the
+    zone as unsigned, as for a zone whose DNSSEC is known to be broken.
+
+  -padding[=0|1]
+    Pad the query with the EDNS Padding option (RFC 7830) to a multiple of
+    128 bytes, per RFC 8467.  Only applies to -tls, -https, -https-get, and
+    -quic.
+
+    Default: 0
+
+  -quic
+    Use DNS over QUIC (DoQ).  When this option is in use, the port number
+    defaults to 853.
+
+  -race
+    When there are several servers, send the query to all of them at once,
+    and use the first answer other than SERVFAIL or REFUSED (rather than try
+    the servers one after another; see -select).
+
   -rdflag[=0|1]
     Toggle the RD (recursion desired) bit in the query.
 
     Default: 1
 
-  -server SERVER
+  -retry-bufsize B
+    If a UDP response is truncated, first retry the query over UDP with an
+    advertised buffer size of B bytes, before retrying over TCP.  Sizes larger
+    than 1232 risk IP fragmentation.
+
+  -search
+    If the query name has no trailing dot, expand it with the search list in
+    /etc/resolv.conf, as per the file's ndots option, the way that a stub
+    resolver does.  By default, the query name is taken as fully-qualified.
+
+  -select POLICY
+    When there are several servers, the order in which to try them: ordered
+    (in the order given), rotate (round-robin), or srtt (fastest first, by
+    smoothed round-trip time).  A query fails over to the next server if it
+    times out or the server returns SERVFAIL or REFUSED.
+
+    Default: ordered
+
+  -server SERVER[,SERVER...]
     The nameserver to query.  For Do53 and DoH, SERVER is of the form
     HOST[:PORT], where HOST may be hostname or IP address.  If PORT is not
     provided, then port 53 is used for Do53,  port 853 for DoT, and port 443
-    for DoH.
+    for DoH.  If several servers are given, the query fails over from one to
+    the next (see -select).
 
-    The default is the first nameserver in /etc/resolv.conf.
+    The default is the nameservers in /etc/resolv.conf.
 
   -subnet ADDR/PREFIX
     Send an EDNS Client Subnet options with the specified IP address or network
@@ -142,10 +214,23 @@ query options:
     This option allows an alternative CA certificate to be used for TLS validation.  CA_FILE must
     be in the PM format.
 
+  -tls-cert CERT_FILE
+    Present the certificate in CERT_FILE (PEM format) to the server, for
+    mutual TLS.  Requires -tls-key.
+
   -tls-hostname HOSTNAME
     Use th provided HOSTNAME during remote server TLS certificate validation.  Otherwise, theh DNS
     server name is used.
 
+  -tls-key KEY_FILE
+    The private key (PEM format) for the -tls-cert certificate.
+
+  -tls-pin PIN[,PIN...]
+    Authenticate the server with an SPKI pin set (RFC 7858): a comma-separated
+    list of base64-encoded SHA-256 digests of the server's SubjectPublicKeyInfo.
+    The TLS handshake fails if the server's certificate chain does not match any
+    of the pins.  Applies to DoT, DoH, and DoQ.
+
   -type QTYPE
     The query type (e.g., A, AAAA, NS)
 
@@ -154,6 +239,10 @@ query options:
     In addition to the standard DNS queries, the tool also supports
     a few meta queries:
 
+      @https
+        Get the HTTPS records (RFC 9460) for QNAME, following any
+        AliasMode records, in order of priority.
+
       @ips
         Get the IP addresses for the QNAME (performs both A and
         a AAAA queries).
@@ -170,6 +259,19 @@ query options:
      Finally, a non-standard type can be specified by its numeric value 
      as TYPE###, e.g.  -type TYPE234.
 
+  -upgrade
+    Discover the encrypted resolvers that the (Do53) server designates, using
+    Discovery of Designated Resolvers (DDR, RFC 9462), and send the query to
+    the most preferred one that supports DoT, DoH, or DoQ, and whose
+    certificate covers the server's IP address.  The (first) SERVER must be an
+    IP address.  Can't be combined with -tcp, -tls, -quic, or the -https options.
+
+  -validate
+    Validate the response with DNSSEC, from the root trust anchor, rather than
+    trust the server's AD bit, and print the result: secure, insecure, or
+    indeterminate.  A bogus response is an error.  Implies -dnssec and
+    -cdflag.
+
 
 examples:
   $ ./resolv -https -type NS www.cs.wm.edu
@@ -182,30 +284,58 @@ type Options struct {
 	four         bool
 	six          bool
 	adflag       bool
+	anchors      string
+	anchorStore  *resolv.TrustAnchorStore // derived
 	bufsize      int
 	cdflag       bool
+	cookie       bool
 	dnssec       bool
+	hedge        bool
 	https        string
 	httpsGET     string
-	httpsURL     string // derived
+	httpsJSON    string
+	httpsPath    string // derived
 	httpsUseGET  bool   // derived
+	httpsUseJSON bool   // derived
 	ignore       bool
+	iterative    bool
+	keepalive    bool
 	maxCNAMEs    int
 	nsid         bool
+	nta          string
+	padding      bool
+	quic         bool
+	race         bool
 	rdflag       bool
+	retryBufsize int
+	search       bool
+	searchList   []string // derived
+	ndots        int      // derived
+	selectStr    string
+	selectPolicy resolv.SelectionPolicy // derived
 	server       string
+	servers      []string // derived
 	subnet       string
 	subnetPrefix netip.Prefix // derived
 	tcp          bool
 	timeout      time.Duration
 	tls          bool
 	tlsCA        string
+	tlsCert      string
 	tlsHostname  string
+	tlsKey       string
+	tlsPin       string
+	tlsConfig    *tls.Config // derived
+	spkiPins     []string    // derived
 	qtypeStr     string
 	qtype        uint16 // derived
+	upgrade      bool
+	upgradeIP    netip.Addr // derived
+	validate     bool
 }
 
 var metaQueries = map[string]bool{
+	"@HTTPS":       true,
 	"@IPS":         true,
 	"@NAMESERVERS": true,
 	"@SERVICES":    true,
@@ -217,6 +347,7 @@ func printUsage() {
 
 func parseOptions() *Options {
 	var ok bool
+	var err error
 	opts := Options{}
 
 	flag.Usage = printUsage
@@ -224,23 +355,41 @@ func parseOptions() *Options {
 	flag.BoolVar(&opts.four, "4", false, "")
 	flag.BoolVar(&opts.six, "6", false, "")
 	flag.BoolVar(&opts.adflag, "adflag", true, "")
+	flag.StringVar(&opts.anchors, "anchors", "", "")
 	flag.IntVar(&opts.bufsize, "bufsize", 0, "")
 	flag.BoolVar(&opts.cdflag, "cdflag", false, "")
+	flag.BoolVar(&opts.cookie, "cookie", false, "")
 	flag.BoolVar(&opts.dnssec, "dnssec", false, "")
+	flag.BoolVar(&opts.hedge, "hedge", false, "")
 	flag.StringVar(&opts.https, "https", "", "")
 	flag.StringVar(&opts.httpsGET, "https-get", "", "")
+	flag.StringVar(&opts.httpsJSON, "https-json", "", "")
 	flag.BoolVar(&opts.ignore, "ignore", false, "")
+	flag.BoolVar(&opts.iterative, "iterative", false, "")
+	flag.BoolVar(&opts.keepalive, "keepalive", false, "")
 	flag.IntVar(&opts.maxCNAMEs, "max-cnames", 0, "")
 	flag.BoolVar(&opts.nsid, "nsid", false, "")
+	flag.StringVar(&opts.nta, "nta", "", "")
+	flag.BoolVar(&opts.padding, "padding", false, "")
+	flag.BoolVar(&opts.quic, "quic", false, "")
+	flag.BoolVar(&opts.race, "race", false, "")
 	flag.BoolVar(&opts.rdflag, "rdflag", true, "")
+	flag.IntVar(&opts.retryBufsize, "retry-bufsize", 0, "")
+	flag.BoolVar(&opts.search, "search", false, "")
+	flag.StringVar(&opts.selectStr, "select", "ordered", "")
 	flag.StringVar(&opts.server, "server", "", "")
 	flag.StringVar(&opts.subnet, "subnet", "", "")
 	flag.BoolVar(&opts.tcp, "tcp", false, "")
 	flag.DurationVar(&opts.timeout, "timeout", resolv.DefaultTimeout, "")
 	flag.BoolVar(&opts.tls, "tls", false, "")
 	flag.StringVar(&opts.tlsCA, "tls-ca", "", "")
+	flag.StringVar(&opts.tlsCert, "tls-cert", "", "")
 	flag.StringVar(&opts.tlsHostname, "tls-hostname", "", "")
+	flag.StringVar(&opts.tlsKey, "tls-key", "", "")
+	flag.StringVar(&opts.tlsPin, "tls-pin", "", "")
 	flag.StringVar(&opts.qtypeStr, "type", "A", "")
+	flag.BoolVar(&opts.upgrade, "upgrade", false, "")
+	flag.BoolVar(&opts.validate, "validate", false, "")
 
 	flag.Parse()
 
@@ -274,25 +423,114 @@ func parseOptions() *Options {
 		}
 	}
 
-	if opts.server == "" {
-		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if opts.server != "" {
+		opts.servers = strings.Split(opts.server, ",")
+	}
+	// An iterative query starts at the root servers, not at resolv.conf's
+	// nameservers.
+	needServers := opts.server == "" && !opts.iterative
+	if needServers || opts.search {
+		conf, err := resolv.ReadResolvConf(resolv.DefaultResolvConfPath)
 		if err != nil {
-			mu.Fatalf("error: unable to retrieve default nameserver: %v", err)
+			mu.Fatalf("error: %v", err)
 		}
-		opts.server = conf.Servers[0]
-		if conf.Port != "" {
-			opts.server = netx.TryJoinHostPort(opts.server, conf.Port)
+		if needServers {
+			for _, addr := range conf.Servers {
+				opts.servers = append(opts.servers, addr.String())
+			}
 		}
+		if opts.search {
+			opts.searchList = conf.Search
+			opts.ndots = conf.NDots
+		}
+	}
+
+	if opts.race && opts.hedge {
+		mu.Fatalf("error: can't specify -race and -hedge together")
+	}
+
+	opts.selectPolicy, err = resolv.ParseSelectionPolicy(opts.selectStr)
+	if err != nil {
+		mu.Fatalf("error: invalid -select: %v", err)
 	}
 
-	if opts.https != "" && opts.httpsGET != "" {
-		mu.Fatalf("error: can't specify -https and -https-get together")
+	n := 0
+	for _, endpoint := range []string{opts.https, opts.httpsGET, opts.httpsJSON} {
+		if endpoint != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		mu.Fatalf("error: can only specify one of -https, -https-get, and -https-json")
 	}
 	if opts.https != "" {
-		opts.httpsURL = fmt.Sprintf("https://%s%s", opts.server, opts.https)
+		opts.httpsPath = opts.https
 	} else if opts.httpsGET != "" {
-		opts.httpsURL = fmt.Sprintf("https://%s%s", opts.server, opts.httpsGET)
+		opts.httpsPath = opts.httpsGET
 		opts.httpsUseGET = true
+	} else if opts.httpsJSON != "" {
+		opts.httpsPath = opts.httpsJSON
+		opts.httpsUseJSON = true
+	}
+
+	if opts.iterative {
+		if opts.server != "" || opts.upgrade || opts.tcp || opts.tls || opts.quic || opts.httpsPath != "" || opts.validate {
+			mu.Fatalf("error: -iterative can't be combined with -server, -upgrade, -tcp, -tls, -quic, -validate, or the -https options")
+		}
+	}
+
+	if (opts.anchors != "" || opts.nta != "") && !opts.validate {
+		mu.Fatalf("error: -anchors and -nta require -validate")
+	}
+	if opts.anchors != "" {
+		opts.anchorStore = resolv.NewTrustAnchorStore()
+		fi, err := os.Stat(opts.anchors)
+		if err != nil {
+			mu.Fatalf("error: %v", err)
+		}
+		if fi.IsDir() {
+			err = opts.anchorStore.LoadDir(opts.anchors)
+		} else {
+			err = opts.anchorStore.LoadFile(opts.anchors)
+		}
+		if err != nil {
+			mu.Fatalf("error: invalid -anchors: %v", err)
+		}
+	}
+	if opts.nta != "" {
+		if opts.anchorStore == nil {
+			opts.anchorStore = resolv.NewTrustAnchorStore()
+			if err := opts.anchorStore.Add(resolv.RootTrustAnchors()...); err != nil {
+				mu.Fatalf("error: %v", err)
+			}
+		}
+		for _, zone := range strings.Split(opts.nta, ",") {
+			opts.anchorStore.AddNegative(zone, 0)
+		}
+	}
+
+	if opts.upgrade {
+		if opts.tcp || opts.tls || opts.quic || opts.httpsPath != "" {
+			mu.Fatalf("error: -upgrade can't be combined with -tcp, -tls, -quic, or the -https options")
+		}
+		host := opts.servers[0]
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			mu.Fatalf("error: -upgrade requires the server to be an IP address: %v", err)
+		}
+		opts.upgradeIP = addr
+		// the designations are only verifiable for the server that made them
+		opts.servers = opts.servers[:1]
+	}
+
+	if opts.bufsize < resolv.MinUDPBufSize || opts.bufsize > resolv.MaxUDPBufSize {
+		mu.Fatalf("error: -bufsize must be in the range [%d, %d]", resolv.MinUDPBufSize, resolv.MaxUDPBufSize)
+	}
+	if opts.retryBufsize < resolv.MinUDPBufSize || opts.retryBufsize > resolv.MaxUDPBufSize {
+		mu.Fatalf("error: -retry-bufsize must be in the range [%d, %d]", resolv.MinUDPBufSize, resolv.MaxUDPBufSize)
 	}
 
 	if opts.subnet != "" {
@@ -303,5 +541,29 @@ func parseOptions() *Options {
 		opts.subnetPrefix = prefix
 	}
 
+	opts.tlsConfig = &tls.Config{
+		ServerName: opts.tlsHostname,
+	}
+	if opts.tlsCA != "" {
+		pool, err := resolv.LoadCAFile(opts.tlsCA)
+		if err != nil {
+			mu.Fatalf("error: invalid -tls-ca: %v", err)
+		}
+		opts.tlsConfig.RootCAs = pool
+	}
+	if (opts.tlsCert == "") != (opts.tlsKey == "") {
+		mu.Fatalf("error: -tls-cert and -tls-key must be specified together")
+	}
+	if opts.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.tlsCert, opts.tlsKey)
+		if err != nil {
+			mu.Fatalf("error: invalid client certificate: %v", err)
+		}
+		opts.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if opts.tlsPin != "" {
+		opts.spkiPins = strings.Split(opts.tlsPin, ",")
+	}
+
 	return &opts
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"strings"
 
@@ -40,21 +41,24 @@ func IsValidDomain(domain string) bool {
 	return true
 }
 
-func DoDNSSDProbe(c *resolv.Client, domain string) *DNSSDProbeResult {
+func DoDNSSDProbe(ctx context.Context, c *resolv.Client, domain string, rec *ScanRecord) *DNSSDProbeResult {
 	var err error
 	var foundFlag bool
 	r := NewDNSSDProbeResult()
 	browserSet := set.New[string]()
 
-	r.ServiceBrowsers, err = c.GetServiceBrowserDomains(domain)
+	r.ServiceBrowsers, err = c.GetServiceBrowserDomainsContext(ctx, domain)
+	rec.NoteError(err)
 	if err != nil {
 		browserSet.Add(r.ServiceBrowsers...)
 	}
-	r.DefaultServiceBrowser, err = c.GetDefaultServiceBrowserDomain(domain)
+	r.DefaultServiceBrowser, err = c.GetDefaultServiceBrowserDomainContext(ctx, domain)
+	rec.NoteError(err)
 	if err != nil {
 		browserSet.Add(r.DefaultServiceBrowser)
 	}
-	r.LegacyServiceBrowsers, err = c.GetLegacyServiceBrowserDomains(domain)
+	r.LegacyServiceBrowsers, err = c.GetLegacyServiceBrowserDomainsContext(ctx, domain)
+	rec.NoteError(err)
 	if err != nil {
 		browserSet.Add(r.LegacyServiceBrowsers...)
 	}
@@ -64,11 +68,15 @@ func DoDNSSDProbe(c *resolv.Client, domain string) *DNSSDProbeResult {
 	}
 
 	for _, browser := range browserSet.Items() {
+		if ctx.Err() != nil {
+			return nil
+		}
 		if !IsValidDomain(browser) {
 			continue
 		}
-		services, err := c.GetServices(browser)
+		services, err := c.GetServicesContext(ctx, browser)
 		if err != nil {
+			rec.NoteError(err)
 			continue
 		}
 
@@ -76,14 +84,16 @@ func DoDNSSDProbe(c *resolv.Client, domain string) *DNSSDProbeResult {
 			if !IsValidDomain(service) {
 				continue
 			}
-			instances, err := c.GetServiceInstances(service)
+			instances, err := c.GetServiceInstancesContext(ctx, service)
 			if err != nil {
+				rec.NoteError(err)
 				continue
 			}
 
 			for _, instance := range instances {
-				info, err := c.GetServiceInstanceInfo(instance)
+				info, err := c.GetServiceInstanceInfoContext(ctx, instance)
 				if err != nil {
+					rec.NoteError(err)
 					continue
 				}
 
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/miekg/dns"
 	"github.com/syslab-wm/mu"
@@ -13,7 +18,7 @@ import (
 	"github.com/syslab-wm/resolv"
 )
 
-func processFile(path string, ch chan<- string) {
+func processFile(ctx context.Context, path string, ch chan<- string) {
 	defer close(ch)
 
 	f, err := os.Open(path)
@@ -26,7 +31,11 @@ func processFile(path string, ch chan<- string) {
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
-		ch <- line
+		select {
+		case ch <- line:
+		case <-ctx.Done():
+			return
+		}
 		i++
 	}
 
@@ -35,59 +44,146 @@ func processFile(path string, ch chan<- string) {
 	}
 }
 
-func newClient(opts *Options) *resolv.Client {
-	c := &resolv.Client{
-		AD:           opts.adflag,
-		CD:           opts.cdflag,
-		ClientSubnet: opts.subnetPrefix,
-		DO:           opts.dnssec,
-		MaxCNAMEs:    opts.maxCNAMEs,
-		NSID:         opts.nsid,
-		RD:           opts.rdflag,
-	}
+// newUpstream returns a transport for the server, as per the options.
+func newUpstream(opts *Options, server string) resolv.Transport {
+	var t resolv.Transport
 
 	if opts.tcp {
-		c.Transport = &resolv.Do53TCP{
-			Server:   netx.TryJoinHostPort(opts.server, "53"),
-			IPv4Only: opts.four,
-			IPv6Only: opts.six,
-			Timeout:  opts.timeout,
-			KeepOpen: opts.keepopen,
+		t = &resolv.Do53TCP{
+			Server:    netx.TryJoinHostPort(server, "53"),
+			IPv4Only:  opts.four,
+			IPv6Only:  opts.six,
+			Timeout:   opts.timeout,
+			KeepOpen:  opts.keepopen,
+			Keepalive: opts.keepalive,
+			Pipeline:  opts.pipeline,
 		}
 	} else if opts.tls {
-		c.Transport = &resolv.DoT{
-			Server:   netx.TryJoinHostPort(opts.server, resolv.DefaultDoTPort),
-			IPv4Only: opts.four,
-			IPv6Only: opts.six,
-			Timeout:  opts.timeout,
-			KeepOpen: opts.keepopen,
+		t = &resolv.DoT{
+			Server:    netx.TryJoinHostPort(server, resolv.DefaultDoTPort),
+			IPv4Only:  opts.four,
+			IPv6Only:  opts.six,
+			Timeout:   opts.timeout,
+			KeepOpen:  opts.keepopen,
+			Keepalive: opts.keepalive,
+			Pipeline:  opts.pipeline,
+			TLSConfig: opts.tlsConfig,
+			SPKIPins:  opts.spkiPins,
 		}
-	} else if opts.httpsURL != "" {
-		c.Transport = &resolv.DoH{
-			ServerURL: opts.httpsURL,
+	} else if opts.quic {
+		t = &resolv.DoQ{
+			Server:    netx.TryJoinHostPort(server, resolv.DefaultDoQPort),
+			IPv4Only:  opts.four,
+			IPv6Only:  opts.six,
+			Timeout:   opts.timeout,
+			KeepOpen:  opts.keepopen,
+			TLSConfig: opts.tlsConfig,
+			SPKIPins:  opts.spkiPins,
+		}
+	} else if opts.httpsPath != "" {
+		t = &resolv.DoH{
+			ServerURL: fmt.Sprintf("https://%s%s", server, opts.httpsPath),
 			Timeout:   opts.timeout,
 			UseGET:    opts.httpsUseGET,
 			KeepOpen:  opts.keepopen,
+			TLSConfig: opts.tlsConfig,
+			SPKIPins:  opts.spkiPins,
 		}
 	} else {
-		c.Transport = &resolv.Do53UDP{
-			Server:           netx.TryJoinHostPort(opts.server, "53"),
+		t = &resolv.Do53UDP{
+			Server:           netx.TryJoinHostPort(server, "53"),
 			IPv4Only:         opts.four,
 			IPv6Only:         opts.six,
 			Timeout:          opts.timeout,
 			UDPBufSize:       opts.bufsize,
+			RetryUDPBufSize:  opts.retryBufsize,
 			IgnoreTruncation: opts.ignore,
+			Retry: resolv.RetryPolicy{
+				Attempts:       opts.attempts,
+				AttemptTimeout: opts.tryTimeout,
+				Backoff:        opts.retryBackoff,
+			},
+		}
+	}
+
+	return t
+}
+
+// newTransport returns a transport for the servers.  With several servers, the
+// transport fails over from one server to the next.  In -pool mode, each
+// server gets its own pool of transports.  With -cache, the transport caches
+// the responses.
+func newTransport(opts *Options) resolv.Transport {
+	var t resolv.Transport
+	var upstreams []resolv.Transport
+
+	for _, server := range opts.servers {
+		server := server
+		if opts.pool {
+			upstreams = append(upstreams, &resolv.Pool{
+				New:       func() resolv.Transport { return newUpstream(opts, server) },
+				MaxIdle:   opts.numWorkers,
+				MaxActive: opts.numWorkers,
+			})
+		} else {
+			upstreams = append(upstreams, newUpstream(opts, server))
 		}
 	}
 
-	return c
+	if len(upstreams) == 1 {
+		t = upstreams[0]
+	} else {
+		t = &resolv.Failover{
+			Upstreams: upstreams,
+			Policy:    opts.selectPolicy,
+		}
+	}
+
+	if opts.cacheSize > 0 {
+		t = &resolv.Cache{
+			Upstream:   t,
+			MaxEntries: opts.cacheSize,
+		}
+	}
+	return t
+}
+
+// newClient returns a new client.  If the transport t is nil, the client gets
+// its own, new transport.
+func newClient(opts *Options, t resolv.Transport) *resolv.Client {
+	if t == nil {
+		t = newTransport(opts)
+	}
+
+	return &resolv.Client{
+		AD:           opts.adflag,
+		CD:           opts.cdflag,
+		ClientSubnet: opts.subnetPrefix,
+		DO:           opts.dnssec,
+		MaxCNAMEs:    opts.maxCNAMEs,
+		NSID:         opts.nsid,
+		RD:           opts.rdflag,
+		Transport:    t,
+	}
 }
 
 type ScanRecord struct {
-	QName      string
-	DNSSDProbe *DNSSDProbeResult
-	PTRProbe   *PTRProbeResult
-	SRVProbe   *SRVProbeResult
+	QName       string
+	DNSSDProbe  *DNSSDProbeResult
+	PTRProbe    *PTRProbeResult
+	SRVProbe    *SRVProbeResult
+	RcodeErrors []*RcodeErrorRecord
+}
+
+// An RcodeErrorRecord records a query of a probe whose response has an error
+// RCODE other than NXDOMAIN (which most probes expect), or has Extended DNS
+// Errors (RFC 8914).
+type RcodeErrorRecord struct {
+	Name           string
+	Type           string
+	Rcode          string
+	Server         string
+	ExtendedErrors []string
 }
 
 func NewScanRecord(qname string) *ScanRecord {
@@ -96,9 +192,33 @@ func NewScanRecord(qname string) *ScanRecord {
 	return rec
 }
 
-// HasResults returns true if at least one of the probes has result data
+// HasResults returns true if at least one of the probes has result data, or
+// the record has errors
 func (r *ScanRecord) HasResults() bool {
-	return r.DNSSDProbe != nil || r.PTRProbe != nil || r.SRVProbe != nil
+	return r.DNSSDProbe != nil || r.PTRProbe != nil || r.SRVProbe != nil || len(r.RcodeErrors) > 0
+}
+
+// NoteError records err in the record's RcodeErrors, if err is an
+// [resolv.RcodeError] worth recording.
+func (r *ScanRecord) NoteError(err error) {
+	var rcodeErr *resolv.RcodeError
+	if !errors.As(err, &rcodeErr) {
+		return
+	}
+	if rcodeErr.Rcode == dns.RcodeNameError && len(rcodeErr.ExtendedErrors) == 0 {
+		return
+	}
+
+	rec := &RcodeErrorRecord{
+		Name:   rcodeErr.Name,
+		Type:   dns.Type(rcodeErr.Qtype).String(),
+		Rcode:  dns.RcodeToString[rcodeErr.Rcode],
+		Server: rcodeErr.Server,
+	}
+	for _, ede := range rcodeErr.ExtendedErrors {
+		rec.ExtendedErrors = append(rec.ExtendedErrors, ede.String())
+	}
+	r.RcodeErrors = append(r.RcodeErrors, rec)
 }
 
 func main() {
@@ -106,6 +226,28 @@ func main() {
 
 	opts := parseOptions()
 
+	// On an interrupt, cancel the queries in flight and stop reading the
+	// input file, so that the scan ends cleanly in the middle of a domain.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// In pipeline mode, all of the workers share one transport (and thus one
+	// connection), and in pool mode, they share a pool of transports;
+	// otherwise, each worker has its own.
+	var shared resolv.Transport
+	if opts.pipeline || opts.pool {
+		shared = newTransport(opts)
+	}
+	if shared != nil {
+		defer shared.Close()
+		if cache, ok := shared.(*resolv.Cache); ok {
+			defer func() {
+				stats := cache.Stats()
+				log.Printf("cache: %d hits, %d misses, %d evictions", stats.Hits, stats.Misses, stats.Evictions)
+			}()
+		}
+	}
+
 	inch := make(chan string, opts.numWorkers)
 	outch := make(chan *ScanRecord, opts.numWorkers)
 	wg.Add(opts.numWorkers)
@@ -117,20 +259,25 @@ func main() {
 			var c *resolv.Client
 			defer func() {
 				wg.Done()
-				if c != nil {
+				if c != nil && shared == nil {
 					c.Close()
 				}
 				log.Printf("worker %d exiting", workerId)
 			}()
 
-			c = newClient(opts)
+			c = newClient(opts, shared)
 			for domainname := range inch {
 				log.Printf("[w=%d]%s\n", workerId, domainname)
 				domainname = dns.Fqdn(domainname)
 				rec := NewScanRecord(domainname)
-				rec.DNSSDProbe = DoDNSSDProbe(c, domainname)
-				rec.PTRProbe = DoPTRProbe(c, domainname)
-				rec.SRVProbe = DoSRVProbe(workerId, c, domainname)
+				rec.DNSSDProbe = DoDNSSDProbe(ctx, c, domainname, rec)
+				rec.PTRProbe = DoPTRProbe(ctx, c, domainname, rec)
+				rec.SRVProbe = DoSRVProbe(ctx, workerId, c, domainname, rec)
+				if ctx.Err() != nil {
+					// the record for an interrupted domain is incomplete
+					log.Printf("[w=%d]%s: scan interrupted", workerId, domainname)
+					return
+				}
 				outch <- rec
 			}
 		}()
@@ -142,7 +289,7 @@ func main() {
 		log.Println("closed outch")
 	}()
 
-	go processFile(opts.inputFile, inch)
+	go processFile(ctx, opts.inputFile, inch)
 
 	jsonWriter := json.NewEncoder(os.Stdout)
 	//jsonWriter.SetIndent("", "    ")
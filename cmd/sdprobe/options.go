@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/netip"
@@ -11,7 +12,6 @@ import (
 
 	"github.com/miekg/dns"
 	"github.com/syslab-wm/mu"
-	"github.com/syslab-wm/netx"
 	"github.com/syslab-wm/resolv"
 )
 
@@ -46,10 +46,29 @@ query options:
 
     Default: 1
 
+  -attempts N
+    For Do53 over UDP, send each query up to N times if no response arrives,
+    with a new message ID and source port each time.
+
+    Default: 1
+
+  -attempt-timeout TIMEOUT
+    For Do53 over UDP, how long each attempt waits for a response.  The default
+    is the -timeout.
+
   -bufsize B
     Set the UDP message buffer size advertised using EDNS0 t B bytes.  The maximum
     and minimum sizes of this buffer are 65535 and 0, respectively.  Values other
-    than 0 will cause an EDNS query to be sent.
+    than 0 will cause an EDNS query to be sent.  EDNS queries otherwise advertise
+    1232 bytes, per the DNS Flag Day 2020 recommendation.
+
+  -cache N
+    Cache up to N responses, and answer repeated queries from the cache for
+    as long as the responses' TTLs allow, including negative responses
+    (NXDOMAIN and NODATA).  In -pipeline and -pool mode, all workers share one
+    cache; otherwise, each worker has its own.  0 disables the cache.
+
+    Default: 0
 
   -cdflag[=0|1]
     Sets (unsets) the CD (checking disabled) bit in the query.  The CD bit
@@ -84,7 +103,9 @@ query options:
     the query.
 
   -keepalive[=0|1]
-    Send an EDNS Keepalive option.
+    Send an EDNS Keepalive option (RFC 7828).  Only applies to -tcp and -tls.
+    With -keepopen, the server's idle timeout determines when to close the
+    connection and reconnect.
 
     Default: 0
 
@@ -114,18 +135,53 @@ query options:
 
     Default: 0
 
+  -pipeline
+    For -tcp and -tls, have all workers share a single connection, and
+    pipeline their queries over that connection (RFC 7766).  Responses may
+    arrive out of order.
+
+  -pool
+    Have all workers share a pool of connections, rather than each worker
+    having its own connection.  Implies -keepopen.
+
+  -quic
+    Use DNS over QUIC (DoQ).  When this option is in use, the port number
+    defaults to 853.
+
   -rdflag[=0|1]
     Toggle the RD (recursion desired) bit in the query.
 
     Default: 1
 
-  -server SERVER
+  -retry-bufsize B
+    If a UDP response is truncated, first retry the query over UDP with an
+    advertised buffer size of B bytes, before retrying over TCP.  Sizes larger
+    than 1232 risk IP fragmentation.
+
+  -retry-backoff DURATION
+    For Do53 over UDP, how long to wait before the second attempt of a query
+    (see -attempts).  The wait doubles for each later attempt, and is
+    randomized to between half and all of that.
+
+    Default: 0s
+
+  -select POLICY
+    When there are several servers, the order in which to try them: ordered
+    (in the order given), rotate (round-robin), or srtt (fastest first, by
+    smoothed round-trip time).  A query fails over to the next server if it
+    times out or the server returns SERVFAIL or REFUSED, and a server that
+    keeps failing is skipped for a while.
+
+    Default: ordered
+
+  -server SERVER[,SERVER...]
     The nameserver to query.  For Do53 and DoH, SERVER is of the form
     HOST[:PORT], where HOST may be hostname or IP address.  If PORT is not
     provided, then port 53 is used for Do53,  port 853 for DoT, and port 443
-    for DoH.
+    for DoH.  If several servers are given, queries fail over from one to the
+    next (see -select).
 
-    The default is the first nameserver in /etc/resolv.conf.
+    The default is the nameservers in /etc/resolv.conf.
 
   -subnet ADDR/PREFIX
     Send an EDNS Client Subnet options with the specified IP address or network
@@ -148,10 +204,23 @@ query options:
     This option allows an alternative CA certificate to be used for TLS validation.  CA_FILE must
     be in the PM format.
 
+  -tls-cert CERT_FILE
+    Present the certificate in CERT_FILE (PEM format) to the server, for
+    mutual TLS.  Requires -tls-key.
+
   -tls-hostname HOSTNAME
     Use th provided HOSTNAME during remote server TLS certificate validation.  Otherwise, theh DNS
     server name is used.
 
+  -tls-key KEY_FILE
+    The private key (PEM format) for the -tls-cert certificate.
+
+  -tls-pin PIN[,PIN...]
+    Authenticate the server with an SPKI pin set (RFC 7858): a comma-separated
+    list of base64-encoded SHA-256 digests of the server's SubjectPublicKeyInfo.
+    The TLS handshake fails if the server's certificate chain does not match any
+    of the pins.  Applies to DoT, DoH, and DoQ.
+
   -type QTYPE
     The query type (e.g., A, AAAA, NS)
 
@@ -188,27 +257,44 @@ type Options struct {
 	four         bool
 	six          bool
 	adflag       bool
+	attempts     int
+	tryTimeout   time.Duration
 	bufsize      int
+	cacheSize    int
 	cdflag       bool
 	dnssec       bool
 	https        string
 	httpsGET     string
-	httpsURL     string // derived
+	httpsPath    string // derived
 	httpsUseGET  bool   // derived
 	ignore       bool
+	keepalive    bool
 	keepopen     bool
 	maxCNAMEs    int
 	numWorkers   int
 	nsid         bool
+	pipeline     bool
+	pool         bool
+	quic         bool
 	rdflag       bool
+	retryBackoff time.Duration
+	retryBufsize int
+	selectStr    string
+	selectPolicy resolv.SelectionPolicy // derived
 	server       string
+	servers      []string // derived
 	subnet       string
 	subnetPrefix netip.Prefix // derived
 	tcp          bool
 	timeout      time.Duration
 	tls          bool
 	tlsCA        string
+	tlsCert      string
 	tlsHostname  string
+	tlsKey       string
+	tlsPin       string
+	tlsConfig    *tls.Config // derived
+	spkiPins     []string    // derived
 	qtypeStr     string
 	qtype        uint16 // derived
 }
@@ -225,6 +311,7 @@ func printUsage() {
 
 func parseOptions() *Options {
 	var ok bool
+	var err error
 	opts := Options{}
 
 	flag.Usage = printUsage
@@ -232,24 +319,37 @@ func parseOptions() *Options {
 	flag.BoolVar(&opts.four, "4", false, "")
 	flag.BoolVar(&opts.six, "6", false, "")
 	flag.BoolVar(&opts.adflag, "adflag", true, "")
+	flag.IntVar(&opts.attempts, "attempts", 1, "")
+	flag.DurationVar(&opts.tryTimeout, "attempt-timeout", 0, "")
 	flag.IntVar(&opts.bufsize, "bufsize", 0, "")
+	flag.IntVar(&opts.cacheSize, "cache", 0, "")
 	flag.BoolVar(&opts.cdflag, "cdflag", false, "")
 	flag.BoolVar(&opts.dnssec, "dnssec", false, "")
 	flag.StringVar(&opts.https, "https", "", "")
 	flag.StringVar(&opts.httpsGET, "https-get", "", "")
 	flag.BoolVar(&opts.ignore, "ignore", false, "")
+	flag.BoolVar(&opts.keepalive, "keepalive", false, "")
 	flag.BoolVar(&opts.keepopen, "keepopen", false, "")
 	flag.IntVar(&opts.maxCNAMEs, "max-cnames", 0, "")
 	flag.IntVar(&opts.numWorkers, "num-workers", 1, "")
 	flag.BoolVar(&opts.nsid, "nsid", false, "")
+	flag.BoolVar(&opts.pipeline, "pipeline", false, "")
+	flag.BoolVar(&opts.pool, "pool", false, "")
+	flag.BoolVar(&opts.quic, "quic", false, "")
 	flag.BoolVar(&opts.rdflag, "rdflag", true, "")
+	flag.DurationVar(&opts.retryBackoff, "retry-backoff", 0, "")
+	flag.IntVar(&opts.retryBufsize, "retry-bufsize", 0, "")
+	flag.StringVar(&opts.selectStr, "select", "ordered", "")
 	flag.StringVar(&opts.server, "server", "", "")
 	flag.StringVar(&opts.subnet, "subnet", "", "")
 	flag.BoolVar(&opts.tcp, "tcp", false, "")
 	flag.DurationVar(&opts.timeout, "timeout", resolv.DefaultTimeout, "")
 	flag.BoolVar(&opts.tls, "tls", false, "")
 	flag.StringVar(&opts.tlsCA, "tls-ca", "", "")
+	flag.StringVar(&opts.tlsCert, "tls-cert", "", "")
 	flag.StringVar(&opts.tlsHostname, "tls-hostname", "", "")
+	flag.StringVar(&opts.tlsKey, "tls-key", "", "")
+	flag.StringVar(&opts.tlsPin, "tls-pin", "", "")
 	flag.StringVar(&opts.qtypeStr, "type", "A", "")
 
 	flag.Parse()
@@ -284,27 +384,58 @@ func parseOptions() *Options {
 		}
 	}
 
-	if opts.server == "" {
-		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if opts.server != "" {
+		opts.servers = strings.Split(opts.server, ",")
+	} else {
+		conf, err := resolv.ReadResolvConf(resolv.DefaultResolvConfPath)
 		if err != nil {
-			mu.Fatalf("error: unable to retrieve default nameserver: %v", err)
+			mu.Fatalf("error: %v", err)
 		}
-		opts.server = conf.Servers[0]
-		if conf.Port != "" {
-			opts.server = netx.TryJoinHostPort(opts.server, conf.Port)
+		for _, addr := range conf.Servers {
+			opts.servers = append(opts.servers, addr.String())
 		}
 	}
 
+	opts.selectPolicy, err = resolv.ParseSelectionPolicy(opts.selectStr)
+	if err != nil {
+		mu.Fatalf("error: invalid -select: %v", err)
+	}
+
+	if opts.pipeline && !opts.tcp && !opts.tls {
+		mu.Fatalf("error: -pipeline requires -tcp or -tls")
+	}
+	if opts.pipeline && opts.pool {
+		mu.Fatalf("error: can't specify -pipeline and -pool together")
+	}
+	if opts.pool {
+		opts.keepopen = true
+	}
+
 	if opts.https != "" && opts.httpsGET != "" {
 		mu.Fatalf("error: can't specify -https and -https-get together")
 	}
 	if opts.https != "" {
-		opts.httpsURL = fmt.Sprintf("https://%s%s", opts.server, opts.https)
+		opts.httpsPath = opts.https
 	} else if opts.httpsGET != "" {
-		opts.httpsURL = fmt.Sprintf("https://%s%s", opts.server, opts.httpsGET)
+		opts.httpsPath = opts.httpsGET
 		opts.httpsUseGET = true
 	}
 
+	if opts.attempts < 1 {
+		mu.Fatalf("error: -attempts must be at least 1")
+	}
+
+	if opts.cacheSize < 0 {
+		mu.Fatalf("error: -cache must be at least 0")
+	}
+
+	if opts.bufsize < resolv.MinUDPBufSize || opts.bufsize > resolv.MaxUDPBufSize {
+		mu.Fatalf("error: -bufsize must be in the range [%d, %d]", resolv.MinUDPBufSize, resolv.MaxUDPBufSize)
+	}
+	if opts.retryBufsize < resolv.MinUDPBufSize || opts.retryBufsize > resolv.MaxUDPBufSize {
+		mu.Fatalf("error: -retry-bufsize must be in the range [%d, %d]", resolv.MinUDPBufSize, resolv.MaxUDPBufSize)
+	}
+
 	if opts.subnet != "" {
 		prefix, err := netip.ParsePrefix(opts.subnet)
 		if err != nil {
@@ -313,5 +444,29 @@ func parseOptions() *Options {
 		opts.subnetPrefix = prefix
 	}
 
+	opts.tlsConfig = &tls.Config{
+		ServerName: opts.tlsHostname,
+	}
+	if opts.tlsCA != "" {
+		pool, err := resolv.LoadCAFile(opts.tlsCA)
+		if err != nil {
+			mu.Fatalf("error: invalid -tls-ca: %v", err)
+		}
+		opts.tlsConfig.RootCAs = pool
+	}
+	if (opts.tlsCert == "") != (opts.tlsKey == "") {
+		mu.Fatalf("error: -tls-cert and -tls-key must be specified together")
+	}
+	if opts.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.tlsCert, opts.tlsKey)
+		if err != nil {
+			mu.Fatalf("error: invalid client certificate: %v", err)
+		}
+		opts.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if opts.tlsPin != "" {
+		opts.spkiPins = strings.Split(opts.tlsPin, ",")
+	}
+
 	return &opts
 }
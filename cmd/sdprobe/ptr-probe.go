@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/syslab-wm/resolv"
@@ -16,14 +17,18 @@ func NewPTRProbeResult() *PTRProbeResult {
 	return r
 }
 
-func DoPTRProbe(c *resolv.Client, domain string) *PTRProbeResult {
+func DoPTRProbe(ctx context.Context, c *resolv.Client, domain string, rec *ScanRecord) *PTRProbeResult {
 	var foundFlag bool
 	r := NewPTRProbeResult()
 
 	for _, service := range Services {
+		if ctx.Err() != nil {
+			return nil
+		}
 		name := fmt.Sprintf("%s.%s", service, domain)
-		instances, err := c.GetServiceInstances(name)
+		instances, err := c.GetServiceInstancesContext(ctx, name)
 		if err != nil {
+			rec.NoteError(err)
 			continue
 		}
 
@@ -32,8 +37,9 @@ func DoPTRProbe(c *resolv.Client, domain string) *PTRProbeResult {
 				continue
 			}
 
-			info, err := c.GetServiceInstanceInfo(instance)
+			info, err := c.GetServiceInstanceInfoContext(ctx, instance)
 			if err != nil {
+				rec.NoteError(err)
 				continue
 			}
 
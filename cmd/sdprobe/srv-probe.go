@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/netip"
 
@@ -18,14 +19,18 @@ func NewSRVProbeResult() *SRVProbeResult {
 	return r
 }
 
-func DoSRVProbe(id int, c *resolv.Client, domain string) *SRVProbeResult {
+func DoSRVProbe(ctx context.Context, id int, c *resolv.Client, domain string, rec *ScanRecord) *SRVProbeResult {
 	var foundFlag bool
 	r := NewSRVProbeResult()
 
 	for _, service := range Services {
+		if ctx.Err() != nil {
+			return nil
+		}
 		name := fmt.Sprintf("%s.%s", service, domain)
-		resp, err := c.Lookup(name, dns.TypeSRV)
+		resp, err := c.LookupContext(ctx, name, dns.TypeSRV)
 		if err != nil {
+			rec.NoteError(err)
 			continue
 		}
 		srvs := resolv.CollectRRs[*dns.SRV](resp.Answer)
@@ -69,7 +74,7 @@ func DoSRVProbe(id int, c *resolv.Client, domain string) *SRVProbeResult {
 				// If no A/AAAA records in the Additional section, do A/AAAA queries
 
 				// not an error if fails
-				addrs, err := c.GetIPs(info.Target)
+				addrs, err := c.GetIPsContext(ctx, info.Target)
 				if err == nil {
 					info.Addrs = addrs
 				}
@@ -11,9 +11,31 @@ const (
 	MinMaxCNAMEs = 0
 	MaxMaxCNAMEs = 10
 
+	// The most CNAMEs that a [Client] synthesizes from the DNAME records of
+	// one response.
+	MaxSynthesizedCNAMEs = 16
+
+	// The default limit on the length of a chain of SVCB AliasMode records;
+	// RFC 9460, Section 2.4.2 requires clients to limit the chain's length.
+	DefaultMaxSVCBAliases = 8
+
 	DefaultDoTPort      = "853"
 	DefaultDoQPort      = "853"
 	DefaultHTTPEndpoint = "/dns-query"
 	DefaultTimeout      = 5 * time.Second
-	DefaultUDPBufSize   = 4096 // in the EDNS0 opt record
+
+	// The block size to which the encrypted transports pad queries, per the
+	// recommended block-length padding policy for clients in RFC 8467.
+	DefaultPadBlockSize = 128
+
+	// When a server signals an idle timeout with the EDNS0 TCP Keepalive
+	// option, a transport stops reusing the connection this long before the
+	// timeout expires, so that a query does not race the server's close.
+	KeepaliveMargin = 500 * time.Millisecond
+
+	// The EDNS0 UDP payload size (in the EDNS0 OPT record) that clients
+	// advertise by default.  DNS Flag Day 2020 recommends 1232 bytes: the
+	// largest size that avoids IP fragmentation on an IPv6 path with the
+	// minimum MTU, since fragmented UDP responses are often dropped.
+	DefaultUDPBufSize = 1232
 )
@@ -0,0 +1,133 @@
+package resolv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/mu"
+)
+
+// Sizes of DNS Cookies, in bytes (RFC 7873, Section 4).
+const (
+	clientCookieLen    = 8
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+)
+
+// The cookie state for one server.
+type serverCookies struct {
+	client []byte
+	server []byte // nil until the server sends us a cookie
+}
+
+// A cookieJar holds a client's DNS Cookie (RFC 7873, RFC 9018) state for each
+// server.  A cookieJar is safe for concurrent use.
+type cookieJar struct {
+	mu      sync.Mutex
+	servers map[string]*serverCookies
+}
+
+func newCookieJar() *cookieJar {
+	return &cookieJar{servers: make(map[string]*serverCookies)}
+}
+
+// get returns the client and server cookies for the server.  The jar creates
+// a new, random client cookie for a server the first time it sees the server,
+// so that different servers cannot use the client cookie to correlate the
+// client's queries.
+func (j *cookieJar) get(server string) (clientCookie, serverCookie []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	sc, ok := j.servers[server]
+	if !ok {
+		sc = &serverCookies{client: make([]byte, clientCookieLen)}
+		if _, err := rand.Read(sc.client); err != nil {
+			mu.Panicf("failed to generate a client cookie: %v", err)
+		}
+		j.servers[server] = sc
+	}
+	return sc.client, sc.server
+}
+
+// update checks the cookie in the server's response to a query that carried
+// clientCookie, and stores the server's new server cookie.  It returns
+// [ErrBadCookie] if the response has a cookie that does not echo
+// clientCookie.  A response without a cookie is from a server that does not
+// support cookies, and update accepts it, unless the server has already sent
+// us a server cookie: a server that supports cookies always returns one (RFC
+// 7873, Section 5.3), so the response is likely spoofed.
+func (j *cookieJar) update(server string, clientCookie []byte, resp *dns.Msg) error {
+	data, ok := edns0Cookie(resp)
+	if !ok {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if sc, ok := j.servers[server]; ok && sc.server != nil {
+			return ErrBadCookie
+		}
+		return nil
+	}
+	if len(data) < clientCookieLen || !bytes.Equal(data[:clientCookieLen], clientCookie) {
+		return ErrBadCookie
+	}
+
+	serverCookie := data[clientCookieLen:]
+	if len(serverCookie) < minServerCookieLen || len(serverCookie) > maxServerCookieLen {
+		// The client cookie is fine, but the server cookie is malformed;
+		// don't echo it back.
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if sc, ok := j.servers[server]; ok && bytes.Equal(sc.client, clientCookie) {
+		sc.server = serverCookie
+	}
+	return nil
+}
+
+type cookieJarKey struct{}
+
+func withCookieJar(ctx context.Context, jar *cookieJar) context.Context {
+	return context.WithValue(ctx, cookieJarKey{}, jar)
+}
+
+func cookieJarFrom(ctx context.Context) *cookieJar {
+	jar, _ := ctx.Value(cookieJarKey{}).(*cookieJar)
+	return jar
+}
+
+// withCookies performs a transport's exchange of req with the server,
+// adding the client's DNS Cookies to the query and checking the cookies in
+// the response, if the context carries a cookie jar (see [Client.Cookies]).
+// If the server responds with BADCOOKIE, withCookies retries the exchange
+// once, with the fresh server cookie from that response.
+func withCookies(ctx context.Context, server string, req *dns.Msg, exchange func(*dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	jar := cookieJarFrom(ctx)
+	if jar == nil {
+		return exchange(req)
+	}
+
+	for retried := false; ; retried = true {
+		clientCookie, serverCookie := jar.get(server)
+		m := req.Copy()
+		AddEDNS0Cookie(m, clientCookie, serverCookie)
+
+		resp, err := exchange(m)
+		if err != nil {
+			return nil, err
+		}
+
+		err = jar.update(server, clientCookie, resp)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Rcode != dns.RcodeBadCookie || retried {
+			return resp, nil
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package resolv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// A cookieServer plays a server that supports DNS Cookies in a test of
+// withCookies.  Its respond function returns the cookie data (client
+// cookie, then server cookie) and rcode for the n'th query (from 0); if the
+// data is nil, the response has no cookie.
+type cookieServer struct {
+	respond func(n int, client []byte) ([]byte, int)
+	queries [][]byte // the cookie data of each query
+}
+
+func (s *cookieServer) exchange(req *dns.Msg) (*dns.Msg, error) {
+	data, _ := edns0Cookie(req)
+	n := len(s.queries)
+	s.queries = append(s.queries, data)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.SetEdns0(DefaultUDPBufSize, false)
+	cookie, rcode := s.respond(n, data[:clientCookieLen])
+	resp.Rcode = rcode
+	if cookie != nil {
+		AddEDNS0Cookie(resp, cookie, nil)
+	}
+	return resp, nil
+}
+
+func cookieData(b ...[]byte) []byte {
+	return bytes.Join(b, nil)
+}
+
+func TestCookies(t *testing.T) {
+	const server = "192.0.2.1:53"
+	serverCookie1 := []byte("server-cookie-1!")
+	serverCookie2 := []byte("server-cookie-2!")
+	wrongClient := []byte("wrong!!!")
+
+	tests := []struct {
+		name     string
+		respond  func(n int, client []byte) ([]byte, int)
+		queries  int // the number of queries that withCookies sends
+		want     error
+		wantCode int
+	}{
+		{
+			name: "no cookie support",
+			respond: func(int, []byte) ([]byte, int) {
+				return nil, dns.RcodeSuccess
+			},
+			queries: 1,
+		},
+		{
+			name: "server cookie",
+			respond: func(_ int, client []byte) ([]byte, int) {
+				return cookieData(client, serverCookie1), dns.RcodeSuccess
+			},
+			queries: 1,
+		},
+		{
+			name: "mismatched client cookie",
+			respond: func(int, []byte) ([]byte, int) {
+				return cookieData(wrongClient, serverCookie1), dns.RcodeSuccess
+			},
+			queries: 1,
+			want:    ErrBadCookie,
+		},
+		{
+			name: "BADCOOKIE retry",
+			respond: func(n int, client []byte) ([]byte, int) {
+				if n == 0 {
+					return cookieData(client, serverCookie1), dns.RcodeBadCookie
+				}
+				return cookieData(client, serverCookie2), dns.RcodeSuccess
+			},
+			queries: 2,
+		},
+		{
+			name: "BADCOOKIE twice",
+			respond: func(_ int, client []byte) ([]byte, int) {
+				return cookieData(client, serverCookie1), dns.RcodeBadCookie
+			},
+			queries:  2,
+			wantCode: dns.RcodeBadCookie,
+		},
+		{
+			name: "BADCOOKIE with mismatched client cookie",
+			respond: func(int, []byte) ([]byte, int) {
+				return cookieData(wrongClient, serverCookie1), dns.RcodeBadCookie
+			},
+			queries: 1,
+			want:    ErrBadCookie,
+		},
+		{
+			name: "BADCOOKIE then missing cookie",
+			respond: func(n int, client []byte) ([]byte, int) {
+				if n == 0 {
+					return cookieData(client, serverCookie1), dns.RcodeBadCookie
+				}
+				return nil, dns.RcodeSuccess
+			},
+			queries: 2,
+			want:    ErrBadCookie,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jar := newCookieJar()
+			ctx := withCookieJar(context.Background(), jar)
+			s := &cookieServer{respond: tt.respond}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.", dns.TypeA)
+			resp, err := withCookies(ctx, server, req, s.exchange)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if err == nil && resp.Rcode != tt.wantCode {
+				t.Errorf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.wantCode])
+			}
+			if len(s.queries) != tt.queries {
+				t.Fatalf("sent %d queries, want %d", len(s.queries), tt.queries)
+			}
+
+			// Every query carries the same client cookie, and a retry
+			// carries the server cookie from the BADCOOKIE response.
+			client, _ := jar.get(server)
+			for i, q := range s.queries {
+				if !bytes.Equal(q[:clientCookieLen], client) {
+					t.Errorf("query %d: client cookie %x, want %x", i, q[:clientCookieLen], client)
+				}
+			}
+			if tt.queries == 2 {
+				if got := s.queries[1][clientCookieLen:]; !bytes.Equal(got, serverCookie1) {
+					t.Errorf("retry has server cookie %q, want %q", got, serverCookie1)
+				}
+			}
+		})
+	}
+}
+
+func TestCookieJarMissingCookie(t *testing.T) {
+	const server = "192.0.2.1:53"
+	jar := newCookieJar()
+	client, _ := jar.get(server)
+
+	noCookie := new(dns.Msg)
+	if err := jar.update(server, client, noCookie); err != nil {
+		t.Errorf("before a server cookie: %v", err)
+	}
+
+	resp := new(dns.Msg)
+	AddEDNS0Cookie(resp, client, []byte("server-cookie-1!"))
+	if err := jar.update(server, client, resp); err != nil {
+		t.Fatal(err)
+	}
+	if _, sc := jar.get(server); string(sc) != "server-cookie-1!" {
+		t.Errorf("jar has server cookie %q", sc)
+	}
+
+	if err := jar.update(server, client, noCookie); !errors.Is(err, ErrBadCookie) {
+		t.Errorf("after a server cookie: got %v, want %v", err, ErrBadCookie)
+	}
+	// Another server's cookies are separate.
+	other, _ := jar.get("192.0.2.2:53")
+	if err := jar.update("192.0.2.2:53", other, noCookie); err != nil {
+		t.Errorf("other server: %v", err)
+	}
+}
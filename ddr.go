@@ -0,0 +1,315 @@
+package resolv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The special-use domain name that a client queries to discover the
+// designated resolvers of an unencrypted resolver (RFC 9462, Section 4).
+const DDRName = "_dns.resolver.arpa."
+
+// A DesignatedResolver is an encrypted resolver that a resolver designates
+// with an SVCB record, as per RFC 9461 (Service Binding Mapping for DNS
+// Servers) and RFC 9462 (Discovery of Designated Resolvers).
+type DesignatedResolver struct {
+	// The resolver's authentication domain name (the SVCB record's
+	// TargetName).  The resolver's certificate must cover this name.
+	Name string
+
+	// The SVCB record's priority; lower values are more preferred.
+	Priority uint16
+
+	// The protocols that the resolver supports, in order of the resolver's
+	// preference: "dot" for DoT, "doq" for DoQ, and "h2" or "h3" for DoH.
+	ALPN []string
+
+	// The port of the resolver; zero if the record does not specify a port,
+	// in which case the protocol's default port applies.
+	Port uint16
+
+	// For DoH, the URI template of the resolver's endpoint relative to the
+	// resolver's origin, such as "/dns-query{?dns}".
+	DoHPath string
+
+	// The addresses of the resolver: the record's ipv4hint and ipv6hint
+	// parameters, or else the addresses of Name.
+	Addrs []netip.Addr
+
+	// If valid, the IP address of the unencrypted resolver that designated
+	// this resolver.  For Verified Discovery (RFC 9462, Section 4.2), the
+	// resolver's certificate must cover this address too.
+	DesignatorIP netip.Addr
+
+	// The base TLS configuration for the resolver's transports (e.g., the
+	// CA certificates).  If nil, the transports use the system's default CA
+	// certificates.  The transports always authenticate the resolver by
+	// Name (and DesignatorIP, if valid).
+	TLSConfig *tls.Config
+}
+
+// ddrParams are the SVCB parameters that this package's discovery of
+// designated resolvers understands.
+var ddrParams = []dns.SVCBKey{
+	dns.SVCB_ALPN,
+	dns.SVCB_PORT,
+	dns.SVCB_IPV4HINT,
+	dns.SVCB_IPV6HINT,
+	dns.SVCB_DOHPATH,
+}
+
+// newDesignatedResolver converts an SVCB record to a DesignatedResolver.  It
+// returns nil if the record has a mandatory parameter that this package does
+// not understand.
+func newDesignatedResolver(rec *SVCBRecord) *DesignatedResolver {
+	for _, key := range rec.Mandatory {
+		if !slices.Contains(ddrParams, key) {
+			return nil
+		}
+	}
+
+	r := &DesignatedResolver{
+		Name:     rec.Target,
+		Priority: rec.Priority,
+		ALPN:     rec.ALPN,
+		Port:     rec.Port,
+		DoHPath:  rec.DoHPath,
+	}
+	r.Addrs = append(r.Addrs, rec.IPv4Hints...)
+	r.Addrs = append(r.Addrs, rec.IPv6Hints...)
+	return r
+}
+
+// getDesignatedResolvers looks up the SVCB records of name, and returns the
+// designated resolvers in order of priority.  If selfName is not empty, a
+// record whose TargetName is "." refers to the resolver named selfName;
+// otherwise, the function ignores such records.
+func (c *Client) getDesignatedResolvers(ctx context.Context, name, selfName string) ([]*DesignatedResolver, error) {
+	recs, err := c.getSVCBRecords(ctx, name, dns.TypeSVCB)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolvers []*DesignatedResolver
+	for _, rec := range recs {
+		r := newDesignatedResolver(rec)
+		if r == nil {
+			continue
+		}
+		if r.Name == rec.Name {
+			if selfName == "" {
+				continue
+			}
+			r.Name = selfName
+		}
+		if len(r.Addrs) == 0 {
+			// Per RFC 9462, Section 4, resolve the name with the same
+			// resolver.  If that fails, the transport resolves the name when
+			// it connects.
+			r.Addrs, _ = c.GetIPsContext(ctx, r.Name)
+		}
+		resolvers = append(resolvers, r)
+	}
+
+	if len(resolvers) == 0 {
+		return nil, ErrNoDesignatedResolver
+	}
+	return resolvers, nil
+}
+
+// GetDesignatedResolvers discovers the encrypted resolvers that the client's
+// (unencrypted) resolver designates, by querying the resolver for the SVCB
+// records of [DDRName] (RFC 9462, Section 4).  resolverIP is the IP address of
+// the client's resolver; the returned resolvers' transports only accept a
+// certificate that covers this address.  The resolvers are in order of
+// priority.
+func (c *Client) GetDesignatedResolvers(resolverIP netip.Addr) ([]*DesignatedResolver, error) {
+	return c.GetDesignatedResolversContext(context.Background(), resolverIP)
+}
+
+// GetDesignatedResolversContext is like [Client.GetDesignatedResolvers], but
+// takes a context.
+func (c *Client) GetDesignatedResolversContext(ctx context.Context, resolverIP netip.Addr) ([]*DesignatedResolver, error) {
+	resolvers, err := c.getDesignatedResolvers(ctx, DDRName, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range resolvers {
+		r.DesignatorIP = resolverIP
+	}
+	return resolvers, nil
+}
+
+// GetNamedResolvers discovers the encrypted resolvers for the resolver with
+// the given name, by querying the SVCB records of "_dns.<name>" (RFC 9461).
+// The resolvers are in order of priority.
+func (c *Client) GetNamedResolvers(name string) ([]*DesignatedResolver, error) {
+	return c.GetNamedResolversContext(context.Background(), name)
+}
+
+// GetNamedResolversContext is like [Client.GetNamedResolvers], but takes a
+// context.
+func (c *Client) GetNamedResolversContext(ctx context.Context, name string) ([]*DesignatedResolver, error) {
+	name = dns.Fqdn(name)
+	return c.getDesignatedResolvers(ctx, "_dns."+name, name)
+}
+
+// verifyDesignatorIP returns a function for a [crypto/tls.Config]'s
+// VerifyConnection that fails the handshake unless the server's certificate
+// chain is verified, and the certificate covers ip.
+func verifyDesignatorIP(ip netip.Addr) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+			// The certificate may be anyone's (e.g., with
+			// InsecureSkipVerify), so it proves nothing.
+			return fmt.Errorf("%w: certificate chain not verified", ErrUnverifiedDesignation)
+		}
+		leaf := cs.VerifiedChains[0][0]
+		if err := leaf.VerifyHostname(ip.String()); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnverifiedDesignation, err)
+		}
+		return nil
+	}
+}
+
+func (r *DesignatedResolver) tlsConfig() *tls.Config {
+	var cfg *tls.Config
+	if r.TLSConfig != nil {
+		cfg = r.TLSConfig.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+	cfg.ServerName = strings.TrimSuffix(r.Name, ".")
+	if r.DesignatorIP.IsValid() {
+		addVerifyConnection(cfg, verifyDesignatorIP(r.DesignatorIP))
+	}
+	return cfg
+}
+
+// servers returns the HOST:PORT of each of the resolver's addresses, or of
+// the resolver's Name, if it has no addresses.
+func (r *DesignatedResolver) servers(defaultPort string) []string {
+	port := defaultPort
+	if r.Port != 0 {
+		port = strconv.Itoa(int(r.Port))
+	}
+	if len(r.Addrs) == 0 {
+		return []string{net.JoinHostPort(strings.TrimSuffix(r.Name, "."), port)}
+	}
+	servers := make([]string, len(r.Addrs))
+	for i, addr := range r.Addrs {
+		servers[i] = net.JoinHostPort(addr.String(), port)
+	}
+	return servers
+}
+
+// dohPath returns the path of the resolver's DoH endpoint, for POST requests:
+// the DoHPath template without its dns variable.
+func (r *DesignatedResolver) dohPath() (string, bool) {
+	path, _, ok := strings.Cut(r.DoHPath, "{?dns}")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return "", false
+	}
+	return path, true
+}
+
+// NewTransport returns a transport for the resolver, using the first protocol
+// in the resolver's ALPN list that this package supports.  The transport
+// authenticates the resolver by its Name (and DesignatorIP, if valid).  If
+// the resolver has several addresses, the transport is a [Failover] that
+// tries each address in turn.  NewTransport returns
+// [ErrNoDesignatedResolver] if the resolver supports none of this package's
+// protocols.
+func (r *DesignatedResolver) NewTransport(timeout time.Duration) (Transport, error) {
+	for _, alpn := range r.ALPN {
+		var newTransport func(server string) Transport
+		var defaultPort string
+
+		switch alpn {
+		case "dot":
+			defaultPort = DefaultDoTPort
+			newTransport = func(server string) Transport {
+				return &DoT{Server: server, Timeout: timeout, TLSConfig: r.tlsConfig()}
+			}
+		case "doq":
+			defaultPort = DefaultDoQPort
+			newTransport = func(server string) Transport {
+				return &DoQ{Server: server, Timeout: timeout, TLSConfig: r.tlsConfig()}
+			}
+		case "h2":
+			// The DoH transport does not speak HTTP/3, so "h3" does not
+			// qualify.
+			path, ok := r.dohPath()
+			if !ok {
+				continue
+			}
+			defaultPort = "443"
+			newTransport = func(server string) Transport {
+				return &DoH{ServerURL: "https://" + server + path, Timeout: timeout, TLSConfig: r.tlsConfig()}
+			}
+		default:
+			continue
+		}
+
+		servers := r.servers(defaultPort)
+		if len(servers) == 1 {
+			return newTransport(servers[0]), nil
+		}
+		f := &Failover{Upstreams: make([]Transport, len(servers))}
+		for i, server := range servers {
+			f.Upstreams[i] = newTransport(server)
+		}
+		return f, nil
+	}
+	return nil, ErrNoDesignatedResolver
+}
+
+// Upgrade discovers the designated resolvers of the client's unencrypted
+// resolver, whose IP address is resolverIP, and returns a transport for the
+// most preferred resolver that it can connect to and verify.  To check a
+// resolver, Upgrade repeats the discovery query over the resolver's
+// transport.  The caller may then replace the client's Transport with the
+// returned transport.
+func (c *Client) Upgrade(resolverIP netip.Addr, timeout time.Duration) (Transport, error) {
+	return c.UpgradeContext(context.Background(), resolverIP, timeout)
+}
+
+// UpgradeContext is like [Client.Upgrade], but takes a context.
+func (c *Client) UpgradeContext(ctx context.Context, resolverIP netip.Addr, timeout time.Duration) (Transport, error) {
+	resolvers, err := c.GetDesignatedResolversContext(ctx, resolverIP)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, r := range resolvers {
+		t, err := r.NewTransport(timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.Name, err))
+			continue
+		}
+
+		_, err = t.ExchangeContext(ctx, c.NewMsg(DDRName, dns.TypeSVCB))
+		if err != nil {
+			t.Close()
+			errs = append(errs, fmt.Errorf("%s: %w", r.Name, err))
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrNoDesignatedResolver, errors.Join(errs...))
+}
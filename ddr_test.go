@@ -0,0 +1,162 @@
+package resolv
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testDoHName = "dns.example.test."
+
+// newDoHTestServer starts a DoH server with the certificate, and returns its
+// port.  The server answers each query with testAnswer.
+func newDoHTestServer(t *testing.T, cert tls.Certificate) uint16 {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		msg, err := testAnswer(req).Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(msg)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // the failed handshakes are expected
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint16(port)
+}
+
+// newDDRTestClient starts an unencrypted resolver on 127.0.0.1 that
+// designates a DoH resolver on port dohPort, and returns a client of the
+// unencrypted resolver.  The designated resolver's first address (127.0.0.2)
+// refuses connections; its second is 127.0.0.1.
+func newDDRTestClient(t *testing.T, dohPort uint16) *Client {
+	svcb, err := dns.NewRR(fmt.Sprintf(
+		`%s 300 IN SVCB 1 %s alpn=h2 port=%d ipv4hint=127.0.0.2,127.0.0.1 dohpath="/dns-query{?dns}"`,
+		DDRName, testDoHName, dohPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startDNSServer(t, "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		if q.Name == DDRName && q.Qtype == dns.TypeSVCB {
+			resp.Answer = append(resp.Answer, svcb)
+		}
+		w.WriteMsg(resp)
+	})
+	return &Client{Transport: &Do53UDP{Server: addr, Timeout: time.Second}, RD: true}
+}
+
+func TestDDRVerifiedDiscovery(t *testing.T) {
+	designator := netip.MustParseAddr("127.0.0.1")
+
+	tests := []struct {
+		name     string
+		hosts    []string // the names and addresses of the certificate
+		insecure bool
+		wantErr  bool
+		want     error // if not nil, the error that the exchange returns
+	}{
+		{"certificate covers the IP", []string{"dns.example.test", "127.0.0.1"}, false, false, nil},
+		{"certificate doesn't cover the IP", []string{"dns.example.test", "127.0.0.2"}, false, true, ErrUnverifiedDesignation},
+		{"unverified certificate", []string{"dns.example.test", "127.0.0.1"}, true, true, ErrUnverifiedDesignation},
+		{"certificate doesn't cover the name", []string{"other.example.test", "127.0.0.1"}, false, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, pool := newTestCertificate(t, tt.hosts...)
+			c := newDDRTestClient(t, newDoHTestServer(t, cert))
+
+			resolvers, err := c.GetDesignatedResolvers(designator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resolvers) != 1 {
+				t.Fatalf("got %d resolvers, want 1", len(resolvers))
+			}
+			r := resolvers[0]
+			wantAddrs := []netip.Addr{netip.MustParseAddr("127.0.0.2"), designator}
+			if r.Name != testDoHName || !slices.Equal(r.Addrs, wantAddrs) || r.DesignatorIP != designator {
+				t.Fatalf("got resolver %+v", r)
+			}
+
+			r.TLSConfig = &tls.Config{RootCAs: pool, InsecureSkipVerify: tt.insecure}
+			tr, err := r.NewTransport(time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+			if f, ok := tr.(*Failover); !ok || len(f.Upstreams) != 2 {
+				t.Fatalf("got transport %T, want a Failover with 2 upstreams", tr)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeTXT)
+			resp, err := tr.Exchange(req)
+			switch {
+			case !tt.wantErr:
+				if err != nil {
+					t.Fatal(err)
+				}
+				// DoH queries have ID 0 (RFC 8484, Section 4.1).
+				checkTestAnswer(t, resp, "www.example.com.", 0)
+			case err == nil:
+				t.Errorf("exchange succeeded, want an error")
+			case tt.want != nil && !errors.Is(err, tt.want):
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDesignatedResolverServers(t *testing.T) {
+	r := &DesignatedResolver{Name: testDoHName}
+	if got, want := r.servers("853"), []string{"dns.example.test:853"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	r.Port = 8853
+	r.Addrs = []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	if got, want := r.servers("853"), []string{"192.0.2.1:8853", "[2001:db8::1]:8853"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
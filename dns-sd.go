@@ -1,6 +1,7 @@
 package resolv
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
@@ -12,24 +13,24 @@ import (
 	"github.com/syslab-wm/mu"
 )
 
-func (c *Client) lookupPTR(domain string) ([]*dns.PTR, error) {
-	resp, err := c.Lookup(domain, dns.TypePTR)
+func (c *Client) lookupPTR(ctx context.Context, domain string) ([]*dns.PTR, error) {
+	resp, err := c.LookupContext(ctx, domain, dns.TypePTR)
 	if err != nil {
 		return nil, err
 	}
 	return CollectRRs[*dns.PTR](resp.Answer), nil
 }
 
-func (c *Client) lookupOnePTR(domain string) (*dns.PTR, error) {
-	ptrs, err := c.lookupPTR(domain)
+func (c *Client) lookupOnePTR(ctx context.Context, domain string) (*dns.PTR, error) {
+	ptrs, err := c.lookupPTR(ctx, domain)
 	if err != nil {
 		return nil, err
 	}
 	return ptrs[0], nil
 }
 
-func (c *Client) getPTR(domain string) ([]string, error) {
-	ptrs, err := c.lookupPTR(domain)
+func (c *Client) getPTR(ctx context.Context, domain string) ([]string, error) {
+	ptrs, err := c.lookupPTR(ctx, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -39,32 +40,32 @@ func (c *Client) getPTR(domain string) ([]string, error) {
 	return domains, nil
 }
 
-func (c *Client) getOnePTR(domain string) (string, error) {
-	ptr, err := c.lookupOnePTR(domain)
+func (c *Client) getOnePTR(ctx context.Context, domain string) (string, error) {
+	ptr, err := c.lookupOnePTR(ctx, domain)
 	if err != nil {
 		return "", err
 	}
 	return ptr.Ptr, nil
 }
 
-func (c *Client) lookupTXT(domain string) ([]*dns.TXT, error) {
-	resp, err := c.Lookup(domain, dns.TypeTXT)
+func (c *Client) lookupTXT(ctx context.Context, domain string) ([]*dns.TXT, error) {
+	resp, err := c.LookupContext(ctx, domain, dns.TypeTXT)
 	if err != nil {
 		return nil, err
 	}
 	return CollectRRs[*dns.TXT](resp.Answer), nil
 }
 
-func (c *Client) lookupOneTXT(domain string) (*dns.TXT, error) {
-	txts, err := c.lookupTXT(domain)
+func (c *Client) lookupOneTXT(ctx context.Context, domain string) (*dns.TXT, error) {
+	txts, err := c.lookupTXT(ctx, domain)
 	if err != nil {
 		return nil, err
 	}
 	return txts[0], nil
 }
 
-func (c *Client) getTXT(domain string) ([][]string, error) {
-	txts, err := c.lookupTXT(domain)
+func (c *Client) getTXT(ctx context.Context, domain string) ([][]string, error) {
+	txts, err := c.lookupTXT(ctx, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -74,8 +75,8 @@ func (c *Client) getTXT(domain string) ([][]string, error) {
 	return values, nil
 }
 
-func (c *Client) getOneTXT(domain string) ([]string, error) {
-	txt, err := c.lookupOneTXT(domain)
+func (c *Client) getOneTXT(ctx context.Context, domain string) ([]string, error) {
+	txt, err := c.lookupOneTXT(ctx, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -83,25 +84,45 @@ func (c *Client) getOneTXT(domain string) ([]string, error) {
 }
 
 func (c *Client) GetServiceBrowserDomains(domain string) ([]string, error) {
+	return c.GetServiceBrowserDomainsContext(context.Background(), domain)
+}
+
+// GetServiceBrowserDomainsContext is like [Client.GetServiceBrowserDomains], but takes a context.
+func (c *Client) GetServiceBrowserDomainsContext(ctx context.Context, domain string) ([]string, error) {
 	fauxDomain := fmt.Sprintf("b._dns-sd._udp.%s", domain)
-	return c.getPTR(fauxDomain)
+	return c.getPTR(ctx, fauxDomain)
 }
 
 func (c *Client) GetDefaultServiceBrowserDomain(domain string) (string, error) {
+	return c.GetDefaultServiceBrowserDomainContext(context.Background(), domain)
+}
+
+// GetDefaultServiceBrowserDomainContext is like [Client.GetDefaultServiceBrowserDomain], but takes a context.
+func (c *Client) GetDefaultServiceBrowserDomainContext(ctx context.Context, domain string) (string, error) {
 	fauxDomain := fmt.Sprintf("db._dns-sd._udp.%s", domain)
-	return c.getOnePTR(fauxDomain)
+	return c.getOnePTR(ctx, fauxDomain)
 }
 
 func (c *Client) GetLegacyServiceBrowserDomains(domain string) ([]string, error) {
+	return c.GetLegacyServiceBrowserDomainsContext(context.Background(), domain)
+}
+
+// GetLegacyServiceBrowserDomainsContext is like [Client.GetLegacyServiceBrowserDomains], but takes a context.
+func (c *Client) GetLegacyServiceBrowserDomainsContext(ctx context.Context, domain string) ([]string, error) {
 	fauxDomain := fmt.Sprintf("lb._dns-sd._udp.%s", domain)
-	return c.getPTR(fauxDomain)
+	return c.getPTR(ctx, fauxDomain)
 }
 
 func (c *Client) GetAllServiceBrowserDomains(domain string) ([]string, error) {
+	return c.GetAllServiceBrowserDomainsContext(context.Background(), domain)
+}
+
+// GetAllServiceBrowserDomainsContext is like [Client.GetAllServiceBrowserDomains], but takes a context.
+func (c *Client) GetAllServiceBrowserDomainsContext(ctx context.Context, domain string) ([]string, error) {
 	var errs []error
 	domainSet := set.New[string]()
 
-	names, err := c.GetServiceBrowserDomains(domain)
+	names, err := c.GetServiceBrowserDomainsContext(ctx, domain)
 	if err != nil {
 		//log.Printf("GetServiceBrowserDomains: err: %v", err)
 		errs = append(errs, err)
@@ -110,7 +131,7 @@ func (c *Client) GetAllServiceBrowserDomains(domain string) ([]string, error) {
 		domainSet.Add(names...)
 	}
 
-	name, err := c.GetDefaultServiceBrowserDomain(domain)
+	name, err := c.GetDefaultServiceBrowserDomainContext(ctx, domain)
 	if err != nil {
 		//log.Printf("GetDefaultServiceBrowserDomain: err: %v", err)
 		errs = append(errs, err)
@@ -119,7 +140,7 @@ func (c *Client) GetAllServiceBrowserDomains(domain string) ([]string, error) {
 		domainSet.Add(name)
 	}
 
-	names, err = c.GetLegacyServiceBrowserDomains(domain)
+	names, err = c.GetLegacyServiceBrowserDomainsContext(ctx, domain)
 	if err != nil {
 		//log.Printf("GetLegacyServiceBrowserDomains: err: %v", err)
 		errs = append(errs, err)
@@ -128,6 +149,10 @@ func (c *Client) GetAllServiceBrowserDomains(domain string) ([]string, error) {
 		domainSet.Add(names...)
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if domainSet.Size() == 0 {
 		if len(errs) == 0 {
 			mu.BUG("got no answers, but got no errors")
@@ -139,13 +164,23 @@ func (c *Client) GetAllServiceBrowserDomains(domain string) ([]string, error) {
 }
 
 func (c *Client) GetServices(domain string) ([]string, error) {
+	return c.GetServicesContext(context.Background(), domain)
+}
+
+// GetServicesContext is like [Client.GetServices], but takes a context.
+func (c *Client) GetServicesContext(ctx context.Context, domain string) ([]string, error) {
 	fauxDomain := fmt.Sprintf("_services._dns-sd._udp.%s", domain)
-	return c.getPTR(fauxDomain)
+	return c.getPTR(ctx, fauxDomain)
 }
 
 func (c *Client) GetServiceInstances(serviceDomain string) ([]string, error) {
+	return c.GetServiceInstancesContext(context.Background(), serviceDomain)
+}
+
+// GetServiceInstancesContext is like [Client.GetServiceInstances], but takes a context.
+func (c *Client) GetServiceInstancesContext(ctx context.Context, serviceDomain string) ([]string, error) {
 	// serviceDomain has the form, e.g.,  _ssh._tcp.<domain>
-	return c.getPTR(serviceDomain)
+	return c.getPTR(ctx, serviceDomain)
 }
 
 // aggregation of SRV, TXT, and A/AAAA records
@@ -168,12 +203,17 @@ func (info *ServiceInstanceInfo) String() string {
 }
 
 func (c *Client) GetServiceInstanceInfo(domain string) (*ServiceInstanceInfo, error) {
+	return c.GetServiceInstanceInfoContext(context.Background(), domain)
+}
+
+// GetServiceInstanceInfoContext is like [Client.GetServiceInstanceInfo], but takes a context.
+func (c *Client) GetServiceInstanceInfoContext(ctx context.Context, domain string) (*ServiceInstanceInfo, error) {
 	var addrs []netip.Addr
 	info := new(ServiceInstanceInfo)
 	info.Name = domain
 
 	// SRV must succeed
-	resp, err := c.Lookup(domain, dns.TypeSRV)
+	resp, err := c.LookupContext(ctx, domain, dns.TypeSRV)
 	if err != nil {
 		return nil, err
 	}
@@ -215,18 +255,24 @@ func (c *Client) GetServiceInstanceInfo(domain string) (*ServiceInstanceInfo, er
 		// If no A/AAAA records in the Additional section, do A/AAAA queries
 
 		// not an error if fails
-		addrs, err := c.GetIPs(info.Target)
+		addrs, err := c.GetIPsContext(ctx, info.Target)
 		if err == nil {
 			info.Addrs = addrs
 		}
 	}
 
 	// not an error if TXT doesn't succeed
-	value, err := c.getOneTXT(domain)
+	value, err := c.getOneTXT(ctx, domain)
 	if err == nil {
 		info.Txt = value
 	}
 
+	// The A/AAAA and TXT lookups are optional, but if they failed because
+	// the caller cancelled the context, the info is incomplete.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	return info, nil
 }
 
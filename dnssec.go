@@ -0,0 +1,777 @@
+package resolv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/circl/sign/ed448"
+	"github.com/miekg/dns"
+)
+
+// A ValidationStatus is the outcome of DNSSEC validation (RFC 4033, Section
+// 5; RFC 4035, Section 4.3).
+type ValidationStatus int
+
+const (
+	// No trust anchor covers the data, or the client did not validate it.
+	Indeterminate ValidationStatus = iota
+
+	// A chain of trust from a trust anchor proves that the data is in an
+	// unsigned zone.
+	Insecure
+
+	// The data should be signed, but its signatures (or the chain of trust
+	// to them) are missing, expired, or invalid.
+	Bogus
+
+	// A chain of trust from a trust anchor proves the data authentic.
+	Secure
+)
+
+var validationStatusNames = []string{
+	Indeterminate: "indeterminate",
+	Insecure:      "insecure",
+	Bogus:         "bogus",
+	Secure:        "secure",
+}
+
+func (s ValidationStatus) String() string {
+	if s < 0 || int(s) >= len(validationStatusNames) {
+		return fmt.Sprintf("ValidationStatus(%d)", int(s))
+	}
+	return validationStatusNames[s]
+}
+
+// rank orders the statuses from the weakest (Bogus) to the strongest
+// (Secure); a response is only as strong as its weakest RRset.
+func (s ValidationStatus) rank() int {
+	switch s {
+	case Bogus:
+		return 0
+	case Indeterminate:
+		return 1
+	case Insecure:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// The root zone's key-signing keys, as DS records: KSK-2017 and KSK-2024.
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// RootTrustAnchors returns the DS records of the root zone's key-signing
+// keys, which a validating [Client] uses by default.
+func RootTrustAnchors() []dns.RR {
+	var anchors []dns.RR
+	for _, s := range rootAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		anchors = append(anchors, rr)
+	}
+	return anchors
+}
+
+// The DNSSEC algorithms that a validating Client supports.
+var supportedAlgorithms = []uint8{
+	dns.RSASHA256,
+	dns.ECDSAP256SHA256,
+	dns.ECDSAP384SHA384,
+	dns.ED25519,
+	dns.ED448,
+}
+
+// The DS digest types that a validating Client supports.
+var supportedDigests = []uint8{
+	dns.SHA1,
+	dns.SHA256,
+	dns.SHA384,
+}
+
+// A zoneState is what the chain of trust proves about a name: the status,
+// and, if Secure, the closest enclosing signed zone and its keys.
+type zoneState struct {
+	status  ValidationStatus
+	reason  string
+	zone    string
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// A validator caches the zoneStates of the names that a validating Client
+// has looked up.
+type validator struct {
+	mu     sync.Mutex
+	states map[string]*zoneState // keyed by canonical name
+
+	// the trust anchors that the states derive from
+	store *TrustAnchorStore
+	gen   uint64
+}
+
+func newValidator() *validator {
+	return &validator{states: make(map[string]*zoneState)}
+}
+
+// sync discards the cached states if the trust anchors have changed.
+func (v *validator) sync(store *TrustAnchorStore) {
+	gen := store.generation()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.store != store || v.gen != gen {
+		clear(v.states)
+		v.store, v.gen = store, gen
+	}
+}
+
+func (v *validator) get(name string) *zoneState {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	st, ok := v.states[name]
+	if !ok {
+		return nil
+	}
+	if !time.Now().Before(st.expires) {
+		delete(v.states, name)
+		return nil
+	}
+	return st
+}
+
+// put caches st for name.  It does not cache Bogus states, which may stem
+// from transient failures.
+func (v *validator) put(name string, st *zoneState) {
+	if st.status == Bogus || !time.Now().Before(st.expires) {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.states[name] = st
+}
+
+// A signedRRset is an RRset and the RRSIGs that cover it.
+type signedRRset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+func (s *signedRRset) name() string {
+	return s.rrs[0].Header().Name
+}
+
+func (s *signedRRset) rrtype() uint16 {
+	return s.rrs[0].Header().Rrtype
+}
+
+func (s *signedRRset) String() string {
+	return fmt.Sprintf("%s %s", s.name(), dns.Type(s.rrtype()))
+}
+
+// minTTL returns the smallest TTL of the records of the RRset.
+func (s *signedRRset) minTTL() uint32 {
+	ttl := s.rrs[0].Header().Ttl
+	for _, rr := range s.rrs[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return ttl
+}
+
+// splitRRsets groups the records of a message section into RRsets, each with
+// the RRSIGs that cover it, in order of appearance.
+func splitRRsets(rrs []dns.RR) []*signedRRset {
+	type key struct {
+		name          string
+		rrtype, class uint16
+	}
+	var sets []*signedRRset
+	index := make(map[key]*signedRRset)
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := key{dns.CanonicalName(hdr.Name), hdr.Rrtype, hdr.Class}
+		set, ok := index[k]
+		if !ok {
+			set = new(signedRRset)
+			index[k] = set
+			sets = append(sets, set)
+		}
+		set.rrs = append(set.rrs, rr)
+	}
+	for _, sig := range CollectRRs[*dns.RRSIG](rrs) {
+		k := key{dns.CanonicalName(sig.Hdr.Name), sig.TypeCovered, sig.Hdr.Class}
+		if set, ok := index[k]; ok {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+	return sets
+}
+
+// canonicalizeRdata lowercases the domain names in the rdata of rr, for the
+// types that RFC 4034, Section 6.2 (as amended by RFC 6840, Section 5.1)
+// lists.
+func canonicalizeRdata(rr dns.RR) {
+	switch rr := rr.(type) {
+	case *dns.NS:
+		rr.Ns = dns.CanonicalName(rr.Ns)
+	case *dns.MD:
+		rr.Md = dns.CanonicalName(rr.Md)
+	case *dns.MF:
+		rr.Mf = dns.CanonicalName(rr.Mf)
+	case *dns.CNAME:
+		rr.Target = dns.CanonicalName(rr.Target)
+	case *dns.SOA:
+		rr.Ns = dns.CanonicalName(rr.Ns)
+		rr.Mbox = dns.CanonicalName(rr.Mbox)
+	case *dns.MB:
+		rr.Mb = dns.CanonicalName(rr.Mb)
+	case *dns.MG:
+		rr.Mg = dns.CanonicalName(rr.Mg)
+	case *dns.MR:
+		rr.Mr = dns.CanonicalName(rr.Mr)
+	case *dns.PTR:
+		rr.Ptr = dns.CanonicalName(rr.Ptr)
+	case *dns.MINFO:
+		rr.Rmail = dns.CanonicalName(rr.Rmail)
+		rr.Email = dns.CanonicalName(rr.Email)
+	case *dns.MX:
+		rr.Mx = dns.CanonicalName(rr.Mx)
+	case *dns.RP:
+		rr.Mbox = dns.CanonicalName(rr.Mbox)
+		rr.Txt = dns.CanonicalName(rr.Txt)
+	case *dns.AFSDB:
+		rr.Hostname = dns.CanonicalName(rr.Hostname)
+	case *dns.RT:
+		rr.Host = dns.CanonicalName(rr.Host)
+	case *dns.SIG:
+		rr.SignerName = dns.CanonicalName(rr.SignerName)
+	case *dns.PX:
+		rr.Map822 = dns.CanonicalName(rr.Map822)
+		rr.Mapx400 = dns.CanonicalName(rr.Mapx400)
+	case *dns.NAPTR:
+		rr.Replacement = dns.CanonicalName(rr.Replacement)
+	case *dns.KX:
+		rr.Exchanger = dns.CanonicalName(rr.Exchanger)
+	case *dns.SRV:
+		rr.Target = dns.CanonicalName(rr.Target)
+	case *dns.DNAME:
+		rr.Target = dns.CanonicalName(rr.Target)
+	}
+}
+
+// signedData returns the data that sig signs for rrset (RFC 4034, Section
+// 3.1.8.1): the RRSIG rdata without the signature, followed by the RRset in
+// canonical form and order.
+func signedData(sig *dns.RRSIG, rrset []dns.RR) ([]byte, error) {
+	data := make([]byte, 18, 512)
+	binary.BigEndian.PutUint16(data[0:], sig.TypeCovered)
+	data[2] = sig.Algorithm
+	data[3] = sig.Labels
+	binary.BigEndian.PutUint32(data[4:], sig.OrigTtl)
+	binary.BigEndian.PutUint32(data[8:], sig.Expiration)
+	binary.BigEndian.PutUint32(data[12:], sig.Inception)
+	binary.BigEndian.PutUint16(data[16:], sig.KeyTag)
+	name := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.CanonicalName(sig.SignerName), name, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, name[:n]...)
+
+	var wires [][]byte
+	rdataOff := 0
+	for _, rr := range rrset {
+		rr = dns.Copy(rr)
+		hdr := rr.Header()
+		hdr.Ttl = sig.OrigTtl
+		if labels := dns.SplitDomainName(hdr.Name); len(labels) > int(sig.Labels) {
+			// the RRset is the expansion of a wildcard
+			hdr.Name = dns.Fqdn("*." + strings.Join(labels[len(labels)-int(sig.Labels):], "."))
+		}
+		hdr.Name = dns.CanonicalName(hdr.Name)
+		canonicalizeRdata(rr)
+
+		wire := make([]byte, dns.Len(rr)+1)
+		off, err := dns.PackRR(rr, wire, 0, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		wires = append(wires, wire[:off])
+		// the owner name, then the type, class, TTL, and RDLENGTH
+		rdataOff, _ = dns.PackDomainName(hdr.Name, name, 0, nil, false)
+		rdataOff += 10
+	}
+
+	slices.SortFunc(wires, func(a, b []byte) int {
+		return bytes.Compare(a[rdataOff:], b[rdataOff:])
+	})
+	wires = slices.CompactFunc(wires, bytes.Equal)
+	for _, wire := range wires {
+		data = append(data, wire...)
+	}
+	return data, nil
+}
+
+// verifySig verifies sig over rrset with key.
+func verifySig(sig *dns.RRSIG, key *dns.DNSKEY, rrset []dns.RR) error {
+	if !slices.Contains(supportedAlgorithms, sig.Algorithm) {
+		return fmt.Errorf("unsupported algorithm %s", dns.AlgorithmToString[sig.Algorithm])
+	}
+	if sig.Algorithm != dns.ED448 {
+		return sig.Verify(key, rrset)
+	}
+
+	// github.com/miekg/dns does not support Ed448, so repeat the checks of
+	// RRSIG.Verify here, and verify the signature with circl's Ed448, with
+	// an empty context (RFC 8080).
+	if !dns.IsRRset(rrset) || rrset[0].Header().Rrtype != sig.TypeCovered || rrset[0].Header().Class != sig.Hdr.Class {
+		return dns.ErrRRset
+	}
+	if sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm || sig.Hdr.Class != key.Hdr.Class ||
+		!strings.EqualFold(sig.SignerName, key.Hdr.Name) || key.Protocol != 3 || key.Flags&dns.ZONE == 0 {
+		return dns.ErrKey
+	}
+	pub, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil {
+		return dns.ErrKey
+	}
+	sigbuf, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return dns.ErrSig
+	}
+	data, err := signedData(sig, rrset)
+	if err != nil {
+		return err
+	}
+	if !ed448.Verify(pub, data, sigbuf, "") {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// verifyRRset checks that one of the RRSIGs of set is a valid, current
+// signature by one of the keys of the secure zone of st.
+func verifyRRset(st *zoneState, set *signedRRset) error {
+	if len(set.sigs) == 0 {
+		return fmt.Errorf("%v: no RRSIG", set)
+	}
+
+	now := time.Now()
+	var errs []error
+	for _, sig := range set.sigs {
+		switch {
+		case !strings.EqualFold(sig.SignerName, st.zone):
+			errs = append(errs, fmt.Errorf("signer %s is not %s", sig.SignerName, st.zone))
+			continue
+		case !sig.ValidityPeriod(now):
+			errs = append(errs, fmt.Errorf("RRSIG by key %d is outside its validity period", sig.KeyTag))
+			continue
+		case int(sig.Labels) > dns.CountLabel(set.name()):
+			errs = append(errs, fmt.Errorf("RRSIG by key %d has too many labels", sig.KeyTag))
+			continue
+		}
+
+		found := false
+		for _, key := range st.keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			found = true
+			err := verifySig(sig, key, set.rrs)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, fmt.Errorf("RRSIG by key %d: %w", sig.KeyTag, err))
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("no DNSKEY %d in %s", sig.KeyTag, st.zone))
+		}
+	}
+	return fmt.Errorf("%v: %w", set, errors.Join(errs...))
+}
+
+// matchesDS returns true if key is the key that ds describes.
+func matchesDS(key *dns.DNSKEY, ds *dns.DS) bool {
+	if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+		return false
+	}
+	keyDS := key.ToDS(ds.DigestType)
+	return keyDS != nil && strings.EqualFold(keyDS.Digest, ds.Digest)
+}
+
+// vouchedFor returns true if one of the DS records, or trusted DNSKEY
+// records, describes key.
+func vouchedFor(key *dns.DNSKEY, dsSet []*dns.DS, trusted []*dns.DNSKEY) bool {
+	return slices.ContainsFunc(dsSet, func(ds *dns.DS) bool { return matchesDS(key, ds) }) ||
+		slices.ContainsFunc(trusted, func(t *dns.DNSKEY) bool { return sameKey(t, key) })
+}
+
+// verifyDNSKEYs checks the DNSKEY RRset of zone against the DS records (or
+// trusted DNSKEY records) that vouch for the zone's key-signing keys.  If the
+// RRset is authentic, it returns a Secure state with the zone's keys.
+func verifyDNSKEYs(zone string, set *signedRRset, dsSet []*dns.DS, trusted []*dns.DNSKEY) *zoneState {
+	var usable []*dns.DS
+	for _, ds := range dsSet {
+		if slices.Contains(supportedAlgorithms, ds.Algorithm) && slices.Contains(supportedDigests, ds.DigestType) {
+			usable = append(usable, ds)
+		}
+	}
+	if len(dsSet) > 0 && len(usable) == 0 && len(trusted) == 0 {
+		// RFC 4035, Section 5.2: treat the zone as unsigned
+		return &zoneState{status: Insecure, reason: fmt.Sprintf("%s: no DS record with a supported algorithm and digest", zone)}
+	}
+	if set == nil {
+		return &zoneState{status: Bogus, reason: fmt.Sprintf("%s: no DNSKEY records", zone)}
+	}
+
+	var keys, ksks []*dns.DNSKEY
+	for _, rr := range set.rrs {
+		key := rr.(*dns.DNSKEY)
+		if key.Flags&dns.ZONE == 0 || key.Flags&dns.REVOKE != 0 || key.Protocol != 3 {
+			continue
+		}
+		keys = append(keys, key)
+		if vouchedFor(key, usable, trusted) {
+			ksks = append(ksks, key)
+		}
+	}
+	if len(ksks) == 0 {
+		return &zoneState{status: Bogus, reason: fmt.Sprintf("%s: no DNSKEY matches the trust anchor or DS records", zone)}
+	}
+
+	st := &zoneState{status: Secure, zone: zone, keys: ksks}
+	if err := verifyRRset(st, set); err != nil {
+		return &zoneState{status: Bogus, reason: err.Error()}
+	}
+	st.keys = keys
+	st.expires = time.Now().Add(time.Duration(set.minTTL()) * time.Second)
+	return st
+}
+
+// findRRset returns the RRset of rrtype at name in rrs, if any.
+func findRRset(rrs []dns.RR, name string, rrtype uint16) *signedRRset {
+	for _, set := range splitRRsets(rrs) {
+		if set.rrtype() == rrtype && strings.EqualFold(set.name(), name) {
+			return set
+		}
+	}
+	return nil
+}
+
+// queryDNSSEC looks up the records that validation needs, with the DO and CD
+// bits set.
+func (c *Client) queryDNSSEC(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = c.RD
+	m.CheckingDisabled = true
+	m.SetEdns0(DefaultUDPBufSize, true)
+	// These are the client's own queries; keep them out of the caller's
+	// ExchangeInfo.
+	return c.Transport.ExchangeContext(WithExchangeInfo(ctx, new(ExchangeInfo)), m)
+}
+
+// fetchDNSKEYs looks up and checks the DNSKEY RRset of zone.
+func (c *Client) fetchDNSKEYs(ctx context.Context, zone string, dsSet []*dns.DS, trusted []*dns.DNSKEY) *zoneState {
+	resp, err := c.queryDNSSEC(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return &zoneState{status: Bogus, reason: fmt.Sprintf("%s: can't look up DNSKEY: %v", zone, err)}
+	}
+	return verifyDNSKEYs(zone, findRRset(resp.Answer, zone, dns.TypeDNSKEY), dsSet, trusted)
+}
+
+// trustAnchors returns the client's trust anchor store.
+func (c *Client) trustAnchors() *TrustAnchorStore {
+	if c.TrustAnchors != nil {
+		return c.TrustAnchors
+	}
+	return defaultTrustAnchors()
+}
+
+// provesInsecureDelegation returns true if the NSEC or NSEC3 records in the
+// authority section of resp, a response to a DS query for name, show that
+// name is a delegation without a DS record.
+func provesInsecureDelegation(resp *dns.Msg, name string) bool {
+	isUnsignedCut := func(types []uint16) bool {
+		return slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA) && !slices.Contains(types, dns.TypeDS)
+	}
+
+	for _, nsec := range CollectRRs[*dns.NSEC](resp.Ns) {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return isUnsignedCut(nsec.TypeBitMap)
+		}
+	}
+	nsec3s := CollectRRs[*dns.NSEC3](resp.Ns)
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return isUnsignedCut(nsec3.TypeBitMap)
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		// an Opt-Out span may cover unsigned delegations (RFC 5155, Section
+		// 6)
+		if nsec3.Flags&1 == 1 && nsec3.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// childState returns what the chain of trust proves about child, given the
+// state of its parent name.  The parent's state must be Secure.
+func (c *Client) childState(ctx context.Context, parent *zoneState, child string) *zoneState {
+	bogus := func(format string, a ...any) *zoneState {
+		return &zoneState{status: Bogus, reason: fmt.Sprintf(format, a...)}
+	}
+
+	resp, err := c.queryDNSSEC(ctx, child, dns.TypeDS)
+	if err != nil {
+		return bogus("%s: can't look up DS: %v", child, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return bogus("%s: DS lookup returned %s", child, dns.RcodeToString[resp.Rcode])
+	}
+
+	if dsSet := findRRset(resp.Answer, child, dns.TypeDS); dsSet != nil {
+		// a signed delegation
+		if err := verifyRRset(parent, dsSet); err != nil {
+			return bogus("%v", err)
+		}
+		st := c.fetchDNSKEYs(ctx, child, CollectRRs[*dns.DS](dsSet.rrs), nil)
+		if st.status == Insecure {
+			st.expires = time.Now().Add(time.Duration(dsSet.minTTL()) * time.Second)
+		}
+		return st
+	}
+
+	if cname := findRRset(resp.Answer, child, dns.TypeCNAME); cname != nil {
+		// an alias, and thus not a zone cut
+		if err := verifyRRset(parent, cname); err != nil {
+			return bogus("%v", err)
+		}
+		st := *parent
+		st.expires = time.Now().Add(time.Duration(cname.minTTL()) * time.Second)
+		return &st
+	}
+
+	// The parent zone denies that child has a DS record; the denial must be
+	// signed by the parent.
+	sets := splitRRsets(resp.Ns)
+	if len(sets) == 0 {
+		return bogus("%s: no DS record and no signed denial", child)
+	}
+	ttl := sets[0].minTTL()
+	for _, set := range sets {
+		if err := verifyRRset(parent, set); err != nil {
+			return bogus("%s: denial of DS: %v", child, err)
+		}
+		ttl = min(ttl, set.minTTL())
+	}
+	expires := time.Now().Add(time.Duration(ttl) * time.Second)
+
+	if resp.Rcode == dns.RcodeSuccess && provesInsecureDelegation(resp, child) {
+		return &zoneState{status: Insecure, reason: fmt.Sprintf("%s is an unsigned delegation from %s", child, parent.zone), expires: expires}
+	}
+	// child is not a zone cut: it is in the parent's zone
+	st := *parent
+	st.expires = expires
+	return &st
+}
+
+// nameState returns what the chain of trust proves about name, walking down
+// from the closest trust anchor one label at a time.
+func (c *Client) nameState(ctx context.Context, name string) *zoneState {
+	name = dns.CanonicalName(name)
+	c.validatorOnce.Do(func() {
+		c.validator = newValidator()
+	})
+	v := c.validator
+
+	store := c.trustAnchors()
+	store.refreshDue(ctx, c.Transport)
+	v.sync(store)
+
+	anchor, dsSet, trusted, negative := store.lookup(name)
+	if negative {
+		return &zoneState{status: Insecure, reason: fmt.Sprintf("negative trust anchor at %s", anchor)}
+	}
+	if anchor == "" {
+		return &zoneState{status: Indeterminate, reason: fmt.Sprintf("no trust anchor covers %s", name)}
+	}
+
+	// the names from the anchor down to name
+	labels := dns.SplitDomainName(name)
+	var names []string
+	for i := len(labels) - dns.CountLabel(anchor); i >= 0; i-- {
+		names = append(names, dns.Fqdn(strings.Join(labels[i:], ".")))
+	}
+
+	// start from the deepest name whose state is in the cache
+	var st *zoneState
+	i := len(names) - 1
+	for ; i >= 0; i-- {
+		if st = v.get(names[i]); st != nil {
+			break
+		}
+	}
+	if st == nil {
+		i = 0
+		st = c.fetchDNSKEYs(ctx, anchor, dsSet, trusted)
+		v.put(anchor, st)
+	}
+
+	for _, n := range names[i+1:] {
+		if st.status != Secure {
+			// an insecure (or bogus) zone has no secure descendants
+			break
+		}
+		st = c.childState(ctx, st, n)
+		v.put(n, st)
+	}
+	return st
+}
+
+// validateRRset validates an RRset of a response.
+func (c *Client) validateRRset(ctx context.Context, set *signedRRset) (ValidationStatus, string) {
+	if len(set.sigs) == 0 {
+		st := c.nameState(ctx, set.name())
+		if st.status == Secure {
+			return Bogus, fmt.Sprintf("%v: no RRSIG in signed zone %s", set, st.zone)
+		}
+		return st.status, st.reason
+	}
+
+	signer := dns.CanonicalName(set.sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, set.name()) {
+		return Bogus, fmt.Sprintf("%v: signer %s is not an ancestor", set, signer)
+	}
+	st := c.nameState(ctx, signer)
+	if st.status != Secure {
+		return st.status, st.reason
+	}
+	if st.zone != signer {
+		return Bogus, fmt.Sprintf("%v: signer %s is not a signed zone", set, signer)
+	}
+	if err := verifyRRset(st, set); err != nil {
+		return Bogus, err.Error()
+	}
+	return Secure, ""
+}
+
+// validate validates resp, and returns its status: the status of its weakest
+// RRset.
+func (c *Client) validate(ctx context.Context, resp *dns.Msg) (ValidationStatus, string) {
+	if len(resp.Question) != 1 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return Indeterminate, ""
+	}
+	q := resp.Question[0]
+
+	status, reason := Secure, ""
+	update := func(s ValidationStatus, r string) {
+		if s.rank() < status.rank() {
+			status, reason = s, r
+		}
+	}
+
+	answer := splitRRsets(resp.Answer)
+	for _, set := range answer {
+		if set.rrtype() == dns.TypeCNAME && len(set.sigs) == 0 && isSynthesized(set, answer) {
+			// the DNAME that the CNAME derives from is signed
+			continue
+		}
+		setStatus, setReason := c.validateRRset(ctx, set)
+		if setStatus == Secure {
+			if labels := int(set.sigs[0].Labels); labels < dns.CountLabel(set.name()) {
+				// the RRset is the expansion of a wildcard
+				if err := verifyWildcardExpansion(resp.Ns, set.name(), labels); err != nil {
+					setStatus, setReason = Bogus, fmt.Sprintf("%v: %v", set, err)
+				}
+			}
+		}
+		update(setStatus, setReason)
+	}
+
+	// A negative response (or a CNAME chain that ends in one) must have a
+	// signed denial of existence in its authority section.
+	if slices.ContainsFunc(answer, func(set *signedRRset) bool {
+		return set.rrtype() == q.Qtype || q.Qtype == dns.TypeANY
+	}) {
+		return status, reason
+	}
+	var denial []*signedRRset
+	for _, set := range splitRRsets(resp.Ns) {
+		switch set.rrtype() {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+			denial = append(denial, set)
+		}
+	}
+	for _, set := range denial {
+		update(c.validateRRset(ctx, set))
+	}
+	if len(denial) > 0 && status == Secure {
+		// the signed NSEC or NSEC3 records must also prove the denial
+		update(VerifyDenial(resp))
+	}
+	hasCNAME := slices.ContainsFunc(answer, func(set *signedRRset) bool {
+		return set.rrtype() == dns.TypeCNAME
+	})
+	if len(denial) == 0 && (resp.Rcode == dns.RcodeNameError || !hasCNAME) {
+		// if the response is a CNAME chain, the client follows it instead
+		st := c.nameState(ctx, q.Name)
+		if st.status == Secure {
+			update(Bogus, fmt.Sprintf("%s: negative response without a signed denial", q.Name))
+		} else {
+			update(st.status, st.reason)
+		}
+	}
+
+	return status, reason
+}
+
+// isSynthesized returns true if the CNAME RRset set is the synthesis of one
+// of the DNAME records in answer (RFC 6672, Section 5.3.1).
+func isSynthesized(set *signedRRset, answer []*signedRRset) bool {
+	cname := set.rrs[0].(*dns.CNAME)
+	for _, other := range answer {
+		if other.rrtype() != dns.TypeDNAME {
+			continue
+		}
+		dname := other.rrs[0].(*dns.DNAME)
+		if !dns.IsSubDomain(dname.Hdr.Name, cname.Hdr.Name) || strings.EqualFold(dname.Hdr.Name, cname.Hdr.Name) {
+			continue
+		}
+		if strings.EqualFold(synthesizeCNAME(dname, cname.Hdr.Name).Target, cname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// withDNSSECOK returns a copy of req with the DO and CD bits set, so that the
+// upstream returns the records that validation needs, even if the upstream
+// considers them bogus.
+func withDNSSECOK(req *dns.Msg) *dns.Msg {
+	req = req.Copy()
+	req.CheckingDisabled = true
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		req.SetEdns0(DefaultUDPBufSize, true)
+	}
+	return req
+}
@@ -0,0 +1,801 @@
+package resolv
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/sign/ed448"
+	"github.com/miekg/dns"
+)
+
+// A testKey is a DNSKEY and its private key, for signing test data.
+type testKey struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer // nil for Ed448
+	ed448  ed448.PrivateKey
+}
+
+func newTestKey(t *testing.T, zone string, flags uint16, alg uint8) *testKey {
+	t.Helper()
+	k := &testKey{key: &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: alg,
+	}}
+	if alg == dns.ED448 {
+		pub, priv, err := ed448.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.ed448 = priv
+		k.key.PublicKey = base64.StdEncoding.EncodeToString(pub)
+		return k
+	}
+
+	bits := map[uint8]int{
+		dns.RSASHA256:       1024,
+		dns.ECDSAP256SHA256: 256,
+		dns.ECDSAP384SHA384: 384,
+		dns.ED25519:         256,
+	}[alg]
+	priv, err := k.key.Generate(bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.signer = priv.(crypto.Signer)
+	return k
+}
+
+// sign returns an RRSIG of rrset by the key, valid from an hour ago until a
+// day from now.
+func (k *testKey) sign(t *testing.T, rrset []dns.RR) *dns.RRSIG {
+	t.Helper()
+	return k.signPeriod(t, rrset, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+}
+
+// signPeriod returns an RRSIG of rrset by the key, valid from inception
+// until expiration.
+func (k *testKey) signPeriod(t *testing.T, rrset []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	t.Helper()
+	hdr := rrset[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: hdr.Class, Ttl: hdr.Ttl},
+		Algorithm:  k.key.Algorithm,
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if k.ed448 == nil {
+		if err := sig.Sign(k.signer, rrset); err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+
+	sig.TypeCovered = hdr.Rrtype
+	sig.Labels = uint8(dns.CountLabel(strings.TrimPrefix(hdr.Name, "*.")))
+	sig.OrigTtl = hdr.Ttl
+	data, err := signedData(sig, rrset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Signature = base64.StdEncoding.EncodeToString(ed448.Sign(k.ed448, data, ""))
+	return sig
+}
+
+// mustRRs parses records in presentation format.
+func mustRRs(t *testing.T, ss ...string) []dns.RR {
+	t.Helper()
+	var rrs []dns.RR
+	for _, s := range ss {
+		rrs = append(rrs, mustRR(t, s))
+	}
+	return rrs
+}
+
+func TestVerifySig(t *testing.T) {
+	for _, alg := range supportedAlgorithms {
+		t.Run(dns.AlgorithmToString[alg], func(t *testing.T) {
+			key := newTestKey(t, "example.", 257, alg)
+			other := newTestKey(t, "example.", 257, alg)
+
+			rrset := mustRRs(t,
+				"WWW.Example. 300 IN A 192.0.2.1",
+				"WWW.Example. 300 IN A 192.0.2.2",
+			)
+			sig := key.sign(t, rrset)
+			mx := mustRRs(t, "www.example. 300 IN MX 10 Mail.Example.")
+			mxSig := key.sign(t, mx)
+			wildcard := mustRRs(t, "*.example. 300 IN TXT \"wild\"")
+			wildcardSig := key.sign(t, wildcard)
+
+			modify := func(f func(sig *dns.RRSIG)) *dns.RRSIG {
+				sig := dns.Copy(sig).(*dns.RRSIG)
+				f(sig)
+				return sig
+			}
+
+			tests := []struct {
+				name  string
+				sig   *dns.RRSIG
+				key   *dns.DNSKEY
+				rrset []dns.RR
+				valid bool
+			}{
+				{"valid", sig, key.key, rrset, true},
+				{"reordered", sig, key.key, []dns.RR{rrset[1], rrset[0]}, true},
+				{"lowercased owner", sig, key.key, mustRRs(t, "www.example. 300 IN A 192.0.2.1", "www.example. 300 IN A 192.0.2.2"), true},
+				{"decremented TTLs", sig, key.key, mustRRs(t, "www.example. 10 IN A 192.0.2.1", "www.example. 10 IN A 192.0.2.2"), true},
+				{"canonical rdata", mxSig, key.key, mustRRs(t, "www.example. 300 IN MX 10 mail.example."), true},
+				{"wildcard expansion", wildcardSig, key.key, mustRRs(t, "a.b.example. 300 IN TXT \"wild\""), true},
+				{"modified rdata", sig, key.key, mustRRs(t, "www.example. 300 IN A 192.0.2.1", "www.example. 300 IN A 192.0.2.3"), false},
+				{"missing record", sig, key.key, rrset[:1], false},
+				{"other key", sig, other.key, rrset, false},
+				{"other signer", modify(func(sig *dns.RRSIG) { sig.SignerName = "other.example." }), key.key, rrset, false},
+				{"other type", sig, key.key, mx, false},
+				{"modified signature", modify(func(sig *dns.RRSIG) {
+					b, _ := base64.StdEncoding.DecodeString(sig.Signature)
+					b[len(b)/2] ^= 1
+					sig.Signature = base64.StdEncoding.EncodeToString(b)
+				}), key.key, rrset, false},
+				{"unsupported algorithm", modify(func(sig *dns.RRSIG) { sig.Algorithm = dns.RSASHA1 }), key.key, rrset, false},
+			}
+			for _, tt := range tests {
+				err := verifySig(tt.sig, tt.key, tt.rrset)
+				if tt.valid && err != nil {
+					t.Errorf("%s: %v", tt.name, err)
+				} else if !tt.valid && err == nil {
+					t.Errorf("%s: invalid signature accepted", tt.name)
+				}
+			}
+		})
+	}
+}
+
+type rrsetKey struct {
+	name   string // in canonical form
+	rrtype uint16
+}
+
+// A testZone is a zone for the DNSSEC tests.  Its sign method adds an NSEC
+// (or NSEC3) chain, and signs each RRset with the zone's key; an unsigned
+// zone has no key.
+type testZone struct {
+	name   string
+	key    *testKey
+	nsec3  bool
+	optOut bool
+
+	rrsets  map[rrsetKey][]dns.RR
+	sigs    map[rrsetKey]*dns.RRSIG
+	denial  []dns.RR          // the NSEC or NSEC3 chain, and its RRSIGs
+	expired map[rrsetKey]bool // the RRsets to sign with expired RRSIGs
+	corrupt map[rrsetKey]bool // the RRsets to sign with invalid RRSIGs
+}
+
+// newTestZone returns a zone with a key of the algorithm, or an unsigned
+// zone if alg is zero.
+func newTestZone(t *testing.T, name string, alg uint8) *testZone {
+	t.Helper()
+	z := &testZone{
+		name:    dns.CanonicalName(name),
+		rrsets:  make(map[rrsetKey][]dns.RR),
+		sigs:    make(map[rrsetKey]*dns.RRSIG),
+		expired: make(map[rrsetKey]bool),
+		corrupt: make(map[rrsetKey]bool),
+	}
+	if alg != 0 {
+		z.key = newTestKey(t, z.name, 257, alg)
+		z.addRRs(z.key.key)
+	}
+	z.add(t, z.name+" 3600 IN SOA ns.example. hostmaster.example. 1 7200 3600 1209600 300")
+	return z
+}
+
+// add adds records in presentation format.
+func (z *testZone) add(t *testing.T, rrs ...string) {
+	t.Helper()
+	z.addRRs(mustRRs(t, rrs...)...)
+}
+
+func (z *testZone) addRRs(rrs ...dns.RR) {
+	for _, rr := range rrs {
+		k := rrsetKey{dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype}
+		z.rrsets[k] = append(z.rrsets[k], rr)
+	}
+}
+
+// delegate adds the NS records of child, and its DS record, with the digest
+// type, if child is signed.
+func (z *testZone) delegate(t *testing.T, child *testZone, digest uint8) {
+	t.Helper()
+	z.add(t, child.name+" 3600 IN NS ns."+child.name)
+	if child.key != nil {
+		z.addRRs(child.key.key.ToDS(digest))
+	}
+}
+
+// isCut returns true if name is a delegation from the zone.
+func (z *testZone) isCut(name string) bool {
+	_, ok := z.rrsets[rrsetKey{name, dns.TypeNS}]
+	return ok && name != z.name
+}
+
+// types returns the owner names of the zone, and the types at each.
+func (z *testZone) types() map[string][]uint16 {
+	names := make(map[string][]uint16)
+	for k := range z.rrsets {
+		names[k.name] = append(names[k.name], k.rrtype)
+	}
+	return names
+}
+
+// sign adds the zone's NSEC or NSEC3 chain, and signs the zone, if it has a
+// key.
+func (z *testZone) sign(t *testing.T) {
+	t.Helper()
+	if z.key == nil {
+		return
+	}
+
+	names := z.types()
+	var owners []string
+	for name := range names {
+		owners = append(owners, name)
+	}
+	slices.SortFunc(owners, canonicalCompare)
+	if z.nsec3 {
+		z.addNSEC3s(names, owners)
+	} else {
+		for i, name := range owners {
+			types := append(slices.Clone(names[name]), dns.TypeRRSIG, dns.TypeNSEC)
+			slices.Sort(types)
+			z.addRRs(&dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: owners[(i+1)%len(owners)],
+				TypeBitMap: types,
+			})
+		}
+	}
+
+	for k, rrset := range z.rrsets {
+		if k.rrtype == dns.TypeNS && z.isCut(k.name) {
+			continue
+		}
+		expiration := time.Now().Add(24 * time.Hour)
+		if z.expired[k] {
+			expiration = time.Now().Add(-time.Minute)
+		}
+		sig := z.key.signPeriod(t, rrset, time.Now().Add(-time.Hour), expiration)
+		if z.corrupt[k] {
+			b, _ := base64.StdEncoding.DecodeString(sig.Signature)
+			b[len(b)/2] ^= 1
+			sig.Signature = base64.StdEncoding.EncodeToString(b)
+		}
+		z.sigs[k] = sig
+		if k.rrtype == dns.TypeNSEC || k.rrtype == dns.TypeNSEC3 {
+			z.denial = append(z.denial, rrset...)
+			z.denial = append(z.denial, sig)
+		}
+	}
+}
+
+// The NSEC3 parameters of the test zones.
+const (
+	testNSEC3Iterations = 1
+	testNSEC3Salt       = "AB"
+)
+
+func (z *testZone) addNSEC3s(names map[string][]uint16, owners []string) {
+	// the empty non-terminals
+	all := slices.Clone(owners)
+	for _, name := range owners {
+		for p := parentName(name); p != z.name && dns.IsSubDomain(z.name, p); p = parentName(p) {
+			if _, ok := names[p]; !ok && !slices.Contains(all, p) {
+				all = append(all, p)
+			}
+		}
+	}
+
+	type hashed struct {
+		hash  string
+		types []uint16
+	}
+	var hashes []hashed
+	for _, name := range all {
+		types := slices.Clone(names[name])
+		insecureCut := z.isCut(name) && !slices.Contains(types, dns.TypeDS)
+		if insecureCut && z.optOut {
+			continue
+		}
+		if len(types) > 0 && !insecureCut {
+			types = append(types, dns.TypeRRSIG)
+		}
+		slices.Sort(types)
+		hashes = append(hashes, hashed{dns.HashName(name, dns.SHA1, testNSEC3Iterations, testNSEC3Salt), types})
+	}
+	slices.SortFunc(hashes, func(a, b hashed) int { return strings.Compare(a.hash, b.hash) })
+
+	var flags uint8
+	if z.optOut {
+		flags = 1
+	}
+	for i, h := range hashes {
+		z.addRRs(&dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(h.hash) + "." + z.name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			Iterations: testNSEC3Iterations,
+			SaltLength: uint8(len(testNSEC3Salt) / 2),
+			Salt:       testNSEC3Salt,
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)].hash,
+			TypeBitMap: h.types,
+		})
+	}
+}
+
+// signed returns the RRset, and its RRSIG, if any.
+func (z *testZone) signed(k rrsetKey) []dns.RR {
+	rrs := slices.Clone(z.rrsets[k])
+	if sig := z.sigs[k]; sig != nil {
+		rrs = append(rrs, sig)
+	}
+	return rrs
+}
+
+// exists returns true if name, or a name below it, has records.
+func (z *testZone) exists(name string) bool {
+	for k := range z.rrsets {
+		if dns.IsSubDomain(name, k.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// answer answers q from the zone, as an authoritative server that sets the
+// DO bit would: a negative response has the SOA record and the whole NSEC or
+// NSEC3 chain, which is more than the denial needs.
+func (z *testZone) answer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+
+	negative := func() *dns.Msg {
+		resp.Ns = append(resp.Ns, z.signed(rrsetKey{z.name, dns.TypeSOA})...)
+		resp.Ns = append(resp.Ns, z.denial...)
+		return resp
+	}
+
+	for _, rrtype := range []uint16{q.Qtype, dns.TypeCNAME} {
+		if _, ok := z.rrsets[rrsetKey{name, rrtype}]; ok {
+			resp.Answer = append(resp.Answer, z.signed(rrsetKey{name, rrtype})...)
+			return resp
+		}
+	}
+	if z.exists(name) {
+		return negative()
+	}
+
+	// the wildcard at the closest encloser
+	ce := parentName(name)
+	for !z.exists(ce) {
+		ce = parentName(ce)
+	}
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	if !z.exists(wildcard) {
+		resp.Rcode = dns.RcodeNameError
+		return negative()
+	}
+	k := rrsetKey{wildcard, q.Qtype}
+	if _, ok := z.rrsets[k]; !ok {
+		k.rrtype = dns.TypeCNAME
+		if _, ok := z.rrsets[k]; !ok {
+			return negative()
+		}
+	}
+	for _, rr := range z.signed(k) {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		resp.Answer = append(resp.Answer, rr)
+	}
+	// the proof that q.Name does not exist
+	resp.Ns = append(resp.Ns, z.denial...)
+	return resp
+}
+
+// A testResolver is a recursive resolver for the DNSSEC tests, which answers
+// each query from the closest zone that it serves; it answers DS queries
+// from the parent zone.  The tamper functions modify the responses to the
+// queries for "name/TYPE".
+type testResolver struct {
+	zones  []*testZone
+	tamper map[string]func(resp *dns.Msg)
+
+	mu      sync.Mutex
+	queries []string // "name/TYPE"
+}
+
+func (r *testResolver) zoneFor(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, z := range r.zones {
+		if !dns.IsSubDomain(z.name, name) || (qtype == dns.TypeDS && z.name == name && name != ".") {
+			continue
+		}
+		if best == nil || dns.CountLabel(z.name) > dns.CountLabel(best.name) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (r *testResolver) serve(w dns.ResponseWriter, req *dns.Msg) {
+	q := dns.CanonicalName(req.Question[0].Name) + "/" + dns.Type(req.Question[0].Qtype).String()
+	r.mu.Lock()
+	r.queries = append(r.queries, q)
+	tamper := r.tamper[q]
+	r.mu.Unlock()
+
+	var resp *dns.Msg
+	if z := r.zoneFor(dns.CanonicalName(req.Question[0].Name), req.Question[0].Qtype); z != nil {
+		resp = z.answer(req)
+	} else {
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeRefused)
+	}
+	resp.Authoritative = false
+	resp.RecursionAvailable = true
+	if tamper != nil {
+		tamper(resp)
+	}
+	w.WriteMsg(resp)
+}
+
+func (r *testResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queries)
+}
+
+// asked returns true if the resolver got a query for q ("name/TYPE").
+func (r *testResolver) asked(q string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Contains(r.queries, q)
+}
+
+// setTamper sets the tamper function for the queries for name and qtype.
+func (r *testResolver) setTamper(name string, qtype uint16, f func(resp *dns.Msg)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tamper == nil {
+		r.tamper = make(map[string]func(resp *dns.Msg))
+	}
+	r.tamper[dns.CanonicalName(name)+"/"+dns.Type(qtype).String()] = f
+}
+
+// start signs the zones, starts the resolver, and returns a transport for
+// it.
+func (r *testResolver) start(t *testing.T) Transport {
+	t.Helper()
+	for _, z := range r.zones {
+		z.sign(t)
+	}
+	// The responses with whole NSEC chains don't fit in UDP.
+	return &Do53TCP{Server: startDNSServer(t, "127.0.0.1:0", r.serve), Timeout: 2 * time.Second}
+}
+
+// newValidatingClient returns a validating client of the transport, with the
+// key of the zone as its trust anchor.
+func newValidatingClient(t *testing.T, tr Transport, anchor *testZone) *Client {
+	t.Helper()
+	store := NewTrustAnchorStore()
+	if err := store.Add(anchor.key.key.ToDS(dns.SHA256)); err != nil {
+		t.Fatal(err)
+	}
+	return &Client{Transport: tr, RD: true, Validate: true, MaxCNAMEs: 8, TrustAnchors: store}
+}
+
+// newTestHierarchy returns the zones of a small signed hierarchy:
+//
+//   - the root, signed with ECDSA P-256
+//   - com., signed with RSA/SHA-256, with NSEC3 and Opt-Out
+//   - example.com., signed with Ed448
+//   - n3.example.com., signed with ECDSA P-384, with NSEC3
+//   - ed.example.com., signed with Ed25519, whose DS uses SHA-384
+//   - insecure.example.com., an unsigned zone
+//   - optout.com., an unsigned zone in the Opt-Out span of com.
+func newTestHierarchy(t *testing.T) map[string]*testZone {
+	t.Helper()
+	zones := map[string]*testZone{
+		".":                     newTestZone(t, ".", dns.ECDSAP256SHA256),
+		"com.":                  newTestZone(t, "com.", dns.RSASHA256),
+		"example.com.":          newTestZone(t, "example.com.", dns.ED448),
+		"n3.example.com.":       newTestZone(t, "n3.example.com.", dns.ECDSAP384SHA384),
+		"ed.example.com.":       newTestZone(t, "ed.example.com.", dns.ED25519),
+		"insecure.example.com.": newTestZone(t, "insecure.example.com.", 0),
+		"optout.com.":           newTestZone(t, "optout.com.", 0),
+	}
+	zones["com."].nsec3, zones["com."].optOut = true, true
+	zones["n3.example.com."].nsec3 = true
+
+	zones["."].delegate(t, zones["com."], dns.SHA256)
+	zones["com."].delegate(t, zones["example.com."], dns.SHA256)
+	zones["com."].delegate(t, zones["optout.com."], 0)
+	zones["example.com."].delegate(t, zones["n3.example.com."], dns.SHA256)
+	zones["example.com."].delegate(t, zones["ed.example.com."], dns.SHA384)
+	zones["example.com."].delegate(t, zones["insecure.example.com."], 0)
+
+	zones["example.com."].add(t,
+		"www.example.com. 300 IN A 192.0.2.1",
+		"alias.example.com. 300 IN CNAME www.n3.example.com.",
+		"a.b.example.com. 300 IN A 192.0.2.2",
+	)
+	zones["n3.example.com."].add(t, "www.n3.example.com. 300 IN A 192.0.2.3")
+	zones["ed.example.com."].add(t, "www.ed.example.com. 300 IN A 192.0.2.4")
+	zones["insecure.example.com."].add(t, "www.insecure.example.com. 300 IN A 198.51.100.1")
+	zones["optout.com."].add(t, "www.optout.com. 300 IN A 198.51.100.2")
+	return zones
+}
+
+func (r *testResolver) addZones(zones map[string]*testZone) {
+	for _, z := range zones {
+		r.zones = append(r.zones, z)
+	}
+}
+
+func TestNameState(t *testing.T) {
+	zones := newTestHierarchy(t)
+	r := &testResolver{}
+	r.addZones(zones)
+	c := newValidatingClient(t, r.start(t), zones["."])
+
+	tests := []struct {
+		name       string
+		wantStatus ValidationStatus
+		wantZone   string
+	}{
+		{"www.example.com.", Secure, "example.com."},
+		{"WWW.Example.COM.", Secure, "example.com."},
+		{"b.example.com.", Secure, "example.com."}, // an empty non-terminal
+		{"a.b.example.com.", Secure, "example.com."},
+		{"nonexistent.example.com.", Secure, "example.com."},
+		{"www.n3.example.com.", Secure, "n3.example.com."},
+		{"www.ed.example.com.", Secure, "ed.example.com."},
+		{"www.insecure.example.com.", Insecure, ""},
+		{"www.optout.com.", Insecure, ""},
+		{"www.example.net.", Secure, "."},
+	}
+	for _, tt := range tests {
+		st := c.nameState(context.Background(), tt.name)
+		if st.status != tt.wantStatus || st.zone != tt.wantZone {
+			t.Errorf("%s: got %v in %q (%s), want %v in %q", tt.name, st.status, st.zone, st.reason, tt.wantStatus, tt.wantZone)
+		}
+	}
+
+	// The states are cached.
+	n := r.count()
+	for _, tt := range tests {
+		c.nameState(context.Background(), tt.name)
+	}
+	if r.count() != n {
+		t.Errorf("cached states took %d more queries", r.count()-n)
+	}
+}
+
+func TestNameStateBrokenChain(t *testing.T) {
+	tests := []struct {
+		name       string
+		modify     func(t *testing.T, zones map[string]*testZone, r *testResolver)
+		qname      string
+		wantStatus ValidationStatus
+	}{
+		{
+			name: "invalid DS signature",
+			modify: func(t *testing.T, zones map[string]*testZone, r *testResolver) {
+				zones["com."].corrupt[rrsetKey{"example.com.", dns.TypeDS}] = true
+			},
+			qname:      "www.example.com.",
+			wantStatus: Bogus,
+		},
+		{
+			name: "expired DNSKEY signature",
+			modify: func(t *testing.T, zones map[string]*testZone, r *testResolver) {
+				zones["n3.example.com."].expired[rrsetKey{"n3.example.com.", dns.TypeDNSKEY}] = true
+			},
+			qname:      "www.n3.example.com.",
+			wantStatus: Bogus,
+		},
+		{
+			name: "DS for another key",
+			modify: func(t *testing.T, zones map[string]*testZone, r *testResolver) {
+				other := newTestKey(t, "ed.example.com.", 257, dns.ED25519)
+				zones["example.com."].rrsets[rrsetKey{"ed.example.com.", dns.TypeDS}] = []dns.RR{other.key.ToDS(dns.SHA256)}
+			},
+			qname:      "www.ed.example.com.",
+			wantStatus: Bogus,
+		},
+		{
+			name: "DS with an unsupported algorithm",
+			modify: func(t *testing.T, zones map[string]*testZone, r *testResolver) {
+				ds := zones["n3.example.com."].key.key.ToDS(dns.SHA256)
+				ds.Algorithm = dns.RSASHA1
+				zones["example.com."].rrsets[rrsetKey{"n3.example.com.", dns.TypeDS}] = []dns.RR{ds}
+			},
+			qname:      "www.n3.example.com.",
+			wantStatus: Insecure,
+		},
+		{
+			name: "DS with an unsupported digest",
+			modify: func(t *testing.T, zones map[string]*testZone, r *testResolver) {
+				ds := zones["n3.example.com."].key.key.ToDS(dns.SHA256)
+				ds.DigestType = dns.GOST94
+				zones["example.com."].rrsets[rrsetKey{"n3.example.com.", dns.TypeDS}] = []dns.RR{ds}
+			},
+			qname:      "www.n3.example.com.",
+			wantStatus: Insecure,
+		},
+		{
+			name: "unsigned denial of DS",
+			modify: func(t *testing.T, zones map[string]*testZone, r *testResolver) {
+				r.setTamper("insecure.example.com.", dns.TypeDS, func(resp *dns.Msg) {
+					resp.Ns = slices.DeleteFunc(resp.Ns, func(rr dns.RR) bool { return rr.Header().Rrtype == dns.TypeRRSIG })
+				})
+			},
+			qname:      "www.insecure.example.com.",
+			wantStatus: Bogus,
+		},
+		{
+			name: "missing denial of DS",
+			modify: func(t *testing.T, zones map[string]*testZone, r *testResolver) {
+				r.setTamper("insecure.example.com.", dns.TypeDS, func(resp *dns.Msg) { resp.Ns = nil })
+			},
+			qname:      "www.insecure.example.com.",
+			wantStatus: Bogus,
+		},
+		{
+			name: "DNSKEY lookup fails",
+			modify: func(t *testing.T, zones map[string]*testZone, r *testResolver) {
+				r.setTamper("ed.example.com.", dns.TypeDNSKEY, func(resp *dns.Msg) {
+					resp.Rcode = dns.RcodeServerFailure
+					resp.Answer = nil
+				})
+			},
+			qname:      "www.ed.example.com.",
+			wantStatus: Bogus,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zones := newTestHierarchy(t)
+			r := &testResolver{}
+			r.addZones(zones)
+			tt.modify(t, zones, r)
+			c := newValidatingClient(t, r.start(t), zones["."])
+
+			st := c.nameState(context.Background(), tt.qname)
+			if st.status != tt.wantStatus {
+				t.Errorf("got %v (%s), want %v", st.status, st.reason, tt.wantStatus)
+			}
+			if st.status != Secure && st.reason == "" {
+				t.Errorf("no reason for %v", st.status)
+			}
+			// The parent is unaffected.
+			if st := c.nameState(context.Background(), "www.example.com."); st.status != Secure && tt.qname != "www.example.com." {
+				t.Errorf("parent zone is %v (%s)", st.status, st.reason)
+			}
+		})
+	}
+}
+
+func TestNameStateTrustAnchors(t *testing.T) {
+	zones := newTestHierarchy(t)
+	r := &testResolver{}
+	r.addZones(zones)
+	tr := r.start(t)
+
+	// a trust anchor for example.com. alone
+	store := NewTrustAnchorStore()
+	if err := store.Add(zones["example.com."].key.key); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Transport: tr, RD: true, Validate: true, TrustAnchors: store}
+	for name, want := range map[string]ValidationStatus{
+		"www.example.com.":    Secure,
+		"www.n3.example.com.": Secure,
+		"www.optout.com.":     Indeterminate,
+		"com.":                Indeterminate,
+	} {
+		if st := c.nameState(context.Background(), name); st.status != want {
+			t.Errorf("%s: got %v (%s), want %v", name, st.status, st.reason, want)
+		}
+	}
+	// The chain of trust starts at the anchor.
+	for _, q := range []string{"./DNSKEY", "example.com./DS"} {
+		if r.asked(q) {
+			t.Errorf("client asked for %s, above the trust anchor", q)
+		}
+	}
+
+	// a negative trust anchor below the positive one
+	store.AddNegative("n3.example.com.", 0)
+	if st := c.nameState(context.Background(), "www.n3.example.com."); st.status != Insecure {
+		t.Errorf("got %v under a negative trust anchor, want %v", st.status, Insecure)
+	}
+	store.RemoveNegative("n3.example.com.")
+	if st := c.nameState(context.Background(), "www.n3.example.com."); st.status != Secure {
+		t.Errorf("got %v after removing the negative trust anchor, want %v", st.status, Secure)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	zones := newTestHierarchy(t)
+	zones["example.com."].add(t,
+		"unsigned.example.com. 300 IN A 192.0.2.5",
+		"corrupt.example.com. 300 IN A 192.0.2.6",
+	)
+	zones["example.com."].corrupt[rrsetKey{"corrupt.example.com.", dns.TypeA}] = true
+	r := &testResolver{}
+	r.addZones(zones)
+	r.setTamper("unsigned.example.com.", dns.TypeA, func(resp *dns.Msg) {
+		resp.Answer = slices.DeleteFunc(resp.Answer, func(rr dns.RR) bool { return rr.Header().Rrtype == dns.TypeRRSIG })
+	})
+	r.setTamper("forged.n3.example.com.", dns.TypeA, func(resp *dns.Msg) {
+		resp.Rcode = dns.RcodeSuccess
+		resp.Ns = nil
+		resp.Answer = mustRRs(t, "forged.n3.example.com. 300 IN A 192.0.2.66")
+		resp.Answer = append(resp.Answer, zones["n3.example.com."].sigs[rrsetKey{"www.n3.example.com.", dns.TypeA}])
+	})
+	c := newValidatingClient(t, r.start(t), zones["."])
+
+	tests := []struct {
+		name        string
+		wantStatus  ValidationStatus
+		wantAnswers int
+	}{
+		{"www.example.com.", Secure, 1},
+		{"alias.example.com.", Secure, 1}, // the client follows the CNAME into n3.example.com.
+		{"www.insecure.example.com.", Insecure, 1},
+		{"www.optout.com.", Insecure, 1},
+		{"unsigned.example.com.", Bogus, 1},
+		{"corrupt.example.com.", Bogus, 1},
+		{"forged.n3.example.com.", Bogus, 1},
+	}
+	for _, tt := range tests {
+		info := new(ExchangeInfo)
+		resp, err := c.LookupContext(WithExchangeInfo(context.Background(), info), tt.name, dns.TypeA)
+		if info.Validation != tt.wantStatus {
+			t.Errorf("%s: got %v (%s), want %v", tt.name, info.Validation, info.ValidationReason, tt.wantStatus)
+		}
+		if tt.wantStatus == Bogus {
+			var verr *ValidationError
+			if !errors.Is(err, ErrBogus) || !errors.As(err, &verr) {
+				t.Errorf("%s: got error %v, want a ValidationError", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if resp.AuthenticatedData != (tt.wantStatus == Secure) {
+			t.Errorf("%s: AD bit is %v for a %v response", tt.name, resp.AuthenticatedData, tt.wantStatus)
+		}
+		if n := len(CollectRRs[*dns.A](resp.Answer)) + len(CollectRRs[*dns.CNAME](resp.Answer)); n != tt.wantAnswers {
+			t.Errorf("%s: got %d answers, want %d", tt.name, n, tt.wantAnswers)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package resolv
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -16,13 +17,36 @@ type Do53TCP struct {
 	Timeout  time.Duration
 	KeepOpen bool
 
+	// Pipeline queries over one connection that all goroutines share (RFC
+	// 7766, Section 6.2.1.1).  The transport sends each query as soon as
+	// the caller issues it, without waiting for the responses to earlier
+	// queries, and matches the responses (which may arrive out of order) to
+	// the queries by message ID.  If the connection closes while queries are
+	// waiting for responses, the transport reconnects and re-sends them.  In
+	// this mode, the connection stays open until Close (regardless of
+	// KeepOpen, but see Keepalive), and the transport is safe for concurrent
+	// use.
+	Pipeline bool
+
+	// Send the EDNS0 TCP Keepalive option (RFC 7828) in queries.  With
+	// KeepOpen or Pipeline, the transport honors the idle timeout that the
+	// server returns: it opens a new connection, rather than reuse one that
+	// the server is about to close, and closes the connection if the
+	// server's timeout is 0 (in Pipeline mode, once no queries are waiting
+	// for responses on it).
+	Keepalive bool
+
 	client *dns.Client
 	conn   *dns.Conn
-}
 
-func (t *Do53TCP) dial() error {
-	var err error
+	// When the server will close the idle connection, per the server's
+	// EDNS0 TCP Keepalive option (zero if unknown).
+	idleDeadline time.Time
 
+	mux lazyMux
+}
+
+func (t *Do53TCP) newDNSClient() (*dns.Client, error) {
 	net := "tcp"
 	if t.IPv4Only {
 		net = "tcp4"
@@ -31,31 +55,107 @@ func (t *Do53TCP) dial() error {
 		net = "tcp6"
 	}
 
-	t.client = &dns.Client{
+	return &dns.Client{
 		Net:     net,
 		Timeout: t.Timeout,
+	}, nil
+}
+
+func (t *Do53TCP) dial(ctx context.Context) error {
+	var err error
+
+	t.client, err = t.newDNSClient()
+	if err != nil {
+		return err
 	}
 
-	t.conn, err = t.client.Dial(t.Server)
+	t.conn, err = t.client.DialContext(ctx, t.Server)
 	if err != nil {
-		return fmt.Errorf("failed to connect to DNS server %s: %w", t.Server, err)
+		return fmt.Errorf("failed to connect to DNS server %s: %w", t.Server, ctxError(ctx, err))
 	}
 	return nil
 }
 
+func (t *Do53TCP) getMux() *muxConn {
+	return t.mux.get(t.newDNSClient, t.Server, t.Timeout, t.Keepalive)
+}
+
 func (t *Do53TCP) isConnected() bool {
 	return t.conn != nil
 }
 
+// idleExpired returns true if the server is about to close the idle
+// connection, as per the idle timeout in the server's last response.
+func (t *Do53TCP) idleExpired() bool {
+	if t.idleDeadline.IsZero() {
+		return false
+	}
+	return time.Now().Add(KeepaliveMargin).After(t.idleDeadline)
+}
+
+// checkHealth implements the [DefaultHealthCheck] of a [Pool].
+func (t *Do53TCP) checkHealth() error {
+	if t.Pipeline || !t.isConnected() {
+		return nil
+	}
+	if t.idleExpired() {
+		return errors.New("server is about to close the idle connection")
+	}
+	return connAlive(t.conn.Conn)
+}
+
+// noteKeepalive records the idle timeout that the server returned in resp.
+func (t *Do53TCP) noteKeepalive(resp *dns.Msg) {
+	timeout, ok := edns0Keepalive(resp)
+	if !ok {
+		return
+	}
+	if timeout == 0 {
+		// the server wants us to close the connection
+		t.Close()
+		return
+	}
+	t.idleDeadline = time.Now().Add(timeout)
+}
+
 func (t *Do53TCP) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return t.ExchangeContext(context.Background(), req)
+}
+
+func (t *Do53TCP) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if t.Keepalive {
+		req = req.Copy()
+		AddEDNS0Keepalive(req)
+	}
+
+	return withCookies(ctx, t.Server, req, func(req *dns.Msg) (*dns.Msg, error) {
+		return t.exchange(ctx, req)
+	})
+}
+
+func (t *Do53TCP) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
 	var err error
 	var reused bool
 	var retried bool
 	var resp *dns.Msg
+	var rtt time.Duration
+
+	if t.Pipeline {
+		start := time.Now()
+		resp, err = t.getMux().Exchange(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		noteExchange(ctx, t.Server, "tcp", time.Since(start), packedLen(resp))
+		return resp, nil
+	}
 
 reconnect:
+	if t.isConnected() && t.idleExpired() {
+		t.Close()
+	}
 	if !t.isConnected() {
-		err = t.dial()
+		err = t.dial(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -63,24 +163,35 @@ reconnect:
 		reused = true
 	}
 
-	resp, _, err = t.client.ExchangeWithConn(req, t.conn)
+	stop := watchConn(ctx, t.conn)
+	resp, rtt, err = t.client.ExchangeWithConnContext(ctx, req, t.conn)
+	stop()
 	if !t.KeepOpen {
 		t.Close()
 	}
 
 	if err == nil {
+		if t.Keepalive && t.isConnected() {
+			t.noteKeepalive(resp)
+		}
+		noteExchange(ctx, t.Server, "tcp", rtt, packedLen(resp))
 		return resp, nil
 	}
 
+	// A failed exchange leaves the connection in an unknown state (e.g., a
+	// late response to this query might still arrive), so don't reuse it.
+	t.Close()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// If the server closed the connection on us rather than returning a
+	// response, and we were reusing an already established connection, try
+	// once to reconnect and resend the query.
 	if !errors.Is(err, io.EOF) {
 		return nil, err
 	}
-
-	// The server closed the connection on us rather than returning a response
-	t.Close()
-
-	// If we were reusing an already established connection, try once to
-	// reconnect and resend the query.
 	if reused && !retried {
 		retried = true
 		goto reconnect
@@ -90,10 +201,15 @@ reconnect:
 }
 
 func (t *Do53TCP) Close() error {
+	if t.Pipeline {
+		return t.getMux().Close()
+	}
+
 	if t.conn == nil {
 		return nil // XXX: should we instead return an error?
 	}
 	err := t.conn.Close()
 	t.conn = nil
+	t.idleDeadline = time.Time{}
 	return err
 }
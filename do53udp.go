@@ -1,26 +1,99 @@
 package resolv
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// A RetryPolicy determines how a [Do53UDP] transport retries a query when no
+// response arrives, as stub resolvers do (e.g., the attempts and timeout
+// options of resolv.conf).  Each attempt uses a new message ID and a new
+// socket (and thus a new source port), so that a late response to an earlier
+// attempt does not count as the response to the current attempt.
+type RetryPolicy struct {
+	// The maximum number of times to send the query.  If zero, the
+	// transport sends the query once.
+	Attempts int
+
+	// How long each attempt waits for a response.  If zero, each attempt
+	// waits for the transport's Timeout.
+	AttemptTimeout time.Duration
+
+	// How long to wait before the second attempt.  The wait doubles before
+	// each later attempt, up to MaxBackoff (if non-zero), and the transport
+	// randomizes each wait to between half and all of its nominal length, so
+	// that many clients that lose responses at the same time do not retry in
+	// lockstep.  If zero, the transport retries immediately.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// backoff returns how long to wait before the given attempt (counting from
+// 0).
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	if p.Backoff <= 0 || attempt == 0 {
+		return 0
+	}
+
+	d := p.Backoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
 type Do53UDP struct {
-	Server           string
-	IPv4Only         bool
-	IPv6Only         bool
-	Timeout          time.Duration
-	UDPBufSize       int
+	Server   string
+	IPv4Only bool
+	IPv6Only bool
+	Timeout  time.Duration
+
+	// The EDNS0 UDP payload size to advertise in queries.  If non-zero, the
+	// transport sets this size in the query's OPT record (adding an OPT
+	// record, if the query does not have one).  If zero, the transport
+	// sends the query as is.  Sizes larger than [DefaultUDPBufSize] risk
+	// IP fragmentation of the responses.
+	UDPBufSize int
+
+	// If a UDP response is truncated, and RetryUDPBufSize is larger than the
+	// size the query advertised, the transport first retries the query over
+	// UDP, advertising RetryUDPBufSize, before falling back to TCP.
+	RetryUDPBufSize int
+
+	// Return truncated responses rather than re-sending the query over TCP.
 	IgnoreTruncation bool
 
+	// How to retry a query when no response arrives.  The zero value sends
+	// each query once.  The transport records the number of attempts in
+	// the context's [ExchangeInfo].
+	Retry RetryPolicy
+
+	// The transport for the fallback to TCP after a truncated response, for
+	// settings of the TCP exchange such as Keepalive (the Server should
+	// match).  If nil, the transport falls back to a [Do53TCP] with the same
+	// Server, IPv4Only, and IPv6Only settings, and a Timeout of one attempt
+	// (the Retry policy's AttemptTimeout, or else Timeout).  Either way, the
+	// fallback sends the same DNS Cookies as the UDP exchange.
+	TCP *Do53TCP
+
 	client *dns.Client
 	conn   *dns.Conn
 }
 
-func (t *Do53UDP) dial() error {
+func (t *Do53UDP) dial(ctx context.Context, timeout time.Duration) error {
 	var err error
 
 	net := "udp"
@@ -33,46 +106,145 @@ func (t *Do53UDP) dial() error {
 
 	t.client = &dns.Client{
 		Net:     net,
-		Timeout: t.Timeout,
+		Timeout: timeout,
 	}
 
-	t.conn, err = t.client.Dial(t.Server)
+	t.conn, err = t.client.DialContext(ctx, t.Server)
 	if err != nil {
-		return fmt.Errorf("failed to connect to DNS server %s: %w", t.Server, err)
+		return fmt.Errorf("failed to connect to DNS server %s: %w", t.Server, ctxError(ctx, err))
 	}
 	return nil
 }
 
 func (t *Do53UDP) Exchange(req *dns.Msg) (*dns.Msg, error) {
-	var err error
-	var resp *dns.Msg
+	return t.ExchangeContext(context.Background(), req)
+}
+
+// attemptTimeout returns how long each attempt waits for a response.
+func (t *Do53UDP) attemptTimeout() time.Duration {
+	if t.Retry.AttemptTimeout > 0 {
+		return t.Retry.AttemptTimeout
+	}
+	return t.Timeout
+}
+
+// tcp returns the transport for the fallback to TCP.
+func (t *Do53UDP) tcp() *Do53TCP {
+	if t.TCP != nil {
+		return t.TCP
+	}
+	return &Do53TCP{
+		Server:   t.Server,
+		IPv4Only: t.IPv4Only,
+		IPv6Only: t.IPv6Only,
+		Timeout:  t.attemptTimeout(),
+	}
+}
+
+// exchangeOnce performs one attempt of an exchange over UDP.
+func (t *Do53UDP) exchangeOnce(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
 	// even though this is UDP, from an API perspective, we still have to call dial
-	err = t.dial()
+	err := t.dial(ctx, t.attemptTimeout())
 	if err != nil {
 		return nil, err
 	}
 
-	resp, _, err = t.client.ExchangeWithConn(req, t.conn)
+	stop := watchConn(ctx, t.conn)
+	resp, rtt, err := t.client.ExchangeWithConnContext(ctx, req, t.conn)
+	stop()
+	t.closeConn()
+	if err != nil {
+		return nil, ctxError(ctx, err)
+	}
+	noteExchange(ctx, t.Server, "udp", rtt, packedLen(resp))
+	return resp, nil
+}
+
+// exchangeUDP performs one exchange over UDP, retrying as per the transport's
+// RetryPolicy if the response times out.
+func (t *Do53UDP) exchangeUDP(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	info := exchangeInfoFrom(ctx)
+	attempts := max(t.Retry.Attempts, 1)
+
+	return withCookies(ctx, t.Server, req, func(req *dns.Msg) (*dns.Msg, error) {
+		for i := 0; ; i++ {
+			if wait := t.Retry.backoff(i); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				}
+			}
+
+			m := req
+			if i > 0 {
+				m = req.Copy()
+				m.Id = dns.Id()
+			}
+
+			info.Attempts++
+			resp, err := t.exchangeOnce(ctx, m)
+			if err == nil {
+				resp.Id = req.Id
+				return resp, nil
+			}
+			if i+1 >= attempts || ctx.Err() != nil || !isTimeout(err) {
+				return nil, err
+			}
+		}
+	})
+}
+
+func (t *Do53UDP) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	info := exchangeInfoFrom(ctx)
+	info.Attempts = 0
+
+	if t.UDPBufSize != 0 {
+		req = withUDPBufSize(req, uint16(t.UDPBufSize))
+	}
+
+	resp, err := t.exchangeUDP(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.Truncated && !t.IgnoreTruncation && t.RetryUDPBufSize > int(udpBufSize(req)) {
+		req = withUDPBufSize(req, uint16(t.RetryUDPBufSize))
+		resp, err = t.exchangeUDP(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if resp.Truncated && !t.IgnoreTruncation {
-		// TODO: we could first try a larger UDP size before falling back to TCP
 		log.Printf("truncated response for req %v, retrying over TCP", req)
-		tcp := &Do53TCP{
-			Server:   t.Server,
-			IPv4Only: t.IPv4Only,
-			IPv6Only: t.IPv6Only,
-			Timeout:  t.Timeout,
-			KeepOpen: false,
-		}
-		return tcp.Exchange(req)
+		info.UDPBufSize = 0
+		info.TCPFallback = true
+		return t.tcp().ExchangeContext(ctx, req)
 	}
 
+	info.UDPBufSize = udpBufSize(req)
 	return resp, nil
 }
 
+func (t *Do53UDP) closeConn() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// Close closes the transport's socket, and the TCP transport, if any.
 func (t *Do53UDP) Close() error {
-	return nil
+	err := t.closeConn()
+	if t.TCP != nil {
+		if tcpErr := t.TCP.Close(); err == nil {
+			err = tcpErr
+		}
+	}
+	return err
 }
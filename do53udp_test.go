@@ -0,0 +1,277 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 500 * time.Millisecond}
+	nominal := []time.Duration{0, 100, 200, 400, 500, 500, 500}
+	for attempt, d := range nominal {
+		d *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			got := p.backoff(attempt)
+			if got < d/2 || got > d {
+				t.Fatalf("attempt %d: backoff %v, want between %v and %v", attempt, got, d/2, d)
+			}
+		}
+	}
+
+	p = RetryPolicy{Backoff: time.Second}
+	if got := p.backoff(20); got < time.Second<<18 {
+		t.Errorf("backoff without MaxBackoff stopped growing: %v", got)
+	}
+	p = RetryPolicy{}
+	if got := p.backoff(3); got != 0 {
+		t.Errorf("zero policy: backoff %v, want 0", got)
+	}
+}
+
+// A udpTestServer is a Do53 server that drops the first drop queries over
+// UDP, and records the ID of each query.  If truncate is set, the server
+// answers UDP queries with an empty, truncated response.  The server
+// supports DNS Cookies, with the server cookie testServerCookie.
+type udpTestServer struct {
+	addr     string
+	drop     int
+	truncate bool
+
+	mu      sync.Mutex
+	ids     []uint16
+	tcpReqs []*dns.Msg
+}
+
+var testServerCookie = []byte("server-cookie-1!")
+
+func newUDPTestServer(t *testing.T, drop int, truncate bool) *udpTestServer {
+	s := &udpTestServer{drop: drop, truncate: truncate}
+	s.addr = startDNSServer(t, "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		s.mu.Lock()
+		if w.LocalAddr().Network() == "tcp" {
+			s.tcpReqs = append(s.tcpReqs, req)
+			s.mu.Unlock()
+			w.WriteMsg(withTestCookie(req, testAnswer(req)))
+			return
+		}
+		s.ids = append(s.ids, req.Id)
+		n := len(s.ids)
+		s.mu.Unlock()
+
+		if n <= s.drop {
+			return
+		}
+		if s.truncate {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Truncated = true
+			w.WriteMsg(withTestCookie(req, resp))
+			return
+		}
+		w.WriteMsg(withTestCookie(req, testAnswer(req)))
+	})
+	return s
+}
+
+// withTestCookie adds a cookie to resp, with the client cookie of req and
+// testServerCookie, if req has a cookie.
+func withTestCookie(req, resp *dns.Msg) *dns.Msg {
+	data, ok := edns0Cookie(req)
+	if ok && len(data) >= clientCookieLen {
+		AddEDNS0Cookie(resp, data[:clientCookieLen], testServerCookie)
+	}
+	return resp
+}
+
+func TestDo53UDPRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		drop     int
+		attempts int
+		wantErr  bool
+	}{
+		{"no loss", 0, 3, false},
+		{"one lost", 1, 3, false},
+		{"two lost", 2, 3, false},
+		{"all lost", 3, 3, true},
+		{"no retries", 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newUDPTestServer(t, tt.drop, false)
+			tr := &Do53UDP{
+				Server:  s.addr,
+				Timeout: 5 * time.Second,
+				Retry: RetryPolicy{
+					Attempts:       tt.attempts,
+					AttemptTimeout: 50 * time.Millisecond,
+					Backoff:        10 * time.Millisecond,
+				},
+			}
+			defer tr.Close()
+
+			info := new(ExchangeInfo)
+			req := new(dns.Msg)
+			req.SetQuestion("example.", dns.TypeTXT)
+			start := time.Now()
+			resp, err := tr.ExchangeContext(WithExchangeInfo(context.Background(), info), req)
+			if tt.wantErr {
+				if !isTimeout(err) {
+					t.Fatalf("got %v, want a timeout", err)
+				}
+				if d := time.Since(start); d > 2*time.Second {
+					t.Errorf("exchange took %v; AttemptTimeout not applied", d)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The response has the caller's ID, whichever attempt
+				// produced it.
+				checkTestAnswer(t, resp, "example.", req.Id)
+			}
+
+			wantAttempts := min(tt.drop+1, max(tt.attempts, 1))
+			if info.Attempts != wantAttempts {
+				t.Errorf("ExchangeInfo has %d attempts, want %d", info.Attempts, wantAttempts)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if len(s.ids) != wantAttempts {
+				t.Fatalf("server got %d queries, want %d", len(s.ids), wantAttempts)
+			}
+			// Each attempt has a new ID.
+			seen := make(map[uint16]bool)
+			for _, id := range s.ids {
+				if seen[id] {
+					t.Errorf("ID %d sent twice", id)
+				}
+				seen[id] = true
+			}
+			if s.ids[0] != req.Id {
+				t.Errorf("first attempt has ID %d, want %d", s.ids[0], req.Id)
+			}
+		})
+	}
+}
+
+func TestDo53UDPRetryOnlyOnTimeout(t *testing.T) {
+	// Nothing listens on the port, so the exchange fails with "connection
+	// refused" rather than a timeout.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	tr := &Do53UDP{
+		Server:  addr,
+		Timeout: time.Second,
+		Retry:   RetryPolicy{Attempts: 3},
+	}
+	info := new(ExchangeInfo)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeTXT)
+	_, err = tr.ExchangeContext(WithExchangeInfo(context.Background(), info), req)
+	if err == nil || isTimeout(err) {
+		t.Fatalf("got %v, want a failure other than a timeout", err)
+	}
+	if info.Attempts != 1 {
+		t.Errorf("made %d attempts, want 1", info.Attempts)
+	}
+}
+
+func TestDo53UDPRetryCanceled(t *testing.T) {
+	s := newUDPTestServer(t, 10, false)
+	tr := &Do53UDP{
+		Server:  s.addr,
+		Timeout: time.Second,
+		Retry:   RetryPolicy{Attempts: 10, AttemptTimeout: 20 * time.Millisecond, Backoff: time.Hour},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeTXT)
+	start := time.Now()
+	if _, err := tr.ExchangeContext(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("backoff ignored the context: exchange took %v", d)
+	}
+}
+
+func TestDo53UDPTCPFallback(t *testing.T) {
+	s := newUDPTestServer(t, 0, true)
+
+	tcp := &Do53TCP{Server: s.addr, Timeout: time.Second, Keepalive: true}
+	tr := &Do53UDP{Server: s.addr, Timeout: time.Second, TCP: tcp}
+	defer tr.Close()
+
+	jar := newCookieJar()
+	info := new(ExchangeInfo)
+	ctx := WithExchangeInfo(withCookieJar(context.Background(), jar), info)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeTXT)
+	resp, err := tr.ExchangeContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestAnswer(t, resp, "example.", req.Id)
+	if !info.TCPFallback || info.Protocol != "tcp" {
+		t.Errorf("got ExchangeInfo %+v, want a TCP fallback", info)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tcpReqs) != 1 {
+		t.Fatalf("server got %d TCP queries, want 1", len(s.tcpReqs))
+	}
+	tcpReq := s.tcpReqs[0]
+	if _, ok := edns0Keepalive(tcpReq); !ok {
+		t.Errorf("TCP query has no Keepalive option")
+	}
+	// The TCP query echoes the server cookie from the UDP response.
+	data, _ := edns0Cookie(tcpReq)
+	client, _ := jar.get(s.addr)
+	if want := cookieData(client, testServerCookie); string(data) != string(want) {
+		t.Errorf("TCP query has cookie %x, want %x", data, want)
+	}
+}
+
+func TestDo53UDPTCPFallbackTimeout(t *testing.T) {
+	// The server truncates over UDP, and is slow over TCP.
+	addr := startDNSServer(t, "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		if w.LocalAddr().Network() == "tcp" {
+			time.Sleep(time.Second)
+			w.WriteMsg(testAnswer(req))
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Truncated = true
+		w.WriteMsg(resp)
+	})
+	tr := &Do53UDP{
+		Server:  addr,
+		Timeout: 10 * time.Second,
+		Retry:   RetryPolicy{Attempts: 2, AttemptTimeout: 100 * time.Millisecond},
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeTXT)
+	start := time.Now()
+	if _, err := tr.Exchange(req); !isTimeout(err) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 800*time.Millisecond {
+		t.Errorf("TCP fallback took %v; AttemptTimeout not applied", d)
+	}
+}
@@ -0,0 +1,217 @@
+package resolv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The response of the DoH JSON API, as documented for Google Public DNS
+// (https://developers.google.com/speed/public-dns/docs/doh/json) and
+// Cloudflare's 1.1.1.1.
+type jsonResponse struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []jsonQuestion
+	Answer     []jsonRR
+	Authority  []jsonRR
+	Additional []jsonRR
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+func (t *DoH) newJSONRequest(ctx context.Context, req *dns.Msg) (*http.Request, error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("the DoH JSON API requires exactly one question; query has %d", len(req.Question))
+	}
+	q := req.Question[0]
+
+	params := url.Values{}
+	params.Set("name", q.Name)
+	params.Set("type", strconv.Itoa(int(q.Qtype)))
+	if req.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		if opt.Do() {
+			params.Set("do", "1")
+		}
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				params.Set("edns_client_subnet", fmt.Sprintf("%v/%d", e.Address, e.SourceNetmask))
+			}
+		}
+	}
+
+	urlStr := fmt.Sprintf("%s?%s", t.ServerURL, params.Encode())
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "application/dns-json")
+	return httpReq, nil
+}
+
+// newRRFromJSON converts a resource record in a JSON response to a dns.RR.
+// The record's data is in presentation format (RFC 1035, Section 5.1; RFC
+// 3597, Section 5 for unknown types), except that some servers don't quote
+// TXT strings.
+func newRRFromJSON(jrr *jsonRR) (dns.RR, error) {
+	name := dns.Fqdn(jrr.Name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid owner name %q", jrr.Name)
+	}
+	hdr := dns.RR_Header{Name: name, Rrtype: jrr.Type, Class: dns.ClassINET, Ttl: jrr.TTL}
+
+	if (jrr.Type == dns.TypeTXT || jrr.Type == dns.TypeSPF) && !strings.HasPrefix(jrr.Data, "\"") {
+		txt := splitTXT(jrr.Data)
+		if jrr.Type == dns.TypeSPF {
+			return &dns.SPF{Hdr: hdr, Txt: txt}, nil
+		}
+		return &dns.TXT{Hdr: hdr, Txt: txt}, nil
+	}
+
+	// Parse only the data, with a placeholder owner name, so that the owner
+	// name can't confuse the parser.
+	typ := dns.Type(jrr.Type).String()
+	if strings.ContainsAny(jrr.Data, "\n\r") {
+		return nil, fmt.Errorf("invalid data for %s %s: %q", jrr.Name, typ, jrr.Data)
+	}
+	rr, err := dns.NewRR(fmt.Sprintf(". 0 IN %s %s", typ, jrr.Data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data for %s %s: %w", jrr.Name, typ, err)
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("empty resource record data for %s %s", jrr.Name, typ)
+	}
+	if rr.Header().Rrtype != jrr.Type {
+		return nil, fmt.Errorf("invalid data for %s %s: %q", jrr.Name, typ, jrr.Data)
+	}
+	rr.Header().Name = hdr.Name
+	rr.Header().Ttl = hdr.Ttl
+	return rr, nil
+}
+
+// splitTXT splits the unquoted text s into TXT character-strings of at most
+// 255 bytes each, escaped as dns.TXT expects.
+func splitTXT(s string) []string {
+	const maxLen = 255
+
+	if s == "" {
+		return []string{""}
+	}
+	var txt []string
+	for len(s) > 0 {
+		n := min(len(s), maxLen)
+		txt = append(txt, escapeTXT(s[:n]))
+		s = s[n:]
+	}
+	return txt
+}
+
+// escapeTXT escapes the quotes, backslashes, and unprintable bytes in s, as
+// in a quoted character-string in presentation format.
+func escapeTXT(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func newRRsFromJSON(jrrs []jsonRR) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for i := range jrrs {
+		rr, err := newRRFromJSON(&jrrs[i])
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// newMsgFromJSON converts the JSON response to the query req to a DNS
+// message.
+func newMsgFromJSON(req *dns.Msg, jresp *jsonResponse) (*dns.Msg, error) {
+	var err error
+
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Rcode = jresp.Status
+	reply.Truncated = jresp.TC
+	reply.RecursionDesired = jresp.RD
+	reply.RecursionAvailable = jresp.RA
+	reply.AuthenticatedData = jresp.AD
+	reply.CheckingDisabled = jresp.CD
+
+	reply.Answer, err = newRRsFromJSON(jresp.Answer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid record in answer section: %w", err)
+	}
+	reply.Ns, err = newRRsFromJSON(jresp.Authority)
+	if err != nil {
+		return nil, fmt.Errorf("invalid record in authority section: %w", err)
+	}
+	reply.Extra, err = newRRsFromJSON(jresp.Additional)
+	if err != nil {
+		return nil, fmt.Errorf("invalid record in additional section: %w", err)
+	}
+
+	return reply, nil
+}
+
+func (t *DoH) exchangeJSON(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	httpReq, err := t.newJSONRequest(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Some servers label the JSON with the generic JSON media type.
+	body, age, err := t.do(ctx, httpReq, "application/dns-json", "application/json")
+	if err != nil {
+		return nil, err
+	}
+
+	var jresp jsonResponse
+	err = json.Unmarshal(body, &jresp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JSON response: %w", err)
+	}
+
+	reply, err := newMsgFromJSON(req, &jresp)
+	if err != nil {
+		return nil, err
+	}
+	decrementTTLs(reply, age)
+	return reply, nil
+}
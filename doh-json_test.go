@@ -0,0 +1,183 @@
+package resolv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newJSONServer returns a DoH transport that uses the JSON API of an
+// httptest server.  The server answers a query of type qtype with the
+// records in answers[qtype], and records the query parameters in params.
+func newJSONServer(t *testing.T, answers map[uint16][]jsonRR, params *[]string) *DoH {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Header.Get("Accept") != "application/dns-json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		*params = append(*params, q.Encode())
+		qtype, err := strconv.Atoi(q.Get("type"))
+		if err != nil {
+			http.Error(w, "bad type", http.StatusBadRequest)
+			return
+		}
+		jresp := jsonResponse{
+			RD:       true,
+			RA:       true,
+			AD:       q.Get("do") == "1",
+			Question: []jsonQuestion{{Name: q.Get("name"), Type: uint16(qtype)}},
+			Answer:   answers[uint16(qtype)],
+		}
+		w.Header().Set("Content-Type", "application/dns-json")
+		json.NewEncoder(w).Encode(&jresp)
+	}))
+	t.Cleanup(srv.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return &DoH{ServerURL: srv.URL + "/resolve", UseJSON: true, TLSConfig: &tls.Config{RootCAs: pool}}
+}
+
+func TestDoHJSON(t *testing.T) {
+	const name = "example.com."
+	long := strings.Repeat("x", 300)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		data  string
+		want  string // the record as miekg/dns prints it
+	}{
+		{"A", dns.TypeA, "192.0.2.1", "example.com.\t300\tIN\tA\t192.0.2.1"},
+		{"TXT unquoted", dns.TypeTXT, "v=spf1 -all", `example.com.	300	IN	TXT	"v=spf1 -all"`},
+		{"TXT unquoted with quote", dns.TypeTXT, `say "hi"; \o/`, `example.com.	300	IN	TXT	"say \"hi\"; \\o/"`},
+		{"TXT unquoted long", dns.TypeTXT, long, `example.com.	300	IN	TXT	"` + long[:255] + `" "` + long[255:] + `"`},
+		{"TXT quoted", dns.TypeTXT, `"v=spf1 -all"`, `example.com.	300	IN	TXT	"v=spf1 -all"`},
+		{"TXT multiple strings", dns.TypeTXT, `"part one" "part two"`, `example.com.	300	IN	TXT	"part one" "part two"`},
+		{"TXT escaped", dns.TypeTXT, `"a \"quote\"; not a comment" "\195\169"`, `example.com.	300	IN	TXT	"a \"quote\"; not a comment" "\195\169"`},
+		{"CAA", dns.TypeCAA, `0 issue "letsencrypt.org; validationmethods=dns-01"`, `example.com.	300	IN	CAA	0 issue "letsencrypt.org; validationmethods=dns-01"`},
+		{"CAA iodef", dns.TypeCAA, `128 iodef "mailto:security@example.com"`, `example.com.	300	IN	CAA	128 iodef "mailto:security@example.com"`},
+		{"SVCB", dns.TypeSVCB, `1 svc.example.net. alpn="h2,h3" port=8443`, `example.com.	300	IN	SVCB	1 svc.example.net. alpn="h2,h3" port="8443"`},
+		{"HTTPS", dns.TypeHTTPS, `1 . alpn=h3,h2 ipv4hint=192.0.2.1,192.0.2.2`, `example.com.	300	IN	HTTPS	1 . alpn="h3,h2" ipv4hint="192.0.2.1,192.0.2.2"`},
+		{"HTTPS alias", dns.TypeHTTPS, `0 cdn.example.net.`, `example.com.	300	IN	HTTPS	0 cdn.example.net.`},
+		{"unknown type", 65280, `\# 4 0a000001`, `example.com.	300	CLASS1	TYPE65280	\# 4 0a000001`},
+		{"known type in generic form", dns.TypeA, `\# 4 c0000201`, "example.com.\t300\tIN\tA\t192.0.2.1"},
+		{"empty unknown type", 65281, `\# 0`, `example.com.	300	CLASS1	TYPE65281	\# 0 `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params []string
+			tr := newJSONServer(t, map[uint16][]jsonRR{
+				tt.qtype: {{Name: "example.com", Type: tt.qtype, TTL: 300, Data: tt.data}},
+			}, &params)
+			defer tr.Close()
+
+			req := new(dns.Msg)
+			req.SetQuestion(name, tt.qtype)
+			resp, err := tr.Exchange(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Answer) != 1 {
+				t.Fatalf("got %d answers, want 1", len(resp.Answer))
+			}
+			rr := resp.Answer[0]
+			if got := rr.String(); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if rr.Header().Rrtype != tt.qtype {
+				t.Errorf("got type %d, want %d", rr.Header().Rrtype, tt.qtype)
+			}
+
+			// The record must survive a round trip through the wireformat.
+			msg, err := resp.Pack()
+			if err != nil {
+				t.Fatalf("failed to pack the response: %v", err)
+			}
+			var resp2 dns.Msg
+			if err := resp2.Unpack(msg); err != nil {
+				t.Fatalf("failed to unpack the response: %v", err)
+			}
+			if !dns.IsDuplicate(rr, resp2.Answer[0]) {
+				t.Errorf("record changed in a round trip: %v", resp2.Answer[0])
+			}
+		})
+	}
+}
+
+func TestDoHJSONTXTBytes(t *testing.T) {
+	// The unquoted text is the literal string: its quotes, backslashes, and
+	// unprintable bytes are data, and reach the wire as is.
+	data := "a\"b\\c\x01d\u00e9"
+	var params []string
+	tr := newJSONServer(t, map[uint16][]jsonRR{
+		dns.TypeTXT: {{Name: "example.com.", Type: dns.TypeTXT, TTL: 60, Data: data}},
+	}, &params)
+	defer tr.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	resp, err := tr.Exchange(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{byte(len(data))}, data...)
+	if !strings.HasSuffix(string(msg), string(want)) {
+		t.Errorf("TXT data on the wire doesn't end with %q: %q", want, msg)
+	}
+}
+
+func TestDoHJSONInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rr   jsonRR
+	}{
+		{"bad address", jsonRR{Name: "example.com.", Type: dns.TypeA, Data: "not an address"}},
+		{"unknown type, not generic", jsonRR{Name: "example.com.", Type: 65280, Data: "0a000001"}},
+		{"generic length mismatch", jsonRR{Name: "example.com.", Type: 65280, Data: `\# 5 0a000001`}},
+		{"second record", jsonRR{Name: "example.com.", Type: dns.TypeA, Data: "192.0.2.1\nexample.com. 60 IN A 192.0.2.2"}},
+		{"bad owner", jsonRR{Name: "a..b", Type: dns.TypeA, Data: "192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rr, err := newRRFromJSON(&tt.rr); err == nil {
+				t.Errorf("got %v, want an error", rr)
+			}
+		})
+	}
+}
+
+func TestDoHJSONQuery(t *testing.T) {
+	var params []string
+	tr := newJSONServer(t, nil, &params)
+	defer tr.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeCAA)
+	req.CheckingDisabled = true
+	req.SetEdns0(DefaultUDPBufSize, true)
+	resp, err := tr.Exchange(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.AuthenticatedData || resp.Id != req.Id {
+		t.Errorf("got response %v", resp)
+	}
+	want := []string{"cd=1&do=1&name=example.com.&type=257"}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("got query parameters %q, want %q", params, want)
+	}
+}
@@ -7,12 +7,19 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// The maximum number of HTTP redirects that a DoH transport follows.
+const maxDoHRedirects = 10
+
 type DoH struct {
 	ServerURL string
 	Timeout   time.Duration
@@ -20,25 +27,46 @@ type DoH struct {
 	KeepOpen  bool
 	TLSConfig *tls.Config
 
+	// Use the JSON API (application/dns-json) that many public resolvers
+	// offer alongside RFC 8484, rather than the DNS wireformat.  The
+	// transport sends the query's name, type, and DO and CD bits as GET
+	// parameters (UseGET is implied), and converts the JSON response to a
+	// DNS message.  The JSON API has no way to carry other EDNS0 options,
+	// so the transport does not pad the query or send cookies.
+	UseJSON bool
+
+	// An out-of-band SPKI pin set; see [DoT].
+	SPKIPins []string
+
+	// Pad queries to a multiple of PadBlockSize bytes; see [DoT].
+	PadBlockSize int
+
 	client *http.Client
 }
 
-func (t *DoH) resetHTTPClient() {
+func (t *DoH) resetHTTPClient() error {
+	tlsConfig, err := newTLSConfig(t.TLSConfig, t.SPKIPins)
+	if err != nil {
+		return err
+	}
+
 	t.client = &http.Client{
-		Timeout: t.Timeout,
+		Timeout:       t.Timeout,
+		CheckRedirect: checkRedirect,
 		Transport: &http.Transport{
-			TLSClientConfig:   t.TLSConfig,
+			TLSClientConfig:   tlsConfig,
 			MaxConnsPerHost:   1,
 			MaxIdleConns:      1,
 			DisableKeepAlives: !t.KeepOpen,
 			ForceAttemptHTTP2: true,
 		},
 	}
+	return nil
 }
 
-func (t *DoH) newGETRequest(dnsQuery []byte) (*http.Request, error) {
+func (t *DoH) newGETRequest(ctx context.Context, dnsQuery []byte) (*http.Request, error) {
 	urlStr := fmt.Sprintf("%s?dns=%s", t.ServerURL, base64.URLEncoding.EncodeToString(dnsQuery))
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, urlStr, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -46,8 +74,8 @@ func (t *DoH) newGETRequest(dnsQuery []byte) (*http.Request, error) {
 	return req, nil
 }
 
-func (t *DoH) newPOSTRequest(dnsQuery []byte) (*http.Request, error) {
-	req, err := http.NewRequestWithContext(context.Background(),
+func (t *DoH) newPOSTRequest(ctx context.Context, dnsQuery []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx,
 		http.MethodPost, t.ServerURL, bytes.NewReader(dnsQuery))
 	if err != nil {
 		return nil, err
@@ -57,45 +85,175 @@ func (t *DoH) newPOSTRequest(dnsQuery []byte) (*http.Request, error) {
 	return req, nil
 }
 
-func (t *DoH) Exchange(req *dns.Msg) (*dns.Msg, error) {
-	var httpReq *http.Request
-	var err error
+// checkRedirect is the DoH transport's redirect policy.  The transport only
+// follows redirects to https URLs, and only if the redirected request has the
+// same method as the original: Go turns a POST into a bodiless GET on a 301,
+// 302, or 303, which would lose the query.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxDoHRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxDoHRedirects)
+	}
+	if req.URL.Scheme != "https" {
+		return fmt.Errorf("%w: %v", ErrBadRedirect, req.URL)
+	}
+	if req.Method != via[0].Method {
+		return fmt.Errorf("%w: %s request redirected as %s", ErrBadRedirect, via[0].Method, req.Method)
+	}
+	return nil
+}
 
-	if t.client == nil || !t.KeepOpen {
-		t.resetHTTPClient()
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date (RFC 9110, Section 10.2.3).
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
 	}
+	return 0
+}
 
-	// Per RFC 8484 (DNS Queries over HTTPS (DoH)), the query's ID SHOULD be 0.
-	req.Id = 0
-	msg, err := req.Pack()
+// parseAge returns the value of the response's Age header (RFC 9111, Section
+// 5.1).
+func parseAge(header http.Header) time.Duration {
+	secs, err := strconv.ParseUint(header.Get("Age"), 10, 32)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create DNS request %w", err)
+		return 0
 	}
+	return time.Duration(secs) * time.Second
+}
 
-	if t.UseGET {
-		httpReq, err = t.newGETRequest(msg)
-	} else {
-		httpReq, err = t.newPOSTRequest(msg)
+// freshnessLifetime returns the response's freshness lifetime, as per RFC
+// 9111, Section 4.2.1, from the perspective of a private cache.
+func freshnessLifetime(header http.Header) time.Duration {
+	for _, cc := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(cc, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				return 0
+			case "max-age":
+				secs, err := strconv.ParseUint(strings.Trim(value, `"`), 10, 32)
+				if err != nil {
+					return 0
+				}
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return 0
 	}
+	date, err := http.ParseTime(header.Get("Date"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		date = time.Now()
 	}
+	if expires.Before(date) {
+		return 0
+	}
+	return expires.Sub(date)
+}
 
+// do sends the HTTP request and returns the body of the response, which must
+// have one of the given media types, and the value of the response's Age
+// header.  do records the exchange and the response's freshness in the
+// context's [ExchangeInfo].
+func (t *DoH) do(ctx context.Context, httpReq *http.Request, mediaTypes ...string) ([]byte, time.Duration, error) {
+	if t.client == nil || !t.KeepOpen {
+		err := t.resetHTTPClient()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	start := time.Now()
 	resp, err := t.client.Do(httpReq)
 	if resp != nil && resp.Body != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error making HTTPS request: %w", err)
+		return nil, 0, fmt.Errorf("error making HTTPS request: %w", ctxError(ctx, err))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxHTTPErrorBody))
+		return nil, 0, &HTTPError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Body:       body,
+		}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !slices.Contains(mediaTypes, mediaType) {
+		return nil, 0, fmt.Errorf("%w: %q", ErrContentType, resp.Header.Get("Content-Type"))
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading HTTPS response: %w", err)
+		return nil, 0, fmt.Errorf("error reading HTTPS response: %w", ctxError(ctx, err))
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTPS response returned an error: %v", resp.StatusCode)
+	noteExchange(ctx, t.ServerURL, "https", time.Since(start), len(body))
+	age := parseAge(resp.Header)
+	info := exchangeInfoFrom(ctx)
+	info.HTTPAge = age
+	info.HTTPFreshness = max(freshnessLifetime(resp.Header)-age, 0)
+
+	return body, age, nil
+}
+
+func (t *DoH) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return t.ExchangeContext(context.Background(), req)
+}
+
+func (t *DoH) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if t.UseJSON {
+		return t.exchangeJSON(ctx, req)
+	}
+	return withCookies(ctx, t.ServerURL, req, func(req *dns.Msg) (*dns.Msg, error) {
+		return t.exchange(ctx, req)
+	})
+}
+
+func (t *DoH) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var httpReq *http.Request
+	var err error
+
+	if t.PadBlockSize > 0 {
+		req, err = withPadding(req, t.PadBlockSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pad DNS request: %w", err)
+		}
+	}
+
+	// Per RFC 8484 (DNS Queries over HTTPS (DoH)), the query's ID SHOULD be 0.
+	req.Id = 0
+	msg, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DNS request %w", err)
+	}
+
+	if t.UseGET {
+		httpReq, err = t.newGETRequest(ctx, msg)
+	} else {
+		httpReq, err = t.newPOSTRequest(ctx, msg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	body, age, err := t.do(ctx, httpReq, "application/dns-message")
+	if err != nil {
+		return nil, err
 	}
 
 	var reply dns.Msg
@@ -104,10 +262,15 @@ func (t *DoH) Exchange(req *dns.Msg) (*dns.Msg, error) {
 		return nil, fmt.Errorf("failed to unpack DNS response message: %w", err)
 	}
 
+	decrementTTLs(&reply, age)
+	exchangeInfoFrom(ctx).ResponsePadded = hasEDNS0Padding(&reply)
 	return &reply, nil
 }
 
 func (t *DoH) Close() error {
+	if t.client == nil {
+		return nil
+	}
 	t.client.CloseIdleConnections()
 	return nil
 }
@@ -0,0 +1,255 @@
+package resolv
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// The DoQ error code for "no error" (RFC 9250, Section 4.3).  A client uses
+// this code when it closes a connection that is no longer needed.
+const doqNoError = 0x0
+
+type DoQ struct {
+	Server    string
+	IPv4Only  bool
+	IPv6Only  bool
+	Timeout   time.Duration
+	KeepOpen  bool
+	TLSConfig *tls.Config
+
+	// An out-of-band SPKI pin set; see [DoT].
+	SPKIPins []string
+
+	// Pad queries to a multiple of PadBlockSize bytes; see [DoT].
+	PadBlockSize int
+
+	udpConn *net.UDPConn
+	conn    quic.Connection
+}
+
+func (t *DoQ) tlsConfig() (*tls.Config, error) {
+	cfg, err := newTLSConfig(t.TLSConfig, t.SPKIPins)
+	if err != nil {
+		return nil, err
+	}
+
+	// Per RFC 9250, the client MUST use the "doq" ALPN token.
+	cfg.NextProtos = []string{"doq"}
+
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(t.Server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS server address %s: %w", t.Server, err)
+		}
+		cfg.ServerName = host
+	}
+	return cfg, nil
+}
+
+func (t *DoQ) dial(ctx context.Context) error {
+	var err error
+
+	network := "udp"
+	if t.IPv4Only {
+		network = "udp4"
+	}
+	if t.IPv6Only {
+		network = "udp6"
+	}
+
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	raddr, err := net.ResolveUDPAddr(network, t.Server)
+	if err != nil {
+		return fmt.Errorf("failed to resolve DNS server %s: %w", t.Server, err)
+	}
+
+	t.udpConn, err = net.ListenUDP(network, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create UDP socket: %w", err)
+	}
+
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	t.conn, err = quic.Dial(ctx, t.udpConn, raddr, tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: t.Timeout,
+	})
+	if err != nil {
+		t.udpConn.Close()
+		t.udpConn = nil
+		return fmt.Errorf("failed to connect to DNS server %s: %w", t.Server, ctxError(ctx, err))
+	}
+	return nil
+}
+
+func (t *DoQ) isConnected() bool {
+	return t.conn != nil
+}
+
+// checkHealth implements the [DefaultHealthCheck] of a [Pool].
+func (t *DoQ) checkHealth() error {
+	if !t.isConnected() {
+		return nil
+	}
+	if err := context.Cause(t.conn.Context()); err != nil {
+		return fmt.Errorf("idle connection closed: %w", err)
+	}
+	return nil
+}
+
+// exchangeOnStream sends the query on a new stream of the current
+// connection, and reads the response from that same stream.
+func (t *DoQ) exchangeOnStream(ctx context.Context, msg []byte) (*dns.Msg, error) {
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	stream, err := t.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	start := time.Now()
+	// Per RFC 9250, each message is prefixed with a 2-byte length field, as
+	// with DNS over TCP.
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err = stream.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client MUST indicate through the STREAM FIN mechanism that no
+	// further data will be sent on the stream.
+	err = stream.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var lenBuf [2]byte
+	_, err = io.ReadFull(stream, lenBuf[:])
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	_, err = io.ReadFull(stream, body)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	err = reply.Unpack(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack DNS response message: %w", err)
+	}
+	noteExchange(ctx, t.Server, "quic", time.Since(start), len(body))
+	return reply, nil
+}
+
+func (t *DoQ) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return t.ExchangeContext(context.Background(), req)
+}
+
+func (t *DoQ) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return withCookies(ctx, t.Server, req, func(req *dns.Msg) (*dns.Msg, error) {
+		return t.exchange(ctx, req)
+	})
+}
+
+func (t *DoQ) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var err error
+	var reused bool
+	var retried bool
+	var resp *dns.Msg
+
+	if t.PadBlockSize > 0 {
+		req, err = withPadding(req, t.PadBlockSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pad DNS request: %w", err)
+		}
+	}
+
+	// Per RFC 9250 (DNS over Dedicated QUIC Connections), the query's ID MUST
+	// be 0.
+	req.Id = 0
+	msg, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DNS request %w", err)
+	}
+
+reconnect:
+	if !t.isConnected() {
+		err = t.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		reused = true
+	}
+
+	resp, err = t.exchangeOnStream(ctx, msg)
+	if !t.KeepOpen {
+		t.Close()
+	}
+
+	if err == nil {
+		exchangeInfoFrom(ctx).ResponsePadded = hasEDNS0Padding(resp)
+		return resp, nil
+	}
+
+	if ctx.Err() != nil {
+		// Only this query's stream failed; the connection itself is fine.
+		return nil, ctx.Err()
+	}
+
+	// The server may have closed an idle connection on us.  If we were
+	// reusing an already established connection, try once to reconnect and
+	// resend the query.
+	t.Close()
+	if reused && !retried {
+		retried = true
+		goto reconnect
+	}
+
+	return nil, err
+}
+
+func (t *DoQ) Close() error {
+	var err error
+	if t.conn != nil {
+		err = t.conn.CloseWithError(doqNoError, "")
+		t.conn = nil
+	}
+	if t.udpConn != nil {
+		t.udpConn.Close()
+		t.udpConn = nil
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+package resolv
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// A doqServer is an in-process DoQ server.  It checks the framing of each
+// query and answers with an A record.
+type doqServer struct {
+	t        *testing.T
+	listener *quic.Listener
+	cert     tls.Certificate
+
+	// If true, the server closes each connection after answering one query.
+	closeAfterOne bool
+
+	mu      sync.Mutex
+	conns   int
+	queries []*dns.Msg
+	errs    []error
+}
+
+func newDoQServer(t *testing.T) (*doqServer, *tls.Config) {
+	cert, pool := newTestCertificate(t, "127.0.0.1")
+	s := &doqServer{t: t, cert: cert}
+
+	var err error
+	s.listener, err = quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+	go s.serve()
+
+	return s, &tls.Config{RootCAs: pool}
+}
+
+func (s *doqServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *doqServer) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+func (s *doqServer) serve() {
+	for {
+		conn, err := s.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *doqServer) serveConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		s.serveStream(stream)
+		if s.closeAfterOne {
+			// give the response time to leave before closing
+			time.Sleep(10 * time.Millisecond)
+			conn.CloseWithError(doqNoError, "")
+			return
+		}
+	}
+}
+
+func (s *doqServer) serveStream(stream quic.Stream) {
+	defer stream.Close()
+
+	// ReadAll returns only once the client sends STREAM FIN, and the
+	// stream must hold exactly one length-prefixed query.
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		s.fail(errors.New("query is not one length-prefixed message"))
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(data[2:]); err != nil {
+		s.fail(err)
+		return
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, req)
+	s.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	msg, err := resp.Pack()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	stream.Write(buf)
+}
+
+func (s *doqServer) check(t *testing.T) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, err := range s.errs {
+		t.Errorf("server: %v", err)
+	}
+	for _, req := range s.queries {
+		if req.Id != 0 {
+			t.Errorf("query has ID %d on the wire, want 0", req.Id)
+		}
+	}
+}
+
+func TestDoQExchange(t *testing.T) {
+	s, cfg := newDoQServer(t)
+	tr := &DoQ{Server: s.addr(), Timeout: 2 * time.Second, KeepOpen: true, TLSConfig: cfg}
+	defer tr.Close()
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		id := req.Id
+		info := new(ExchangeInfo)
+		resp, err := tr.ExchangeContext(WithExchangeInfo(context.Background(), info), req)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("query %d: got %d answers, want 1", i, len(resp.Answer))
+		}
+		if resp.Id != 0 && resp.Id != id {
+			t.Errorf("query %d: response ID %d", i, resp.Id)
+		}
+		if info.Protocol != "quic" || info.Server != s.addr() || info.Size == 0 {
+			t.Errorf("query %d: ExchangeInfo %+v", i, info)
+		}
+	}
+	s.check(t)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queries) != 3 {
+		t.Errorf("server got %d queries, want 3", len(s.queries))
+	}
+	if s.conns != 1 {
+		t.Errorf("KeepOpen transport used %d connections, want 1", s.conns)
+	}
+}
+
+func TestDoQReconnect(t *testing.T) {
+	s, cfg := newDoQServer(t)
+	s.closeAfterOne = true
+	tr := &DoQ{Server: s.addr(), Timeout: 2 * time.Second, KeepOpen: true, TLSConfig: cfg}
+	defer tr.Close()
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		if _, err := tr.Exchange(req); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		// let the server's close arrive
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.check(t)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns != 2 {
+		t.Errorf("transport used %d connections, want 2", s.conns)
+	}
+}
+
+func TestDoQSPKIPinMismatch(t *testing.T) {
+	s, cfg := newDoQServer(t)
+	other, _ := newTestCertificate(t, "127.0.0.1")
+
+	tr := &DoQ{Server: s.addr(), Timeout: 2 * time.Second, TLSConfig: cfg, SPKIPins: []string{SPKIPin(other.Leaf)}}
+	defer tr.Close()
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	if _, err := tr.Exchange(req); !errors.Is(err, ErrSPKIPinMismatch) {
+		t.Errorf("got %v, want %v", err, ErrSPKIPinMismatch)
+	}
+
+	tr = &DoQ{Server: s.addr(), Timeout: 2 * time.Second, TLSConfig: cfg, SPKIPins: []string{SPKIPin(s.cert.Leaf)}}
+	defer tr.Close()
+	if _, err := tr.Exchange(req); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package resolv
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -11,20 +12,56 @@ import (
 )
 
 type DoT struct {
-	Server    string
-	IPv4Only  bool
-	IPv6Only  bool
-	Timeout   time.Duration
-	KeepOpen  bool
-	TLSConfig *tls.Config // XXX probably not needed, as dns.Client already has this field
+	Server   string
+	IPv4Only bool
+	IPv6Only bool
+	Timeout  time.Duration
+	KeepOpen bool
+
+	// Pipeline queries over one connection that all goroutines share; see
+	// [Do53TCP].
+	Pipeline bool
+
+	// Send the EDNS0 TCP Keepalive option (RFC 7828) in queries.  With
+	// KeepOpen or Pipeline, the transport honors the idle timeout that the
+	// server returns: it opens a new connection, rather than reuse one that
+	// the server is about to close, and closes the connection if the
+	// server's timeout is 0 (in Pipeline mode, once no queries are waiting
+	// for responses on it).
+	Keepalive bool
+
+	// The TLS configuration for the connection (e.g., the CA certificates,
+	// the expected ServerName, and client certificates for mutual TLS).  If
+	// nil, the connection uses the system's default CA certificates and the
+	// host part of Server as the ServerName.
+	TLSConfig *tls.Config
+
+	// An out-of-band SPKI pin set (RFC 7858, Section 4.2): base64-encoded
+	// SHA-256 digests of SubjectPublicKeyInfos (see [SPKIPin]).  If not
+	// empty, the TLS handshake fails unless the server's certificate chain
+	// matches one of the pins.  The pins are checked in addition to the
+	// usual certificate verification; set TLSConfig's InsecureSkipVerify to
+	// authenticate the server by its pin alone.
+	SPKIPins []string
+
+	// Pad queries with the EDNS0 Padding option (RFC 7830), so that their
+	// lengths are a multiple of PadBlockSize bytes, which hides the exact
+	// length of the query name from anyone watching the traffic.  RFC 8467
+	// recommends a block size of [DefaultPadBlockSize].  If zero, the
+	// transport does not pad queries.
+	PadBlockSize int
 
 	client *dns.Client
 	conn   *dns.Conn
-}
 
-func (t *DoT) dial() error {
-	var err error
+	// When the server will close the idle connection, per the server's
+	// EDNS0 TCP Keepalive option (zero if unknown).
+	idleDeadline time.Time
+
+	mux lazyMux
+}
 
+func (t *DoT) newDNSClient() (*dns.Client, error) {
 	net := "tcp-tls"
 	if t.IPv4Only {
 		net = "tcp4-tls"
@@ -33,31 +70,121 @@ func (t *DoT) dial() error {
 		net = "tcp6-tls"
 	}
 
-	t.client = &dns.Client{
-		Net:     net,
-		Timeout: t.Timeout,
+	tlsConfig, err := newTLSConfig(t.TLSConfig, t.SPKIPins)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dns.Client{
+		Net:       net,
+		Timeout:   t.Timeout,
+		TLSConfig: tlsConfig,
+	}, nil
+}
+
+func (t *DoT) dial(ctx context.Context) error {
+	var err error
+
+	t.client, err = t.newDNSClient()
+	if err != nil {
+		return err
 	}
 
-	t.conn, err = t.client.Dial(t.Server)
+	t.conn, err = t.client.DialContext(ctx, t.Server)
 	if err != nil {
-		return fmt.Errorf("failed to connect to DNS server %s: %w", t.Server, err)
+		return fmt.Errorf("failed to connect to DNS server %s: %w", t.Server, ctxError(ctx, err))
 	}
 	return nil
 }
 
+func (t *DoT) getMux() *muxConn {
+	return t.mux.get(t.newDNSClient, t.Server, t.Timeout, t.Keepalive)
+}
+
 func (t *DoT) isConnected() bool {
 	return t.conn != nil
 }
 
+// idleExpired returns true if the server is about to close the idle
+// connection, as per the idle timeout in the server's last response.
+func (t *DoT) idleExpired() bool {
+	if t.idleDeadline.IsZero() {
+		return false
+	}
+	return time.Now().Add(KeepaliveMargin).After(t.idleDeadline)
+}
+
+// checkHealth implements the [DefaultHealthCheck] of a [Pool].
+func (t *DoT) checkHealth() error {
+	if t.Pipeline || !t.isConnected() {
+		return nil
+	}
+	if t.idleExpired() {
+		return errors.New("server is about to close the idle connection")
+	}
+	return connAlive(t.conn.Conn)
+}
+
+// noteKeepalive records the idle timeout that the server returned in resp.
+func (t *DoT) noteKeepalive(resp *dns.Msg) {
+	timeout, ok := edns0Keepalive(resp)
+	if !ok {
+		return
+	}
+	if timeout == 0 {
+		// the server wants us to close the connection
+		t.Close()
+		return
+	}
+	t.idleDeadline = time.Now().Add(timeout)
+}
+
 func (t *DoT) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return t.ExchangeContext(context.Background(), req)
+}
+
+func (t *DoT) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if t.Keepalive {
+		req = req.Copy()
+		AddEDNS0Keepalive(req)
+	}
+
+	return withCookies(ctx, t.Server, req, func(req *dns.Msg) (*dns.Msg, error) {
+		return t.exchange(ctx, req)
+	})
+}
+
+func (t *DoT) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
 	var err error
 	var reused bool
 	var retried bool
 	var resp *dns.Msg
+	var rtt time.Duration
+
+	if t.PadBlockSize > 0 {
+		req, err = withPadding(req, t.PadBlockSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pad DNS request: %w", err)
+		}
+	}
+
+	if t.Pipeline {
+		start := time.Now()
+		resp, err = t.getMux().Exchange(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		noteExchange(ctx, t.Server, "tls", time.Since(start), packedLen(resp))
+		exchangeInfoFrom(ctx).ResponsePadded = hasEDNS0Padding(resp)
+		return resp, nil
+	}
 
 reconnect:
+	if t.isConnected() && t.idleExpired() {
+		t.Close()
+	}
 	if !t.isConnected() {
-		err = t.dial()
+		err = t.dial(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -65,24 +192,36 @@ reconnect:
 		reused = true
 	}
 
-	resp, _, err = t.client.ExchangeWithConn(req, t.conn)
+	stop := watchConn(ctx, t.conn)
+	resp, rtt, err = t.client.ExchangeWithConnContext(ctx, req, t.conn)
+	stop()
 	if !t.KeepOpen {
 		t.Close()
 	}
 
 	if err == nil {
+		if t.Keepalive && t.isConnected() {
+			t.noteKeepalive(resp)
+		}
+		noteExchange(ctx, t.Server, "tls", rtt, packedLen(resp))
+		exchangeInfoFrom(ctx).ResponsePadded = hasEDNS0Padding(resp)
 		return resp, nil
 	}
 
+	// A failed exchange leaves the connection in an unknown state (e.g., a
+	// late response to this query might still arrive), so don't reuse it.
+	t.Close()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// If the server closed the connection on us rather than returning a
+	// response, and we were reusing an already established connection, try
+	// once to reconnect and resend the query.
 	if !errors.Is(err, io.EOF) {
 		return nil, err
 	}
-
-	// The server closed the connection on us rather than returning a response
-	t.Close()
-
-	// If we were reusing an already established connection, try once to
-	// reconnect and resend the query.
 	if reused && !retried {
 		retried = true
 		goto reconnect
@@ -92,10 +231,15 @@ reconnect:
 }
 
 func (t *DoT) Close() error {
+	if t.Pipeline {
+		return t.getMux().Close()
+	}
+
 	if t.conn == nil {
 		return nil
 	}
 	err := t.conn.Close()
 	t.conn = nil
+	t.idleDeadline = time.Time{}
 	return err
 }
@@ -0,0 +1,152 @@
+package resolv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/circl/sign/ed448"
+)
+
+// littleEndianBytes encodes x in n bytes, in little-endian order.
+func littleEndianBytes(x *big.Int, n int) []byte {
+	b := x.FillBytes(make([]byte, n))
+	slices.Reverse(b)
+	return b
+}
+
+// littleEndian decodes b, in little-endian order.
+func littleEndian(b []byte) *big.Int {
+	b = slices.Clone(b)
+	slices.Reverse(b)
+	return new(big.Int).SetBytes(b)
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The test vectors of RFC 8032, Section 7.4, without a context.
+var ed448Vectors = []struct {
+	name                  string
+	secret, pub, msg, sig string
+}{
+	{
+		name: "blank",
+		secret: `6c82a562cb808d10d632be89c8513ebf6c929f34ddfa8c9f63c9960ef6e348a3
+			528c8a3fcc2f044e39a3fc5b94492f8f032e7549a20098f95b`,
+		pub: `5fd7449b59b461fd2ce787ec616ad46a1da1342485a70e1f8a0ea75d80e96778
+			edf124769b46c7061bd6783df1e50f6cd1fa1abeafe8256180`,
+		msg: ``,
+		sig: `533a37f6bbe457251f023c0d88f976ae2dfb504a843e34d2074fd823d41a591f
+			2b233f034f628281f2fd7a22ddd47d7828c59bd0a21bfd3980ff0d2028d4b18a
+			9df63e006c5d1c2d345b925d8dc00b4104852db99ac5c7cdda8530a113a0f4db
+			b61149f05a7363268c71d95808ff2e652600`,
+	},
+	{
+		name: "1 octet",
+		secret: `c4eab05d357007c632f3dbb48489924d552b08fe0c353a0d4a1f00acda2c463a
+			fbea67c5e8d2877c5e3bc397a659949ef8021e954e0a12274e`,
+		pub: `43ba28f430cdff456ae531545f7ecd0ac834a55d9358c0372bfa0c6c6798c086
+			6aea01eb00742802b8438ea4cb82169c235160627b4c3a9480`,
+		msg: `03`,
+		sig: `26b8f91727bd62897af15e41eb43c377efb9c610d48f2335cb0bd0087810f435
+			2541b143c4b981b7e18f62de8ccdf633fc1bf037ab7cd779805e0dbcc0aae1cb
+			cee1afb2e027df36bc04dcecbf154336c19f0af7e0a6472905e799f1953d2a0f
+			f3348ab21aa4adafd1d234441cf807c03a00`,
+	},
+	{
+		name: "11 octets",
+		secret: `cd23d24f714274e744343237b93290f511f6425f98e64459ff203e8985083ffd
+			f60500553abc0e05cd02184bdb89c4ccd67e187951267eb328`,
+		pub: `dcea9e78f35a1bf3499a831b10b86c90aac01cd84b67a0109b55a36e9328b1e3
+			65fce161d71ce7131a543ea4cb5f7e9f1d8b00696447001400`,
+		msg: `0c3e544074ec63b0265e0c`,
+		sig: `1f0a8888ce25e8d458a21130879b840a9089d999aaba039eaf3e3afa090a09d3
+			89dba82c4ff2ae8ac5cdfb7c55e94d5d961a29fe0109941e00b8dbdeea6d3b05
+			1068df7254c0cdc129cbe62db2dc957dbb47b51fd3f213fb8698f064774250a5
+			028961c9bf8ffd973fe5d5c206492b140e00`,
+	},
+}
+
+func TestEd448Vectors(t *testing.T) {
+	for _, v := range ed448Vectors {
+		t.Run(v.name, func(t *testing.T) {
+			pub, msg, sig := unhex(t, v.pub), unhex(t, v.msg), unhex(t, v.sig)
+			if !ed448.Verify(pub, msg, sig, "") {
+				t.Errorf("valid signature rejected")
+			}
+
+			// Signing with the secret reproduces the vector, so the keys
+			// of the other tests sign as DNSSEC expects.
+			key := ed448.NewKeyFromSeed(unhex(t, v.secret))
+			if got := key.Public().(ed448.PublicKey); !bytes.Equal(got, pub) {
+				t.Errorf("got public key %x, want %x", got, pub)
+			}
+			if got := ed448.Sign(key, msg, ""); !bytes.Equal(got, sig) {
+				t.Errorf("got signature %x, want %x", got, sig)
+			}
+		})
+	}
+}
+
+func TestEd448VerifyInvalid(t *testing.T) {
+	v := ed448Vectors[2]
+	pub, msg, sig := unhex(t, v.pub), unhex(t, v.msg), unhex(t, v.sig)
+
+	flip := func(b []byte, bit int) []byte {
+		b = bytes.Clone(b)
+		b[bit/8] ^= 1 << (bit % 8)
+		return b
+	}
+
+	// the field prime, 2^448 - 2^224 - 1, and the order of the base point,
+	// 2^446 - 13818066809895115352007386748515426880336692474882178609894547503885
+	p := new(big.Int).Lsh(big.NewInt(1), 448)
+	p.Sub(p, new(big.Int).Lsh(big.NewInt(1), 224))
+	p.Sub(p, big.NewInt(1))
+	l := new(big.Int).Lsh(big.NewInt(1), 446)
+	c, _ := new(big.Int).SetString("13818066809895115352007386748515426880336692474882178609894547503885", 10)
+	l.Sub(l, c)
+
+	// S + L encodes the same scalar as S, but is not canonical.
+	s := littleEndian(sig[ed448.PublicKeySize:])
+	sPlusL := append(bytes.Clone(sig[:ed448.PublicKeySize]), littleEndianBytes(s.Add(s, l), ed448.PublicKeySize)...)
+	lOnly := append(bytes.Clone(sig[:ed448.PublicKeySize]), littleEndianBytes(l, ed448.PublicKeySize)...)
+
+	// The y-coordinate p + 1 is congruent to 1, the y-coordinate of the
+	// identity, but is not canonical.
+	yPlusP := littleEndianBytes(new(big.Int).Add(p, big.NewInt(1)), ed448.PublicKeySize)
+
+	tests := []struct {
+		name          string
+		pub, msg, sig []byte
+	}{
+		{"flipped message bit", pub, flip(msg, 5), sig},
+		{"flipped R bit", pub, msg, flip(sig, 3)},
+		{"flipped S bit", pub, msg, flip(sig, 8*ed448.PublicKeySize+3)},
+		{"flipped key bit", flip(pub, 17), msg, sig},
+		{"S + L", pub, msg, sPlusL},
+		{"S = L", pub, msg, lOnly},
+		{"non-canonical key y", yPlusP, msg, sig},
+		{"non-canonical R y", pub, msg, append(yPlusP, sig[ed448.PublicKeySize:]...)},
+		{"short signature", pub, msg, sig[:len(sig)-1]},
+		{"short key", pub[:len(pub)-1], msg, sig},
+		{"key with high bits", flip(pub, 8*ed448.PublicKeySize-2), msg, sig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ed448.Verify(tt.pub, tt.msg, tt.sig, "") {
+				t.Errorf("invalid signature accepted")
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package resolv
 
 import (
+	"encoding/hex"
+	"fmt"
 	"net/netip"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/syslab-wm/mu"
@@ -11,7 +14,8 @@ import (
 func AddEDNS0NSID(m *dns.Msg) {
 	opt := m.IsEdns0()
 	if opt == nil {
-		m.SetEdns0(4096, false)
+		m.SetEdns0(DefaultUDPBufSize, false)
+		opt = m.IsEdns0()
 	}
 	e := &dns.EDNS0_NSID{
 		Code: dns.EDNS0NSID,
@@ -23,6 +27,7 @@ func AddEDNS0Subnet(m *dns.Msg, prefix netip.Prefix) {
 	opt := m.IsEdns0()
 	if opt == nil {
 		m.SetEdns0(DefaultUDPBufSize, false)
+		opt = m.IsEdns0()
 	}
 
 	e := &dns.EDNS0_SUBNET{
@@ -42,16 +47,220 @@ func AddEDNS0Subnet(m *dns.Msg, prefix netip.Prefix) {
 	opt.Option = append(opt.Option, e)
 }
 
-/*
-func AddEDNS0Cookie(m *dns.Msg) {
+// edns0Subnet returns the source prefix of the EDNS0 Client Subnet option in
+// m, masked to its length.  The boolean is false if m has no such option, or
+// the option is malformed.
+func edns0Subnet(m *dns.Msg) (netip.Prefix, bool) {
 	opt := m.IsEdns0()
 	if opt == nil {
-		m.SetEdns0(4096, false)
+		return netip.Prefix{}, false
 	}
-	e := &dns.EDNS0_COOKIE{
-		Code: dns.EDNS0COOKIE,
-        Cookie: // TODO: 8 bytes, hex-encoded (so a 16-byte string)
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(e.Address)
+		if !ok {
+			return netip.Prefix{}, false
+		}
+		if e.Family == 1 {
+			addr = addr.Unmap()
+		}
+		prefix, err := addr.Prefix(int(e.SourceNetmask))
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		return prefix, true
+	}
+	return netip.Prefix{}, false
+}
+
+// AddEDNS0Keepalive adds an EDNS0 TCP Keepalive option (RFC 7828) to m.  The
+// option asks the server to report how long it will keep an idle connection
+// open.  Per the RFC, a client must only send the option over a
+// connection-oriented transport (e.g., TCP or TLS), and its query must not
+// specify a timeout.
+func AddEDNS0Keepalive(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(DefaultUDPBufSize, false)
+		opt = m.IsEdns0()
+	}
+	e := &dns.EDNS0_TCP_KEEPALIVE{
+		Code: dns.EDNS0TCPKEEPALIVE,
+	}
+	opt.Option = append(opt.Option, e)
+}
+
+// edns0Keepalive returns the idle timeout from the EDNS0 TCP Keepalive option
+// in the response m.  The boolean is false if m does not have the option.  A
+// timeout of 0 means that the server wants the client to close the
+// connection.
+func edns0Keepalive(m *dns.Msg) (time.Duration, bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			// the timeout is in units of 100 milliseconds
+			return time.Duration(e.Timeout) * 100 * time.Millisecond, true
+		}
+	}
+	return 0, false
+}
+
+// withPadding returns a copy of m with an EDNS0 Padding option (RFC 7830)
+// that pads the packed message to a multiple of blockSize bytes, as per the
+// block-length padding policy of RFC 8467.  The padding replaces any padding
+// option that m already has.
+func withPadding(m *dns.Msg, blockSize int) (*dns.Msg, error) {
+	m = m.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(DefaultUDPBufSize, false)
+		opt = m.IsEdns0()
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	// the padding option's code and length fields take 4 bytes
+	n := len(buf) + 4
+	padLen := (blockSize - n%blockSize) % blockSize
+	e := &dns.EDNS0_PADDING{
+		Padding: make([]byte, padLen),
 	}
 	opt.Option = append(opt.Option, e)
+	return m, nil
+}
+
+// hasEDNS0Padding returns true if m has an EDNS0 Padding option.
+func hasEDNS0Padding(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
+
+// withUDPBufSize returns a copy of m that advertises an EDNS0 UDP payload
+// size of size bytes.  If m does not have an OPT record, the copy gets one.
+func withUDPBufSize(m *dns.Msg, size uint16) *dns.Msg {
+	m = m.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(size, false)
+	} else {
+		opt.SetUDPSize(size)
+	}
+	return m
+}
+
+// udpBufSize returns the EDNS0 UDP payload size that m advertises, or 0 if m
+// does not have an OPT record.
+func udpBufSize(m *dns.Msg) uint16 {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	return opt.UDPSize()
+}
+
+// AddEDNS0Cookie adds an EDNS0 Cookie option (RFC 7873) with the client
+// cookie and server cookie to m, replacing any cookie option that m already
+// has.  The serverCookie may be nil, if the client does not yet know the
+// server's cookie.
+func AddEDNS0Cookie(m *dns.Msg, clientCookie, serverCookie []byte) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(DefaultUDPBufSize, false)
+		opt = m.IsEdns0()
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+
+	e := &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(clientCookie) + hex.EncodeToString(serverCookie),
+	}
+	opt.Option = append(options, e)
+}
+
+// edns0Cookie returns the raw data (client cookie, followed by the server
+// cookie, if any) of the EDNS0 Cookie option in m.  The boolean is false if m
+// does not have the option.
+func edns0Cookie(m *dns.Msg) ([]byte, bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil, false
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_COOKIE); ok {
+			data, err := hex.DecodeString(e.Cookie)
+			if err != nil {
+				return nil, false
+			}
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// An ExtendedError is an EDNS0 Extended DNS Error (RFC 8914): an INFO-CODE
+// that explains an error response (e.g., DNSSEC Bogus, or Blocked) or a
+// degraded response (e.g., Stale Answer), and optional EXTRA-TEXT.
+type ExtendedError struct {
+	InfoCode  uint16
+	ExtraText string
+}
+
+func (e ExtendedError) String() string {
+	name, ok := dns.ExtendedErrorCodeToString[e.InfoCode]
+	if !ok {
+		name = "Unknown"
+	}
+	s := fmt.Sprintf("%s (%d)", name, e.InfoCode)
+	if e.ExtraText != "" {
+		s += ": " + e.ExtraText
+	}
+	return s
+}
+
+// EDNS0ExtendedErrors returns the Extended DNS Errors (RFC 8914) in m, in the
+// order in which they appear in m's OPT record.  A response may have several.
+func EDNS0ExtendedErrors(m *dns.Msg) []ExtendedError {
+	var errs []ExtendedError
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok {
+			errs = append(errs, ExtendedError{InfoCode: e.InfoCode, ExtraText: e.ExtraText})
+		}
+	}
+	return errs
 }
-*/
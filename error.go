@@ -1,5 +1,15 @@
 package resolv
 
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+)
+
 type Error struct{ err string }
 
 func (e *Error) Error() string {
@@ -12,7 +22,8 @@ func (e *Error) Error() string {
 // These are errors that a client's Exchange method may return.
 var (
 	// ErrRcode indicates that the DNS response has an RCODE that is not
-	// NOERROR ([github.com/miekg/dns.RcodeSuccess]).
+	// NOERROR ([github.com/miekg/dns.RcodeSuccess]).  A [Client] returns an
+	// [RcodeError], which matches ErrRcode and says which RCODE.
 	ErrRcode error = &Error{err: "response rcode is not success"} // DNS response's rcode is something other than Sucess
 
 	// ErrNoData represents the NODATA pseudo RCODE.  NODATA is not a real
@@ -37,7 +48,242 @@ var (
 	// its RR type.  This type of error should be rare.
 	ErrBadData error = &Error{err: "response has an answer the data does not conform to the RR type"}
 
+	// ErrBadCookie indicates that the response has a DNS Cookie (RFC 7873)
+	// that does not echo the client cookie in the query, or lacks a cookie
+	// even though the server has sent cookies before.  This suggests that
+	// the response is spoofed.
+	ErrBadCookie error = &Error{err: "response cookie is missing or does not match the client cookie"}
+
 	// ErrMaxCNAMEs indicates that the client followed its configurd maximum number of
 	// CNAMEs without resolving the query.
 	ErrMaxCNAMEs error = &Error{err: "query followed max number of CNAMEs"}
+
+	// ErrMaxSVCBAliases indicates that the client followed its configured
+	// maximum number of SVCB or HTTPS AliasMode records without reaching a
+	// ServiceMode record.
+	ErrMaxSVCBAliases error = &Error{err: "query followed max number of SVCB aliases"}
+
+	// ErrSVCBAliasLoop indicates that a chain of SVCB or HTTPS AliasMode
+	// records loops.
+	ErrSVCBAliasLoop error = &Error{err: "SVCB aliases form a loop"}
+)
+
+// These are errors that a transport's TLS handshake may fail with.
+var (
+	// ErrSPKIPinMismatch indicates that the public key of the server's
+	// certificate does not match any pin in the transport's SPKI pin set
+	// (RFC 7858, Section 4.2).
+	ErrSPKIPinMismatch error = &Error{err: "server public key does not match any SPKI pin"}
+
+	// ErrUnverifiedDesignation indicates that the certificate of a
+	// designated resolver does not cover the IP address of the unencrypted
+	// resolver that designated it, and so the designation cannot be verified
+	// (RFC 9462, Section 4.2).
+	ErrUnverifiedDesignation error = &Error{err: "designated resolver's certificate does not cover the designating resolver's IP address"}
+)
+
+// These are errors that the discovery of designated resolvers may return.
+var (
+	// ErrNoDesignatedResolver indicates that the resolver does not designate
+	// an encrypted resolver that this package supports.
+	ErrNoDesignatedResolver error = &Error{err: "no supported designated resolver"}
+)
+
+// These are errors that a [DoH] transport may return.
+var (
+	// ErrContentType indicates that the HTTP response's Content-Type is not
+	// that of a DNS response (e.g., application/dns-message).
+	ErrContentType error = &Error{err: "HTTP response has an unexpected content type"}
+
+	// ErrBadRedirect indicates that the server redirected the HTTP request to
+	// a URL that is not https, or in a way that would change the request's
+	// method (e.g., a 302 for a POST).
+	ErrBadRedirect error = &Error{err: "HTTP request redirected to an unusable location"}
+)
+
+// These are errors that an [Iterative] transport may return.
+var (
+	// ErrNoAuthoritativeAnswer indicates that none of the servers of a zone
+	// returned a usable response: each timed out, failed, returned an error
+	// RCODE (e.g., REFUSED), or returned a referral that does not lead
+	// closer to the query's name (a lame delegation).
+	ErrNoAuthoritativeAnswer error = &Error{err: "no authoritative server returned a usable response"}
+
+	// ErrIterationLimit indicates that the iterative resolution of a query
+	// sent too many queries, or nested too deeply in resolving the names of
+	// nameservers, which suggests a misconfiguration or a loop.
+	ErrIterationLimit error = &Error{err: "iterative resolution exceeded its limits"}
 )
+
+// These are errors that a validating [Client] may return.
+var (
+	// ErrBogus indicates that DNSSEC validation of a response failed: the
+	// response's signatures, or the chain of trust to them, are missing,
+	// expired, or invalid.  A [ValidationError] matches ErrBogus.
+	ErrBogus error = &Error{err: "DNSSEC validation failed"}
+
+	// ErrValidateIterative indicates that the client is set to Validate over
+	// an [Iterative] transport, which drops the RRSIGs that validation needs.
+	ErrValidateIterative error = &Error{err: "can't validate the responses of an iterative transport"}
+)
+
+// An HTTPError is the error that a [DoH] transport returns when the HTTP
+// response has a status other than 200 OK.
+type HTTPError struct {
+	// The HTTP status code, e.g., 429 (Too Many Requests).
+	StatusCode int
+
+	// How long the server asked the client to wait before retrying, per
+	// the response's Retry-After header; zero if the header is absent or
+	// invalid.
+	RetryAfter time.Duration
+
+	// The start of the response body, which often explains the error.
+	Body []byte
+}
+
+// The most of an error response's body that an HTTPError keeps.
+const maxHTTPErrorBody = 512
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("resolv: HTTPS response returned an error: %d %s",
+		e.StatusCode, http.StatusText(e.StatusCode))
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(" (retry after %v)", e.RetryAfter)
+	}
+	if body := strings.TrimSpace(string(e.Body)); body != "" && utf8.ValidString(body) {
+		body, _, _ = strings.Cut(body, "\n")
+		msg += ": " + body
+	}
+	return msg
+}
+
+// An RcodeError is the error that a [Client] returns for a response whose
+// RCODE is not NOERROR.  An RcodeError matches [ErrRcode].
+type RcodeError struct {
+	// The query whose response has the error RCODE.
+	Name  string
+	Qtype uint16
+
+	// The response's RCODE (e.g., [github.com/miekg/dns.RcodeServerFailure]),
+	// including the extended RCODE bits of the response's OPT record.
+	Rcode int
+
+	// The Extended DNS Errors (RFC 8914) in the response, which may explain
+	// the error.
+	ExtendedErrors []ExtendedError
+
+	// The server that returned the response (see [ExchangeInfo]); empty if
+	// the transport does not record it.
+	Server string
+}
+
+// newRcodeError returns an RcodeError for resp, which server returned in
+// response to a query of q.  (An error response may lack the question.)
+func newRcodeError(q dns.Question, resp *dns.Msg, server string) *RcodeError {
+	return &RcodeError{
+		Name:           q.Name,
+		Qtype:          q.Qtype,
+		Rcode:          resp.Rcode,
+		ExtendedErrors: EDNS0ExtendedErrors(resp),
+		Server:         server,
+	}
+}
+
+func (e *RcodeError) Error() string {
+	rcode, ok := dns.RcodeToString[e.Rcode]
+	if !ok {
+		rcode = fmt.Sprintf("RCODE%d", e.Rcode)
+	}
+	msg := fmt.Sprintf("resolv: %s %s: response rcode is %s", e.Name, dns.Type(e.Qtype), rcode)
+	if e.Server != "" {
+		msg += " from " + e.Server
+	}
+	if len(e.ExtendedErrors) > 0 {
+		edes := make([]string, len(e.ExtendedErrors))
+		for i, ede := range e.ExtendedErrors {
+			edes[i] = ede.String()
+		}
+		msg += ": " + strings.Join(edes, "; ")
+	}
+	return msg
+}
+
+// Is returns true if target is [ErrRcode].
+func (e *RcodeError) Is(target error) bool {
+	return target == ErrRcode
+}
+
+// A ValidationError is the error that a validating [Client] returns for a
+// Bogus response.
+type ValidationError struct {
+	// The query whose response failed validation.
+	Name  string
+	Qtype uint16
+
+	// Why the response is Bogus.
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("resolv: DNSSEC validation of %s %s failed: %s",
+		e.Name, dns.Type(e.Qtype), e.Reason)
+}
+
+// Is returns true if target is [ErrBogus].
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrBogus
+}
+
+// A DenialError is the error that a validating [Client] returns for a
+// negative response (NXDOMAIN or NODATA).  It says whether DNSSEC proves the
+// denial of existence.
+type DenialError struct {
+	// The name and type that the response denies: the query's name, or the
+	// target of a CNAME chain.
+	Name  string
+	Qtype uint16
+
+	// True if the response is NXDOMAIN (the name does not exist), and false
+	// if the response is NODATA (the name has no records of the type).
+	NXDomain bool
+
+	// Secure if the response's signed NSEC or NSEC3 records prove the denial
+	// (see [VerifyDenial]); Insecure if the name is in an unsigned zone or
+	// in an NSEC3 Opt-Out span; Bogus if the proof is missing or invalid;
+	// and Indeterminate if no trust anchor covers the name.
+	Status ValidationStatus
+
+	// Unless the Status is Secure, the reason for it.
+	Reason string
+
+	// The error for the negative response: an [RcodeError] (for NXDOMAIN)
+	// or ErrNoData.
+	Err error
+}
+
+func (e *DenialError) Error() string {
+	kind := "NODATA"
+	if e.NXDomain {
+		kind = "NXDOMAIN"
+	}
+	msg := fmt.Sprintf("resolv: %s %s: %s, denial of existence is %v", e.Name, dns.Type(e.Qtype), kind, e.Status)
+	if e.Status == Secure {
+		msg = fmt.Sprintf("resolv: %s %s: %s, denial of existence is proven", e.Name, dns.Type(e.Qtype), kind)
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// Unwrap returns the error for the negative response, so that a DenialError
+// matches [ErrRcode] (and [errors.As] finds the [RcodeError]) or [ErrNoData].
+func (e *DenialError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is [ErrBogus] and the denial is Bogus.
+func (e *DenialError) Is(target error) bool {
+	return target == ErrBogus && e.Status == Bogus
+}
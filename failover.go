@@ -0,0 +1,296 @@
+package resolv
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A SelectionPolicy determines the order in which a [Failover] transport
+// tries its upstreams.
+type SelectionPolicy int
+
+const (
+	// Try the upstreams in the order of the Failover's Upstreams.
+	SelectOrdered SelectionPolicy = iota
+
+	// Rotate through the upstreams: each query starts with the upstream after
+	// the one that the previous query started with.
+	SelectRotate
+
+	// Try the upstreams in order of their smoothed round-trip time (SRTT),
+	// fastest first.  An upstream without any RTT samples goes first, so that
+	// the Failover measures every upstream.
+	SelectSRTT
+)
+
+var selectionPolicyNames = []string{
+	SelectOrdered: "ordered",
+	SelectRotate:  "rotate",
+	SelectSRTT:    "srtt",
+}
+
+func (p SelectionPolicy) String() string {
+	if p < 0 || int(p) >= len(selectionPolicyNames) {
+		return fmt.Sprintf("SelectionPolicy(%d)", int(p))
+	}
+	return selectionPolicyNames[p]
+}
+
+// ParseSelectionPolicy returns the SelectionPolicy with the given name
+// ("ordered", "rotate", or "srtt").
+func ParseSelectionPolicy(name string) (SelectionPolicy, error) {
+	i := slices.Index(selectionPolicyNames, strings.ToLower(name))
+	if i < 0 {
+		return 0, fmt.Errorf("invalid selection policy %q", name)
+	}
+	return SelectionPolicy(i), nil
+}
+
+// The defaults for a [Failover]'s circuit breaker.
+const (
+	DefaultFailoverMaxFailures = 3
+	DefaultFailoverBackoff     = 30 * time.Second
+)
+
+// UpstreamStats describes one upstream of a [Failover].
+type UpstreamStats struct {
+	Queries  uint64 // the number of queries sent to the upstream
+	Failures uint64 // the number of those queries that failed
+
+	// The upstream's smoothed round-trip time; zero if the upstream has not
+	// answered a query yet.
+	SRTT time.Duration
+
+	// If the upstream is unhealthy (its circuit breaker is open), the time
+	// at which the Failover starts trying the upstream again; zero
+	// otherwise.
+	UnhealthyUntil time.Time
+}
+
+type upstreamState struct {
+	UpstreamStats
+	consecutiveFailures int
+}
+
+// A Failover is a Transport that sends each query to one of several upstream
+// transports, and fails over to the next upstream if the query times out or
+// otherwise fails, or if the response has an RCODE of SERVFAIL or REFUSED.
+// If all of the upstreams fail, the Failover returns the last SERVFAIL or
+// REFUSED response, if any, and otherwise the last error.  The Failover
+// records the index of the upstream that produced the response (or the
+// error) in the context's [ExchangeInfo], along with the details of that
+// upstream's exchange.
+//
+// The Failover tracks the health of each upstream: after MaxFailures
+// consecutive failures, the upstream is unhealthy for the Backoff period,
+// during which the Failover skips the upstream, unless every upstream is
+// unhealthy; then the Failover tries the unhealthy upstreams, the soonest
+// to recover first.  After the Backoff period, the Failover tries the
+// upstream again; a single failure then makes the upstream unhealthy for
+// another Backoff period, while a success makes the upstream healthy.
+//
+// A Failover is safe for concurrent use if its upstreams are (e.g., if each
+// upstream is a [Pool]).  A program must not modify a Failover's settings
+// after its first exchange.
+type Failover struct {
+	// The upstream transports.  The upstreams may use different protocols.
+	Upstreams []Transport
+
+	// The order in which the Failover tries the upstreams.
+	Policy SelectionPolicy
+
+	// The number of consecutive failures after which an upstream is
+	// unhealthy.  If zero, the Failover uses [DefaultFailoverMaxFailures].
+	MaxFailures int
+
+	// How long an upstream stays unhealthy.  If zero, the Failover uses
+	// [DefaultFailoverBackoff].
+	Backoff time.Duration
+
+	mu     sync.Mutex
+	states []*upstreamState
+	next   int // for SelectRotate, the upstream that the next query starts with
+}
+
+func (f *Failover) maxFailures() int {
+	if f.MaxFailures > 0 {
+		return f.MaxFailures
+	}
+	return DefaultFailoverMaxFailures
+}
+
+func (f *Failover) backoff() time.Duration {
+	if f.Backoff > 0 {
+		return f.Backoff
+	}
+	return DefaultFailoverBackoff
+}
+
+// init allocates the upstream states.  The caller must hold f.mu.
+func (f *Failover) init() {
+	if f.states != nil {
+		return
+	}
+	f.states = make([]*upstreamState, len(f.Upstreams))
+	for i := range f.states {
+		f.states[i] = new(upstreamState)
+	}
+}
+
+// order returns the indices of the upstreams that the next query should try,
+// in order: the healthy upstreams, in the order of the policy, or, if no
+// upstream is healthy, the unhealthy upstreams, the soonest to recover first.
+func (f *Failover) order() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	n := len(f.Upstreams)
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+
+	switch f.Policy {
+	case SelectRotate:
+		start := f.next
+		f.next = (f.next + 1) % n
+		for i := range indices {
+			indices[i] = (start + i) % n
+		}
+	case SelectSRTT:
+		slices.SortStableFunc(indices, func(a, b int) int {
+			return cmp.Compare(f.states[a].SRTT, f.states[b].SRTT)
+		})
+	}
+
+	now := time.Now()
+	var healthy, unhealthy []int
+	for _, i := range indices {
+		if now.Before(f.states[i].UnhealthyUntil) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	slices.SortStableFunc(unhealthy, func(a, b int) int {
+		return f.states[a].UnhealthyUntil.Compare(f.states[b].UnhealthyUntil)
+	})
+	return unhealthy
+}
+
+// record updates the state of upstream i after a query that took rtt.
+func (f *Failover) record(i int, rtt time.Duration, failed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.states[i]
+	s.Queries++
+	if !failed {
+		s.consecutiveFailures = 0
+		s.UnhealthyUntil = time.Time{}
+		if s.SRTT == 0 {
+			s.SRTT = rtt
+		} else {
+			// the smoothing factor from RFC 6298
+			s.SRTT = (7*s.SRTT + rtt) / 8
+		}
+		return
+	}
+
+	s.Failures++
+	s.consecutiveFailures++
+	if s.consecutiveFailures >= f.maxFailures() {
+		s.UnhealthyUntil = time.Now().Add(f.backoff())
+	}
+	// Penalize the upstream, so that SelectSRTT prefers the others.
+	s.SRTT = max(2*s.SRTT, rtt)
+}
+
+// Stats returns the statistics of each upstream, in the order of Upstreams.
+func (f *Failover) Stats() []UpstreamStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	stats := make([]UpstreamStats, len(f.states))
+	for i, s := range f.states {
+		stats[i] = s.UpstreamStats
+	}
+	return stats
+}
+
+// shouldFailover returns true if resp is an answer that another upstream
+// might improve on.
+func shouldFailover(resp *dns.Msg) bool {
+	return resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused
+}
+
+func (f *Failover) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return f.ExchangeContext(context.Background(), req)
+}
+
+func (f *Failover) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var lastResp, lastErr *upstreamResult
+
+	if len(f.Upstreams) == 0 {
+		return nil, fmt.Errorf("failover transport has no upstreams")
+	}
+
+	for _, i := range f.order() {
+		start := time.Now()
+		// Some transports modify the query (e.g., DoH zeroes the ID), so give
+		// each upstream its own copy, and its own ExchangeInfo.
+		info := new(ExchangeInfo)
+		resp, err := f.Upstreams[i].ExchangeContext(WithExchangeInfo(ctx, info), req.Copy())
+		rtt := time.Since(start)
+
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up; that's not the upstream's fault.
+			return nil, ctx.Err()
+		}
+
+		res := &upstreamResult{i: i, resp: resp, err: err, info: info}
+		failed := err != nil || shouldFailover(resp)
+		f.record(i, rtt, failed)
+		if !failed {
+			res.note(ctx)
+			return resp, nil
+		}
+
+		if err != nil {
+			lastErr = res
+		} else {
+			lastResp = res
+		}
+	}
+
+	if lastResp != nil {
+		lastResp.note(ctx)
+		return lastResp.resp, nil
+	}
+	lastErr.note(ctx)
+	return nil, lastErr.err
+}
+
+// Close closes all of the upstreams, and returns the first error.
+func (f *Failover) Close() error {
+	var firstErr error
+	for _, t := range f.Upstreams {
+		err := t.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
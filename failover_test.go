@@ -0,0 +1,162 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFailoverExchangeInfo(t *testing.T) {
+	const fail = -1
+
+	tests := []struct {
+		name       string
+		upstreams  []Transport
+		wantRcode  int // fail if the failover returns an error
+		wantIndex  int
+		wantServer string
+	}{
+		{
+			name: "first succeeds",
+			upstreams: []Transport{
+				upstream("ok0", 0, dns.RcodeSuccess),
+				upstream("ok1", 0, dns.RcodeSuccess),
+			},
+			wantRcode:  dns.RcodeSuccess,
+			wantIndex:  0,
+			wantServer: "ok0",
+		},
+		{
+			name: "fail over after an error",
+			upstreams: []Transport{
+				upstream("error", 0, fail),
+				upstream("ok", 10*time.Millisecond, dns.RcodeNameError),
+			},
+			wantRcode:  dns.RcodeNameError,
+			wantIndex:  1,
+			wantServer: "ok",
+		},
+		{
+			name: "last SERVFAIL wins over a later error",
+			upstreams: []Transport{
+				upstream("refused", 0, dns.RcodeRefused),
+				upstream("servfail", 10*time.Millisecond, dns.RcodeServerFailure),
+				upstream("error", 0, fail),
+			},
+			wantRcode:  dns.RcodeServerFailure,
+			wantIndex:  1,
+			wantServer: "servfail",
+		},
+		{
+			name: "all fail",
+			upstreams: []Transport{
+				upstream("error0", 0, fail),
+				upstream("error1", 0, fail),
+			},
+			wantRcode:  fail,
+			wantIndex:  1,
+			wantServer: "error1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Failover{Upstreams: tt.upstreams}
+			info := &ExchangeInfo{QName: "example."}
+			req := new(dns.Msg)
+			req.SetQuestion("example.", dns.TypeA)
+			resp, err := f.ExchangeContext(WithExchangeInfo(context.Background(), info), req)
+			if tt.wantRcode == fail {
+				if err == nil {
+					t.Fatalf("got rcode %d, want an error", resp.Rcode)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if resp.Rcode != tt.wantRcode {
+				t.Errorf("got rcode %d, want %d", resp.Rcode, tt.wantRcode)
+			}
+
+			// The details all describe the same exchange.
+			if info.Upstream != tt.wantIndex || info.Server != tt.wantServer {
+				t.Errorf("ExchangeInfo has upstream %d, server %q; want %d, %q",
+					info.Upstream, info.Server, tt.wantIndex, tt.wantServer)
+			}
+			if rtt := upstreamDelay(tt.upstreams[tt.wantIndex]); info.RTT != rtt {
+				t.Errorf("ExchangeInfo has RTT %v, want %v", info.RTT, rtt)
+			}
+			if info.QName != "example." {
+				t.Errorf("ExchangeInfo lost the QName")
+			}
+		})
+	}
+}
+
+// upstreamDelay returns the RTT that a test upstream records.
+func upstreamDelay(tr Transport) time.Duration {
+	info := new(ExchangeInfo)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	tr.ExchangeContext(WithExchangeInfo(context.Background(), info), req)
+	return info.RTT
+}
+
+func TestFailoverSkipsUnhealthy(t *testing.T) {
+	var queries [2]atomic.Int32
+	var rcode1 atomic.Int32 // the RCODE of upstream 1
+	f := &Failover{
+		Upstreams: []Transport{
+			funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+				queries[0].Add(1)
+				return nil, errors.New("upstream 0 failed")
+			}),
+			funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+				queries[1].Add(1)
+				resp := new(dns.Msg)
+				resp.SetRcode(req, int(rcode1.Load()))
+				return resp, nil
+			}),
+		},
+		MaxFailures: 3,
+		Backoff:     time.Hour,
+	}
+	exchange := func() *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("example.", dns.TypeA)
+		resp, err := f.Exchange(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Upstream 0 fails until it is unhealthy.
+	for i := 0; i < 3; i++ {
+		exchange()
+	}
+	if n := queries[0].Load(); n != 3 {
+		t.Fatalf("upstream 0 got %d queries, want 3", n)
+	}
+
+	// Upstream 1 fails too, but it is still healthy, so the Failover doesn't
+	// try upstream 0.
+	rcode1.Store(dns.RcodeServerFailure)
+	for i := 0; i < 3; i++ {
+		if resp := exchange(); resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("got rcode %d, want SERVFAIL", resp.Rcode)
+		}
+	}
+	if n := queries[0].Load(); n != 3 {
+		t.Errorf("unhealthy upstream 0 got %d queries while upstream 1 was healthy", n-3)
+	}
+
+	// Now neither upstream is healthy: the Failover tries both, upstream 0
+	// (the soonest to recover) first.
+	exchange()
+	if n0, n1 := queries[0].Load(), queries[1].Load(); n0 != 4 || n1 != 7 {
+		t.Errorf("got %d and %d queries, want 4 and 7", n0, n1)
+	}
+}
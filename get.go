@@ -1,6 +1,7 @@
 package resolv
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
@@ -11,9 +12,14 @@ import (
 )
 
 func (c *Client) GetIP4s(domain string) ([]netip.Addr, error) {
+	return c.GetIP4sContext(context.Background(), domain)
+}
+
+// GetIP4sContext is like [Client.GetIP4s], but takes a context.
+func (c *Client) GetIP4sContext(ctx context.Context, domain string) ([]netip.Addr, error) {
 	var addrs []netip.Addr
 
-	resp, err := c.Lookup(domain, dns.TypeA)
+	resp, err := c.LookupContext(ctx, domain, dns.TypeA)
 	if err != nil {
 		return nil, err
 	}
@@ -35,9 +41,14 @@ func (c *Client) GetIP4s(domain string) ([]netip.Addr, error) {
 }
 
 func (c *Client) GetIP6s(domain string) ([]netip.Addr, error) {
+	return c.GetIP6sContext(context.Background(), domain)
+}
+
+// GetIP6sContext is like [Client.GetIP6s], but takes a context.
+func (c *Client) GetIP6sContext(ctx context.Context, domain string) ([]netip.Addr, error) {
 	var addrs []netip.Addr
 
-	resp, err := c.Lookup(domain, dns.TypeAAAA)
+	resp, err := c.LookupContext(ctx, domain, dns.TypeAAAA)
 	if err != nil {
 		return nil, err
 	}
@@ -59,23 +70,32 @@ func (c *Client) GetIP6s(domain string) ([]netip.Addr, error) {
 }
 
 func (c *Client) GetIPs(name string) ([]netip.Addr, error) {
+	return c.GetIPsContext(context.Background(), name)
+}
+
+// GetIPsContext is like [Client.GetIPs], but takes a context.
+func (c *Client) GetIPsContext(ctx context.Context, name string) ([]netip.Addr, error) {
 	var addrs []netip.Addr
 	var errs []error
 
-	a, err := c.GetIP4s(name)
+	a, err := c.GetIP4sContext(ctx, name)
 	if err != nil {
 		errs = append(errs, err)
 	} else {
 		addrs = append(addrs, a...)
 	}
 
-	a, err = c.GetIP6s(name)
+	a, err = c.GetIP6sContext(ctx, name)
 	if err != nil {
 		errs = append(errs, err)
 	} else {
 		addrs = append(addrs, a...)
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if len(addrs) > 0 {
 		return addrs, nil
 	}
@@ -97,18 +117,18 @@ func (ns *Nameserver) String() string {
 	return fmt.Sprintf("name: %s, addrs: %v", ns.Name, ns.Addrs)
 }
 
-func (c *Client) lookupNS(domain string) ([]*dns.NS, *dns.Msg, error) {
-	resp, err := c.Lookup(domain, dns.TypeNS)
+func (c *Client) lookupNS(ctx context.Context, domain string) ([]*dns.NS, *dns.Msg, error) {
+	resp, err := c.LookupContext(ctx, domain, dns.TypeNS)
 	if err != nil {
 		return nil, resp, err
 	}
 	return CollectRRs[*dns.NS](resp.Answer), resp, nil
 }
 
-func (c *Client) getNS(domain string) ([]string, error) {
+func (c *Client) getNS(ctx context.Context, domain string) ([]string, error) {
 	var servers []string
 
-	nses, resp, err := c.lookupNS(domain)
+	nses, resp, err := c.lookupNS(ctx, domain)
 	if err == nil {
 		servers = functools.Map[*dns.NS, string](nses, func(ns *dns.NS) string {
 			return ns.Ns
@@ -119,7 +139,7 @@ func (c *Client) getNS(domain string) ([]string, error) {
 	// check if the query returned RCode success, but failed because there
 	// simply wasn't an answer.  In such a case, see if the Authority section
 	// has an SOA entry, and return the nameserver in that entry
-	if err == ErrRcode {
+	if errors.Is(err, ErrRcode) {
 		return nil, err
 	}
 
@@ -140,16 +160,21 @@ func (c *Client) getNS(domain string) ([]string, error) {
 }
 
 func (c *Client) GetNameservers(name string) ([]*Nameserver, error) {
+	return c.GetNameserversContext(context.Background(), name)
+}
+
+// GetNameserversContext is like [Client.GetNameservers], but takes a context.
+func (c *Client) GetNameserversContext(ctx context.Context, name string) ([]*Nameserver, error) {
 	var addrErrs []error
 	var results []*Nameserver
 
-	servers, err := c.getNS(name)
+	servers, err := c.getNS(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, server := range servers {
-		addrs, err := c.GetIPs(server)
+		addrs, err := c.GetIPsContext(ctx, server)
 		if err != nil {
 			addrErrs = append(addrErrs, err)
 			continue
@@ -157,6 +182,10 @@ func (c *Client) GetNameservers(name string) ([]*Nameserver, error) {
 		results = append(results, &Nameserver{Name: server, Addrs: addrs})
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if len(results) > 0 {
 		return results, nil
 	}
@@ -168,19 +197,3 @@ func (c *Client) GetNameservers(name string) ([]*Nameserver, error) {
 	mu.BUG("neither addresses nor errors")
 	return nil, nil
 }
-
-// SVCB records for a DNS service identified as dns1.example.com would be queried at _dns.dns1.example.com.
-
-// https://www.rfc-editor.org/rfc/rfc9461.html
-// https://www.rfc-editor.org/rfc/rfc9462.html
-/*
-func (c *Client) GetDoHPath(name string) (string, error) {
-    s := new(dns.SVCB)
-    s.Hdr = dns.RR_Header{Name: ".", Rrtype: dns.TypeSVCB, Class: dns.ClassINET}
-
-    e := new(dns.SVCBAlpn)
-    e.Alphn = []string{"h2", "h3"}
-
-    p := new(nds.SVCBDoHPath)
-}
-*/
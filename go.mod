@@ -3,7 +3,9 @@ module github.com/syslab-wm/resolv
 go 1.21.6
 
 require (
+	github.com/cloudflare/circl v1.3.7
 	github.com/miekg/dns v1.1.58
+	github.com/quic-go/quic-go v0.42.0
 	github.com/syslab-wm/adt v0.0.0-20240318160205-63295273c7e3
 	github.com/syslab-wm/functools v0.0.0-20240317173703-a058dbb9d1c7
 	github.com/syslab-wm/mu v0.2.0
@@ -11,6 +13,12 @@ require (
 )
 
 require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/crypto v0.18.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
 	golang.org/x/mod v0.14.0 // indirect
 	golang.org/x/net v0.20.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
@@ -0,0 +1,121 @@
+package resolv
+
+import (
+	"context"
+	"time"
+)
+
+// An ExchangeInfo records details about how a transport produced a response.
+// To collect these details for a query, attach an ExchangeInfo to the
+// query's context with [WithExchangeInfo], and then inspect the
+// ExchangeInfo after the exchange returns.
+type ExchangeInfo struct {
+	// The server that produced the response: its address (host:port), or,
+	// for [DoH], its URL.  For an [Iterative] transport, this is the
+	// authoritative server that produced the final response.  This is empty
+	// if a [Cache] answered the query.
+	Server string
+
+	// The protocol of the exchange that produced the response: "udp",
+	// "tcp", "tls" ([DoT]), "https" ([DoH]), or "quic" ([DoQ]).  This is
+	// "tcp" if a [Do53UDP] transport fell back to TCP.
+	Protocol string
+
+	// The round-trip time of the exchange that produced the response: from
+	// sending the query to receiving the response.  This does not include
+	// earlier attempts that timed out, or, except for [DoH] (where the HTTP
+	// client sets up connections as needed), the time to set up a
+	// connection.
+	RTT time.Duration
+
+	// The size of the response, in bytes.  For [DoQ], this is the size of
+	// the message as received, and for [DoH], the size of the HTTP response
+	// body; for the other transports, which do not expose the raw message,
+	// it is the size of the response when packed with name compression.
+	Size int
+
+	// The EDNS0 UDP payload size advertised in the UDP query that produced
+	// the response.  This is 0 if the query did not include an OPT record,
+	// or if the response came over a transport other than UDP.
+	UDPBufSize uint16
+
+	// True if the UDP response was truncated, and the transport re-sent the
+	// query over TCP to get the full response.
+	TCPFallback bool
+
+	// True if the response has an EDNS0 Padding option (RFC 7830).  Only
+	// the encrypted transports ([DoT], [DoH], [DoQ]) record this.
+	ResponsePadded bool
+
+	// For [DoH], the value of the HTTP response's Age header: how long the
+	// response sat in an HTTP cache.  The transport has already decremented
+	// the response's TTLs by this amount (RFC 8484, Section 5.1).
+	HTTPAge time.Duration
+
+	// For [DoH], how much longer the HTTP response stays fresh: the freshness
+	// lifetime from the response's Cache-Control max-age directive (or else
+	// its Expires header), minus HTTPAge.  This is zero if the response is
+	// stale, uncacheable, or has no explicit freshness lifetime.
+	HTTPFreshness time.Duration
+
+	// For [Do53UDP], the number of times the transport sent the query over
+	// UDP, including any retries after timeouts (see [RetryPolicy]) and after
+	// truncated responses.
+	Attempts int
+
+	// True if a [Cache] answered the query from its cache.
+	CacheHit bool
+
+	// For [Client.Lookup], the fully-qualified name that produced the
+	// response: the name after any expansion with the client's Search list.
+	QName string
+
+	// For a validating [Client], the DNSSEC validation status of the
+	// response, and, unless the status is Secure, the reason for it.  If
+	// the client followed CNAMEs, this is the weakest status of the
+	// responses.
+	Validation       ValidationStatus
+	ValidationReason string
+
+	// For a [Failover] or [Race], the index (in Upstreams) of the upstream
+	// that produced the response.
+	Upstream int
+}
+
+type exchangeInfoKey struct{}
+
+// WithExchangeInfo returns a copy of ctx that carries info.  The transports
+// fill in info during any exchange that uses the returned context.
+func WithExchangeInfo(ctx context.Context, info *ExchangeInfo) context.Context {
+	return context.WithValue(ctx, exchangeInfoKey{}, info)
+}
+
+// exchangeInfoFrom returns the ExchangeInfo that ctx carries.  If ctx does
+// not carry one, the function returns a throwaway ExchangeInfo, so that the
+// transports can record details unconditionally.
+func exchangeInfoFrom(ctx context.Context) *ExchangeInfo {
+	info, ok := ctx.Value(exchangeInfoKey{}).(*ExchangeInfo)
+	if !ok || info == nil {
+		return new(ExchangeInfo)
+	}
+	return info
+}
+
+// setTransportInfo sets the details in info that the transports record to
+// those in from, and keeps the details that a [Client] records (QName and the
+// validation status).
+func (info *ExchangeInfo) setTransportInfo(from *ExchangeInfo) {
+	qname, status, reason := info.QName, info.Validation, info.ValidationReason
+	*info = *from
+	info.QName, info.Validation, info.ValidationReason = qname, status, reason
+}
+
+// noteExchange records, in the context's ExchangeInfo, the server, protocol,
+// round-trip time, and size of the exchange that produced a response.
+func noteExchange(ctx context.Context, server, protocol string, rtt time.Duration, size int) {
+	info := exchangeInfoFrom(ctx)
+	info.Server = server
+	info.Protocol = protocol
+	info.RTT = rtt
+	info.Size = size
+}
@@ -0,0 +1,540 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootHints are the addresses of the root servers (a.root-servers.net
+// through m.root-servers.net), as in the IANA root hints file, named.root.
+var rootHints = []netip.Addr{
+	netip.MustParseAddr("198.41.0.4"),
+	netip.MustParseAddr("2001:503:ba3e::2:30"),
+	netip.MustParseAddr("170.247.170.2"),
+	netip.MustParseAddr("2801:1b8:10::b"),
+	netip.MustParseAddr("192.33.4.12"),
+	netip.MustParseAddr("2001:500:2::c"),
+	netip.MustParseAddr("199.7.91.13"),
+	netip.MustParseAddr("2001:500:2d::d"),
+	netip.MustParseAddr("192.203.230.10"),
+	netip.MustParseAddr("2001:500:a8::e"),
+	netip.MustParseAddr("192.5.5.241"),
+	netip.MustParseAddr("2001:500:2f::f"),
+	netip.MustParseAddr("192.112.36.4"),
+	netip.MustParseAddr("2001:500:12::d0d"),
+	netip.MustParseAddr("198.97.190.53"),
+	netip.MustParseAddr("2001:500:1::53"),
+	netip.MustParseAddr("192.36.148.17"),
+	netip.MustParseAddr("2001:7fe::53"),
+	netip.MustParseAddr("192.58.128.30"),
+	netip.MustParseAddr("2001:503:c27::2:30"),
+	netip.MustParseAddr("193.0.14.129"),
+	netip.MustParseAddr("2001:7fd::1"),
+	netip.MustParseAddr("199.7.83.42"),
+	netip.MustParseAddr("2001:500:9f::42"),
+	netip.MustParseAddr("202.12.27.33"),
+	netip.MustParseAddr("2001:dc3::35"),
+}
+
+// The default timeout for each query that an [Iterative] transport sends to
+// an authoritative server.
+const DefaultIterativeTimeout = 2 * time.Second
+
+const (
+	// The most queries that an Iterative transport sends to the
+	// authoritative servers to resolve one query.
+	maxIterativeQueries = 100
+
+	// How deeply an Iterative transport nests when it resolves the names of
+	// nameservers that lack glue, which in turn may lack glue.
+	maxIterativeDepth = 4
+
+	// The longest chain of CNAME and DNAME records that an Iterative
+	// transport follows.
+	maxIterativeAliases = 16
+)
+
+// An Iterative is a Transport that resolves queries itself, as a recursive
+// resolver does, rather than send them to a recursive resolver.  Starting
+// from the root servers (or the closest delegation in its cache), it sends
+// each query to the authoritative servers of a zone, and follows their
+// referrals down to the zone that has the answer.  To reach the nameservers
+// of a referral, it uses the referral's glue records that are in the
+// bailiwick of the referring zone, and otherwise resolves the nameservers'
+// names itself.  It follows CNAME and DNAME records (RFC 6672) from one zone
+// to another, and returns the whole chain in the response's answer.
+//
+// The Iterative caches delegations (the addresses of each zone's
+// nameservers) for the TTL of the zone's NS records.  It does not cache
+// answers; for that, wrap it in a [Cache].  An Iterative neither validates
+// DNSSEC nor sets the AD bit of its responses.  It ignores the RD bit of
+// queries.
+//
+// An Iterative is safe for concurrent use.  A program must not modify an
+// Iterative's settings after its first exchange.
+type Iterative struct {
+	// The addresses of the root servers.  If nil, the transport uses the
+	// addresses from the IANA root hints file.
+	RootHints []netip.Addr
+
+	// The port of the authoritative servers.  If empty, the transport uses
+	// port 53.
+	Port string
+
+	// Only query authoritative servers over IPv4 (or IPv6).
+	IPv4Only bool
+	IPv6Only bool
+
+	// The timeout for each query to an authoritative server.  If zero, the
+	// transport uses [DefaultIterativeTimeout].
+	Timeout time.Duration
+
+	mu          sync.Mutex
+	delegations map[string]*delegation // keyed by the zone's canonical name
+}
+
+type delegation struct {
+	servers []netip.Addr
+	expires time.Time
+}
+
+// iterState is the state of one iterative resolution.
+type iterState struct {
+	req     *dns.Msg      // the client's query, a template for the transport's queries
+	queries int           // the number of queries sent so far
+	last    *ExchangeInfo // the exchange of the last query that got a response
+}
+
+func (t *Iterative) port() string {
+	if t.Port != "" {
+		return t.Port
+	}
+	return "53"
+}
+
+func (t *Iterative) timeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return DefaultIterativeTimeout
+}
+
+// filterAddrs returns the addresses that the transport may query, in the
+// order in which to query them: the IPv4 addresses and then the IPv6
+// addresses, each in random order, to spread the load over the servers.
+func (t *Iterative) filterAddrs(addrs []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is4() || addr.Is4In6() {
+			if !t.IPv6Only {
+				v4 = append(v4, addr.Unmap())
+			}
+		} else if !t.IPv4Only {
+			v6 = append(v6, addr)
+		}
+	}
+	rand.Shuffle(len(v4), func(i, j int) { v4[i], v4[j] = v4[j], v4[i] })
+	rand.Shuffle(len(v6), func(i, j int) { v6[i], v6[j] = v6[j], v6[i] })
+	return append(v4, v6...)
+}
+
+// closestDelegation returns the closest enclosing zone of name whose
+// nameservers the transport knows, and the addresses of those nameservers.
+func (t *Iterative) closestDelegation(name string) (string, []netip.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	for i := range labels {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		d, ok := t.delegations[zone]
+		if !ok {
+			continue
+		}
+		if now.Before(d.expires) {
+			return zone, d.servers
+		}
+		delete(t.delegations, zone)
+	}
+
+	if t.RootHints != nil {
+		return ".", t.RootHints
+	}
+	return ".", rootHints
+}
+
+func (t *Iterative) addDelegation(zone string, servers []netip.Addr, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.delegations == nil {
+		t.delegations = make(map[string]*delegation)
+	}
+	t.delegations[dns.CanonicalName(zone)] = &delegation{
+		servers: servers,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// query sends one query for name and qtype to the authoritative server at
+// addr.
+func (t *Iterative) query(ctx context.Context, st *iterState, addr netip.Addr, name string, qtype uint16) (*dns.Msg, error) {
+	st.queries++
+	if st.queries > maxIterativeQueries {
+		return nil, ErrIterationLimit
+	}
+
+	m := st.req.Copy()
+	m.Id = dns.Id()
+	m.RecursionDesired = false
+	m.Question = []dns.Question{{Name: name, Qtype: qtype, Qclass: st.req.Question[0].Qclass}}
+
+	tr := &Do53UDP{
+		Server:     net.JoinHostPort(addr.String(), t.port()),
+		Timeout:    t.timeout(),
+		UDPBufSize: DefaultUDPBufSize,
+	}
+	// The caller's ExchangeInfo describes the client's exchange with this
+	// transport, not this transport's exchanges with the servers.
+	info := new(ExchangeInfo)
+	resp, err := tr.ExchangeContext(WithExchangeInfo(ctx, info), m)
+	if err != nil {
+		return nil, err
+	}
+	st.last = info
+	return resp, nil
+}
+
+// findReferral returns the child zone, nameserver names, and NS TTL of a
+// referral in resp from zone toward name.  The child zone is empty if resp is
+// not such a referral.
+func findReferral(resp *dns.Msg, zone, name string) (string, []string, uint32) {
+	var child string
+	var nsNames []string
+	var ttl uint32
+
+	if resp.Rcode != dns.RcodeSuccess || len(CollectRRs[*dns.SOA](resp.Ns)) > 0 {
+		return "", nil, 0
+	}
+	for _, ns := range CollectRRs[*dns.NS](resp.Ns) {
+		owner := ns.Hdr.Name
+		if child == "" {
+			// The child must be below zone, and at or above name.
+			if !dns.IsSubDomain(zone, owner) || dns.CountLabel(owner) <= dns.CountLabel(zone) || !dns.IsSubDomain(owner, name) {
+				continue
+			}
+			child = owner
+			ttl = ns.Hdr.Ttl
+		} else if !strings.EqualFold(owner, child) {
+			continue
+		}
+		nsNames = append(nsNames, dns.Fqdn(ns.Ns))
+		ttl = min(ttl, ns.Hdr.Ttl)
+	}
+	return child, nsNames, ttl
+}
+
+// isUsable returns true if resp, from a server of zone, is an answer, a
+// negative answer, or a referral toward name.
+func isUsable(resp *dns.Msg, zone, name string) bool {
+	switch {
+	case resp.Rcode == dns.RcodeNameError:
+		return true
+	case resp.Rcode != dns.RcodeSuccess:
+		return false
+	case len(resp.Answer) > 0 || resp.Authoritative:
+		return true
+	case len(CollectRRs[*dns.SOA](resp.Ns)) > 0:
+		return true
+	}
+	child, _, _ := findReferral(resp, zone, name)
+	return child != ""
+}
+
+// queryZone sends the query for name and qtype to the servers of zone, one
+// after another, until one returns a usable response.
+func (t *Iterative) queryZone(ctx context.Context, st *iterState, zone string, servers []netip.Addr, name string, qtype uint16) (*dns.Msg, error) {
+	var errs []error
+
+	for _, addr := range t.filterAddrs(servers) {
+		resp, err := t.query(ctx, st, addr, name, qtype)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, ErrIterationLimit) {
+				return nil, err
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			continue
+		}
+		if isUsable(resp, zone, name) {
+			return resp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: unusable response (rcode %s)", addr, dns.RcodeToString[resp.Rcode]))
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("%w: zone %s has no nameserver addresses", ErrNoAuthoritativeAnswer, zone)
+	}
+	return nil, fmt.Errorf("%w: zone %s: %w", ErrNoAuthoritativeAnswer, zone, errors.Join(errs...))
+}
+
+// synthesizeCNAME returns the CNAME record that the DNAME record dname
+// implies for name, which is below dname's owner (RFC 6672, Section 2.2).
+func synthesizeCNAME(dname *dns.DNAME, name string) *dns.CNAME {
+	prefix := name[:len(name)-len(dname.Hdr.Name)]
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dname.Hdr.Class,
+			Ttl:    dname.Hdr.Ttl,
+		},
+		Target: prefix + dns.Fqdn(dname.Target),
+	}
+}
+
+// followAnswer follows the CNAME and DNAME records in the answer of resp,
+// from a server of zone, starting at name.  It returns the alias records
+// that it followed, the name at the end of the chain, and the records of
+// qtype at that name, if any.  It only trusts the records in zone's
+// bailiwick.
+func followAnswer(resp *dns.Msg, zone, name string, qtype uint16) ([]dns.RR, string, []dns.RR) {
+	var aliases, answer []dns.RR
+
+	for i := 0; i < maxIterativeAliases && dns.IsSubDomain(zone, name); i++ {
+		var cname *dns.CNAME
+		var dname *dns.DNAME
+		for _, rr := range resp.Answer {
+			hdr := rr.Header()
+			switch {
+			case strings.EqualFold(hdr.Name, name) && (hdr.Rrtype == qtype || qtype == dns.TypeANY):
+				answer = append(answer, rr)
+			case hdr.Rrtype == dns.TypeCNAME && strings.EqualFold(hdr.Name, name):
+				cname = rr.(*dns.CNAME)
+			case hdr.Rrtype == dns.TypeDNAME && dns.IsSubDomain(hdr.Name, name) &&
+				!strings.EqualFold(hdr.Name, name) && dns.IsSubDomain(zone, hdr.Name):
+				dname = rr.(*dns.DNAME)
+			}
+		}
+		if len(answer) > 0 {
+			return aliases, name, answer
+		}
+
+		if dname != nil {
+			aliases = append(aliases, dname)
+			synth := synthesizeCNAME(dname, name)
+			if _, ok := dns.IsDomainName(synth.Target); !ok {
+				// the target is too long (RFC 6672, Section 2.2)
+				return aliases, name, nil
+			}
+			if cname == nil || !strings.EqualFold(cname.Target, synth.Target) {
+				cname = synth
+			}
+		}
+		if cname == nil {
+			break
+		}
+		aliases = append(aliases, cname)
+		name = dns.Fqdn(cname.Target)
+	}
+
+	return aliases, name, nil
+}
+
+// resolveAddrs resolves the addresses of a nameserver.
+func (t *Iterative) resolveAddrs(ctx context.Context, st *iterState, name string, depth int) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	var err error
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if (qtype == dns.TypeA && t.IPv6Only) || (qtype == dns.TypeAAAA && t.IPv4Only) {
+			continue
+		}
+		var rrs []dns.RR
+		_, rrs, err = t.resolve(ctx, st, name, qtype, depth)
+		if err != nil {
+			continue
+		}
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.A:
+				if addr, ok := netip.AddrFromSlice(rr.A.To4()); ok {
+					addrs = append(addrs, addr)
+				}
+			case *dns.AAAA:
+				if addr, ok := netip.AddrFromSlice(rr.AAAA); ok {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, err
+}
+
+// referralServers returns the addresses of the nameservers of a referral in
+// resp from zone to child: the glue addresses in zone's bailiwick, or else
+// the addresses that the transport resolves for the nameservers' names.
+func (t *Iterative) referralServers(ctx context.Context, st *iterState, resp *dns.Msg, zone, child string, nsNames []string, depth int) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+
+	isNS := func(name string) bool {
+		return slices.ContainsFunc(nsNames, func(ns string) bool {
+			return strings.EqualFold(ns, name)
+		})
+	}
+	for _, rr := range resp.Extra {
+		owner := rr.Header().Name
+		if !isNS(owner) || !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if addr, ok := netip.AddrFromSlice(rr.A.To4()); ok {
+				addrs = append(addrs, addr)
+			}
+		case *dns.AAAA:
+			if addr, ok := netip.AddrFromSlice(rr.AAAA); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(t.filterAddrs(addrs)) > 0 {
+		return addrs, nil
+	}
+
+	// glueless delegation
+	for _, ns := range nsNames {
+		if dns.IsSubDomain(child, ns) {
+			// only the glue that the referral lacks could reach this
+			// nameserver
+			continue
+		}
+		addrs, err := t.resolveAddrs(ctx, st, ns, depth+1)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, ErrIterationLimit) {
+			return nil, err
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, nil
+}
+
+// resolve resolves name and qtype iteratively.  It returns the final
+// authoritative response, and the answer: the chain of aliases that it
+// followed from name, and the records of qtype at the end of the chain.
+func (t *Iterative) resolve(ctx context.Context, st *iterState, name string, qtype uint16, depth int) (*dns.Msg, []dns.RR, error) {
+	var answer []dns.RR
+
+	if depth > maxIterativeDepth {
+		return nil, nil, ErrIterationLimit
+	}
+
+	zone, servers := t.closestDelegation(name)
+	for {
+		resp, err := t.queryZone(ctx, st, zone, servers, name, qtype)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		aliases, target, rrs := followAnswer(resp, zone, name, qtype)
+		answer = append(answer, aliases...)
+		answer = append(answer, rrs...)
+		if len(rrs) > 0 {
+			return resp, answer, nil
+		}
+		if len(answer) > maxIterativeAliases {
+			return nil, nil, ErrIterationLimit
+		}
+
+		if target != name {
+			// The response ends at an alias whose target it lacks the
+			// records of.  Ask for the target afresh: from the servers of
+			// the zone if it is in the zone, and otherwise from the
+			// closest delegation that the transport knows.
+			name = target
+			if !dns.IsSubDomain(zone, name) {
+				zone, servers = t.closestDelegation(name)
+			}
+			continue
+		}
+
+		child, nsNames, ttl := findReferral(resp, zone, name)
+		if child == "" {
+			// a negative answer (NXDOMAIN or NODATA)
+			return resp, answer, nil
+		}
+		servers, err = t.referralServers(ctx, st, resp, zone, child, nsNames, depth)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(servers) == 0 {
+			return nil, nil, fmt.Errorf("%w: can't find the addresses of the nameservers of %s", ErrNoAuthoritativeAnswer, child)
+		}
+		t.addDelegation(child, servers, ttl)
+		zone = child
+	}
+}
+
+func (t *Iterative) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return t.ExchangeContext(context.Background(), req)
+}
+
+func (t *Iterative) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("iterative transport requires a query with one question")
+	}
+
+	st := &iterState{req: req}
+	final, answer, err := t.resolve(ctx, st, dns.Fqdn(req.Question[0].Name), req.Question[0].Qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.last != nil {
+		noteExchange(ctx, st.last.Server, st.last.Protocol, st.last.RTT, st.last.Size)
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Rcode = final.Rcode
+	resp.Answer = answer
+	resp.Ns = final.Ns
+	if req.IsEdns0() != nil {
+		if opt := final.IsEdns0(); opt != nil {
+			resp.Extra = append(resp.Extra, opt)
+		}
+	}
+	return resp, nil
+}
+
+// Close discards the transport's cache of delegations.
+func (t *Iterative) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.delegations = nil
+	return nil
+}
@@ -0,0 +1,401 @@
+package resolv
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// An authServer is an authoritative server for a test of Iterative.  It
+// serves its zones from their zone files, refers queries below its zone cuts
+// to the child zones, with the glue that its zone has, and synthesizes CNAME
+// records from DNAME records.  Like some real servers, it doesn't chase the
+// CNAME records in its answers.  If refuse is set, the server is lame: it
+// refuses every query.
+type authServer struct {
+	zones  map[string][]dns.RR // keyed by the zone's canonical name
+	refuse bool
+
+	mu      sync.Mutex
+	queries int
+}
+
+// newAuthServer returns an authServer for the zones in the zone file, where
+// each zone starts with its SOA record.
+func newAuthServer(t *testing.T, zones string) *authServer {
+	s := &authServer{zones: make(map[string][]dns.RR)}
+	var origin string
+	zp := dns.NewZoneParser(strings.NewReader(zones), "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			origin = dns.CanonicalName(rr.Header().Name)
+		}
+		s.zones[origin] = append(s.zones[origin], rr)
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// mustRR parses a record in presentation format.
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func (s *authServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+func (s *authServer) serve(w dns.ResponseWriter, req *dns.Msg) {
+	s.mu.Lock()
+	s.queries++
+	s.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	defer w.WriteMsg(resp)
+
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+	zone := ""
+	for z := range s.zones {
+		if dns.IsSubDomain(z, name) && (zone == "" || dns.CountLabel(z) > dns.CountLabel(zone)) {
+			zone = z
+		}
+	}
+	if s.refuse || zone == "" {
+		resp.Rcode = dns.RcodeRefused
+		return
+	}
+	rrs := s.zones[zone]
+
+	// a referral from the highest zone cut at or above name
+	cut := ""
+	for _, rr := range rrs {
+		owner := rr.Header().Name
+		if rr.Header().Rrtype == dns.TypeNS && owner != zone && dns.IsSubDomain(owner, name) &&
+			(cut == "" || dns.CountLabel(owner) < dns.CountLabel(cut)) {
+			cut = owner
+		}
+	}
+	if cut != "" {
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == cut {
+				resp.Ns = append(resp.Ns, ns)
+				for _, glue := range rrs {
+					typ := glue.Header().Rrtype
+					if (typ == dns.TypeA || typ == dns.TypeAAAA) && glue.Header().Name == ns.Ns {
+						resp.Extra = append(resp.Extra, glue)
+					}
+				}
+			}
+		}
+		return
+	}
+
+	resp.Authoritative = true
+	for _, rr := range rrs {
+		if dname, ok := rr.(*dns.DNAME); ok && dname.Hdr.Name != name && dns.IsSubDomain(dname.Hdr.Name, name) {
+			resp.Answer = append(resp.Answer, dname, synthesizeCNAME(dname, q.Name))
+			return
+		}
+	}
+
+	exists := false
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if dns.IsSubDomain(name, hdr.Name) {
+			exists = true
+		}
+		if hdr.Name != name {
+			continue
+		}
+		if hdr.Rrtype == q.Qtype || (hdr.Rrtype == dns.TypeCNAME && q.Qtype != dns.TypeCNAME) {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if len(resp.Answer) > 0 {
+		return
+	}
+	if !exists {
+		resp.Rcode = dns.RcodeNameError
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			resp.Ns = append(resp.Ns, rr)
+		}
+	}
+}
+
+// iterativeWorld is a hierarchy of zones on loopback servers, all on the same
+// port.
+const iterativeWorld = `
+. 300 IN SOA a.root. hostmaster.root. 1 3600 600 86400 300
+. 300 IN NS a.root.
+com. 300 IN NS ns.com.
+ns.com. 300 IN A 127.0.0.2
+net. 300 IN NS ns.net.
+ns.net. 300 IN A 127.0.0.3
+---127.0.0.2
+com. 300 IN SOA ns.com. hostmaster.com. 1 3600 600 86400 300
+com. 300 IN NS ns.com.
+example.com. 300 IN NS ns1.example.com.
+ns1.example.com. 300 IN A 127.0.0.4
+ns1.example.com. 300 IN AAAA ::1
+glueless.com. 300 IN NS ns.provider.net.
+ns.provider.net. 300 IN A 127.0.0.99
+lame.com. 300 IN NS ns1.lame.com.
+lame.com. 300 IN NS ns2.lame.com.
+ns1.lame.com. 300 IN A 127.0.0.6
+ns2.lame.com. 300 IN A 127.0.0.4
+alllame.com. 300 IN NS ns.alllame.com.
+ns.alllame.com. 300 IN A 127.0.0.6
+---127.0.0.3
+net. 300 IN SOA ns.net. hostmaster.net. 1 3600 600 86400 300
+net. 300 IN NS ns.net.
+provider.net. 300 IN SOA ns.provider.net. hostmaster.provider.net. 1 3600 600 86400 300
+provider.net. 300 IN NS ns.provider.net.
+ns.provider.net. 300 IN A 127.0.0.5
+---127.0.0.4
+example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 60
+example.com. 300 IN NS ns1.example.com.
+ns1.example.com. 300 IN A 127.0.0.4
+www.example.com. 300 IN A 192.0.2.1
+alias.example.com. 300 IN CNAME www.example.com.
+far.example.com. 300 IN CNAME www.glueless.com.
+dangling.example.com. 300 IN CNAME nope.example.com.
+d.example.com. 300 IN DNAME glueless.com.
+dd.example.com. 300 IN DNAME sub.example.com.
+y.sub.example.com. 300 IN A 192.0.2.5
+lame.com. 300 IN SOA ns2.lame.com. hostmaster.lame.com. 1 3600 600 86400 60
+lame.com. 300 IN NS ns1.lame.com.
+lame.com. 300 IN NS ns2.lame.com.
+www.lame.com. 300 IN A 192.0.2.4
+---127.0.0.5
+glueless.com. 300 IN SOA ns.provider.net. hostmaster.glueless.com. 1 3600 600 86400 60
+glueless.com. 300 IN NS ns.provider.net.
+www.glueless.com. 300 IN A 192.0.2.2
+x.glueless.com. 300 IN A 192.0.2.3
+`
+
+// newIterativeTest starts the servers of iterativeWorld (the root server is
+// 127.0.0.1, and 127.0.0.6 is lame), and returns an Iterative transport that
+// uses them, and the servers, keyed by address.
+func newIterativeTest(t *testing.T) (*Iterative, map[string]*authServer) {
+	servers := make(map[string]*authServer)
+	var port string
+	for i, part := range strings.Split(iterativeWorld, "---") {
+		addr, zone := "127.0.0.1", part
+		if i > 0 {
+			addr, zone, _ = strings.Cut(part, "\n")
+		}
+		s := newAuthServer(t, zone)
+		if port == "" {
+			_, port, _ = net.SplitHostPort(startDNSServer(t, addr+":0", s.serve))
+		} else {
+			startDNSServer(t, net.JoinHostPort(addr, port), s.serve)
+		}
+		servers[addr] = s
+	}
+	lame := &authServer{refuse: true}
+	startDNSServer(t, net.JoinHostPort("127.0.0.6", port), lame.serve)
+	servers["127.0.0.6"] = lame
+
+	return &Iterative{
+		RootHints: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+		Port:      port,
+		IPv4Only:  true,
+		Timeout:   time.Second,
+	}, servers
+}
+
+func TestIterative(t *testing.T) {
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		want      []string // the answer
+		wantErr   error
+	}{
+		{
+			name:  "in-bailiwick glue",
+			qname: "www.example.com.", qtype: dns.TypeA,
+			want: []string{"www.example.com. 300 IN A 192.0.2.1"},
+		},
+		{
+			name:  "glueless NS",
+			qname: "www.glueless.com.", qtype: dns.TypeA,
+			want: []string{"www.glueless.com. 300 IN A 192.0.2.2"},
+		},
+		{
+			name:  "lame delegation",
+			qname: "www.lame.com.", qtype: dns.TypeA,
+			want: []string{"www.lame.com. 300 IN A 192.0.2.4"},
+		},
+		{
+			name:  "all servers lame",
+			qname: "www.alllame.com.", qtype: dns.TypeA,
+			wantErr: ErrNoAuthoritativeAnswer,
+		},
+		{
+			name:  "CNAME in zone",
+			qname: "alias.example.com.", qtype: dns.TypeA,
+			want: []string{
+				"alias.example.com. 300 IN CNAME www.example.com.",
+				"www.example.com. 300 IN A 192.0.2.1",
+			},
+		},
+		{
+			name:  "CNAME across zones",
+			qname: "far.example.com.", qtype: dns.TypeA,
+			want: []string{
+				"far.example.com. 300 IN CNAME www.glueless.com.",
+				"www.glueless.com. 300 IN A 192.0.2.2",
+			},
+		},
+		{
+			name:  "DNAME in zone",
+			qname: "y.dd.example.com.", qtype: dns.TypeA,
+			want: []string{
+				"dd.example.com. 300 IN DNAME sub.example.com.",
+				"y.dd.example.com. 300 IN CNAME y.sub.example.com.",
+				"y.sub.example.com. 300 IN A 192.0.2.5",
+			},
+		},
+		{
+			name:  "DNAME across zones",
+			qname: "x.d.example.com.", qtype: dns.TypeA,
+			want: []string{
+				"d.example.com. 300 IN DNAME glueless.com.",
+				"x.d.example.com. 300 IN CNAME x.glueless.com.",
+				"x.glueless.com. 300 IN A 192.0.2.3",
+			},
+		},
+		{
+			name:  "NXDOMAIN",
+			qname: "nope.example.com.", qtype: dns.TypeA,
+			wantRcode: dns.RcodeNameError,
+		},
+		{
+			name:  "NODATA",
+			qname: "www.example.com.", qtype: dns.TypeAAAA,
+		},
+		{
+			name:  "CNAME to NXDOMAIN",
+			qname: "dangling.example.com.", qtype: dns.TypeA,
+			wantRcode: dns.RcodeNameError,
+			want:      []string{"dangling.example.com. 300 IN CNAME nope.example.com."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, _ := newIterativeTest(t)
+			defer tr.Close()
+
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+			resp, err := tr.Exchange(req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if len(resp.Answer) != len(tt.want) {
+				t.Fatalf("got answer %v, want %q", resp.Answer, tt.want)
+			}
+			for i, s := range tt.want {
+				if want := mustRR(t, s); !dns.IsDuplicate(resp.Answer[i], want) {
+					t.Errorf("answer %d: got %v, want %v", i, resp.Answer[i], want)
+				}
+			}
+			if len(tt.want) == 0 && len(CollectRRs[*dns.SOA](resp.Ns)) == 0 {
+				t.Errorf("negative answer has no SOA record")
+			}
+		})
+	}
+}
+
+func TestIterativeDelegationCache(t *testing.T) {
+	tr, servers := newIterativeTest(t)
+	defer tr.Close()
+	root := servers["127.0.0.1"]
+
+	query := func() {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		if _, err := tr.Exchange(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query()
+	if n := root.count(); n != 1 {
+		t.Fatalf("root got %d queries, want 1", n)
+	}
+	if zone, _ := tr.closestDelegation("www.example.com."); zone != "example.com." {
+		t.Errorf("closest delegation is %q, want example.com.", zone)
+	}
+
+	// The delegation is cached.
+	query()
+	if n := root.count(); n != 1 {
+		t.Errorf("root got %d queries, want 1", n)
+	}
+	if n := servers["127.0.0.2"].count(); n != 1 {
+		t.Errorf("com server got %d queries, want 1", n)
+	}
+
+	// The delegations expire.
+	tr.mu.Lock()
+	for _, d := range tr.delegations {
+		d.expires = time.Now().Add(-time.Second)
+	}
+	tr.mu.Unlock()
+	query()
+	if n := root.count(); n != 2 {
+		t.Errorf("root got %d queries after the delegations expired, want 2", n)
+	}
+	tr.mu.Lock()
+	if d, ok := tr.delegations["example.com."]; !ok || !d.expires.After(time.Now()) {
+		t.Errorf("expired delegation was not replaced")
+	}
+	tr.mu.Unlock()
+}
+
+func TestIterativeValidate(t *testing.T) {
+	tr, servers := newIterativeTest(t)
+	defer tr.Close()
+
+	c := &Client{Transport: tr, Validate: true}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	if _, err := c.Exchange(req); !errors.Is(err, ErrValidateIterative) {
+		t.Fatalf("err = %v, want ErrValidateIterative", err)
+	}
+	if n := servers["127.0.0.1"].count(); n != 0 {
+		t.Errorf("root got %d queries, want 0", n)
+	}
+}
@@ -1,6 +1,9 @@
 package resolv
 
 import (
+	"strings"
+	"time"
+
 	"github.com/miekg/dns"
 	"github.com/syslab-wm/functools"
 )
@@ -19,6 +22,9 @@ func CollectRRs[T dns.RR](rrs []dns.RR) []T {
 	})
 }
 
+// OrderCNAMEs sorts a in place into a chain, in which each CNAME's target
+// is the next CNAME's owner; names compare case-insensitively.  It returns
+// false if the CNAMEs do not form a single chain.
 func OrderCNAMEs(a []*dns.CNAME) bool {
 	if len(a) == 0 {
 		return true
@@ -29,7 +35,7 @@ func OrderCNAMEs(a []*dns.CNAME) bool {
 	for flag {
 		flag = false
 		for i := n; i < len(a); i++ {
-			if a[i].Target == a[0].Hdr.Name {
+			if strings.EqualFold(a[i].Target, a[0].Hdr.Name) {
 				tmp := a[i]
 				for j := i; j > 0; j-- {
 					a[j] = a[j-1]
@@ -39,7 +45,7 @@ func OrderCNAMEs(a []*dns.CNAME) bool {
 				n++
 			}
 
-			if a[n-1].Target == a[i].Hdr.Name {
+			if strings.EqualFold(a[n-1].Target, a[i].Hdr.Name) {
 				a[n], a[i] = a[i], a[n]
 				flag = true
 				n++
@@ -49,3 +55,34 @@ func OrderCNAMEs(a []*dns.CNAME) bool {
 
 	return n == len(a)
 }
+
+// decrementTTLs reduces the TTLs of the records in m by age: how long m sat
+// in a cache (e.g., an HTTP cache in front of a DoH server, per RFC 8484,
+// Section 5.1, or a [Cache]).  TTLs stop at zero.
+func decrementTTLs(m *dns.Msg, age time.Duration) {
+	secs := uint32(age / time.Second)
+	if secs == 0 {
+		return
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > secs {
+				hdr.Ttl -= secs
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+}
+
+// packedLen returns the length of m when packed with name compression, which
+// approximates the size of m on the wire.
+func packedLen(m *dns.Msg) int {
+	c := *m
+	c.Compress = true
+	return c.Len()
+}
@@ -0,0 +1,410 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The maximum number of times a muxConn re-sends a query after the
+// connection closes while the query is waiting for a response.
+const muxMaxResends = 1
+
+var errMuxClosed = errors.New("multiplexed connection closed")
+
+type muxResult struct {
+	resp *dns.Msg
+	err  error
+}
+
+// A muxQuery is a query that is waiting for its response.
+type muxQuery struct {
+	msg     *dns.Msg // the query, with the ID that the muxConn allocated
+	sent    bool     // whether the muxConn has written the query to a connection
+	resends int
+	ch      chan muxResult
+}
+
+func (q *muxQuery) deliver(resp *dns.Msg, err error) {
+	// The channel is buffered, and the muxConn delivers at most one result
+	// per query, so this never blocks.
+	select {
+	case q.ch <- muxResult{resp: resp, err: err}:
+	default:
+	}
+}
+
+// A muxDial is a dial of a new connection that is in progress.  The goroutines
+// that need the connection wait for done, rather than dial their own.
+type muxDial struct {
+	done chan struct{}
+	conn *dns.Conn
+	err  error
+}
+
+// A muxConn multiplexes queries over a single TCP or TLS connection, as per
+// RFC 7766, Section 6.2.1.1.  Any number of goroutines may send queries
+// concurrently; the muxConn gives each outstanding query a unique message
+// ID, writes the queries to the connection as they arrive (pipelining), and
+// has a reader goroutine that matches the responses, which may arrive in any
+// order, to the queries by ID.
+//
+// If the connection closes while queries are waiting for responses, the
+// muxConn reconnects and re-sends those queries.
+//
+// With keepalive, the muxConn honors the idle timeout in the EDNS0 TCP
+// Keepalive option (RFC 7828) of the responses: once no queries are pending,
+// it closes a connection that the server is about to close (or, with a
+// timeout of 0, has asked the client to close), and the next query opens a
+// new one.
+type muxConn struct {
+	dial      func(context.Context) (*dns.Conn, error)
+	timeout   time.Duration
+	keepalive bool
+
+	mu      sync.Mutex // protects the fields below
+	conn    *dns.Conn
+	dialing *muxDial // non-nil while a dial is in progress
+	pending map[uint16]*muxQuery
+
+	// When the server will close the idle connection, per the server's
+	// EDNS0 TCP Keepalive option (zero if unknown).
+	idleDeadline time.Time
+
+	// Serializes writes to the connection.  The reader goroutine does not
+	// need this lock: it is the connection's only reader.
+	writeMu sync.Mutex
+}
+
+func newMuxConn(dial func(context.Context) (*dns.Conn, error), timeout time.Duration, keepalive bool) *muxConn {
+	return &muxConn{
+		dial:      dial,
+		timeout:   timeout,
+		keepalive: keepalive,
+		pending:   make(map[uint16]*muxQuery),
+	}
+}
+
+// A lazyMux is a transport's muxConn, which the transport creates on first
+// use.
+type lazyMux struct {
+	mu  sync.Mutex
+	mux *muxConn
+}
+
+// get returns the muxConn, and creates it, with a dial function that dials
+// server with a client from newClient, if it does not exist yet.
+func (l *lazyMux) get(newClient func() (*dns.Client, error), server string, timeout time.Duration, keepalive bool) *muxConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mux == nil {
+		dial := func(ctx context.Context) (*dns.Conn, error) {
+			client, err := newClient()
+			if err != nil {
+				return nil, err
+			}
+			conn, err := client.DialContext(ctx, server)
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect to DNS server %s: %w", server, ctxError(ctx, err))
+			}
+			return conn, nil
+		}
+		l.mux = newMuxConn(dial, timeout, keepalive)
+	}
+	return l.mux
+}
+
+// register allocates an unused message ID for the query and adds the query to
+// the set of pending queries.
+func (m *muxConn) register(req *dns.Msg) *muxQuery {
+	q := &muxQuery{
+		msg: req.Copy(),
+		ch:  make(chan muxResult, 1),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		id := uint16(rand.Uint32())
+		if _, ok := m.pending[id]; !ok {
+			q.msg.Id = id
+			m.pending[id] = q
+			return q
+		}
+	}
+}
+
+func (m *muxConn) unregister(q *muxQuery) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending[q.msg.Id] == q {
+		delete(m.pending, q.msg.Id)
+	}
+}
+
+// idleExpired returns true if the server is about to close the idle
+// connection, as per the idle timeout in the server's last response.  The
+// caller must hold m.mu.
+func (m *muxConn) idleExpired() bool {
+	if m.idleDeadline.IsZero() {
+		return false
+	}
+	return time.Now().Add(KeepaliveMargin).After(m.idleDeadline)
+}
+
+// retireIdle closes the current connection if no queries are waiting for
+// responses on it, and the server is about to close it.  The caller must
+// hold m.mu.
+func (m *muxConn) retireIdle() {
+	if m.conn == nil || !m.idleExpired() {
+		return
+	}
+	for _, q := range m.pending {
+		if q.sent {
+			return
+		}
+	}
+	// The connection's reader sees that the connection is no longer the
+	// current one, and exits.
+	m.conn.Close()
+	m.conn = nil
+	m.idleDeadline = time.Time{}
+}
+
+// connect returns the current connection, and dials a new one (and starts
+// its reader) if there isn't one.  Only one goroutine dials at a time; the
+// others wait for its dial, or until their ctx is done.
+func (m *muxConn) connect(ctx context.Context) (*dns.Conn, error) {
+	for {
+		m.mu.Lock()
+		m.retireIdle()
+		if m.conn != nil {
+			conn := m.conn
+			m.mu.Unlock()
+			return conn, nil
+		}
+
+		d := m.dialing
+		if d == nil {
+			d = &muxDial{done: make(chan struct{})}
+			m.dialing = d
+			m.mu.Unlock()
+
+			conn, err := m.dial(ctx)
+
+			m.mu.Lock()
+			m.dialing = nil
+			if err == nil {
+				m.conn = conn
+				go m.read(conn)
+			}
+			d.conn, d.err = conn, err
+			close(d.done)
+			m.mu.Unlock()
+			return conn, err
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if d.err == nil {
+			return d.conn, nil
+		}
+		if errors.Is(d.err, context.Canceled) || errors.Is(d.err, context.DeadlineExceeded) {
+			// The dial failed because the goroutine that dialed gave up,
+			// which says nothing about the server; dial again.
+			continue
+		}
+		return nil, d.err
+	}
+}
+
+func (m *muxConn) write(conn *dns.Conn, msg *dns.Msg) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	if m.timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(m.timeout))
+	}
+	return conn.WriteMsg(msg)
+}
+
+// read is the reader goroutine for conn.  It delivers each response to the
+// pending query with the response's ID, until reading from the connection
+// fails.
+func (m *muxConn) read(conn *dns.Conn) {
+	for {
+		resp, err := conn.ReadMsg()
+		if err != nil {
+			m.lost(conn)
+			return
+		}
+
+		m.mu.Lock()
+		q, ok := m.pending[resp.Id]
+		if ok && questionMatches(q.msg, resp) {
+			delete(m.pending, resp.Id)
+		} else {
+			// A response to a query that already gave up waiting, or a
+			// bogus response.
+			q = nil
+		}
+		if m.keepalive && m.conn == conn {
+			if timeout, ok := edns0Keepalive(resp); ok {
+				m.idleDeadline = time.Now().Add(timeout)
+			}
+			m.retireIdle()
+		}
+		m.mu.Unlock()
+
+		if q != nil {
+			q.deliver(resp, nil)
+		}
+	}
+}
+
+// lost handles the loss of conn: if conn is still the current connection, it
+// reconnects, and re-sends any queries that are still waiting for responses.
+func (m *muxConn) lost(conn *dns.Conn) {
+	m.mu.Lock()
+	if m.conn != conn {
+		// Close, or an earlier call to lost, already retired this
+		// connection.
+		m.mu.Unlock()
+		return
+	}
+	conn.Close()
+	m.conn = nil
+
+	var resend []*muxQuery
+	for id, q := range m.pending {
+		if !q.sent {
+			// Exchange has yet to write the query; it will write it to
+			// the new connection.
+			continue
+		}
+		if q.resends >= muxMaxResends {
+			delete(m.pending, id)
+			q.deliver(nil, errMuxClosed)
+			continue
+		}
+		q.resends++
+		resend = append(resend, q)
+	}
+	m.mu.Unlock()
+
+	if len(resend) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	newConn, err := m.connect(ctx)
+	for _, q := range resend {
+		if err == nil {
+			err = m.write(newConn, q.msg)
+		}
+		if err != nil {
+			m.unregister(q)
+			q.deliver(nil, err)
+		}
+	}
+}
+
+// Exchange sends req over the multiplexed connection and waits for the
+// response.  The response has the same ID as req.
+func (m *muxConn) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	q := m.register(req)
+	defer m.unregister(q)
+
+	for {
+		conn, err := m.connect(ctx)
+		if err != nil {
+			return nil, ctxError(ctx, err)
+		}
+
+		m.mu.Lock()
+		current := m.conn == conn
+		q.sent = current
+		m.mu.Unlock()
+		if !current {
+			// The connection went idle and was retired after connect
+			// returned it.
+			continue
+		}
+
+		err = m.write(conn, q.msg)
+		if err != nil {
+			// Handle a failed write as a lost connection: this re-sends
+			// the query (along with any other pending queries) on a new
+			// connection.
+			m.lost(conn)
+		}
+		break
+	}
+
+	select {
+	case r := <-q.ch:
+		if r.err != nil {
+			return nil, r.err
+		}
+		r.resp.Id = req.Id
+		return r.resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the current connection.  Any queries still waiting for
+// responses fail.  A later call to Exchange opens a new connection.
+func (m *muxConn) Close() error {
+	m.mu.Lock()
+	conn := m.conn
+	m.conn = nil
+	pending := m.pending
+	m.pending = make(map[uint16]*muxQuery)
+	m.mu.Unlock()
+
+	for _, q := range pending {
+		q.deliver(nil, errMuxClosed)
+	}
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// questionMatches returns true if resp's question section matches req's.
+func questionMatches(req, resp *dns.Msg) bool {
+	if len(req.Question) != len(resp.Question) {
+		return false
+	}
+	for i, q := range req.Question {
+		r := resp.Question[i]
+		if q.Qtype != r.Qtype || q.Qclass != r.Qclass || !strings.EqualFold(q.Name, r.Name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A tcpTestServer is an in-process DNS server over TCP whose handle function
+// scripts each connection.  The connections are numbered from 0.
+type tcpTestServer struct {
+	ln     net.Listener
+	handle func(n int, conn *dns.Conn)
+	conns  atomic.Int32
+}
+
+func newTCPTestServer(t *testing.T, handle func(n int, conn *dns.Conn)) *tcpTestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &tcpTestServer{ln: ln, handle: handle}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := int(s.conns.Add(1)) - 1
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer conn.Close()
+				s.handle(n, conn)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *tcpTestServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+// testAnswer returns a response to req with a TXT record that holds req's
+// name, so that a test can tell which query a response answers.
+func testAnswer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	q := req.Question[0]
+	resp.Answer = append(resp.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{q.Name},
+	})
+	return resp
+}
+
+// checkTestAnswer checks that resp is the answer to a query for name with
+// the given ID.
+func checkTestAnswer(t *testing.T, resp *dns.Msg, name string, id uint16) {
+	t.Helper()
+	if resp.Id != id {
+		t.Errorf("%s: response ID %d, want %d", name, resp.Id, id)
+	}
+	txts := CollectRRs[*dns.TXT](resp.Answer)
+	if len(txts) != 1 || txts[0].Txt[0] != name {
+		t.Errorf("%s: got answer %v", name, resp.Answer)
+	}
+}
+
+// pipelineQueries sends n concurrent queries over tr, and checks that each
+// gets its own response.
+func pipelineQueries(t *testing.T, tr Transport, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("q%d.example.", i)
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeTXT)
+			resp, err := tr.ExchangeContext(context.Background(), req)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			checkTestAnswer(t, resp, name, req.Id)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMuxOutOfOrder(t *testing.T) {
+	const n = 8
+	s := newTCPTestServer(t, func(_ int, conn *dns.Conn) {
+		// read all of the queries, then answer them in reverse order
+		var reqs []*dns.Msg
+		seen := make(map[uint16]bool)
+		for len(reqs) < n {
+			req, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			if seen[req.Id] {
+				t.Errorf("two pending queries with ID %d", req.Id)
+			}
+			seen[req.Id] = true
+			reqs = append(reqs, req)
+		}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			conn.WriteMsg(testAnswer(reqs[i]))
+		}
+		conn.ReadMsg() // wait for the client to close
+	})
+
+	tr := &Do53TCP{Server: s.addr(), Timeout: 2 * time.Second, Pipeline: true}
+	defer tr.Close()
+	pipelineQueries(t, tr, n)
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("transport used %d connections, want 1", got)
+	}
+}
+
+func TestMuxResend(t *testing.T) {
+	const n = 4
+	s := newTCPTestServer(t, func(i int, conn *dns.Conn) {
+		if i == 0 {
+			// read the queries, and drop the connection without
+			// answering
+			for j := 0; j < n; j++ {
+				if _, err := conn.ReadMsg(); err != nil {
+					return
+				}
+			}
+			return
+		}
+		for {
+			req, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			conn.WriteMsg(testAnswer(req))
+		}
+	})
+
+	tr := &Do53TCP{Server: s.addr(), Timeout: 2 * time.Second, Pipeline: true}
+	defer tr.Close()
+	pipelineQueries(t, tr, n)
+	if got := s.conns.Load(); got != 2 {
+		t.Errorf("transport used %d connections, want 2", got)
+	}
+}
+
+func TestMuxKeepalive(t *testing.T) {
+	s := newTCPTestServer(t, func(_ int, conn *dns.Conn) {
+		for {
+			req, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			if req.IsEdns0() == nil {
+				t.Errorf("query has no OPT record")
+				return
+			}
+			resp := testAnswer(req)
+			resp.SetEdns0(DefaultUDPBufSize, false)
+			// ask the client to close the connection
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+			conn.WriteMsg(resp)
+		}
+	})
+
+	tr := &Do53TCP{Server: s.addr(), Timeout: 2 * time.Second, Pipeline: true, Keepalive: true}
+	defer tr.Close()
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("q%d.example.", i)
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeTXT)
+		resp, err := tr.Exchange(req)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkTestAnswer(t, resp, name, req.Id)
+	}
+	if got := s.conns.Load(); got != 3 {
+		t.Errorf("transport used %d connections, want 3 (one per query)", got)
+	}
+}
+
+func TestMuxConnect(t *testing.T) {
+	var dials atomic.Int32
+	release := make(chan struct{})
+	m := newMuxConn(func(ctx context.Context) (*dns.Conn, error) {
+		dials.Add(1)
+		select {
+		case <-release:
+			return nil, errors.New("dial failed")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}, 0, false)
+
+	// The first query dials (slowly); the others wait for its dial.
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, err := m.connect(context.Background())
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// A query that gives up must not wait for the dial.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := m.connect(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("connect took %v after its context was done", d)
+	}
+
+	// Registering a query doesn't wait for the dial.
+	q := m.register(new(dns.Msg).SetQuestion("example.", dns.TypeA))
+	m.unregister(q)
+
+	close(release)
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err == nil {
+			t.Errorf("connect succeeded")
+		}
+	}
+	if got := dials.Load(); got != 1 {
+		t.Errorf("got %d dials, want 1", got)
+	}
+}
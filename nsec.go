@@ -0,0 +1,376 @@
+package resolv
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 9276, Section 3.2 lets a validator treat a response whose NSEC3
+// records have more iterations than this as insecure.
+const maxNSEC3Iterations = 150
+
+// canonicalLabels returns the labels of name in wire format and lowercase,
+// from the rightmost label to the leftmost.
+func canonicalLabels(name string) [][]byte {
+	wire := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), wire, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	// only ASCII letters have case (RFC 4343); bytes.ToLower would decode
+	// the other bytes as UTF-8
+	wire = wire[:n]
+	for i, b := range wire {
+		if 'A' <= b && b <= 'Z' {
+			wire[i] = b + 'a' - 'A'
+		}
+	}
+
+	var labels [][]byte
+	for off := 0; off < len(wire) && wire[off] != 0; off += int(wire[off]) + 1 {
+		labels = append(labels, wire[off+1:off+1+int(wire[off])])
+	}
+	slices.Reverse(labels)
+	return labels
+}
+
+// canonicalCompare compares two names in the canonical order of RFC 4034,
+// Section 6.1.
+func canonicalCompare(a, b string) int {
+	return slices.CompareFunc(canonicalLabels(a), canonicalLabels(b), bytes.Compare)
+}
+
+// commonAncestor returns the longest ancestor (or self) that a and b share.
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	labels := dns.SplitDomainName(a)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// parentName returns the name one label up from name.
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// deniedName returns the name whose denial a negative response proves: the
+// query's name, or the target of the CNAME chain in the answer section.  It
+// returns the empty string if resp lacks the question.
+func deniedName(resp *dns.Msg) string {
+	if len(resp.Question) == 0 {
+		return ""
+	}
+	name := resp.Question[0].Name
+	cnames := CollectRRs[*dns.CNAME](resp.Answer)
+	for range cnames {
+		i := slices.IndexFunc(cnames, func(cname *dns.CNAME) bool {
+			return strings.EqualFold(cname.Hdr.Name, name)
+		})
+		if i < 0 {
+			break
+		}
+		name = cnames[i].Target
+	}
+	return name
+}
+
+// nsecCovers returns true if the NSEC record proves that there are no names
+// in between its owner and its next name, and name is such a name.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// the last NSEC of the zone, whose next name is the zone's apex
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// nsecDenial checks that the NSEC records prove that sname has no records of
+// qtype (if nxdomain is false) or does not exist (RFC 4035, Section 5.4).
+func nsecDenial(nsecs []*dns.NSEC, sname string, qtype uint16, nxdomain bool) error {
+	// noType checks that a matching NSEC denies qtype at its owner
+	noType := func(nsec *dns.NSEC) error {
+		types := nsec.TypeBitMap
+		switch {
+		case slices.Contains(types, qtype) || slices.Contains(types, dns.TypeCNAME):
+			return fmt.Errorf("NSEC at %s shows that %s exists", nsec.Hdr.Name, dns.Type(qtype))
+		case qtype != dns.TypeDS && slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA):
+			return fmt.Errorf("NSEC at %s is from the parent side of a delegation", nsec.Hdr.Name)
+		case qtype == dns.TypeDS && slices.Contains(types, dns.TypeSOA) && nsec.Hdr.Name != ".":
+			return fmt.Errorf("NSEC at %s is from the child side of a delegation", nsec.Hdr.Name)
+		}
+		return nil
+	}
+
+	// covering returns the NSEC that proves that name does not exist
+	covering := func(name string) *dns.NSEC {
+		for _, nsec := range nsecs {
+			if !nsecCovers(nsec, name) {
+				continue
+			}
+			if dns.IsSubDomain(name, nsec.NextDomain) {
+				// name is an empty non-terminal
+				continue
+			}
+			types := nsec.TypeBitMap
+			if dns.IsSubDomain(nsec.Hdr.Name, name) && (slices.Contains(types, dns.TypeDNAME) ||
+				slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA)) {
+				// the parent zone can't speak for the names below a zone
+				// cut or a DNAME
+				continue
+			}
+			return nsec
+		}
+		return nil
+	}
+
+	matching := func(name string) *dns.NSEC {
+		for _, nsec := range nsecs {
+			if strings.EqualFold(nsec.Hdr.Name, name) {
+				return nsec
+			}
+		}
+		return nil
+	}
+
+	if nsec := matching(sname); nsec != nil {
+		if nxdomain {
+			return fmt.Errorf("NSEC at %s shows that it exists", sname)
+		}
+		return noType(nsec)
+	}
+
+	if !nxdomain {
+		for _, nsec := range nsecs {
+			if nsecCovers(nsec, sname) && dns.IsSubDomain(sname, nsec.NextDomain) {
+				// sname is an empty non-terminal: it exists, but has no
+				// records
+				return nil
+			}
+		}
+	}
+
+	nsec := covering(sname)
+	if nsec == nil {
+		return fmt.Errorf("no NSEC proves that %s does not exist", sname)
+	}
+
+	// The closest encloser is the longest existing ancestor of sname; the
+	// wildcard at the closest encloser must not exist (for NXDOMAIN), or
+	// must not have qtype (for NODATA).
+	ce := commonAncestor(sname, nsec.Hdr.Name)
+	if other := commonAncestor(sname, nsec.NextDomain); dns.CountLabel(other) > dns.CountLabel(ce) {
+		ce = other
+	}
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+
+	if nxdomain {
+		if matching(wildcard) != nil {
+			return fmt.Errorf("NSEC shows that the wildcard %s exists", wildcard)
+		}
+		if covering(wildcard) == nil {
+			return fmt.Errorf("no NSEC proves that the wildcard %s does not exist", wildcard)
+		}
+		return nil
+	}
+	wnsec := matching(wildcard)
+	if wnsec == nil {
+		return fmt.Errorf("no NSEC proves that %s %s does not exist", sname, dns.Type(qtype))
+	}
+	return noType(wnsec)
+}
+
+// An nsec3Set is the NSEC3 records of a response, which all use the same
+// hash parameters.
+type nsec3Set []*dns.NSEC3
+
+func (s nsec3Set) match(name string) *dns.NSEC3 {
+	for _, nsec3 := range s {
+		if nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+func (s nsec3Set) cover(name string) *dns.NSEC3 {
+	for _, nsec3 := range s {
+		if nsec3.Cover(name) && !nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// closestEncloser finds the closest provable encloser of name: its longest
+// ancestor (or self) that has a matching NSEC3 record, and the next closer
+// name, the ancestor one label longer (RFC 5155, Section 8.3).  The next
+// closer name is empty if name itself matches.
+func (s nsec3Set) closestEncloser(name string) (ce, nc string, err error) {
+	for candidate := dns.Fqdn(name); ; candidate = parentName(candidate) {
+		if nsec3 := s.match(candidate); nsec3 != nil {
+			types := nsec3.TypeBitMap
+			if nc != "" && (slices.Contains(types, dns.TypeDNAME) ||
+				slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA)) {
+				return "", "", fmt.Errorf("closest encloser %s is a zone cut or a DNAME", candidate)
+			}
+			return candidate, nc, nil
+		}
+		if candidate == "." {
+			return "", "", fmt.Errorf("no NSEC3 proves a closest encloser of %s", name)
+		}
+		nc = candidate
+	}
+}
+
+// nsec3Denial checks that the NSEC3 records prove that sname has no records
+// of qtype (if nxdomain is false) or does not exist (RFC 5155, Section 8).
+// The proof is Insecure if it depends on an Opt-Out span, or if the records
+// use an unknown hash or too many iterations.
+func nsec3Denial(s nsec3Set, sname string, qtype uint16, nxdomain bool) (ValidationStatus, error) {
+	first := s[0]
+	for _, nsec3 := range s {
+		if nsec3.Hash != first.Hash || nsec3.Iterations != first.Iterations || !strings.EqualFold(nsec3.Salt, first.Salt) {
+			return Bogus, fmt.Errorf("NSEC3 records have different parameters")
+		}
+	}
+	if first.Hash != dns.SHA1 {
+		return Insecure, fmt.Errorf("NSEC3 records use unknown hash algorithm %d", first.Hash)
+	}
+	if first.Iterations > maxNSEC3Iterations {
+		return Insecure, fmt.Errorf("NSEC3 records use %d iterations", first.Iterations)
+	}
+
+	noType := func(nsec3 *dns.NSEC3, name string) error {
+		types := nsec3.TypeBitMap
+		switch {
+		case slices.Contains(types, qtype) || slices.Contains(types, dns.TypeCNAME):
+			return fmt.Errorf("NSEC3 for %s shows that %s exists", name, dns.Type(qtype))
+		case qtype != dns.TypeDS && slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA):
+			return fmt.Errorf("NSEC3 for %s is from the parent side of a delegation", name)
+		case qtype == dns.TypeDS && slices.Contains(types, dns.TypeSOA) && name != ".":
+			return fmt.Errorf("NSEC3 for %s is from the child side of a delegation", name)
+		}
+		return nil
+	}
+
+	if !nxdomain {
+		// RFC 5155, Sections 8.5 and 8.6
+		if nsec3 := s.match(sname); nsec3 != nil {
+			if err := noType(nsec3, sname); err != nil {
+				return Bogus, err
+			}
+			return Secure, nil
+		}
+	} else if s.match(sname) != nil {
+		return Bogus, fmt.Errorf("NSEC3 shows that %s exists", sname)
+	}
+
+	ce, nc, err := s.closestEncloser(sname)
+	if err != nil {
+		return Bogus, err
+	}
+	ncNSEC3 := s.cover(nc)
+	if ncNSEC3 == nil {
+		return Bogus, fmt.Errorf("no NSEC3 covers the next closer name %s", nc)
+	}
+	optOut := ncNSEC3.Flags&1 == 1
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+
+	if nxdomain {
+		// RFC 5155, Section 8.4
+		if s.match(wildcard) != nil {
+			return Bogus, fmt.Errorf("NSEC3 shows that the wildcard %s exists", wildcard)
+		}
+		if s.cover(wildcard) == nil {
+			return Bogus, fmt.Errorf("no NSEC3 proves that the wildcard %s does not exist", wildcard)
+		}
+		if optOut {
+			return Insecure, fmt.Errorf("%s is in an NSEC3 Opt-Out span, and may be an unsigned delegation", nc)
+		}
+		return Secure, nil
+	}
+
+	// RFC 5155, Section 8.7: a wildcard without qtype
+	if nsec3 := s.match(wildcard); nsec3 != nil {
+		if err := noType(nsec3, wildcard); err != nil {
+			return Bogus, err
+		}
+		return Secure, nil
+	}
+	// RFC 5155, Section 8.6 (and Errata 3441): an unsigned delegation in an
+	// Opt-Out span
+	if optOut {
+		return Insecure, fmt.Errorf("%s is in an NSEC3 Opt-Out span, and may be an unsigned delegation", nc)
+	}
+	return Bogus, fmt.Errorf("no NSEC3 proves that %s %s does not exist", sname, dns.Type(qtype))
+}
+
+// VerifyDenial checks the authenticated denial of existence in a negative
+// response (NXDOMAIN or NODATA): that the NSEC (RFC 4035) or NSEC3 (RFC
+// 5155) records of the authority section prove that the query's name (or the
+// target of the CNAME chain in the answer section) does not exist, or has no
+// records of the query's type.  The checks include the closest encloser
+// proof, the non-existence of a matching wildcard, and the type bitmaps.
+//
+// VerifyDenial returns Secure if the records prove the denial, Insecure
+// (with a reason) if the proof depends on an NSEC3 Opt-Out span, or if the
+// NSEC3 records use an unknown hash or too many iterations, and Bogus (with
+// a reason) otherwise.  VerifyDenial does not check the records'
+// signatures; a [Client] with Validate set checks both.
+func VerifyDenial(resp *dns.Msg) (ValidationStatus, string) {
+	if len(resp.Question) != 1 {
+		return Bogus, "response does not have exactly one question"
+	}
+	qtype := resp.Question[0].Qtype
+	sname := deniedName(resp)
+	nxdomain := resp.Rcode == dns.RcodeNameError
+
+	var status ValidationStatus
+	var err error
+	if nsecs := CollectRRs[*dns.NSEC](resp.Ns); len(nsecs) > 0 {
+		status, err = Secure, nsecDenial(nsecs, sname, qtype, nxdomain)
+		if err != nil {
+			status = Bogus
+		}
+	} else if nsec3s := CollectRRs[*dns.NSEC3](resp.Ns); len(nsec3s) > 0 {
+		status, err = nsec3Denial(nsec3s, sname, qtype, nxdomain)
+	} else {
+		status, err = Bogus, fmt.Errorf("no NSEC or NSEC3 records")
+	}
+
+	if err != nil {
+		return status, fmt.Sprintf("denial of %s %s: %v", sname, dns.Type(qtype), err)
+	}
+	return status, ""
+}
+
+// verifyWildcardExpansion checks that the NSEC or NSEC3 records in ns prove
+// that no closer match than the wildcard exists for name, the owner of an
+// RRset that the expansion of a wildcard with the given number of labels
+// produced (RFC 4035, Section 5.3.4; RFC 5155, Section 8.8).
+func verifyWildcardExpansion(ns []dns.RR, name string, labels int) error {
+	if nsecs := CollectRRs[*dns.NSEC](ns); len(nsecs) > 0 {
+		for _, nsec := range nsecs {
+			if nsecCovers(nsec, name) && !dns.IsSubDomain(name, nsec.NextDomain) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no NSEC proves that %s does not exist", name)
+	}
+
+	// the next closer name is the name one label longer than the wildcard's
+	// closest encloser
+	nameLabels := dns.SplitDomainName(name)
+	nc := dns.Fqdn(strings.Join(nameLabels[len(nameLabels)-labels-1:], "."))
+	if nsec3s := nsec3Set(CollectRRs[*dns.NSEC3](ns)); nsec3s.cover(nc) != nil {
+		return nil
+	}
+	return fmt.Errorf("no NSEC or NSEC3 proves that %s does not exist", name)
+}
@@ -0,0 +1,289 @@
+package resolv
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanonicalCompare(t *testing.T) {
+	// RFC 4034, Section 6.1
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		`\001.z.example.`,
+		"*.z.example.",
+		`\200.z.example.`,
+	}
+	for i := range names {
+		for j := range names {
+			got := canonicalCompare(names[i], names[j])
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got != want {
+				t.Errorf("canonicalCompare(%q, %q) = %d, want %d", names[i], names[j], got, want)
+			}
+		}
+	}
+}
+
+// newDenialZone returns a signed zone with NSEC records, or with NSEC3
+// records (with Opt-Out, if optOut is set), for the tests of denial of
+// existence.
+func newDenialZone(t *testing.T, name string, nsec3, optOut bool) *testZone {
+	z := newTestZone(t, name, dns.ECDSAP256SHA256)
+	z.nsec3, z.optOut = nsec3, optOut
+	z.add(t,
+		"www."+name+" 300 IN A 192.0.2.1",
+		"a.ent."+name+" 300 IN A 192.0.2.2",
+		"*.wild."+name+" 300 IN A 192.0.2.3",
+		"dangling."+name+" 300 IN CNAME nx."+name,
+		"unsigned."+name+" 300 IN NS ns.example.net.",
+		"signed."+name+" 300 IN NS ns.example.net.",
+		"signed."+name+" 300 IN DS 12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"dname."+name+" 300 IN DNAME example.net.",
+	)
+	z.sign(t)
+	return z
+}
+
+// Tampering with the responses of a denial zone.
+var (
+	// keepDenial keeps the denial records (and their RRSIGs) for which keep
+	// returns true.
+	keepDenial = func(keep func(rr dns.RR) bool) func(resp *dns.Msg) {
+		return func(resp *dns.Msg) {
+			resp.Ns = slices.DeleteFunc(resp.Ns, func(rr dns.RR) bool {
+				switch rr := rr.(type) {
+				case *dns.NSEC, *dns.NSEC3:
+					return !keep(rr)
+				case *dns.RRSIG:
+					return rr.TypeCovered == dns.TypeNSEC || rr.TypeCovered == dns.TypeNSEC3
+				}
+				return false
+			})
+		}
+	}
+
+	setNXDOMAIN = func(resp *dns.Msg) {
+		resp.Rcode = dns.RcodeNameError
+	}
+
+	stripAnswer = func(resp *dns.Msg) {
+		resp.Answer = nil
+	}
+
+	stripDenial = keepDenial(func(rr dns.RR) bool { return false })
+
+	not = func(f func(rr dns.RR) bool) func(rr dns.RR) bool {
+		return func(rr dns.RR) bool { return !f(rr) }
+	}
+
+	setNSEC3 = func(f func(nsec3 *dns.NSEC3)) func(resp *dns.Msg) {
+		return func(resp *dns.Msg) {
+			for _, nsec3 := range CollectRRs[*dns.NSEC3](resp.Ns) {
+				f(nsec3)
+			}
+		}
+	}
+)
+
+type denialTest struct {
+	name   string
+	qname  string // relative to the zone
+	qtype  uint16
+	tamper []func(resp *dns.Msg)
+	want   ValidationStatus
+}
+
+func runDenialTests(t *testing.T, z *testZone, tests []denialTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname+"."+z.name, tt.qtype)
+			resp := z.answer(req)
+			if len(CollectRRs[*dns.NSEC](resp.Ns))+len(CollectRRs[*dns.NSEC3](resp.Ns)) == 0 {
+				// the proof for a forged negative response
+				resp.Ns = append(resp.Ns, z.denial...)
+			}
+			for _, tamper := range tt.tamper {
+				tamper(resp)
+			}
+
+			status, reason := VerifyDenial(resp)
+			if status != tt.want {
+				t.Errorf("got %v (%s), want %v", status, reason, tt.want)
+			}
+			if status != Secure && reason == "" {
+				t.Errorf("no reason for %v", status)
+			}
+		})
+	}
+}
+
+func TestVerifyDenialNSEC(t *testing.T) {
+	z := newDenialZone(t, "example.", false, false)
+
+	// the NSEC that covers zzz.example.
+	coversZZZ := func(rr dns.RR) bool {
+		nsec, ok := rr.(*dns.NSEC)
+		return ok && nsecCovers(nsec, "zzz.example.")
+	}
+
+	runDenialTests(t, z, []denialTest{
+		{name: "NXDOMAIN", qname: "nx", qtype: dns.TypeA, want: Secure},
+		{name: "NXDOMAIN after the last name", qname: "zzz", qtype: dns.TypeA, want: Secure},
+		{name: "NXDOMAIN below an existing name", qname: "nx.www", qtype: dns.TypeA, want: Secure},
+		{name: "NODATA", qname: "www", qtype: dns.TypeTXT, want: Secure},
+		{name: "NODATA at an empty non-terminal", qname: "ent", qtype: dns.TypeA, want: Secure},
+		{name: "NODATA at a wildcard", qname: "a.wild", qtype: dns.TypeTXT, want: Secure},
+		{name: "NODATA for DS at an unsigned delegation", qname: "unsigned", qtype: dns.TypeDS, want: Secure},
+		{name: "CNAME to NXDOMAIN", qname: "dangling", qtype: dns.TypeA, tamper: []func(*dns.Msg){setNXDOMAIN}, want: Secure},
+
+		{name: "NXDOMAIN for an existing name", qname: "www", qtype: dns.TypeA, tamper: []func(*dns.Msg){stripAnswer, setNXDOMAIN}, want: Bogus},
+		{name: "NODATA for an existing type", qname: "www", qtype: dns.TypeA, tamper: []func(*dns.Msg){stripAnswer}, want: Bogus},
+		{name: "NXDOMAIN for an empty non-terminal", qname: "ent", qtype: dns.TypeA, tamper: []func(*dns.Msg){setNXDOMAIN}, want: Bogus},
+		{name: "NXDOMAIN without the wildcard proof", qname: "zzz", qtype: dns.TypeA, tamper: []func(*dns.Msg){keepDenial(coversZZZ)}, want: Bogus},
+		{name: "NXDOMAIN with a matching wildcard", qname: "x.wild", qtype: dns.TypeA, tamper: []func(*dns.Msg){stripAnswer, setNXDOMAIN}, want: Bogus},
+		{name: "NODATA at a wildcard for its type", qname: "a.wild", qtype: dns.TypeA, tamper: []func(*dns.Msg){stripAnswer}, want: Bogus},
+		{name: "NODATA from the parent side of a delegation", qname: "unsigned", qtype: dns.TypeA, want: Bogus},
+		{name: "NODATA for DS at a signed delegation", qname: "signed", qtype: dns.TypeDS, tamper: []func(*dns.Msg){stripAnswer}, want: Bogus},
+		{name: "NXDOMAIN below a delegation", qname: "x.unsigned", qtype: dns.TypeA, want: Bogus},
+		{name: "NXDOMAIN below a DNAME", qname: "x.dname", qtype: dns.TypeA, want: Bogus},
+		{name: "no NSEC records", qname: "nx", qtype: dns.TypeA, tamper: []func(*dns.Msg){stripDenial}, want: Bogus},
+	})
+}
+
+func TestVerifyDenialNSEC3(t *testing.T) {
+	z := newDenialZone(t, "example.", true, false)
+
+	// the NSEC3 records that cover or match the names
+	nsec3For := func(names ...string) func(rr dns.RR) bool {
+		return func(rr dns.RR) bool {
+			nsec3, ok := rr.(*dns.NSEC3)
+			return ok && slices.ContainsFunc(names, func(name string) bool {
+				return nsec3.Cover(name) || nsec3.Match(name)
+			})
+		}
+	}
+
+	runDenialTests(t, z, []denialTest{
+		{name: "NXDOMAIN", qname: "nx", qtype: dns.TypeA, want: Secure},
+		{name: "NXDOMAIN two labels below the closest encloser", qname: "a.b", qtype: dns.TypeA, want: Secure},
+		{name: "NXDOMAIN with the minimal proof", qname: "nx", qtype: dns.TypeA,
+			tamper: []func(*dns.Msg){keepDenial(nsec3For("example.", "nx.example.", "*.example."))}, want: Secure},
+		{name: "NODATA", qname: "www", qtype: dns.TypeTXT, want: Secure},
+		{name: "NODATA at an empty non-terminal", qname: "ent", qtype: dns.TypeA, want: Secure},
+		{name: "NODATA at a wildcard", qname: "a.wild", qtype: dns.TypeTXT, want: Secure},
+		{name: "NODATA for DS at an unsigned delegation", qname: "unsigned", qtype: dns.TypeDS, want: Secure},
+		{name: "CNAME to NXDOMAIN", qname: "dangling", qtype: dns.TypeA, tamper: []func(*dns.Msg){setNXDOMAIN}, want: Secure},
+
+		{name: "NXDOMAIN for an existing name", qname: "www", qtype: dns.TypeA, tamper: []func(*dns.Msg){stripAnswer, setNXDOMAIN}, want: Bogus},
+		{name: "NODATA for an existing type", qname: "www", qtype: dns.TypeA, tamper: []func(*dns.Msg){stripAnswer}, want: Bogus},
+		{name: "NXDOMAIN without the closest encloser", qname: "nx", qtype: dns.TypeA,
+			tamper: []func(*dns.Msg){keepDenial(not(nsec3For("example.")))}, want: Bogus},
+		{name: "NXDOMAIN without the next closer name", qname: "nx", qtype: dns.TypeA,
+			tamper: []func(*dns.Msg){keepDenial(not(nsec3For("nx.example.")))}, want: Bogus},
+		{name: "NXDOMAIN without the wildcard proof", qname: "nx", qtype: dns.TypeA,
+			tamper: []func(*dns.Msg){keepDenial(not(nsec3For("*.example.")))}, want: Bogus},
+		{name: "NXDOMAIN with a matching wildcard", qname: "x.wild", qtype: dns.TypeA, tamper: []func(*dns.Msg){stripAnswer, setNXDOMAIN}, want: Bogus},
+		{name: "NODATA from the parent side of a delegation", qname: "unsigned", qtype: dns.TypeA, want: Bogus},
+		{name: "NXDOMAIN below a delegation", qname: "x.unsigned", qtype: dns.TypeA, want: Bogus},
+		{name: "NXDOMAIN below a DNAME", qname: "x.dname", qtype: dns.TypeA, want: Bogus},
+		{name: "mixed parameters", qname: "nx", qtype: dns.TypeA,
+			tamper: []func(*dns.Msg){func(resp *dns.Msg) { CollectRRs[*dns.NSEC3](resp.Ns)[0].Iterations++ }}, want: Bogus},
+		{name: "too many iterations", qname: "nx", qtype: dns.TypeA,
+			tamper: []func(*dns.Msg){setNSEC3(func(nsec3 *dns.NSEC3) { nsec3.Iterations = maxNSEC3Iterations + 1 })}, want: Insecure},
+		{name: "unknown hash", qname: "nx", qtype: dns.TypeA,
+			tamper: []func(*dns.Msg){setNSEC3(func(nsec3 *dns.NSEC3) { nsec3.Hash = 2 })}, want: Insecure},
+	})
+}
+
+func TestVerifyDenialNSEC3OptOut(t *testing.T) {
+	z := newDenialZone(t, "example.", true, true)
+	if slices.ContainsFunc(CollectRRs[*dns.NSEC3](z.denial), func(nsec3 *dns.NSEC3) bool { return nsec3.Match("unsigned.example.") }) {
+		t.Fatal("the Opt-Out span has an NSEC3 record for the unsigned delegation")
+	}
+
+	runDenialTests(t, z, []denialTest{
+		{name: "NODATA for DS at an unsigned delegation", qname: "unsigned", qtype: dns.TypeDS, want: Insecure},
+		{name: "NXDOMAIN in an Opt-Out span", qname: "nx", qtype: dns.TypeA, want: Insecure},
+		{name: "NODATA", qname: "www", qtype: dns.TypeTXT, want: Secure},
+		{name: "NODATA for DS at a signed delegation", qname: "signed", qtype: dns.TypeDS, tamper: []func(*dns.Msg){stripAnswer}, want: Bogus},
+	})
+}
+
+func TestVerifyWildcardExpansion(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		z := newDenialZone(t, "example.", nsec3, false)
+		req := new(dns.Msg)
+		req.SetQuestion("a.wild.example.", dns.TypeA)
+		resp := z.answer(req)
+		if len(resp.Answer) == 0 || CollectRRs[*dns.RRSIG](resp.Answer)[0].Labels != 2 {
+			t.Fatalf("got response %v, want a wildcard expansion", resp)
+		}
+
+		if err := verifyWildcardExpansion(resp.Ns, "a.wild.example.", 2); err != nil {
+			t.Errorf("nsec3 %v: %v", nsec3, err)
+		}
+		// a name that exists can't be the expansion of a wildcard
+		if err := verifyWildcardExpansion(resp.Ns, "www.example.", 1); err == nil {
+			t.Errorf("nsec3 %v: accepted an expansion for an existing name", nsec3)
+		}
+		if err := verifyWildcardExpansion(nil, "a.wild.example.", 2); err == nil {
+			t.Errorf("nsec3 %v: accepted an expansion without a proof", nsec3)
+		}
+	}
+}
+
+func TestNSEC3ClosestEncloser(t *testing.T) {
+	z := newDenialZone(t, "example.", true, false)
+	s := nsec3Set(CollectRRs[*dns.NSEC3](z.denial))
+
+	tests := []struct {
+		name, wantCE, wantNC string
+		wantErr              bool
+	}{
+		{"www.example.", "www.example.", "", false},
+		{"nx.example.", "example.", "nx.example.", false},
+		{"a.b.c.www.example.", "www.example.", "c.www.example.", false},
+		{"x.ent.example.", "ent.example.", "x.ent.example.", false},
+		{"x.unsigned.example.", "", "", true}, // below a delegation
+		{"x.dname.example.", "", "", true},    // below a DNAME
+		{"www.example.net.", "", "", true},
+	}
+	for _, tt := range tests {
+		ce, nc, err := s.closestEncloser(tt.name)
+		if (err != nil) != tt.wantErr || ce != tt.wantCE || nc != tt.wantNC {
+			t.Errorf("%s: got %q, %q, %v; want %q, %q", tt.name, ce, nc, err, tt.wantCE, tt.wantNC)
+		}
+	}
+}
+
+func TestDeniedName(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("a.example.", dns.TypeA)
+	resp.Answer = mustRRs(t,
+		"b.example. 300 IN CNAME c.example.",
+		"A.Example. 300 IN CNAME b.example.",
+		"c.example. 300 IN CNAME a.example.", // a loop
+	)
+	if got := deniedName(resp); !strings.EqualFold(got, "a.example.") {
+		t.Errorf("got %q, want a.example.", got)
+	}
+	resp.Answer = resp.Answer[:2]
+	if got := deniedName(resp); got != "c.example." {
+		t.Errorf("got %q, want c.example.", got)
+	}
+}
@@ -0,0 +1,291 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The default maximum number of idle transports that a [Pool] keeps.
+const DefaultPoolMaxIdle = 2
+
+type pooledTransport struct {
+	t        Transport
+	lastUsed time.Time
+	gen      uint64 // the pool's generation when the pool created t
+}
+
+// PoolStats describes the transports of a [Pool].
+type PoolStats struct {
+	Idle   int // the number of idle transports in the pool
+	Active int // the number of transports in use by an exchange
+}
+
+// A Pool is a Transport that keeps a pool of other transports (each with its
+// own connection), and lends one of them to each exchange.  Unlike the other
+// transports, a Pool is safe for concurrent use by multiple goroutines, and
+// thus so is a [Client] whose Transport is a Pool.
+//
+// The pooled transports should keep their connections open between
+// exchanges (e.g., a [Do53TCP], [DoT], or [DoH] with KeepOpen set);
+// otherwise, the pool merely limits the number of concurrent exchanges.
+//
+// A program must not modify a Pool's settings after its first exchange.
+type Pool struct {
+	// New returns a new transport for the pool.  The Pool calls New whenever
+	// an exchange needs a transport and the pool has no idle transports.
+	New func() Transport
+
+	// The maximum number of idle transports that the pool keeps.  If zero,
+	// the pool keeps at most [DefaultPoolMaxIdle] idle transports.
+	MaxIdle int
+
+	// The maximum number of transports that may be in use at once.  If all of
+	// them are in use, an exchange waits until one is free (or until the
+	// exchange's context is done).  If zero, there is no limit.
+	MaxActive int
+
+	// The pool closes transports that have been idle for longer than
+	// IdleTimeout.  If zero, the pool does not close idle transports.
+	// Servers close idle connections too (e.g., after a few seconds, for
+	// DNS over TCP), so IdleTimeout should be shorter than the server's
+	// idle timeout.
+	IdleTimeout time.Duration
+
+	// The pool calls HealthCheck on an idle transport before lending it to
+	// an exchange.  If HealthCheck returns an error, the pool closes the
+	// transport and tries another.  If nil, the pool uses
+	// [DefaultHealthCheck].
+	HealthCheck func(Transport) error
+
+	mu       sync.Mutex
+	idle     []*pooledTransport // the most recently used transport is last
+	active   int
+	gen      uint64 // incremented by Close
+	initOnce sync.Once
+	sem      chan struct{} // limits active transports to MaxActive
+}
+
+func (p *Pool) init() {
+	if p.MaxActive > 0 {
+		p.sem = make(chan struct{}, p.MaxActive)
+	}
+}
+
+func (p *Pool) maxIdle() int {
+	if p.MaxIdle > 0 {
+		return p.MaxIdle
+	}
+	return DefaultPoolMaxIdle
+}
+
+// acquire waits for permission to use another transport, if the pool limits
+// the number of active transports.
+func (p *Pool) acquire(ctx context.Context) error {
+	p.initOnce.Do(p.init)
+	if p.sem == nil {
+		return nil
+	}
+	select {
+	case p.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+// popIdle removes and returns the most recently used idle transport that has
+// not exceeded the idle timeout, closing any that have.  It returns nil if
+// there is no such transport.
+func (p *Pool) popIdle() *pooledTransport {
+	var expired []Transport
+
+	p.mu.Lock()
+	if p.IdleTimeout > 0 {
+		// The transports are in order of last use, so the expired transports
+		// are at the front of the slice.
+		cutoff := time.Now().Add(-p.IdleTimeout)
+		i := 0
+		for i < len(p.idle) && p.idle[i].lastUsed.Before(cutoff) {
+			expired = append(expired, p.idle[i].t)
+			i++
+		}
+		p.idle = p.idle[i:]
+	}
+
+	var pt *pooledTransport
+	if n := len(p.idle); n > 0 {
+		pt = p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	for _, e := range expired {
+		e.Close()
+	}
+	return pt
+}
+
+func (p *Pool) healthCheck(t Transport) error {
+	if p.HealthCheck != nil {
+		return p.HealthCheck(t)
+	}
+	return DefaultHealthCheck(t)
+}
+
+// get returns a transport for an exchange: an idle transport that passes the
+// health check, or else a new transport.
+func (p *Pool) get() *pooledTransport {
+	for {
+		pt := p.popIdle()
+		if pt == nil {
+			break
+		}
+		if p.healthCheck(pt.t) == nil {
+			return pt
+		}
+		pt.t.Close()
+	}
+
+	p.mu.Lock()
+	gen := p.gen
+	p.mu.Unlock()
+	return &pooledTransport{t: p.New(), gen: gen}
+}
+
+// put returns a transport to the pool.  If the pool already has its maximum
+// number of idle transports, put closes the least recently used one.  If the
+// pool was closed since the transport was created, put closes the transport
+// instead.
+func (p *Pool) put(pt *pooledTransport) {
+	var evicted Transport
+
+	p.mu.Lock()
+	if pt.gen != p.gen {
+		p.mu.Unlock()
+		pt.t.Close()
+		return
+	}
+	pt.lastUsed = time.Now()
+	p.idle = append(p.idle, pt)
+	if len(p.idle) > p.maxIdle() {
+		evicted = p.idle[0].t
+		p.idle[0] = nil
+		p.idle = p.idle[1:]
+	}
+	p.mu.Unlock()
+
+	if evicted != nil {
+		evicted.Close()
+	}
+}
+
+func (p *Pool) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return p.ExchangeContext(context.Background(), req)
+}
+
+func (p *Pool) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.release()
+
+	p.mu.Lock()
+	p.active++
+	p.mu.Unlock()
+
+	pt := p.get()
+	resp, err := pt.t.ExchangeContext(ctx, req)
+
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+
+	if err != nil {
+		// The transport's connection may be broken; don't reuse it.
+		pt.t.Close()
+		return nil, err
+	}
+
+	p.put(pt)
+	return resp, nil
+}
+
+// Stats returns the number of idle and active transports in the pool.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{Idle: len(p.idle), Active: p.active}
+}
+
+// Close closes the pool's idle transports.  Transports that are in use are
+// closed when their exchanges complete, rather than return to the pool.  The
+// pool remains usable after Close: later exchanges get new transports.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.gen++
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, pt := range idle {
+		err := pt.t.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// A healthChecker is a transport that can check, without sending a query,
+// whether its connection is still usable.
+type healthChecker interface {
+	checkHealth() error
+}
+
+// DefaultHealthCheck is the health check of a [Pool] whose HealthCheck is nil.
+// It returns an error if t is a [Do53TCP], [DoT], or [DoQ] whose open
+// connection the server has closed (or, per the EDNS0 TCP Keepalive option,
+// is about to close), or on which unexpected data has arrived.  It does not
+// send a query, and it returns nil for other transports.
+func DefaultHealthCheck(t Transport) error {
+	if hc, ok := t.(healthChecker); ok {
+		return hc.checkHealth()
+	}
+	return nil
+}
+
+// How long connAlive waits for data (or EOF) on a connection.
+const connAliveWait = time.Millisecond
+
+// connAlive returns an error if conn is closed, or has data to read.  A DNS
+// connection that is waiting for a query should have nothing to read; if the
+// server closed it, reading returns EOF.
+func connAlive(conn net.Conn) error {
+	var buf [1]byte
+
+	conn.SetReadDeadline(time.Now().Add(connAliveWait))
+	defer conn.SetReadDeadline(time.Time{})
+	_, err := conn.Read(buf[:])
+	if err == nil {
+		return errors.New("unexpected data on idle connection")
+	}
+	if isTimeout(err) {
+		return nil
+	}
+	return fmt.Errorf("idle connection failed: %w", err)
+}
@@ -0,0 +1,299 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A fakeTransport answers every query, and counts how often it is closed.
+type fakeTransport struct {
+	id     int
+	closed atomic.Int32
+	fail   bool
+	block  chan struct{} // if not nil, exchanges wait for it to close
+}
+
+func (t *fakeTransport) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return t.ExchangeContext(context.Background(), req)
+}
+
+func (t *fakeTransport) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if t.block != nil {
+		select {
+		case <-t.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if t.fail {
+		return nil, errors.New("exchange failed")
+	}
+	return testAnswer(req), nil
+}
+
+func (t *fakeTransport) Close() error {
+	t.closed.Add(1)
+	return nil
+}
+
+// newFakePool returns a pool of fakeTransports, and a function that returns
+// the transports that the pool has created so far.
+func newFakePool() (*Pool, func() []*fakeTransport) {
+	var mu sync.Mutex
+	var all []*fakeTransport
+	p := &Pool{
+		New: func() Transport {
+			mu.Lock()
+			defer mu.Unlock()
+			t := &fakeTransport{id: len(all)}
+			all = append(all, t)
+			return t
+		},
+	}
+	return p, func() []*fakeTransport {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*fakeTransport(nil), all...)
+	}
+}
+
+func poolQuery(t *testing.T, p *Pool) {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeTXT)
+	resp, err := p.Exchange(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestAnswer(t, resp, "example.", req.Id)
+}
+
+func TestPoolReuse(t *testing.T) {
+	p, created := newFakePool()
+	for i := 0; i < 3; i++ {
+		poolQuery(t, p)
+	}
+	if n := len(created()); n != 1 {
+		t.Errorf("pool created %d transports, want 1", n)
+	}
+	if s := p.Stats(); s != (PoolStats{Idle: 1}) {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	p, created := newFakePool()
+	p.MaxIdle = 2
+	for i := 0; i < 4; i++ {
+		p.put(p.get())
+	}
+	// get reuses the idle transport, so only one exists
+	if n := len(created()); n != 1 {
+		t.Fatalf("pool created %d transports, want 1", n)
+	}
+
+	var pts []*pooledTransport
+	for i := 0; i < 4; i++ {
+		pts = append(pts, p.get())
+	}
+	for _, pt := range pts {
+		p.put(pt)
+	}
+	if s := p.Stats(); s.Idle != 2 {
+		t.Errorf("pool has %d idle transports, want 2", s.Idle)
+	}
+	// the least recently used transports are closed
+	for i, ft := range created() {
+		got := ft.closed.Load()
+		want := int32(0)
+		if pts[0].t == ft || pts[1].t == ft {
+			want = 1
+		}
+		if got != want {
+			t.Errorf("transport %d closed %d times, want %d", i, got, want)
+		}
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	p, created := newFakePool()
+	p.IdleTimeout = 20 * time.Millisecond
+	poolQuery(t, p)
+	time.Sleep(40 * time.Millisecond)
+	poolQuery(t, p)
+
+	all := created()
+	if len(all) != 2 {
+		t.Fatalf("pool created %d transports, want 2", len(all))
+	}
+	if all[0].closed.Load() != 1 {
+		t.Errorf("expired transport not closed")
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	p, created := newFakePool()
+	p.HealthCheck = func(tr Transport) error {
+		if tr.(*fakeTransport).id == 0 {
+			return errors.New("unhealthy")
+		}
+		return nil
+	}
+	poolQuery(t, p)
+	poolQuery(t, p)
+	poolQuery(t, p)
+
+	all := created()
+	if len(all) != 2 {
+		t.Fatalf("pool created %d transports, want 2", len(all))
+	}
+	if all[0].closed.Load() != 1 || all[1].closed.Load() != 0 {
+		t.Errorf("pool closed the wrong transport")
+	}
+}
+
+func TestPoolFailedExchange(t *testing.T) {
+	p := &Pool{New: func() Transport { return &fakeTransport{fail: true} }}
+	ft := p.New().(*fakeTransport)
+	p.New = func() Transport { return ft }
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeTXT)
+	if _, err := p.Exchange(req); err == nil {
+		t.Fatal("exchange succeeded")
+	}
+	if ft.closed.Load() != 1 || p.Stats().Idle != 0 {
+		t.Errorf("failed transport returned to the pool")
+	}
+}
+
+func TestPoolMaxActive(t *testing.T) {
+	block := make(chan struct{})
+	p := &Pool{
+		New:       func() Transport { return &fakeTransport{block: block} },
+		MaxActive: 1,
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := p.Exchange(new(dns.Msg).SetQuestion("example.", dns.TypeTXT))
+		done <- err
+	}()
+	for p.Stats().Active != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A second exchange waits for the first, or for its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := p.ExchangeContext(ctx, new(dns.Msg).SetQuestion("example.", dns.TypeTXT))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(block)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if s := p.Stats(); s != (PoolStats{Idle: 1}) {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	p, created := newFakePool()
+
+	idle := p.get()
+	inUse := p.get()
+	p.put(idle)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if idle.t.(*fakeTransport).closed.Load() != 1 {
+		t.Errorf("Close didn't close the idle transport")
+	}
+
+	// A transport that was in use is closed when it returns.
+	p.put(inUse)
+	if inUse.t.(*fakeTransport).closed.Load() != 1 {
+		t.Errorf("put after Close didn't close the transport")
+	}
+	if s := p.Stats(); s.Idle != 0 {
+		t.Errorf("pool has %d idle transports after Close", s.Idle)
+	}
+
+	// The pool remains usable.
+	poolQuery(t, p)
+	if s := p.Stats(); s.Idle != 1 || len(created()) != 3 {
+		t.Errorf("got stats %+v after %d transports", s, len(created()))
+	}
+}
+
+func TestPoolDefaultHealthCheck(t *testing.T) {
+	// The server answers one query per connection, then closes it.
+	s := newTCPTestServer(t, func(_ int, conn *dns.Conn) {
+		req, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		conn.WriteMsg(testAnswer(req))
+	})
+
+	var created atomic.Int32
+	p := &Pool{New: func() Transport {
+		created.Add(1)
+		return &Do53TCP{Server: s.addr(), Timeout: 2 * time.Second, KeepOpen: true}
+	}}
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		poolQuery(t, p)
+		// let the server's close arrive
+		time.Sleep(20 * time.Millisecond)
+		if err := DefaultHealthCheck(p.idle[0].t); err == nil {
+			t.Errorf("query %d: health check passed on closed connection", i)
+		}
+	}
+	if got := created.Load(); got != 3 {
+		t.Errorf("pool created %d transports, want 3", got)
+	}
+}
+
+func TestDefaultHealthCheck(t *testing.T) {
+	s := newTCPTestServer(t, func(_ int, conn *dns.Conn) {
+		for {
+			req, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			conn.WriteMsg(testAnswer(req))
+		}
+	})
+
+	tr := &Do53TCP{Server: s.addr(), Timeout: 2 * time.Second, KeepOpen: true}
+	defer tr.Close()
+	if err := DefaultHealthCheck(tr); err != nil {
+		t.Errorf("unconnected transport: %v", err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeTXT)
+	if _, err := tr.Exchange(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := DefaultHealthCheck(tr); err != nil {
+		t.Errorf("open connection: %v", err)
+	}
+	// the health check must not disturb the connection
+	if _, err := tr.Exchange(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("transport used %d connections, want 1", got)
+	}
+}
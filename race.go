@@ -0,0 +1,256 @@
+package resolv
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The defaults for a hedged [Race].
+const (
+	DefaultHedgePercentile = 95
+	DefaultHedgeDelay      = 100 * time.Millisecond
+)
+
+const (
+	// The number of recent response times that a hedged Race keeps.
+	hedgeWindow = 100
+
+	// The number of response times that a hedged Race needs before it
+	// computes the hedge delay from them, rather than use the initial delay.
+	minHedgeSamples = 10
+)
+
+// AcceptNoError is an Accept function for a [Race] that accepts any response
+// other than SERVFAIL or REFUSED, which suggest a problem with the upstream
+// rather than with the query.
+func AcceptNoError(resp *dns.Msg) bool {
+	return !shouldFailover(resp)
+}
+
+// A Race is a Transport that sends each query to several upstream transports
+// (which may use different protocols, such as a [Do53UDP] and a [DoH]), and
+// returns the first acceptable response.  Once it has that response, the Race
+// cancels the exchanges with the other upstreams, and waits for them to
+// return before it returns the response, so that no exchange outlives the
+// call (a transport such as [Do53UDP] is not safe for concurrent use, even
+// when its exchanges are one at a time).  If no upstream returns an acceptable
+// response, the Race returns the last unacceptable response, if any, and
+// otherwise the last error.
+//
+// By default, a Race sends the query to all of the upstreams at once.  In
+// Hedge mode, the Race sends the query to the first upstream only, and sends
+// it to each next upstream if it has not received an acceptable response
+// after a delay: the HedgePercentile of the Race's recent response times.
+// This reduces tail latency at a small cost in extra queries.
+//
+// The Race records the index of the upstream that produced the response (or
+// the error) in the context's [ExchangeInfo], along with the details of that
+// upstream's exchange.  A Race is safe for concurrent use if its
+// upstreams are.  A program must not modify a Race's settings after its first
+// exchange.
+type Race struct {
+	// The upstream transports.  In Hedge mode, the order of the upstreams is
+	// the order in which the Race tries them.
+	Upstreams []Transport
+
+	// Accept returns true if resp is an acceptable response.  If nil, the
+	// Race uses [AcceptNoError].
+	Accept func(resp *dns.Msg) bool
+
+	// Send the query to one upstream at a time, as described above.
+	Hedge bool
+
+	// In Hedge mode, the percentile (between 0 and 100) of recent response
+	// times after which the Race sends the query to the next upstream.  If
+	// zero, the Race uses [DefaultHedgePercentile].
+	HedgePercentile float64
+
+	// In Hedge mode, the delay to use until the Race has enough response
+	// times to compute the percentile.  If zero, the Race uses
+	// [DefaultHedgeDelay].
+	InitialHedgeDelay time.Duration
+
+	mu      sync.Mutex
+	samples []time.Duration // a ring buffer of recent response times
+	next    int             // the next slot in samples
+}
+
+type upstreamResult struct {
+	i    int // the upstream's index
+	resp *dns.Msg
+	err  error
+	info *ExchangeInfo
+}
+
+// note records the details of the upstream's exchange, and the upstream's
+// index, in the context's ExchangeInfo.
+func (res *upstreamResult) note(ctx context.Context) {
+	info := exchangeInfoFrom(ctx)
+	info.setTransportInfo(res.info)
+	info.Upstream = res.i
+}
+
+func (r *Race) accept(resp *dns.Msg) bool {
+	if r.Accept != nil {
+		return r.Accept(resp)
+	}
+	return AcceptNoError(resp)
+}
+
+// addSample records the response time of a successful race.
+func (r *Race) addSample(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.samples) < hedgeWindow {
+		r.samples = append(r.samples, d)
+		return
+	}
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % hedgeWindow
+}
+
+// hedgeDelay returns how long to wait for a response before sending the
+// query to the next upstream.
+func (r *Race) hedgeDelay() time.Duration {
+	r.mu.Lock()
+	samples := slices.Clone(r.samples)
+	r.mu.Unlock()
+
+	if len(samples) < minHedgeSamples {
+		if r.InitialHedgeDelay > 0 {
+			return r.InitialHedgeDelay
+		}
+		return DefaultHedgeDelay
+	}
+
+	p := r.HedgePercentile
+	if p <= 0 || p > 100 {
+		p = DefaultHedgePercentile
+	}
+	slices.Sort(samples)
+	i := int(p / 100 * float64(len(samples)-1))
+	return samples[i]
+}
+
+func (r *Race) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return r.ExchangeContext(context.Background(), req)
+}
+
+func (r *Race) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var lastResp, lastErr *upstreamResult
+
+	n := len(r.Upstreams)
+	if n == 0 {
+		return nil, fmt.Errorf("race transport has no upstreams")
+	}
+
+	// Once the Race has its response, it cancels raceCtx, and waits for the
+	// pending exchanges to finish.
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	results := make(chan upstreamResult, n)
+	launched := 0
+	launch := func() {
+		i := launched
+		launched++
+		go func() {
+			// Each upstream gets its own copy of the query, since some
+			// transports modify it, and its own ExchangeInfo.
+			info := new(ExchangeInfo)
+			resp, err := r.Upstreams[i].ExchangeContext(WithExchangeInfo(raceCtx, info), req.Copy())
+			results <- upstreamResult{i: i, resp: resp, err: err, info: info}
+		}()
+	}
+
+	var delay time.Duration
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	resetTimer := func() {
+		if launched == n {
+			timerC = nil
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+
+	if r.Hedge {
+		launch()
+		if launched < n {
+			delay = r.hedgeDelay()
+			timer = time.NewTimer(delay)
+			defer timer.Stop()
+			timerC = timer.C
+		}
+	} else {
+		for launched < n {
+			launch()
+		}
+	}
+
+	for pending := launched; pending > 0; {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil && r.accept(res.resp) {
+				r.addSample(time.Since(start))
+				cancel()
+				for ; pending > 0; pending-- {
+					<-results
+				}
+				res.note(ctx)
+				return res.resp, nil
+			}
+			if res.err != nil {
+				lastErr = &res
+			} else {
+				lastResp = &res
+			}
+			// In Hedge mode, don't wait for the timer if the upstream
+			// failed.
+			if r.Hedge && launched < n {
+				launch()
+				pending++
+				resetTimer()
+			}
+		case <-timerC:
+			launch()
+			pending++
+			resetTimer()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if lastResp != nil {
+		lastResp.note(ctx)
+		return lastResp.resp, nil
+	}
+	lastErr.note(ctx)
+	return nil, lastErr.err
+}
+
+// Close closes all of the upstreams, and returns the first error.
+func (r *Race) Close() error {
+	var firstErr error
+	for _, t := range r.Upstreams {
+		err := t.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,226 @@
+package resolv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A funcTransport is a Transport whose exchanges call the function.
+type funcTransport func(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+
+func (f funcTransport) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return f(context.Background(), req)
+}
+
+func (f funcTransport) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return f(ctx, req)
+}
+
+func (f funcTransport) Close() error {
+	return nil
+}
+
+// upstream returns a funcTransport for a test of Race or Failover.  After
+// delay, the transport answers with rcode, or fails if rcode is negative;
+// either way, it records its exchange in the context's ExchangeInfo, with
+// name as the server.
+func upstream(name string, delay time.Duration, rcode int) funcTransport {
+	return func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		noteExchange(ctx, name, "udp", delay, 0)
+		if rcode < 0 {
+			return nil, fmt.Errorf("%s failed", name)
+		}
+		resp := new(dns.Msg)
+		resp.SetRcode(req, rcode)
+		return resp, nil
+	}
+}
+
+func TestRace(t *testing.T) {
+	const fail = -1
+
+	tests := []struct {
+		name       string
+		upstreams  []funcTransport
+		hedge      bool
+		wantRcode  int // fail if the race returns an error
+		wantIndex  int
+		wantServer string
+	}{
+		{
+			name: "fastest wins",
+			upstreams: []funcTransport{
+				upstream("slow", 200*time.Millisecond, dns.RcodeSuccess),
+				upstream("fast", 0, dns.RcodeSuccess),
+			},
+			wantRcode:  dns.RcodeSuccess,
+			wantIndex:  1,
+			wantServer: "fast",
+		},
+		{
+			name: "unacceptable response",
+			upstreams: []funcTransport{
+				upstream("servfail", 0, dns.RcodeServerFailure),
+				upstream("ok", 20*time.Millisecond, dns.RcodeNameError),
+			},
+			wantRcode:  dns.RcodeNameError,
+			wantIndex:  1,
+			wantServer: "ok",
+		},
+		{
+			name: "all unacceptable",
+			upstreams: []funcTransport{
+				upstream("refused", 0, dns.RcodeRefused),
+				upstream("servfail", 20*time.Millisecond, dns.RcodeServerFailure),
+				upstream("error", 40*time.Millisecond, fail),
+			},
+			wantRcode:  dns.RcodeServerFailure,
+			wantIndex:  1,
+			wantServer: "servfail",
+		},
+		{
+			name: "all fail",
+			upstreams: []funcTransport{
+				upstream("error0", 20*time.Millisecond, fail),
+				upstream("error1", 0, fail),
+			},
+			wantRcode:  fail,
+			wantIndex:  0,
+			wantServer: "error0",
+		},
+		{
+			name: "hedge after failure",
+			upstreams: []funcTransport{
+				upstream("error", 0, fail),
+				upstream("ok", 0, dns.RcodeSuccess),
+			},
+			hedge:      true,
+			wantRcode:  dns.RcodeSuccess,
+			wantIndex:  1,
+			wantServer: "ok",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Race{Hedge: tt.hedge, InitialHedgeDelay: time.Second}
+			for _, u := range tt.upstreams {
+				r.Upstreams = append(r.Upstreams, u)
+			}
+
+			info := &ExchangeInfo{QName: "example."}
+			req := new(dns.Msg)
+			req.SetQuestion("example.", dns.TypeA)
+			resp, err := r.ExchangeContext(WithExchangeInfo(context.Background(), info), req)
+			if tt.wantRcode == fail {
+				if err == nil {
+					t.Fatalf("got rcode %d, want an error", resp.Rcode)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if resp.Rcode != tt.wantRcode {
+				t.Errorf("got rcode %d, want %d", resp.Rcode, tt.wantRcode)
+			}
+
+			if info.Upstream != tt.wantIndex {
+				t.Errorf("ExchangeInfo has upstream %d, want %d", info.Upstream, tt.wantIndex)
+			}
+			if info.Server != tt.wantServer {
+				t.Errorf("ExchangeInfo has server %q, want %q", info.Server, tt.wantServer)
+			}
+			if info.QName != "example." {
+				t.Errorf("ExchangeInfo lost the QName")
+			}
+		})
+	}
+}
+
+func TestRaceWaitsForLosers(t *testing.T) {
+	finished := make(chan struct{})
+	r := &Race{Upstreams: []Transport{
+		upstream("fast", 0, dns.RcodeSuccess),
+		funcTransport(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+			// a loser that is slow to notice the cancellation
+			<-ctx.Done()
+			time.Sleep(50 * time.Millisecond)
+			close(finished)
+			return nil, ctx.Err()
+		}),
+	}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	if _, err := r.Exchange(req); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Errorf("race returned before the loser finished")
+	}
+}
+
+// TestRaceReuse reuses a Race of two Do53UDP upstreams, which are not safe
+// for concurrent use, for one query after another; the slow upstream always
+// loses.  Run with -race.
+func TestRaceReuse(t *testing.T) {
+	fast := startDNSServer(t, "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(testAnswer(req))
+	})
+	slow := startDNSServer(t, "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteMsg(testAnswer(req))
+	})
+	r := &Race{Upstreams: []Transport{
+		&Do53UDP{Server: slow, Timeout: time.Second},
+		&Do53UDP{Server: fast, Timeout: time.Second},
+	}}
+	defer r.Close()
+
+	for i := 0; i < 20; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.", dns.TypeTXT)
+		req.Id = uint16(i)
+		info := new(ExchangeInfo)
+		resp, err := r.ExchangeContext(WithExchangeInfo(context.Background(), info), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTestAnswer(t, resp, "example.", req.Id)
+		if info.Upstream != 1 {
+			t.Errorf("query %d: got upstream %d, want the fast one", i, info.Upstream)
+		}
+	}
+}
+
+func TestRaceExchangeInfo(t *testing.T) {
+	r := &Race{Upstreams: []Transport{
+		upstream("error0", 0, -1),
+		upstream("error1", 20*time.Millisecond, -1),
+	}}
+	info := new(ExchangeInfo)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	_, err := r.ExchangeContext(WithExchangeInfo(context.Background(), info), req)
+	if err == nil || err.Error() != "error1 failed" {
+		t.Fatalf("got error %v, want the last one", err)
+	}
+	if info.Upstream != 1 || info.Server != "error1" {
+		t.Errorf("got upstream %d, server %q; want 1, error1", info.Upstream, info.Server)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.ExchangeContext(ctx, req); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
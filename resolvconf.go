@@ -0,0 +1,201 @@
+package resolv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The defaults and limits for the options of resolv.conf, as in glibc (see
+// resolv.conf(5)).
+const (
+	DefaultResolvConfPath = "/etc/resolv.conf"
+
+	defaultResolvConfNDots    = 1
+	defaultResolvConfAttempts = 2
+	maxResolvConfNDots        = 15
+	maxResolvConfTimeout      = 30 * time.Second
+	maxResolvConfAttempts     = 5
+)
+
+// A ResolvConf is the parsed form of a resolv.conf(5) file.  Like glibc, the
+// parser ignores lines that it does not understand, and applies glibc's
+// defaults for the settings that the file omits.
+type ResolvConf struct {
+	// The nameservers, in the order of the file.  If the file lists none,
+	// this is the loopback address 127.0.0.1, as with glibc.
+	Servers []netip.Addr
+
+	// The search list (from the last search or domain line).  If the file
+	// has neither, this is the domain of the host's hostname, if any.
+	Search []string
+
+	// The options line.
+	NDots    int           // ndots:n (default: 1)
+	Timeout  time.Duration // timeout:n, in seconds (default: 5s)
+	Attempts int           // attempts:n (default: 2)
+	Rotate   bool          // rotate: spread the queries over the nameservers
+	EDNS0    bool          // edns0: advertise a larger UDP buffer with EDNS0
+	TrustAD  bool          // trust-ad: set the AD bit in queries
+}
+
+// ReadResolvConf reads and parses the resolv.conf file at path.
+func ReadResolvConf(path string) (*ResolvConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	conf, err := parseResolvConf(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return conf, nil
+}
+
+func parseResolvConf(r io.Reader) (*ResolvConf, error) {
+	conf := &ResolvConf{
+		NDots:    defaultResolvConfNDots,
+		Timeout:  DefaultTimeout,
+		Attempts: defaultResolvConfAttempts,
+	}
+	haveSearch := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 {
+				continue
+			}
+			addr, err := netip.ParseAddr(fields[1])
+			if err != nil {
+				continue
+			}
+			conf.Servers = append(conf.Servers, addr)
+		case "domain":
+			if len(fields) < 2 {
+				continue
+			}
+			conf.Search = fields[1:2]
+			haveSearch = true
+		case "search":
+			conf.Search = fields[1:]
+			haveSearch = true
+		case "options":
+			for _, opt := range fields[1:] {
+				conf.setOption(opt)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(conf.Servers) == 0 {
+		conf.Servers = []netip.Addr{netip.AddrFrom4([4]byte{127, 0, 0, 1})}
+	}
+	if !haveSearch {
+		if hostname, err := os.Hostname(); err == nil {
+			if _, domain, ok := strings.Cut(hostname, "."); ok && domain != "" {
+				conf.Search = []string{domain}
+			}
+		}
+	}
+
+	return conf, nil
+}
+
+// setOption applies one option of an options line.
+func (conf *ResolvConf) setOption(opt string) {
+	name, value, _ := strings.Cut(opt, ":")
+	switch name {
+	case "ndots":
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			conf.NDots = min(n, maxResolvConfNDots)
+		}
+	case "timeout":
+		if n, err := strconv.Atoi(value); err == nil && n >= 1 {
+			conf.Timeout = min(time.Duration(n)*time.Second, maxResolvConfTimeout)
+		}
+	case "attempts":
+		if n, err := strconv.Atoi(value); err == nil && n >= 1 {
+			conf.Attempts = min(n, maxResolvConfAttempts)
+		}
+	case "rotate":
+		conf.Rotate = true
+	case "edns0":
+		conf.EDNS0 = true
+	case "trust-ad":
+		conf.TrustAD = true
+	}
+}
+
+// NewTransport returns a Do53 transport for the nameservers.  Each query
+// makes up to Attempts attempts at a nameserver, with a timeout of Timeout
+// each, before it fails over to the next nameserver.  With several
+// nameservers, the transport is a [Failover], which starts each query with
+// the next nameserver if Rotate is set.
+func (conf *ResolvConf) NewTransport() Transport {
+	udpBufSize := 0
+	if conf.EDNS0 {
+		udpBufSize = DefaultUDPBufSize
+	}
+
+	var upstreams []Transport
+	for _, addr := range conf.Servers {
+		upstreams = append(upstreams, &Do53UDP{
+			Server:     net.JoinHostPort(addr.String(), "53"),
+			Timeout:    conf.Timeout,
+			UDPBufSize: udpBufSize,
+			Retry: RetryPolicy{
+				Attempts: conf.Attempts,
+			},
+		})
+	}
+
+	if len(upstreams) == 1 {
+		return upstreams[0]
+	}
+	policy := SelectOrdered
+	if conf.Rotate {
+		policy = SelectRotate
+	}
+	return &Failover{
+		Upstreams: upstreams,
+		Policy:    policy,
+	}
+}
+
+// NewClientFromResolvConf returns a Client that behaves like a glibc stub
+// resolver configured by the resolv.conf file at path (usually
+// [DefaultResolvConfPath]): it queries the file's nameservers (see
+// [ResolvConf.NewTransport]) with the RD bit set, sets the AD bit if the file
+// has the trust-ad option, and expands names that are not fully-qualified
+// with the file's search list and ndots option.
+func NewClientFromResolvConf(path string) (*Client, error) {
+	conf, err := ReadResolvConf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		AD:        conf.TrustAD,
+		RD:        true,
+		Search:    conf.Search,
+		NDots:     conf.NDots,
+		Transport: conf.NewTransport(),
+	}, nil
+}
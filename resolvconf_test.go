@@ -0,0 +1,115 @@
+package resolv
+
+import (
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	// the search list that the parser derives from the hostname, if the
+	// file has neither a search nor a domain line
+	var hostSearch []string
+	if hostname, err := os.Hostname(); err == nil {
+		if _, domain, ok := strings.Cut(hostname, "."); ok && domain != "" {
+			hostSearch = []string{domain}
+		}
+	}
+	localhost := []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+
+	tests := []struct {
+		name string
+		file string
+		want ResolvConf
+	}{
+		{
+			name: "empty",
+			file: "",
+			want: ResolvConf{Servers: localhost, Search: hostSearch, NDots: 1, Timeout: DefaultTimeout, Attempts: 2},
+		},
+		{
+			name: "nameservers",
+			file: "# comment\n; comment\nnameserver 192.0.2.1\nnameserver 2001:db8::1\nnameserver bogus\nnameserver\n",
+			want: ResolvConf{
+				Servers:  []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+				Search:   hostSearch,
+				NDots:    1,
+				Timeout:  DefaultTimeout,
+				Attempts: 2,
+			},
+		},
+		{
+			name: "options",
+			file: "options ndots:3 timeout:2 attempts:4 rotate edns0 trust-ad unknown:1\n",
+			want: ResolvConf{
+				Servers: localhost, Search: hostSearch,
+				NDots: 3, Timeout: 2 * time.Second, Attempts: 4,
+				Rotate: true, EDNS0: true, TrustAD: true,
+			},
+		},
+		{
+			name: "options at their limits",
+			file: "options ndots:99 timeout:99 attempts:99\n",
+			want: ResolvConf{Servers: localhost, Search: hostSearch, NDots: 15, Timeout: 30 * time.Second, Attempts: 5},
+		},
+		{
+			name: "invalid options",
+			file: "options ndots:-1 timeout:0 attempts:x\n",
+			want: ResolvConf{Servers: localhost, Search: hostSearch, NDots: 1, Timeout: DefaultTimeout, Attempts: 2},
+		},
+		{
+			name: "options on several lines",
+			file: "options ndots:2\noptions attempts:3\n",
+			want: ResolvConf{Servers: localhost, Search: hostSearch, NDots: 2, Timeout: DefaultTimeout, Attempts: 3},
+		},
+		{
+			name: "search",
+			file: "search example.com example.net\n",
+			want: ResolvConf{Servers: localhost, Search: []string{"example.com", "example.net"}, NDots: 1, Timeout: DefaultTimeout, Attempts: 2},
+		},
+		{
+			name: "domain",
+			file: "domain example.com other\n",
+			want: ResolvConf{Servers: localhost, Search: []string{"example.com"}, NDots: 1, Timeout: DefaultTimeout, Attempts: 2},
+		},
+		{
+			name: "search after domain",
+			file: "domain example.com\nsearch example.net example.org\n",
+			want: ResolvConf{Servers: localhost, Search: []string{"example.net", "example.org"}, NDots: 1, Timeout: DefaultTimeout, Attempts: 2},
+		},
+		{
+			name: "domain after search",
+			file: "search example.net example.org\ndomain example.com\n",
+			want: ResolvConf{Servers: localhost, Search: []string{"example.com"}, NDots: 1, Timeout: DefaultTimeout, Attempts: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := parseResolvConf(strings.NewReader(tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*conf, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", *conf, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvConfNewTransport(t *testing.T) {
+	conf, err := parseResolvConf(strings.NewReader("nameserver 192.0.2.1\nnameserver 192.0.2.2\noptions timeout:3 attempts:4 rotate edns0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := conf.NewTransport().(*Failover)
+	if !ok || len(f.Upstreams) != 2 || f.Policy != SelectRotate {
+		t.Fatalf("got transport %#v, want a rotating Failover of 2 upstreams", conf.NewTransport())
+	}
+	udp := f.Upstreams[1].(*Do53UDP)
+	if udp.Server != "192.0.2.2:53" || udp.Timeout != 3*time.Second || udp.Retry.Attempts != 4 || udp.UDPBufSize != DefaultUDPBufSize {
+		t.Errorf("got upstream %+v", udp)
+	}
+}
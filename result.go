@@ -0,0 +1,69 @@
+package resolv
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A Result describes how a [Client] resolved a query: the final response,
+// along with each exchange (hop) that led to it.
+type Result struct {
+	// The final response: the response that [Client.LookupContext] would
+	// return.  This is nil if the last hop failed.
+	Msg *dns.Msg
+
+	// The fully-qualified name that produced Msg: the name after any
+	// expansion with the client's Search list.
+	QName string
+
+	// The CNAME chain from QName to the name that has the records (or that
+	// the server denied), across all of the hops to QName.
+	CNAMEs []*dns.CNAME
+
+	// The hops, in the order the client sent them: one for each name of
+	// the search list that the client tried, and one for each CNAME target
+	// that the client re-queried.  The hops do not include the queries that
+	// the client sends to validate the responses.
+	Hops []*Hop
+
+	// For a validating client, the DNSSEC validation status of the
+	// response, and, unless the status is Secure, the reason for it.  If
+	// the client followed CNAMEs, this is the weakest status of the hops.
+	Validation       ValidationStatus
+	ValidationReason string
+
+	// The time from the start of the query to the final response,
+	// including any validation queries.
+	Elapsed time.Duration
+}
+
+// A Hop is one exchange of a [Result]: a query that the client sent, and
+// the response it got.  The embedded [ExchangeInfo] records how the
+// transport produced the response (e.g., the server, protocol, round-trip
+// time, and retries); its QName is the hop's QNAME, and its validation
+// status is that of the hop's response alone.
+type Hop struct {
+	Query    *dns.Msg
+	Response *dns.Msg // nil if the exchange failed
+	ExchangeInfo
+}
+
+// Query is like [Client.LookupContext], but returns a Result that records
+// each hop of the query, rather than only the final response.  Query returns
+// the Result even if it also returns an error, so that the caller can
+// inspect the hops that led to the error; the error is the one that
+// LookupContext would return.
+func (c *Client) Query(ctx context.Context, name string, qtype uint16) (*Result, error) {
+	res := new(Result)
+	info := exchangeInfoFrom(ctx)
+	start := time.Now()
+
+	var err error
+	res.Msg, err = c.lookup(WithExchangeInfo(ctx, info), name, qtype, res)
+	res.Elapsed = time.Since(start)
+	res.QName = info.QName
+	res.Validation, res.ValidationReason = info.Validation, info.ValidationReason
+	return res, err
+}
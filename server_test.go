@@ -0,0 +1,45 @@
+package resolv
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startDNSServer starts an in-process DNS server that serves h over UDP and
+// TCP at addr (HOST:PORT), and returns the address.  If addr's port is 0, the
+// server picks a free port.
+func startDNSServer(t *testing.T, addr string, h dns.HandlerFunc) string {
+	t.Helper()
+
+	var pc net.PacketConn
+	var ln net.Listener
+	for attempt := 0; ; attempt++ {
+		var err error
+		pc, err = net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		pc.Close()
+		// another test may have the TCP port of the free UDP port
+		if _, port, _ := net.SplitHostPort(addr); port != "0" || attempt == 10 {
+			t.Fatal(err)
+		}
+	}
+	addr = pc.LocalAddr().String()
+
+	for _, srv := range []*dns.Server{{PacketConn: pc, Handler: h}, {Listener: ln, Handler: h}} {
+		srv := srv
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	return addr
+}
@@ -0,0 +1,248 @@
+package resolv
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/syslab-wm/functools"
+)
+
+// An SVCBRecord is the parsed form of a ServiceMode SVCB or HTTPS record (RFC
+// 9460).
+type SVCBRecord struct {
+	// The record's owner name.  If the client followed AliasMode records (or
+	// CNAMEs), this is the name at the end of the chain.
+	Name string
+
+	TTL uint32
+
+	// The record's SvcPriority; lower values are more preferred.  Since
+	// SVCBRecords only describe ServiceMode records, this is never 0.
+	Priority uint16
+
+	// The record's TargetName: the domain name of the service endpoint.  A
+	// TargetName of "." in the record means the owner name, so Target is
+	// then the same as Name.
+	Target string
+
+	// The keys of the parameters that the client must understand in order to
+	// use the record (the "mandatory" parameter).  A client should ignore the
+	// record if it does not support all of these keys.
+	Mandatory []dns.SVCBKey
+
+	// The protocols (ALPN IDs) that the endpoint supports (the "alpn"
+	// parameter), and whether the endpoint does not support the scheme's
+	// default protocol (the "no-default-alpn" parameter).
+	ALPN          []string
+	NoDefaultALPN bool
+
+	// The endpoint's port; zero if the record does not specify a port, in
+	// which case the scheme's default port applies.
+	Port uint16
+
+	// Addresses of the endpoint that the client may use before (or instead
+	// of) resolving Target (the "ipv4hint" and "ipv6hint" parameters).
+	IPv4Hints []netip.Addr
+	IPv6Hints []netip.Addr
+
+	// The endpoint's ECHConfigList, for TLS Encrypted Client Hello (the
+	// "ech" parameter).
+	ECHConfig []byte
+
+	// The URI template of a DoH endpoint (the "dohpath" parameter; RFC 9461).
+	DoHPath string
+}
+
+// String returns the record's priority, target, and parameters, in the
+// style of the record's presentation format.
+func (r *SVCBRecord) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s", r.Priority, r.Target)
+	if len(r.Mandatory) > 0 {
+		keys := functools.Map[dns.SVCBKey, string](r.Mandatory, func(key dns.SVCBKey) string {
+			return key.String()
+		})
+		fmt.Fprintf(&b, " mandatory=%s", strings.Join(keys, ","))
+	}
+	if len(r.ALPN) > 0 {
+		fmt.Fprintf(&b, " alpn=%s", strings.Join(r.ALPN, ","))
+	}
+	if r.NoDefaultALPN {
+		b.WriteString(" no-default-alpn")
+	}
+	if r.Port != 0 {
+		fmt.Fprintf(&b, " port=%d", r.Port)
+	}
+	if len(r.IPv4Hints) > 0 {
+		fmt.Fprintf(&b, " ipv4hint=%s", joinAddrs(r.IPv4Hints))
+	}
+	if len(r.ECHConfig) > 0 {
+		fmt.Fprintf(&b, " ech=%s", base64.StdEncoding.EncodeToString(r.ECHConfig))
+	}
+	if len(r.IPv6Hints) > 0 {
+		fmt.Fprintf(&b, " ipv6hint=%s", joinAddrs(r.IPv6Hints))
+	}
+	if r.DoHPath != "" {
+		fmt.Fprintf(&b, " dohpath=%s", r.DoHPath)
+	}
+	return b.String()
+}
+
+func joinAddrs(addrs []netip.Addr) string {
+	strs := functools.Map[netip.Addr, string](addrs, func(addr netip.Addr) string {
+		return addr.String()
+	})
+	return strings.Join(strs, ",")
+}
+
+func newSVCBRecord(svcb *dns.SVCB) *SVCBRecord {
+	r := &SVCBRecord{
+		Name:     svcb.Hdr.Name,
+		TTL:      svcb.Hdr.Ttl,
+		Priority: svcb.Priority,
+		Target:   svcb.Target,
+	}
+	if r.Target == "." {
+		r.Target = r.Name
+	}
+
+	for _, kv := range svcb.Value {
+		switch v := kv.(type) {
+		case *dns.SVCBMandatory:
+			r.Mandatory = v.Code
+		case *dns.SVCBAlpn:
+			r.ALPN = v.Alpn
+		case *dns.SVCBNoDefaultAlpn:
+			r.NoDefaultALPN = true
+		case *dns.SVCBPort:
+			r.Port = v.Port
+		case *dns.SVCBIPv4Hint:
+			for _, ip := range v.Hint {
+				if addr, ok := netip.AddrFromSlice(ip.To4()); ok {
+					r.IPv4Hints = append(r.IPv4Hints, addr)
+				}
+			}
+		case *dns.SVCBIPv6Hint:
+			for _, ip := range v.Hint {
+				if addr, ok := netip.AddrFromSlice(ip); ok {
+					r.IPv6Hints = append(r.IPv6Hints, addr)
+				}
+			}
+		case *dns.SVCBECHConfig:
+			r.ECHConfig = v.ECH
+		case *dns.SVCBDoHPath:
+			r.DoHPath = v.Template
+		}
+	}
+
+	return r
+}
+
+// collectSVCBs returns the SVCB records (or, for HTTPS, the SVCB part of the
+// HTTPS records) in rrs.
+func collectSVCBs(rrs []dns.RR, qtype uint16) []*dns.SVCB {
+	var svcbs []*dns.SVCB
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.SVCB:
+			if qtype == dns.TypeSVCB {
+				svcbs = append(svcbs, rr)
+			}
+		case *dns.HTTPS:
+			if qtype == dns.TypeHTTPS {
+				svcbs = append(svcbs, &rr.SVCB)
+			}
+		}
+	}
+	return svcbs
+}
+
+func (c *Client) maxSVCBAliases() int {
+	if c.MaxSVCBAliases > 0 {
+		return c.MaxSVCBAliases
+	}
+	return DefaultMaxSVCBAliases
+}
+
+// getSVCBRecords looks up the SVCB or HTTPS (qtype) records for name,
+// following AliasMode records, and returns the ServiceMode records in order
+// of priority.
+func (c *Client) getSVCBRecords(ctx context.Context, name string, qtype uint16) ([]*SVCBRecord, error) {
+	name = dns.Fqdn(name)
+	seen := map[string]bool{name: true}
+
+	for i := 0; ; i++ {
+		resp, err := c.LookupContext(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+
+		var alias *dns.SVCB
+		var recs []*SVCBRecord
+		for _, svcb := range collectSVCBs(resp.Answer, qtype) {
+			if svcb.Priority == 0 {
+				alias = svcb
+				break
+			}
+			recs = append(recs, newSVCBRecord(svcb))
+		}
+
+		if alias == nil {
+			if len(recs) == 0 {
+				return nil, ErrNoData
+			}
+			slices.SortStableFunc(recs, func(a, b *SVCBRecord) int {
+				return int(a.Priority) - int(b.Priority)
+			})
+			return recs, nil
+		}
+
+		// Per RFC 9460, Section 2.4.2, an RRset with an AliasMode record
+		// should have no ServiceMode records; if it does, ignore them.
+		if alias.Target == "." {
+			// The service is not available or does not exist (RFC 9460,
+			// Section 2.5.1).
+			return nil, ErrNoData
+		}
+		if i >= c.maxSVCBAliases() {
+			return nil, ErrMaxSVCBAliases
+		}
+		name = dns.Fqdn(alias.Target)
+		if seen[name] {
+			return nil, ErrSVCBAliasLoop
+		}
+		seen[name] = true
+	}
+}
+
+// GetSVCBRecords looks up the SVCB records (RFC 9460) for name, such as
+// "_dns.resolver.example" or "_8443._foo.api.example".  It follows AliasMode
+// records (up to the client's MaxSVCBAliases), and returns the ServiceMode
+// records in order of priority.  If the records mark the service as
+// unavailable (an AliasMode record with a TargetName of "."), it returns
+// [ErrNoData].
+func (c *Client) GetSVCBRecords(name string) ([]*SVCBRecord, error) {
+	return c.GetSVCBRecordsContext(context.Background(), name)
+}
+
+// GetSVCBRecordsContext is like [Client.GetSVCBRecords], but takes a context.
+func (c *Client) GetSVCBRecordsContext(ctx context.Context, name string) ([]*SVCBRecord, error) {
+	return c.getSVCBRecords(ctx, name, dns.TypeSVCB)
+}
+
+// GetHTTPSRecords is like [Client.GetSVCBRecords], but looks up the HTTPS
+// records for name, which describe how to reach the HTTPS origin at name.
+func (c *Client) GetHTTPSRecords(name string) ([]*SVCBRecord, error) {
+	return c.GetHTTPSRecordsContext(context.Background(), name)
+}
+
+// GetHTTPSRecordsContext is like [Client.GetHTTPSRecords], but takes a
+// context.
+func (c *Client) GetHTTPSRecordsContext(ctx context.Context, name string) ([]*SVCBRecord, error) {
+	return c.getSVCBRecords(ctx, name, dns.TypeHTTPS)
+}
@@ -0,0 +1,124 @@
+package resolv
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+// SPKIPin returns the SPKI pin (RFC 7858, Section 4.2) for the certificate:
+// the base64 encoding of the SHA-256 digest of the certificate's DER-encoded
+// SubjectPublicKeyInfo.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// LoadCAFile reads a file of one or more PEM-encoded CA certificates and
+// returns them as a certificate pool, suitable for a [crypto/tls.Config]'s
+// RootCAs.
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+func decodeSPKIPins(pins []string) ([][]byte, error) {
+	var digests [][]byte
+	for _, pin := range pins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPKI pin %q: %w", pin, err)
+		}
+		if len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: not a SHA-256 digest", pin)
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+func matchesSPKIPin(cert *x509.Certificate, digests [][]byte) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, digest := range digests {
+		if subtle.ConstantTimeCompare(sum[:], digest) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySPKIPins returns a function for a [crypto/tls.Config]'s
+// VerifyConnection that fails the handshake unless the server's certificate
+// chain matches one of the pins.  If the chain was verified, any certificate
+// in the verified chains may match the pin; otherwise (e.g., the config sets
+// InsecureSkipVerify), only the server's own certificate may match, since the
+// server could present arbitrary intermediates.
+func verifySPKIPins(digests [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		var certs []*x509.Certificate
+		if len(cs.VerifiedChains) > 0 {
+			for _, chain := range cs.VerifiedChains {
+				certs = append(certs, chain...)
+			}
+		} else if len(cs.PeerCertificates) > 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+
+		for _, cert := range certs {
+			if matchesSPKIPin(cert, digests) {
+				return nil
+			}
+		}
+		return ErrSPKIPinMismatch
+	}
+}
+
+// newTLSConfig returns the TLS configuration a transport uses for its
+// connections: a copy of cfg (or an empty configuration, if cfg is nil) that
+// additionally enforces the SPKI pin set, if the set is not empty.
+func newTLSConfig(cfg *tls.Config, pins []string) (*tls.Config, error) {
+	if cfg != nil {
+		cfg = cfg.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+
+	if len(pins) == 0 {
+		return cfg, nil
+	}
+
+	digests, err := decodeSPKIPins(pins)
+	if err != nil {
+		return nil, err
+	}
+
+	addVerifyConnection(cfg, verifySPKIPins(digests))
+	return cfg, nil
+}
+
+// addVerifyConnection adds the check to cfg's VerifyConnection, after any
+// check that cfg already has.
+func addVerifyConnection(cfg *tls.Config, check func(tls.ConnectionState) error) {
+	verify := cfg.VerifyConnection
+	if verify == nil {
+		cfg.VerifyConnection = check
+		return
+	}
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := verify(cs); err != nil {
+			return err
+		}
+		return check(cs)
+	}
+}
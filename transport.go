@@ -1,10 +1,41 @@
 package resolv
 
 import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
 	"github.com/miekg/dns"
 )
 
 type Transport interface {
 	Exchange(*dns.Msg) (*dns.Msg, error)
+	ExchangeContext(context.Context, *dns.Msg) (*dns.Msg, error)
 	Close() error
 }
+
+// watchConn arranges for any blocked I/O on conn to fail as soon as ctx is
+// done.  The caller must call the returned stop function once the exchange
+// completes, so that a later cancellation of ctx does not affect conn.
+func watchConn(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+// ctxError returns ctx's error if ctx is done; otherwise it returns err.  The
+// transports use this so that an exchange that fails because the caller
+// cancelled it reports the cancellation rather than an I/O timeout.
+func ctxError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// isTimeout returns true if err is a network timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}